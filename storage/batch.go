@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MaxBatchSize is the largest number of paths accepted by a batch operation
+const MaxBatchSize = 1000
+
+// DeleteResult is the outcome of deleting one path of a batch
+// It is serialized as JSON when returned through the FFI
+type DeleteResult struct {
+	Path      string    `json:"path"`
+	Deleted   bool      `json:"deleted"`
+	Error     *string   `json:"error,omitempty"`
+	ErrorCode ErrorCode `json:"error_code,omitempty"`
+}
+
+// NewDeleteResult builds the DeleteResult for a path from the error of its delete
+func NewDeleteResult(path string, err error) DeleteResult {
+	if err == nil {
+		return DeleteResult{Path: path, Deleted: true}
+	}
+
+	msg := err.Error()
+	return DeleteResult{
+		Path:      path,
+		Error:     &msg,
+		ErrorCode: AsPluginError(err).Code(),
+	}
+}
+
+// ExistsResult reports whether one path of a batch exists
+// It is serialized as JSON when returned through the FFI
+type ExistsResult struct {
+	Path   string `json:"path"`
+	Exists bool   `json:"exists"`
+}
+
+// parsePathList decodes the JSON array of paths sent by the host
+func parsePathList(pathsJSON string) ([]string, error) {
+	var paths []string
+	if err := json.Unmarshal([]byte(pathsJSON), &paths); err != nil {
+		return nil, NewInvalidInputError("failed to parse path list: " + err.Error())
+	}
+	if len(paths) > MaxBatchSize {
+		return nil, NewInvalidInputError(fmt.Sprintf("batch may not contain more than %d paths", MaxBatchSize))
+	}
+	return paths, nil
+}
+
+// deleteFiles deletes every path and reports the outcome per path
+// Invalid paths fail individually without reaching the plugin
+// Plugins without native batch deletes get one DeleteFile call per path
+func deleteFiles(plugin StoragePlugin, paths []string) ([]DeleteResult, error) {
+	results := make([]DeleteResult, len(paths))
+
+	var valid []string
+	var indexes []int
+	for i, path := range paths {
+		normalized, err := ValidatePath(path)
+		if err != nil {
+			results[i] = NewDeleteResult(path, err)
+			continue
+		}
+		valid = append(valid, normalized)
+		indexes = append(indexes, i)
+	}
+	if len(valid) == 0 {
+		return results, nil
+	}
+
+	if batch, ok := plugin.(BatchDeleteStoragePlugin); ok {
+		batchResults, err := batch.DeleteFiles(valid)
+		if err != nil {
+			return nil, err
+		}
+		if len(batchResults) != len(valid) {
+			return nil, NewStorageError(fmt.Sprintf("plugin returned %d results for %d paths", len(batchResults), len(valid)))
+		}
+		for i, result := range batchResults {
+			results[indexes[i]] = result
+		}
+		return results, nil
+	}
+
+	for i, path := range valid {
+		results[indexes[i]] = NewDeleteResult(path, plugin.DeleteFile(path))
+	}
+	return results, nil
+}
+
+// filesExist checks every path and reports the outcome per path
+// Invalid paths are reported as missing without reaching the plugin
+// Plugins without native bulk checks get one FileExists call per path
+func filesExist(plugin StoragePlugin, paths []string) ([]ExistsResult, error) {
+	results := make([]ExistsResult, len(paths))
+
+	var valid []string
+	var indexes []int
+	for i, path := range paths {
+		results[i] = ExistsResult{Path: path}
+
+		normalized, err := ValidatePath(path)
+		if err != nil {
+			continue
+		}
+		valid = append(valid, normalized)
+		indexes = append(indexes, i)
+	}
+	if len(valid) == 0 {
+		return results, nil
+	}
+
+	if batch, ok := plugin.(BatchExistsStoragePlugin); ok {
+		batchResults, err := batch.FilesExist(valid)
+		if err != nil {
+			return nil, err
+		}
+		if len(batchResults) != len(valid) {
+			return nil, NewStorageError(fmt.Sprintf("plugin returned %d results for %d paths", len(batchResults), len(valid)))
+		}
+		for i, result := range batchResults {
+			results[indexes[i]] = result
+		}
+		return results, nil
+	}
+
+	for i, path := range valid {
+		results[indexes[i]] = ExistsResult{Path: path, Exists: plugin.FileExists(path)}
+	}
+	return results, nil
+}
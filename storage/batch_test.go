@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePathList(t *testing.T) {
+	tooMany := "[" + strings.Repeat(`"a",`, MaxBatchSize) + `"a"]`
+	tests := []struct {
+		name      string
+		json      string
+		wantPaths int
+		wantErr   bool
+	}{
+		{name: "empty", json: `[]`},
+		{name: "paths", json: `["a","b/c"]`, wantPaths: 2},
+		{name: "too many", json: tooMany, wantErr: true},
+		{name: "not a list", json: `{"path":"a"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths, err := parsePathList(tt.json)
+			if tt.wantErr {
+				checkErrorType(t, err, ptr(InvalidInputError))
+				return
+			}
+			checkErrorType(t, err, nil)
+			if len(paths) != tt.wantPaths {
+				t.Errorf("parsed %d paths, want %d", len(paths), tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestDeleteFilesFallback(t *testing.T) {
+	plugin := newMemoryPlugin(map[string]string{"a": "x", "b": "y"})
+
+	results, err := deleteFiles(plugin, []string{"a", "missing", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []DeleteResult{
+		{Path: "a", Deleted: true},
+		{Path: "missing", ErrorCode: ErrorCodeNotFound},
+		{Path: "b", Deleted: true},
+	}
+	for i, result := range results {
+		if result.Path != want[i].Path || result.Deleted != want[i].Deleted || result.ErrorCode != want[i].ErrorCode || (result.Error != nil) == result.Deleted {
+			t.Errorf("result %d = %+v, want %+v", i, result, want[i])
+		}
+	}
+	if plugin.FileExists("a") || plugin.FileExists("b") {
+		t.Error("files weren't deleted")
+	}
+}
+
+func TestFilesExistFallback(t *testing.T) {
+	plugin := newMemoryPlugin(map[string]string{"a": "x"})
+
+	results, err := filesExist(plugin, []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || !results[0].Exists || results[1].Exists || results[1].Path != "b" {
+		t.Errorf("results = %+v", results)
+	}
+}
+
+// shortBatchPlugin returns a result for the first path only
+type shortBatchPlugin struct {
+	*memoryPlugin
+}
+
+func (p *shortBatchPlugin) DeleteFiles(paths []string) ([]DeleteResult, error) {
+	return []DeleteResult{NewDeleteResult(paths[0], nil)}, nil
+}
+
+func (p *shortBatchPlugin) FilesExist(paths []string) ([]ExistsResult, error) {
+	return []ExistsResult{{Path: paths[0]}}, nil
+}
+
+func TestBatchResultCount(t *testing.T) {
+	plugin := &shortBatchPlugin{newMemoryPlugin(nil)}
+	paths := []string{"a", "b"}
+
+	if _, err := deleteFiles(plugin, paths); err == nil {
+		t.Error("deleteFiles accepted fewer results than paths")
+	}
+	if _, err := filesExist(plugin, paths); err == nil {
+		t.Error("filesExist accepted fewer results than paths")
+	}
+
+	// A single path gets a single result
+	results, err := deleteFiles(plugin, paths[:1])
+	if err != nil || len(results) != 1 {
+		t.Errorf("deleteFiles() = %v, %v", results, err)
+	}
+	if plugin.count("delete") != 0 {
+		t.Errorf("native batch fell back to %d DeleteFile calls", plugin.count("delete"))
+	}
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitBreakerSettings configures the circuit breaker middleware
+type CircuitBreakerSettings struct {
+	// FailureThreshold is the number of consecutive failures that opens the circuit
+	FailureThreshold int
+
+	// Cooldown is how long the circuit stays open before a trial call is let through
+	Cooldown time.Duration
+}
+
+// DefaultCircuitBreakerSettings opens the circuit after 5 consecutive failures for 30s
+func DefaultCircuitBreakerSettings() CircuitBreakerSettings {
+	return CircuitBreakerSettings{
+		FailureThreshold: 5,
+		Cooldown:         30 * time.Second,
+	}
+}
+
+// circuitBreaker tracks the health of a backend
+// Only retryable errors count as failures, other errors show the backend is responding
+type circuitBreaker struct {
+	settings CircuitBreakerSettings
+
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether a call may go through and whether it is the trial call of a half-open circuit
+func (b *circuitBreaker) allow() (bool, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures < b.settings.FailureThreshold {
+		return true, false
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false, false
+	}
+
+	b.probing = true
+	return true, true
+}
+
+// record updates the breaker with the outcome of a call
+func (b *circuitBreaker) record(err error, trial bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if trial {
+		b.probing = false
+	}
+
+	// A cancelled call says nothing about the backend
+	if err != nil && AsPluginError(err).Type == CancelledErrorType {
+		return
+	}
+	if err == nil || !AsPluginError(err).Retryable() {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.settings.FailureThreshold {
+		b.openUntil = time.Now().Add(b.settings.Cooldown)
+	}
+}
+
+// WithCircuitBreaker returns a Middleware that stops calling a failing backend
+// After FailureThreshold consecutive retryable failures calls are rejected with an UnavailableErrorType
+// error for Cooldown, then a single trial call decides whether the circuit closes again
+func WithCircuitBreaker(settings CircuitBreakerSettings) Middleware {
+	return func(plugin StoragePlugin) StoragePlugin {
+		breaker := &circuitBreaker{settings: settings}
+		name := plugin.ProviderName()
+
+		return Intercept(func(ctx context.Context, call Call, invoke func(ctx context.Context) error) error {
+			allowed, trial := breaker.allow()
+			if !allowed {
+				return NewUnavailableError(fmt.Sprintf("circuit breaker is open for %s", name))
+			}
+
+			err := invoke(ctx)
+			breaker.record(err, trial)
+			return err
+		})(plugin)
+	}
+}
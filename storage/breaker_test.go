@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	network := NewNetworkError("connection reset")
+
+	tests := []struct {
+		name        string
+		outcomes    []error
+		wantAllowed bool
+	}{
+		{name: "closed", outcomes: []error{network, network}, wantAllowed: true},
+		{name: "opens at the threshold", outcomes: []error{network, network, network}},
+		{name: "success resets", outcomes: []error{network, network, nil, network, network}, wantAllowed: true},
+		{name: "permanent error resets", outcomes: []error{network, network, NewNotFoundError("a"), network}, wantAllowed: true},
+		{name: "cancelled calls don't count", outcomes: []error{network, network, NewCancelledError("cancelled"), network}},
+		{name: "unknown errors reset", outcomes: []error{network, network, errors.New("boom"), network}, wantAllowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := &circuitBreaker{settings: CircuitBreakerSettings{FailureThreshold: 3, Cooldown: time.Hour}}
+			for _, err := range tt.outcomes {
+				breaker.record(err, false)
+			}
+
+			allowed, trial := breaker.allow()
+			if allowed != tt.wantAllowed || trial {
+				t.Errorf("allow() = %v, %v, want %v, false", allowed, trial, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	tests := []struct {
+		name        string
+		trial       error
+		wantAllowed bool
+	}{
+		{name: "trial succeeds", trial: nil, wantAllowed: true},
+		{name: "trial fails", trial: NewTimeoutError("timed out")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := &circuitBreaker{settings: CircuitBreakerSettings{FailureThreshold: 1, Cooldown: 20 * time.Millisecond}}
+			breaker.record(NewNetworkError("connection reset"), false)
+			if allowed, _ := breaker.allow(); allowed {
+				t.Fatal("allow() = true right after the circuit opened")
+			}
+
+			time.Sleep(30 * time.Millisecond)
+			allowed, trial := breaker.allow()
+			if !allowed || !trial {
+				t.Fatalf("allow() after the cooldown = %v, %v, want a trial call", allowed, trial)
+			}
+			if allowed, _ := breaker.allow(); allowed {
+				t.Fatal("a second call was let through during the trial")
+			}
+
+			breaker.record(tt.trial, true)
+			if allowed, trial := breaker.allow(); allowed != tt.wantAllowed || trial {
+				t.Errorf("allow() after the trial = %v, %v, want %v, false", allowed, trial, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestWithCircuitBreaker(t *testing.T) {
+	inner := newMemoryPlugin(map[string]string{"a": "data"})
+	inner.fail("retrieve", NewNetworkError("connection reset"))
+	plugin := WithCircuitBreaker(CircuitBreakerSettings{FailureThreshold: 2, Cooldown: time.Hour})(inner)
+
+	for i := 0; i < 2; i++ {
+		_, err := plugin.RetrieveFile("a")
+		checkErrorType(t, err, ptr(NetworkErrorType))
+	}
+
+	inner.fail("retrieve", nil)
+	_, err := plugin.RetrieveFile("a")
+	checkErrorType(t, err, ptr(UnavailableErrorType))
+	if calls := inner.count("retrieve"); calls != 2 {
+		t.Errorf("retrieve called %d times, want 2 before the circuit opened", calls)
+	}
+}
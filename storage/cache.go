@@ -0,0 +1,356 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// CacheOptions configures a CachingPlugin
+type CacheOptions struct {
+	// MaxBytes is the total size of the cached files, the least recently used files are evicted beyond it
+	MaxBytes int64
+
+	// MaxFileSize is the largest file that is cached
+	MaxFileSize int64
+
+	// TTL is how long a file is served from the cache, 0 caches files until they are evicted or invalidated
+	TTL time.Duration
+}
+
+// DefaultCacheOptions caches files up to 1 MiB in 64 MiB for 5 minutes
+func DefaultCacheOptions() CacheOptions {
+	return CacheOptions{
+		MaxBytes:    64 << 20,
+		MaxFileSize: 1 << 20,
+		TTL:         5 * time.Minute,
+	}
+}
+
+// CacheStats reports the activity of a CachingPlugin
+type CacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+type cacheEntry struct {
+	path    string
+	data    []byte
+	expires time.Time
+}
+
+// CachingPlugin is a read-through LRU cache in front of a StoragePlugin
+//
+// Retrieved files are kept in memory and invalidated by every write that goes through the
+// plugin: stores, deletes, uploads, copies and moves. Writes made by other processes are
+// only picked up once the TTL expires. Cached data is shared, callers must not modify it.
+type CachingPlugin struct {
+	*interceptedPlugin
+	options CacheOptions
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int64
+	hits    int64
+	misses  int64
+
+	// generation is incremented by every invalidation so a retrieve that raced
+	// with a write doesn't cache the data it read before the write
+	generation uint64
+
+	// multipartPaths maps the uploads initiated through the plugin to their path
+	multipartPaths map[string]string
+}
+
+// NewCachingPlugin wraps inner with a read-through cache
+func NewCachingPlugin(inner StoragePlugin, options CacheOptions) *CachingPlugin {
+	return &CachingPlugin{
+		interceptedPlugin: &interceptedPlugin{inner: inner, interceptor: passthrough},
+		options:           options,
+		entries:           make(map[string]*list.Element),
+		lru:               list.New(),
+		multipartPaths:    make(map[string]string),
+	}
+}
+
+// WithCache returns a Middleware that caches retrieved files
+func WithCache(options CacheOptions) Middleware {
+	return func(plugin StoragePlugin) StoragePlugin {
+		return NewCachingPlugin(plugin, options)
+	}
+}
+
+// passthrough is an Interceptor that calls the plugin directly
+func passthrough(ctx context.Context, call Call, invoke func(ctx context.Context) error) error {
+	return invoke(ctx)
+}
+
+// Stats returns the current cache statistics
+func (p *CachingPlugin) Stats() CacheStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return CacheStats{Hits: p.hits, Misses: p.misses, Entries: p.lru.Len(), Bytes: p.bytes}
+}
+
+// Purge removes every file from the cache
+func (p *CachingPlugin) Purge() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.generation++
+	p.entries = make(map[string]*list.Element)
+	p.lru.Init()
+	p.bytes = 0
+}
+
+// lookup returns the cached data of path and the current generation
+func (p *CachingPlugin) lookup(path string) ([]byte, uint64, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if element, ok := p.entries[path]; ok {
+		entry := element.Value.(*cacheEntry)
+		if entry.expires.IsZero() || time.Now().Before(entry.expires) {
+			p.lru.MoveToFront(element)
+			p.hits++
+			return entry.data, p.generation, true
+		}
+		p.remove(element)
+	}
+
+	p.misses++
+	return nil, p.generation, false
+}
+
+// add caches data unless the path was invalidated since generation
+func (p *CachingPlugin) add(path string, data []byte, generation uint64) {
+	size := int64(len(data))
+	if size > p.options.MaxFileSize || size > p.options.MaxBytes {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if generation != p.generation {
+		return
+	}
+	if element, ok := p.entries[path]; ok {
+		p.remove(element)
+	}
+
+	entry := &cacheEntry{path: path, data: data}
+	if p.options.TTL > 0 {
+		entry.expires = time.Now().Add(p.options.TTL)
+	}
+	p.entries[path] = p.lru.PushFront(entry)
+	p.bytes += size
+
+	for p.bytes > p.options.MaxBytes {
+		p.remove(p.lru.Back())
+	}
+}
+
+// remove drops an entry, the mutex must be held
+func (p *CachingPlugin) remove(element *list.Element) {
+	entry := p.lru.Remove(element).(*cacheEntry)
+	delete(p.entries, entry.path)
+	p.bytes -= int64(len(entry.data))
+}
+
+// invalidate drops the cached data of the paths
+func (p *CachingPlugin) invalidate(paths ...string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.generation++
+	for _, path := range paths {
+		if element, ok := p.entries[path]; ok {
+			p.remove(element)
+		}
+	}
+}
+
+// RetrieveFile returns the cached data or retrieves and caches the file
+func (p *CachingPlugin) RetrieveFile(path string) ([]byte, error) {
+	return p.RetrieveFileWithContext(context.Background(), path)
+}
+
+// RetrieveFileWithContext returns the cached data or retrieves and caches the file
+func (p *CachingPlugin) RetrieveFileWithContext(ctx context.Context, path string) ([]byte, error) {
+	data, generation, ok := p.lookup(path)
+	if ok {
+		return data, nil
+	}
+
+	data, err := retrieveFile(ctx, p.inner, path)
+	if err != nil {
+		return nil, err
+	}
+	p.add(path, data, generation)
+	return data, nil
+}
+
+// StoreFile stores the file and invalidates its cached data
+func (p *CachingPlugin) StoreFile(path string, data []byte, contentType *string) error {
+	return p.StoreFileWithContext(context.Background(), path, data, contentType)
+}
+
+// StoreFileWithContext stores the file and invalidates its cached data
+func (p *CachingPlugin) StoreFileWithContext(ctx context.Context, path string, data []byte, contentType *string) error {
+	defer p.invalidate(path)
+	return storeFile(ctx, p.inner, path, data, contentType, ProgressFromContext(ctx))
+}
+
+// StoreFileWithOptions stores the file and invalidates its cached data
+func (p *CachingPlugin) StoreFileWithOptions(ctx context.Context, path string, data []byte, options StoreOptions) error {
+	defer p.invalidate(path)
+	return storeWithOptions(ctx, p.inner, path, data, options, ProgressFromContext(ctx))
+}
+
+// DeleteFile deletes the file and invalidates its cached data
+func (p *CachingPlugin) DeleteFile(path string) error {
+	return p.DeleteFileWithContext(context.Background(), path)
+}
+
+// DeleteFileWithContext deletes the file and invalidates its cached data
+func (p *CachingPlugin) DeleteFileWithContext(ctx context.Context, path string) error {
+	defer p.invalidate(path)
+	return deleteFile(ctx, p.inner, path)
+}
+
+// DeleteFiles deletes the files and invalidates their cached data
+func (p *CachingPlugin) DeleteFiles(paths []string) ([]DeleteResult, error) {
+	defer p.invalidate(paths...)
+	return deleteFiles(p.inner, paths)
+}
+
+// CopyFile copies the file and invalidates the cached data of the destination
+func (p *CachingPlugin) CopyFile(sourcePath string, destinationPath string) error {
+	defer p.invalidate(destinationPath)
+	return copyFile(p.inner, sourcePath, destinationPath)
+}
+
+// MoveFile moves the file and invalidates the cached data of both paths
+func (p *CachingPlugin) MoveFile(sourcePath string, destinationPath string) error {
+	defer p.invalidate(sourcePath, destinationPath)
+	return moveFile(p.inner, sourcePath, destinationPath)
+}
+
+// OpenUpload starts an upload that invalidates the cached data of its path when it is committed
+func (p *CachingPlugin) OpenUpload(path string, contentType *string) (UploadWriter, error) {
+	writer, err := newUploadWriter(p.inner, path, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingUpload{UploadWriter: writer, plugin: p, path: path}, nil
+}
+
+type cachingUpload struct {
+	UploadWriter
+	plugin *CachingPlugin
+	path   string
+}
+
+func (u *cachingUpload) Commit() error {
+	defer u.plugin.invalidate(u.path)
+	return u.UploadWriter.Commit()
+}
+
+// InitiateMultipartUpload starts a multipart upload and remembers its path for invalidation
+func (p *CachingPlugin) InitiateMultipartUpload(path string, contentType *string) (string, error) {
+	multipart, err := multipartPlugin(p.inner)
+	if err != nil {
+		return "", err
+	}
+
+	uploadID, err := multipart.InitiateMultipartUpload(path, contentType)
+	if err != nil {
+		return "", err
+	}
+
+	p.mutex.Lock()
+	p.multipartPaths[uploadID] = path
+	p.mutex.Unlock()
+	return uploadID, nil
+}
+
+// CompleteMultipartUpload completes the upload and invalidates the cached data of its path
+// The whole cache is purged for uploads that weren't initiated through this plugin
+func (p *CachingPlugin) CompleteMultipartUpload(uploadID string, parts []UploadedPart) error {
+	multipart, err := multipartPlugin(p.inner)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	path, known := p.multipartPaths[uploadID]
+	p.mutex.Unlock()
+
+	err = multipart.CompleteMultipartUpload(uploadID, parts)
+	if known {
+		p.invalidate(path)
+	} else {
+		p.Purge()
+	}
+	if err == nil {
+		p.forgetMultipart(uploadID)
+	}
+	return err
+}
+
+// AbortMultipartUpload aborts the upload
+func (p *CachingPlugin) AbortMultipartUpload(uploadID string) error {
+	multipart, err := multipartPlugin(p.inner)
+	if err != nil {
+		return err
+	}
+
+	if err := multipart.AbortMultipartUpload(uploadID); err != nil {
+		return err
+	}
+	p.forgetMultipart(uploadID)
+	return nil
+}
+
+func (p *CachingPlugin) forgetMultipart(uploadID string) {
+	p.mutex.Lock()
+	delete(p.multipartPaths, uploadID)
+	p.mutex.Unlock()
+}
+
+// RestoreVersion restores a version and invalidates the cached data of the file
+func (p *CachingPlugin) RestoreVersion(path string, versionID string) error {
+	versioning, err := versioningPlugin(p.inner)
+	if err != nil {
+		return err
+	}
+
+	defer p.invalidate(path)
+	return versioning.RestoreVersion(path, versionID)
+}
+
+// SweepExpiredFiles deletes the expired files and purges the cache if any were deleted
+func (p *CachingPlugin) SweepExpiredFiles(ctx context.Context) (int, error) {
+	lifecycle, err := lifecyclePlugin(p.inner)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := lifecycle.SweepExpiredFiles(ctx)
+	if deleted > 0 {
+		p.Purge()
+	}
+	return deleted, err
+}
+
+// Cleanup empties the cache and cleans up the wrapped plugin
+func (p *CachingPlugin) Cleanup() error {
+	p.Purge()
+	return p.inner.Cleanup()
+}
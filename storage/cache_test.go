@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCachingPluginInvalidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		failure error
+		write   func(p *CachingPlugin) error
+		// stale are the cached paths the write must invalidate, kept the ones it must leave cached
+		stale []string
+		kept  []string
+	}{
+		{
+			name:  "store",
+			write: func(p *CachingPlugin) error { return p.StoreFile("a", []byte("new"), nil) },
+			stale: []string{"a"},
+			kept:  []string{"b"},
+		},
+		{
+			name: "store with options",
+			write: func(p *CachingPlugin) error {
+				return p.StoreFileWithOptions(context.Background(), "a", []byte("new"), StoreOptions{})
+			},
+			stale: []string{"a"},
+			kept:  []string{"b"},
+		},
+		{
+			name:  "delete",
+			write: func(p *CachingPlugin) error { return p.DeleteFile("a") },
+			stale: []string{"a"},
+			kept:  []string{"b"},
+		},
+		{
+			name: "batch delete",
+			write: func(p *CachingPlugin) error {
+				_, err := p.DeleteFiles([]string{"a", "b"})
+				return err
+			},
+			stale: []string{"a", "b"},
+		},
+		{
+			name:  "copy",
+			write: func(p *CachingPlugin) error { return p.CopyFile("a", "b") },
+			stale: []string{"b"},
+			kept:  []string{"a"},
+		},
+		{
+			name:  "move",
+			write: func(p *CachingPlugin) error { return p.MoveFile("a", "b") },
+			stale: []string{"a", "b"},
+		},
+		{
+			name: "upload",
+			write: func(p *CachingPlugin) error {
+				writer, err := p.OpenUpload("a", nil)
+				if err != nil {
+					return err
+				}
+				if err := writer.WriteChunk([]byte("new")); err != nil {
+					return err
+				}
+				return writer.Commit()
+			},
+			stale: []string{"a"},
+			kept:  []string{"b"},
+		},
+		{
+			name:    "failed store",
+			failure: NewNetworkError("connection reset"),
+			write:   func(p *CachingPlugin) error { return p.StoreFile("a", []byte("new"), nil) },
+			stale:   []string{"a"},
+			kept:    []string{"b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newMemoryPlugin(map[string]string{"a": "old a", "b": "old b"})
+			plugin := NewCachingPlugin(inner, CacheOptions{MaxBytes: 1 << 20, MaxFileSize: 1 << 10})
+			for _, path := range []string{"a", "b"} {
+				if _, err := plugin.RetrieveFile(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			inner.fail("store", tt.failure)
+			if err := tt.write(plugin); (err != nil) != (tt.failure != nil) {
+				t.Fatalf("write error = %v, want %v", err, tt.failure)
+			}
+
+			for _, path := range tt.stale {
+				if _, _, cached := plugin.lookup(path); cached {
+					t.Errorf("%s is still cached after the write", path)
+				}
+			}
+			for _, path := range tt.kept {
+				if _, _, cached := plugin.lookup(path); !cached {
+					t.Errorf("%s was dropped from the cache", path)
+				}
+			}
+		})
+	}
+}
+
+// gatedPlugin holds retrieves after reading the file until release is closed
+type gatedPlugin struct {
+	*memoryPlugin
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (p *gatedPlugin) RetrieveFile(path string) ([]byte, error) {
+	data, err := p.memoryPlugin.RetrieveFile(path)
+	close(p.read)
+	<-p.release
+	return data, err
+}
+
+func TestCachingPluginRacingRetrieve(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(p *CachingPlugin) error
+	}{
+		{name: "store", write: func(p *CachingPlugin) error { return p.StoreFile("a", []byte("new"), nil) }},
+		{name: "store of another file", write: func(p *CachingPlugin) error { return p.StoreFile("b", []byte("new"), nil) }},
+		{name: "purge", write: func(p *CachingPlugin) error { p.Purge(); return nil }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := &gatedPlugin{memoryPlugin: newMemoryPlugin(map[string]string{"a": "old"}), read: make(chan struct{}), release: make(chan struct{})}
+			plugin := NewCachingPlugin(inner, CacheOptions{MaxBytes: 1 << 20, MaxFileSize: 1 << 10})
+
+			retrieved := make(chan []byte)
+			go func() {
+				data, _ := plugin.RetrieveFile("a")
+				retrieved <- data
+			}()
+
+			// The write lands after the retrieve read the old data but before it returns
+			<-inner.read
+			if err := tt.write(plugin); err != nil {
+				t.Fatal(err)
+			}
+			close(inner.release)
+			<-retrieved
+
+			if _, _, cached := plugin.lookup("a"); cached {
+				t.Error("data read before the write was cached")
+			}
+		})
+	}
+}
+
+func TestCachingPluginLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		options    CacheOptions
+		wait       time.Duration
+		wantCached []string
+	}{
+		{name: "everything fits", options: CacheOptions{MaxBytes: 100, MaxFileSize: 100}, wantCached: []string{"small", "medium", "large"}},
+		{name: "file too large", options: CacheOptions{MaxBytes: 100, MaxFileSize: 20}, wantCached: []string{"small", "medium"}},
+		{name: "least recently used evicted", options: CacheOptions{MaxBytes: 50, MaxFileSize: 100}, wantCached: []string{"medium", "large"}},
+		{name: "expired", options: CacheOptions{MaxBytes: 100, MaxFileSize: 100, TTL: 10 * time.Millisecond}, wait: 20 * time.Millisecond},
+		{name: "not yet expired", options: CacheOptions{MaxBytes: 100, MaxFileSize: 100, TTL: time.Hour}, wantCached: []string{"small", "medium", "large"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newMemoryPlugin(map[string]string{
+				"small":  "0123456789",
+				"medium": "01234567890123456789",
+				"large":  "012345678901234567890123456789",
+			})
+			plugin := NewCachingPlugin(inner, tt.options)
+			for _, path := range []string{"small", "medium", "large"} {
+				if _, err := plugin.RetrieveFile(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			time.Sleep(tt.wait)
+
+			var cached []string
+			for _, path := range []string{"small", "medium", "large"} {
+				if _, _, ok := plugin.lookup(path); ok {
+					cached = append(cached, path)
+				}
+			}
+			if len(cached) != len(tt.wantCached) {
+				t.Fatalf("cached %v, want %v", cached, tt.wantCached)
+			}
+			for i := range cached {
+				if cached[i] != tt.wantCached[i] {
+					t.Fatalf("cached %v, want %v", cached, tt.wantCached)
+				}
+			}
+			if stats := plugin.Stats(); stats.Bytes > tt.options.MaxBytes {
+				t.Errorf("cache holds %d bytes, more than %d", stats.Bytes, tt.options.MaxBytes)
+			}
+		})
+	}
+}
+
+func TestCachingPluginHits(t *testing.T) {
+	inner := newMemoryPlugin(map[string]string{"a": "data"})
+	plugin := NewCachingPlugin(inner, DefaultCacheOptions())
+
+	for i := 0; i < 3; i++ {
+		data, err := plugin.RetrieveFile("a")
+		if err != nil || string(data) != "data" {
+			t.Fatalf("RetrieveFile() = %q, %v", data, err)
+		}
+	}
+	if calls := inner.count("retrieve"); calls != 1 {
+		t.Errorf("retrieve called %d times, want 1", calls)
+	}
+	if stats := plugin.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 || stats.Bytes != 4 {
+		t.Errorf("Stats() = %+v, want 2 hits, 1 miss, 1 entry of 4 bytes", stats)
+	}
+}
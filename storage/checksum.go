@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+)
+
+// ChecksumAlgorithm names a supported digest algorithm
+type ChecksumAlgorithm string
+
+const (
+	ChecksumSHA256 ChecksumAlgorithm = "sha256"
+	ChecksumMD5    ChecksumAlgorithm = "md5"
+	ChecksumCRC32C ChecksumAlgorithm = "crc32c"
+)
+
+// Checksum is a digest of a file's content
+// Value is the lowercase hex encoding of the digest (big-endian for CRC32C)
+type Checksum struct {
+	Algorithm ChecksumAlgorithm `json:"algorithm"`
+	Value     string            `json:"value"`
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// NewChecksumHash returns a hash for the algorithm, for computing checksums incrementally
+func NewChecksumHash(algorithm ChecksumAlgorithm) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumMD5:
+		return md5.New(), nil
+	case ChecksumCRC32C:
+		return crc32.New(crc32cTable), nil
+	default:
+		return nil, NewInvalidInputError(fmt.Sprintf("unsupported checksum algorithm %q", algorithm))
+	}
+}
+
+// ComputeChecksum computes the checksum of data with the given algorithm
+func ComputeChecksum(algorithm ChecksumAlgorithm, data []byte) (*Checksum, error) {
+	h, err := NewChecksumHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(data)
+
+	return &Checksum{
+		Algorithm: algorithm,
+		Value:     hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// Verify checks that data matches the checksum
+// A mismatch is reported as a ChecksumMismatchErrorType error
+func (c *Checksum) Verify(data []byte) error {
+	h, err := NewChecksumHash(c.Algorithm)
+	if err != nil {
+		return err
+	}
+	h.Write(data)
+	return c.verifyHash(h)
+}
+
+// verifyHash checks the digest of a hash created with NewChecksumHash for the checksum's algorithm
+func (c *Checksum) verifyHash(h hash.Hash) error {
+	actual := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(actual, c.Value) {
+		return NewChecksumMismatchError(fmt.Sprintf("expected %s %s, got %s", c.Algorithm, c.Value, actual))
+	}
+	return nil
+}
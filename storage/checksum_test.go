@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"testing"
+)
+
+func TestChecksumVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum Checksum
+		data     string
+		wantType *ErrorType
+	}{
+		{name: "sha256", checksum: Checksum{Algorithm: ChecksumSHA256, Value: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}, data: "abc"},
+		{name: "md5", checksum: Checksum{Algorithm: ChecksumMD5, Value: "900150983cd24fb0d6963f7d28e17f72"}, data: "abc"},
+		{name: "crc32c", checksum: Checksum{Algorithm: ChecksumCRC32C, Value: "364b3fb7"}, data: "abc"},
+		{name: "upper case digest", checksum: Checksum{Algorithm: ChecksumMD5, Value: "900150983CD24FB0D6963F7D28E17F72"}, data: "abc"},
+		{name: "sha256 mismatch", checksum: Checksum{Algorithm: ChecksumSHA256, Value: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}, data: "abd", wantType: ptr(ChecksumMismatchErrorType)},
+		{name: "crc32c mismatch", checksum: Checksum{Algorithm: ChecksumCRC32C, Value: "00000000"}, data: "abc", wantType: ptr(ChecksumMismatchErrorType)},
+		{name: "empty digest", checksum: Checksum{Algorithm: ChecksumMD5}, data: "abc", wantType: ptr(ChecksumMismatchErrorType)},
+		{name: "unsupported algorithm", checksum: Checksum{Algorithm: "sha1", Value: "a9993e364706816aba3e25717850c26c9cd0d89d"}, data: "abc", wantType: ptr(InvalidInputError)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkErrorType(t, tt.checksum.Verify([]byte(tt.data)), tt.wantType)
+		})
+	}
+}
+
+// checksumPlugin keeps the checksums passed in the store options and reports them from StatFile
+type checksumPlugin struct {
+	*memoryPlugin
+	checksums map[string]*Checksum
+}
+
+func newChecksumPlugin() *checksumPlugin {
+	return &checksumPlugin{memoryPlugin: newMemoryPlugin(nil), checksums: make(map[string]*Checksum)}
+}
+
+func (p *checksumPlugin) StoreFileWithOptions(ctx context.Context, path string, data []byte, options StoreOptions) error {
+	p.checksums[path] = options.Checksum
+	return p.StoreFile(path, data, options.ContentType)
+}
+
+func (p *checksumPlugin) StatFile(path string) (*FileMetadata, error) {
+	metadata, err := p.memoryPlugin.StatFile(path)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Checksum = p.checksums[path]
+	return metadata, nil
+}
+
+func TestStoreFileWithOptionsChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		plugin   func() StoragePlugin
+		checksum *Checksum
+		wantType *ErrorType
+	}{
+		{name: "match", plugin: func() StoragePlugin { return newChecksumPlugin() }, checksum: &Checksum{Algorithm: ChecksumMD5, Value: "900150983cd24fb0d6963f7d28e17f72"}},
+		{name: "mismatch", plugin: func() StoragePlugin { return newChecksumPlugin() }, checksum: &Checksum{Algorithm: ChecksumMD5, Value: "00"}, wantType: ptr(ChecksumMismatchErrorType)},
+		{name: "no checksum", plugin: func() StoragePlugin { return newChecksumPlugin() }},
+		{name: "plain plugin match", plugin: func() StoragePlugin { return newMemoryPlugin(nil) }, checksum: &Checksum{Algorithm: ChecksumMD5, Value: "900150983cd24fb0d6963f7d28e17f72"}},
+		{name: "plain plugin mismatch", plugin: func() StoragePlugin { return newMemoryPlugin(nil) }, checksum: &Checksum{Algorithm: ChecksumMD5, Value: "00"}, wantType: ptr(ChecksumMismatchErrorType)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := tt.plugin()
+			options := StoreOptions{ContentType: ptr("text/plain"), Checksum: tt.checksum}
+
+			err := storeFileWithOptions(context.Background(), plugin, "a", []byte("abc"), options, nil)
+			checkErrorType(t, err, tt.wantType)
+			if stored := plugin.FileExists("a"); stored != (tt.wantType == nil) {
+				t.Errorf("stored = %v after error %v", stored, err)
+			}
+		})
+	}
+}
+
+func TestRetrieveFileVerified(t *testing.T) {
+	tests := []struct {
+		name string
+		// corrupt replaces the content behind the recorded checksum
+		corrupt  bool
+		checksum *Checksum
+		wantType *ErrorType
+	}{
+		{name: "intact", checksum: &Checksum{Algorithm: ChecksumSHA256, Value: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}},
+		{name: "corrupted", corrupt: true, checksum: &Checksum{Algorithm: ChecksumSHA256, Value: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}, wantType: ptr(ChecksumMismatchErrorType)},
+		{name: "no recorded checksum", corrupt: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := newChecksumPlugin()
+			options := StoreOptions{Checksum: tt.checksum}
+			if err := storeFileWithOptions(context.Background(), plugin, "a", []byte("abc"), options, nil); err != nil {
+				t.Fatal(err)
+			}
+			if tt.corrupt {
+				plugin.memoryPlugin.StoreFile("a", []byte("abd"), nil)
+			}
+
+			data, err := retrieveFileVerified(context.Background(), plugin, "a")
+			checkErrorType(t, err, tt.wantType)
+			if tt.wantType == nil && len(data) != 3 {
+				t.Errorf("retrieved %q", data)
+			}
+		})
+	}
+
+	_, err := retrieveFileVerified(context.Background(), newChecksumPlugin(), "missing")
+	checkErrorType(t, err, ptr(NotFoundErrorType))
+}
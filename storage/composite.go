@@ -0,0 +1,642 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CompositePolicy selects how a CompositePlugin spreads files over its backends
+type CompositePolicy int
+
+const (
+	// MirrorPolicy writes every file to all backends and reads from the first backend that has it
+	MirrorPolicy CompositePolicy = iota
+
+	// TieredPolicy writes to the first (hot) backend and reads with fallback to the later (cold) backends
+	// Files are moved one tier down once they are older than CompositeOptions.MigrateAfter
+	TieredPolicy
+)
+
+func (p CompositePolicy) String() string {
+	switch p {
+	case MirrorPolicy:
+		return "Mirror"
+	case TieredPolicy:
+		return "Tiered"
+	default:
+		return fmt.Sprintf("CompositePolicy(%d)", int(p))
+	}
+}
+
+// CompositeOptions configures a CompositePlugin
+type CompositeOptions struct {
+	Policy CompositePolicy
+
+	// WriteQuorum is the number of backends that must accept a mirrored write, 0 means all of them
+	// The first backend must always accept it. Replicas that missed a write aren't repaired, they keep
+	// the previous version until the file is written again and serve it when reads fall back to them
+	WriteQuorum int
+
+	// PromoteOnRead copies files found in a cold tier back to the hot tier when they are read
+	PromoteOnRead bool
+
+	// MigrateAfter is the age after which files are moved to the next tier, 0 disables migration
+	MigrateAfter time.Duration
+
+	// MigrationInterval is how often migration runs in the background, 0 disables background
+	// migration so Migrate has to be called explicitly
+	MigrationInterval time.Duration
+}
+
+// CompositePlugin combines several backends into one StoragePlugin
+//
+// With MirrorPolicy every write goes to all backends, with TieredPolicy new files land in the
+// first backend and are migrated down the tiers as they age. Reads try the backends in order
+// and fall back to the next one when a file is missing or a backend fails.
+type CompositePlugin struct {
+	backends []StoragePlugin
+	options  CompositeOptions
+	locks    PathMutex
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewCompositePlugin combines the backends, the first backend is the primary or hot tier
+// Background migration is started for tiered plugins with a MigrationInterval and stopped by Cleanup
+func NewCompositePlugin(options CompositeOptions, backends ...StoragePlugin) (*CompositePlugin, error) {
+	if len(backends) == 0 {
+		return nil, NewConfigurationError("composite plugin needs at least one backend")
+	}
+	if options.Policy != MirrorPolicy && options.Policy != TieredPolicy {
+		return nil, NewConfigurationError("unknown composite policy " + options.Policy.String())
+	}
+	if options.WriteQuorum < 0 || options.WriteQuorum > len(backends) {
+		return nil, NewConfigurationError(fmt.Sprintf("write quorum must be between 0 and %d", len(backends)))
+	}
+
+	p := &CompositePlugin{
+		backends: backends,
+		options:  options,
+		stop:     make(chan struct{}),
+	}
+	if options.Policy == TieredPolicy && options.MigrateAfter > 0 && options.MigrationInterval > 0 && len(backends) > 1 {
+		go runPeriodically(p.stop, options.MigrationInterval, func(ctx context.Context) { p.Migrate(ctx) })
+	}
+	return p, nil
+}
+
+// quorum returns the number of backends that must accept a mirrored write
+func (p *CompositePlugin) quorum() int {
+	if p.options.WriteQuorum == 0 {
+		return len(p.backends)
+	}
+	return p.options.WriteQuorum
+}
+
+// writeAll runs write on the primary, then on the other backends concurrently, and checks the quorum
+// A write that misses the quorum isn't undone, the previous data is gone from the backends that
+// accepted it. The returned error keeps the type of the first replica failure so retryable
+// failures can be retried, and says how many backends applied the write.
+func (p *CompositePlugin) writeAll(write func(backend StoragePlugin, primary bool) error) error {
+	if err := write(p.backends[0], true); err != nil {
+		return err
+	}
+
+	replicas := p.backends[1:]
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for i, backend := range replicas {
+		wg.Add(1)
+		go func(i int, backend StoragePlugin) {
+			defer wg.Done()
+			errs[i] = write(backend, false)
+		}(i, backend)
+	}
+	wg.Wait()
+
+	accepted := 1
+	var firstErr error
+	for _, err := range errs {
+		if err == nil {
+			accepted++
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if accepted < p.quorum() {
+		failure := AsPluginError(firstErr)
+		return &PluginError{
+			Type:    failure.Type,
+			Message: fmt.Sprintf("write applied to %d of %d backends, %d required: %s", accepted, len(p.backends), p.quorum(), failure.Message),
+		}
+	}
+	return nil
+}
+
+// deleteAll deletes a file from every backend
+// Returns a NotFoundErrorType error only when no backend had the file
+func (p *CompositePlugin) deleteAll(ctx context.Context, path string) error {
+	found := false
+	var firstErr error
+	for _, backend := range p.backends {
+		err := deleteFile(ctx, backend, path)
+		switch {
+		case err == nil:
+			found = true
+		case !IsNotFound(err) && firstErr == nil:
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if !found {
+		return NewNotFoundError(path)
+	}
+	return nil
+}
+
+// find calls read on the backends in order until one of them succeeds
+// Missing files and failing backends fall through to the next backend
+func find[T any](p *CompositePlugin, path string, read func(backend StoragePlugin) (T, error)) (T, int, error) {
+	var lastErr error
+	for i, backend := range p.backends {
+		value, err := read(backend)
+		if err == nil {
+			return value, i, nil
+		}
+		if !IsNotFound(err) || lastErr == nil {
+			lastErr = err
+		}
+	}
+
+	var zero T
+	if lastErr == nil {
+		lastErr = NewNotFoundError(path)
+	}
+	return zero, -1, lastErr
+}
+
+// currentFile returns the metadata of the hottest copy of a file, nil when no tier has it
+// Unlike find it fails when a tier can't be checked, rather than returning an older copy from a colder tier
+func (p *CompositePlugin) currentFile(path string) (*FileMetadata, error) {
+	for _, backend := range p.backends {
+		metadata, err := statFile(backend, path)
+		if err == nil {
+			return metadata, nil
+		}
+		if !IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// deleteColdCopies deletes the copies of a file in the tiers below the hot tier after it has been
+// written there. Failures are ignored, the hot copy shadows the stale ones
+func (p *CompositePlugin) deleteColdCopies(ctx context.Context, path string) {
+	for _, backend := range p.backends[1:] {
+		deleteFile(ctx, backend, path)
+	}
+}
+
+// transferFile copies a file from one backend to another, keeping its content type and custom metadata
+func transferFile(ctx context.Context, source StoragePlugin, destination StoragePlugin, path string) error {
+	data, err := retrieveFile(ctx, source, path)
+	if err != nil {
+		return err
+	}
+
+	var options StoreOptions
+	if metadata, err := statFile(source, path); err == nil {
+		options = preservedOptions(metadata)
+	}
+	return storeWithOptions(ctx, destination, path, data, options, nil)
+}
+
+// StoreFile stores the file according to the policy
+func (p *CompositePlugin) StoreFile(path string, data []byte, contentType *string) error {
+	return p.StoreFileWithContext(context.Background(), path, data, contentType)
+}
+
+// RetrieveFile retrieves the file from the first backend that has it
+func (p *CompositePlugin) RetrieveFile(path string) ([]byte, error) {
+	return p.RetrieveFileWithContext(context.Background(), path)
+}
+
+// DeleteFile deletes the file from every backend
+func (p *CompositePlugin) DeleteFile(path string) error {
+	return p.DeleteFileWithContext(context.Background(), path)
+}
+
+// FileExists reports whether any backend has the file
+func (p *CompositePlugin) FileExists(path string) bool {
+	exists, err := p.FileExistsWithContext(context.Background(), path)
+	return err == nil && exists
+}
+
+// GenerateURL generates the URL of the backend holding the file
+func (p *CompositePlugin) GenerateURL(path string, baseURL string) *string {
+	for _, backend := range p.backends {
+		if backend.FileExists(path) {
+			return backend.GenerateURL(path, baseURL)
+		}
+	}
+	return p.backends[0].GenerateURL(path, baseURL)
+}
+
+// ProviderName lists the policy and the backends, e.g. "Mirror(Local Filesystem, S3)"
+func (p *CompositePlugin) ProviderName() string {
+	names := make([]string, len(p.backends))
+	for i, backend := range p.backends {
+		names[i] = backend.ProviderName()
+	}
+	return p.options.Policy.String() + "(" + strings.Join(names, ", ") + ")"
+}
+
+// Cleanup stops background migration and cleans up every backend
+func (p *CompositePlugin) Cleanup() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+
+	var firstErr error
+	for _, backend := range p.backends {
+		if err := backend.Cleanup(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// StoreFileWithContext stores the file according to the policy
+// Progress is reported for the write to the first backend
+func (p *CompositePlugin) StoreFileWithContext(ctx context.Context, path string, data []byte, contentType *string) error {
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	if p.options.Policy == TieredPolicy {
+		if err := storeFile(ctx, p.backends[0], path, data, contentType, ProgressFromContext(ctx)); err != nil {
+			return err
+		}
+		p.deleteColdCopies(ctx, path)
+		return nil
+	}
+
+	return p.writeAll(func(backend StoragePlugin, primary bool) error {
+		var progress ProgressFunc
+		if primary {
+			progress = ProgressFromContext(ctx)
+		}
+		return storeFile(ctx, backend, path, data, contentType, progress)
+	})
+}
+
+// RetrieveFileWithContext retrieves the file from the first backend that has it
+func (p *CompositePlugin) RetrieveFileWithContext(ctx context.Context, path string) ([]byte, error) {
+	data, tier, err := find(p, path, func(backend StoragePlugin) ([]byte, error) {
+		return retrieveFile(ctx, backend, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if tier > 0 && p.options.Policy == TieredPolicy && p.options.PromoteOnRead {
+		p.promote(ctx, tier, path, data)
+	}
+	return data, nil
+}
+
+// promote copies a file found in a cold tier to the hot tier, failures are ignored
+func (p *CompositePlugin) promote(ctx context.Context, tier int, path string, data []byte) {
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	// Don't overwrite a newer version written while the file was being read
+	if exists, err := fileExists(ctx, p.backends[0], path); err != nil || exists {
+		return
+	}
+
+	var options StoreOptions
+	if metadata, err := statFile(p.backends[tier], path); err == nil {
+		options = preservedOptions(metadata)
+	}
+	storeWithOptions(ctx, p.backends[0], path, data, options, nil)
+}
+
+// DeleteFileWithContext deletes the file from every backend
+func (p *CompositePlugin) DeleteFileWithContext(ctx context.Context, path string) error {
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	return p.deleteAll(ctx, path)
+}
+
+// FileExistsWithContext reports whether any backend has the file
+func (p *CompositePlugin) FileExistsWithContext(ctx context.Context, path string) (bool, error) {
+	var firstErr error
+	for _, backend := range p.backends {
+		exists, err := fileExists(ctx, backend, path)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if exists {
+			return true, nil
+		}
+	}
+	return false, firstErr
+}
+
+// StoreFileWithOptions stores the file according to the policy
+// Mirrored writes check preconditions against the first backend, tiered writes against the
+// hottest copy of the file, which is the one reads return
+func (p *CompositePlugin) StoreFileWithOptions(ctx context.Context, path string, data []byte, options StoreOptions) error {
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	if p.options.Policy == TieredPolicy {
+		if options.hasPreconditions() {
+			current, err := p.currentFile(path)
+			if err != nil {
+				return err
+			}
+			if err := CheckPreconditions(current, options); err != nil {
+				return err
+			}
+			// Checked under the path lock, the hot tier may not even have the file
+			options.IfMatch = nil
+			options.IfNoneMatch = nil
+		}
+
+		if err := storeWithOptions(ctx, p.backends[0], path, data, options, ProgressFromContext(ctx)); err != nil {
+			return err
+		}
+		p.deleteColdCopies(ctx, path)
+		return nil
+	}
+
+	return p.writeAll(func(backend StoragePlugin, primary bool) error {
+		if primary {
+			return storeWithOptions(ctx, backend, path, data, options, ProgressFromContext(ctx))
+		}
+
+		replica := options
+		replica.IfMatch = nil
+		replica.IfNoneMatch = nil
+		return storeWithOptions(ctx, backend, path, data, replica, nil)
+	})
+}
+
+// StatFile returns the metadata from the first backend that has the file
+func (p *CompositePlugin) StatFile(path string) (*FileMetadata, error) {
+	metadata, _, err := find(p, path, func(backend StoragePlugin) (*FileMetadata, error) {
+		return statFile(backend, path)
+	})
+	return metadata, err
+}
+
+// CopyFile copies the file on every backend when mirroring, or inside the tier holding it
+func (p *CompositePlugin) CopyFile(sourcePath string, destinationPath string) error {
+	return p.relocate(sourcePath, destinationPath, false)
+}
+
+// MoveFile moves the file on every backend when mirroring, or inside the tier holding it
+func (p *CompositePlugin) MoveFile(sourcePath string, destinationPath string) error {
+	return p.relocate(sourcePath, destinationPath, true)
+}
+
+// relocate copies or moves a file according to the policy
+func (p *CompositePlugin) relocate(sourcePath string, destinationPath string, move bool) error {
+	operation := copyFile
+	if move {
+		operation = moveFile
+	}
+	if sourcePath == destinationPath {
+		return NewInvalidInputError("source and destination paths are the same")
+	}
+
+	unlock := p.locks.LockPair(sourcePath, destinationPath)
+	defer unlock()
+
+	if p.options.Policy == MirrorPolicy {
+		return p.writeAll(func(backend StoragePlugin, primary bool) error {
+			return operation(backend, sourcePath, destinationPath)
+		})
+	}
+
+	tier := -1
+	for i, backend := range p.backends {
+		if backend.FileExists(sourcePath) {
+			tier = i
+			break
+		}
+	}
+	if tier < 0 {
+		return NewNotFoundError(sourcePath)
+	}
+
+	if err := operation(p.backends[tier], sourcePath, destinationPath); err != nil {
+		return err
+	}
+
+	// Older copies in hotter tiers would shadow the destination, stale copies of a moved source must go
+	ctx := context.Background()
+	for i, backend := range p.backends {
+		if i < tier {
+			deleteFile(ctx, backend, destinationPath)
+		}
+	}
+	if move {
+		for i, backend := range p.backends {
+			if i != tier {
+				deleteFile(ctx, backend, sourcePath)
+			}
+		}
+	}
+	return nil
+}
+
+// compositeCursor is the state of a tiered listing
+// Each tier keeps the cursor of the page that still has files after After
+type compositeCursor struct {
+	After   string    `json:"after"`
+	Cursors []*string `json:"cursors"`
+}
+
+// ListFiles lists the first backend when mirroring, or merges the listings of all tiers
+func (p *CompositePlugin) ListFiles(prefix string, cursor string, limit int) (*ListResult, error) {
+	if p.options.Policy == MirrorPolicy {
+		return listFiles(p.backends[0], prefix, cursor, limit)
+	}
+
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	state := compositeCursor{Cursors: make([]*string, len(p.backends))}
+	for i := range state.Cursors {
+		empty := ""
+		state.Cursors[i] = &empty
+	}
+	if cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || json.Unmarshal(decoded, &state) != nil || len(state.Cursors) != len(p.backends) {
+			return nil, NewInvalidInputError("invalid cursor")
+		}
+	}
+
+	// The hottest tier wins when a file exists in several tiers
+	merged := make(map[string]FileMetadata)
+	pages := make([]*ListResult, len(p.backends))
+	for i, backend := range p.backends {
+		if state.Cursors[i] == nil {
+			continue
+		}
+
+		page, err := listFiles(backend, prefix, *state.Cursors[i], limit)
+		if err != nil {
+			return nil, err
+		}
+		pages[i] = page
+		for _, file := range page.Files {
+			if _, exists := merged[file.Path]; !exists && file.Path > state.After {
+				merged[file.Path] = file
+			}
+		}
+	}
+
+	paths := make([]string, 0, len(merged))
+	for path := range merged {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	remaining := len(paths) > limit
+	if remaining {
+		paths = paths[:limit]
+	}
+	result := &ListResult{Files: make([]FileMetadata, len(paths))}
+	for i, path := range paths {
+		result.Files[i] = merged[path]
+	}
+	if len(paths) > 0 {
+		state.After = paths[len(paths)-1]
+	}
+
+	// A tier moves on to its next page once every file of its current page has been returned
+	more := remaining
+	for i, page := range pages {
+		if page == nil {
+			continue
+		}
+		if len(page.Files) == 0 || page.Files[len(page.Files)-1].Path <= state.After {
+			state.Cursors[i] = page.NextCursor
+		}
+		if state.Cursors[i] != nil {
+			more = true
+		}
+	}
+
+	if more {
+		encoded, err := json.Marshal(state)
+		if err != nil {
+			return nil, NewStorageError("failed to encode cursor: " + err.Error())
+		}
+		next := base64.RawURLEncoding.EncodeToString(encoded)
+		result.NextCursor = &next
+	}
+	return result, nil
+}
+
+// Migrate moves files older than MigrateAfter one tier down and returns the number of files moved
+// The coldest tiers are migrated first so a file moves at most one tier per run
+func (p *CompositePlugin) Migrate(ctx context.Context) (int, error) {
+	if p.options.Policy != TieredPolicy || p.options.MigrateAfter <= 0 {
+		return 0, nil
+	}
+
+	cutoff := time.Now().Add(-p.options.MigrateAfter)
+	moved := 0
+	for tier := len(p.backends) - 2; tier >= 0; tier-- {
+		n, err := p.migrateTier(ctx, tier, cutoff)
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// migrateTier moves the files of a tier last modified before cutoff to the next tier
+func (p *CompositePlugin) migrateTier(ctx context.Context, tier int, cutoff time.Time) (int, error) {
+	source, destination := p.backends[tier], p.backends[tier+1]
+
+	moved := 0
+	cursor := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return moved, contextError(err)
+		}
+
+		page, err := listFiles(source, "", cursor, DefaultListLimit)
+		if err != nil {
+			return moved, err
+		}
+
+		for _, file := range page.Files {
+			if file.LastModified == nil || !file.LastModified.Before(cutoff) {
+				continue
+			}
+
+			ok, err := p.migrateFile(ctx, source, destination, file)
+			if err != nil {
+				return moved, err
+			}
+			if ok {
+				moved++
+			}
+		}
+
+		if page.NextCursor == nil {
+			return moved, nil
+		}
+		cursor = *page.NextCursor
+	}
+}
+
+// migrateFile moves one file to the next tier unless it changed since it was listed
+func (p *CompositePlugin) migrateFile(ctx context.Context, source StoragePlugin, destination StoragePlugin, file FileMetadata) (bool, error) {
+	unlock := p.locks.Lock(file.Path)
+	defer unlock()
+
+	current, err := statFile(source, file.Path)
+	if err != nil {
+		if IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if current.Size != file.Size || current.LastModified == nil || !current.LastModified.Equal(*file.LastModified) {
+		return false, nil
+	}
+
+	if err := transferFile(ctx, source, destination, file.Path); err != nil {
+		return false, err
+	}
+	if err := deleteFile(ctx, source, file.Path); err != nil && !IsNotFound(err) {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTiers returns a memory plugin per tier holding the given files
+func newTiers(tiers ...map[string]string) []*memoryPlugin {
+	plugins := make([]*memoryPlugin, len(tiers))
+	for i, files := range tiers {
+		plugins[i] = newMemoryPlugin(files)
+	}
+	return plugins
+}
+
+func newTieredPlugin(t *testing.T, options CompositeOptions, tiers []*memoryPlugin) *CompositePlugin {
+	t.Helper()
+
+	backends := make([]StoragePlugin, len(tiers))
+	for i, tier := range tiers {
+		backends[i] = tier
+	}
+	plugin, err := NewCompositePlugin(options, backends...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { plugin.Cleanup() })
+	return plugin
+}
+
+func TestCompositeListFilesCursor(t *testing.T) {
+	many := make(map[string]string)
+	for i := 0; i < 25; i++ {
+		many[fmt.Sprintf("f%02d", i)] = "cold"
+	}
+
+	tests := []struct {
+		name  string
+		tiers []map[string]string
+		// want maps every listed path to the size of the hottest copy
+		want map[string]int64
+	}{
+		{
+			name:  "disjoint tiers",
+			tiers: []map[string]string{{"a": "1", "c": "1", "e": "1"}, {"b": "22", "d": "22", "f": "22"}},
+			want:  map[string]int64{"a": 1, "b": 2, "c": 1, "d": 2, "e": 1, "f": 2},
+		},
+		{
+			name:  "hottest copy wins",
+			tiers: []map[string]string{{"b": "1", "c": "1"}, {"a": "22", "b": "22", "c": "22", "d": "22"}},
+			want:  map[string]int64{"a": 2, "b": 1, "c": 1, "d": 2},
+		},
+		{
+			name:  "empty hot tier",
+			tiers: []map[string]string{{}, {"a": "22", "b": "22", "c": "22"}},
+			want:  map[string]int64{"a": 2, "b": 2, "c": 2},
+		},
+		{
+			name:  "three tiers",
+			tiers: []map[string]string{{"d": "1"}, {"b": "22", "d": "22"}, {"a": "333", "b": "333", "c": "333", "d": "333", "e": "333"}},
+			want:  map[string]int64{"a": 3, "b": 2, "c": 3, "d": 1, "e": 3},
+		},
+		{
+			name:  "cold tier with many pages",
+			tiers: []map[string]string{{"f03": "1", "f17": "1", "zz": "1"}, many},
+			want: func() map[string]int64 {
+				want := map[string]int64{"zz": 1}
+				for path := range many {
+					want[path] = 4
+				}
+				want["f03"], want["f17"] = 1, 1
+				return want
+			}(),
+		},
+	}
+
+	for _, tt := range tests {
+		for _, limit := range []int{1, 2, 3, 7, 100} {
+			t.Run(fmt.Sprintf("%s/limit %d", tt.name, limit), func(t *testing.T) {
+				plugin := newTieredPlugin(t, CompositeOptions{Policy: TieredPolicy}, newTiers(tt.tiers...))
+
+				var listed []string
+				cursor := ""
+				for pages := 0; ; pages++ {
+					if pages > len(tt.want)+1 {
+						t.Fatalf("listing didn't end after %d pages", pages)
+					}
+
+					page, err := plugin.ListFiles("", cursor, limit)
+					if err != nil {
+						t.Fatalf("ListFiles() error = %v", err)
+					}
+					if len(page.Files) > limit {
+						t.Fatalf("page of %d files, limit %d", len(page.Files), limit)
+					}
+					for _, file := range page.Files {
+						if want, ok := tt.want[file.Path]; !ok || file.Size != want {
+							t.Errorf("listed %s of %d bytes, want %d bytes (listed %v)", file.Path, file.Size, want, ok)
+						}
+						listed = append(listed, file.Path)
+					}
+
+					if page.NextCursor == nil {
+						break
+					}
+					cursor = *page.NextCursor
+				}
+
+				if !sort.StringsAreSorted(listed) || len(listed) != len(tt.want) {
+					t.Errorf("listed %v, want each of the %d files once in order", listed, len(tt.want))
+				}
+				for i := 1; i < len(listed); i++ {
+					if listed[i] == listed[i-1] {
+						t.Errorf("%s listed twice", listed[i])
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCompositeListFilesInvalidCursor(t *testing.T) {
+	plugin := newTieredPlugin(t, CompositeOptions{Policy: TieredPolicy}, newTiers(nil, nil))
+
+	for _, cursor := range []string{"not base64!", "bm90IGpzb24", "eyJjdXJzb3JzIjpbXX0"} {
+		_, err := plugin.ListFiles("", cursor, 10)
+		checkErrorType(t, err, ptr(InvalidInputError))
+	}
+}
+
+func TestCompositeMigrate(t *testing.T) {
+	const old = 2 * time.Hour
+
+	tests := []struct {
+		name   string
+		policy CompositePolicy
+		tiers  []map[string]string
+		// aged are the files last modified before the cutoff, by tier
+		aged      map[int][]string
+		wantMoved int
+		// want maps every file to the tier it must be in afterwards
+		want map[string]int
+	}{
+		{
+			name:      "old files move down",
+			policy:    TieredPolicy,
+			tiers:     []map[string]string{{"old": "x", "new": "x"}, {}},
+			aged:      map[int][]string{0: {"old"}},
+			wantMoved: 1,
+			want:      map[string]int{"old": 1, "new": 0},
+		},
+		{
+			name:   "coldest tier keeps its files",
+			policy: TieredPolicy,
+			tiers:  []map[string]string{{}, {"old": "x"}},
+			aged:   map[int][]string{1: {"old"}},
+			want:   map[string]int{"old": 1},
+		},
+		{
+			name:      "one tier per run",
+			policy:    TieredPolicy,
+			tiers:     []map[string]string{{"hot": "x"}, {"warm": "x"}, {}},
+			aged:      map[int][]string{0: {"hot"}, 1: {"warm"}},
+			wantMoved: 2,
+			want:      map[string]int{"hot": 1, "warm": 2},
+		},
+		{
+			name:      "replaces the colder copy",
+			policy:    TieredPolicy,
+			tiers:     []map[string]string{{"a": "new"}, {"a": "old"}},
+			aged:      map[int][]string{0: {"a"}},
+			wantMoved: 1,
+			want:      map[string]int{"a": 1},
+		},
+		{
+			name:   "mirrors don't migrate",
+			policy: MirrorPolicy,
+			tiers:  []map[string]string{{"old": "x"}, {"old": "x"}},
+			aged:   map[int][]string{0: {"old"}, 1: {"old"}},
+			want:   map[string]int{"old": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tiers := newTiers(tt.tiers...)
+			for tier, paths := range tt.aged {
+				for _, path := range paths {
+					tiers[tier].age(path, old)
+				}
+			}
+			plugin := newTieredPlugin(t, CompositeOptions{Policy: tt.policy, MigrateAfter: time.Hour}, tiers)
+
+			moved, err := plugin.Migrate(context.Background())
+			if err != nil {
+				t.Fatalf("Migrate() error = %v", err)
+			}
+			if moved != tt.wantMoved {
+				t.Errorf("Migrate() moved %d files, want %d", moved, tt.wantMoved)
+			}
+
+			for path, want := range tt.want {
+				if _, ok := tiers[want].data(path); !ok {
+					t.Errorf("%s isn't in tier %d", path, want)
+				}
+				if tt.policy == MirrorPolicy {
+					continue
+				}
+				for tier := range tiers {
+					if _, ok := tiers[tier].data(path); ok && tier != want {
+						t.Errorf("%s is also in tier %d", path, tier)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCompositeTieredWrites(t *testing.T) {
+	tests := []struct {
+		name     string
+		write    func(p *CompositePlugin) error
+		wantType *ErrorType
+		// wantHot is the content of the hot copy afterwards, wantCold whether the cold copy is left
+		wantHot  string
+		wantCold bool
+	}{
+		{
+			name:    "store replaces the cold copy",
+			write:   func(p *CompositePlugin) error { return p.StoreFile("a", []byte("new"), nil) },
+			wantHot: "new",
+		},
+		{
+			name: "create-only store sees the cold copy",
+			write: func(p *CompositePlugin) error {
+				return p.StoreFileWithOptions(context.Background(), "a", []byte("new"), StoreOptions{IfNoneMatch: ptr("*")})
+			},
+			wantType: ptr(PreconditionFailedErrorType),
+			wantCold: true,
+		},
+		{
+			name: "conditional store matches the cold copy",
+			write: func(p *CompositePlugin) error {
+				return p.StoreFileWithOptions(context.Background(), "a", []byte("new"), StoreOptions{IfMatch: ptr("*")})
+			},
+			wantHot: "new",
+		},
+		{
+			name:     "move of a cold file",
+			write:    func(p *CompositePlugin) error { return p.MoveFile("a", "b") },
+			wantCold: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tiers := newTiers(map[string]string{}, map[string]string{"a": "old"})
+			plugin := newTieredPlugin(t, CompositeOptions{Policy: TieredPolicy}, tiers)
+
+			err := tt.write(plugin)
+			checkErrorType(t, err, tt.wantType)
+
+			hot, ok := tiers[0].data("a")
+			if (tt.wantHot != "") != ok || string(hot) != tt.wantHot {
+				t.Errorf("hot copy = %q, %v, want %q", hot, ok, tt.wantHot)
+			}
+			if _, ok := tiers[1].data("a"); ok != tt.wantCold {
+				t.Errorf("cold copy left = %v, want %v", ok, tt.wantCold)
+			}
+		})
+	}
+}
+
+func TestCompositeMirrorQuorum(t *testing.T) {
+	replicaDown := NewNetworkError("replica down")
+
+	tests := []struct {
+		name     string
+		quorum   int
+		failing  []int
+		wantType *ErrorType
+	}{
+		{name: "all backends", failing: nil},
+		{name: "quorum met", quorum: 2, failing: []int{2}},
+		{name: "quorum missed", quorum: 3, failing: []int{2}, wantType: ptr(NetworkErrorType)},
+		{name: "primary only", quorum: 1, failing: []int{1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends := newTiers(map[string]string{"a": "old"}, map[string]string{"a": "old"}, map[string]string{"a": "old"})
+			plugin := newTieredPlugin(t, CompositeOptions{Policy: MirrorPolicy, WriteQuorum: tt.quorum}, backends)
+			for _, i := range tt.failing {
+				backends[i].fail("store", replicaDown)
+			}
+
+			err := plugin.StoreFile("a", []byte("new"), nil)
+			checkErrorType(t, err, tt.wantType)
+
+			// The write isn't rolled back when the quorum is missed
+			if data, _ := backends[0].data("a"); string(data) != "new" {
+				t.Errorf("primary = %q, want %q", data, "new")
+			}
+			for _, i := range tt.failing {
+				if data, _ := backends[i].data("a"); string(data) != "old" {
+					t.Errorf("failed replica %d = %q, want %q", i, data, "old")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,369 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// CompressionCodec compresses and decompresses stored data
+// Additional codecs such as zstd can be added with RegisterCompressionCodec
+type CompressionCodec interface {
+	// Encoding returns the name recorded with data compressed by this codec, e.g. "gzip"
+	Encoding() string
+
+	// Compress compresses data
+	Compress(data []byte) ([]byte, error)
+
+	// Decompress reverses Compress
+	// originalSize is the size recorded when the data was compressed, data that would decompress
+	// to more than that must be rejected rather than read into memory
+	Decompress(data []byte, originalSize int64) ([]byte, error)
+}
+
+// Codecs available for decompression, keyed by encoding
+var (
+	compressionCodecs = map[string]CompressionCodec{"gzip": GzipCodec(gzip.DefaultCompression)}
+	codecsMutex       sync.RWMutex
+)
+
+// RegisterCompressionCodec makes a codec available for decompression
+// Codecs used in CompressionRules are registered automatically
+func RegisterCompressionCodec(codec CompressionCodec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	compressionCodecs[codec.Encoding()] = codec
+}
+
+func getCompressionCodec(encoding string) (CompressionCodec, bool) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+
+	codec, ok := compressionCodecs[encoding]
+	return codec, ok
+}
+
+type gzipCodec struct {
+	level int
+}
+
+// GzipCodec returns a gzip codec using the given compression level
+func GzipCodec(level int) CompressionCodec {
+	return gzipCodec{level: level}
+}
+
+func (c gzipCodec) Encoding() string {
+	return "gzip"
+}
+
+func (c gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gzipCodec) Decompress(data []byte, originalSize int64) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(reader, originalSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decompressed)) > originalSize {
+		return nil, fmt.Errorf("data decompresses to more than the recorded %d bytes", originalSize)
+	}
+	return decompressed, nil
+}
+
+// CompressionRule selects a codec for a set of content types
+type CompressionRule struct {
+	// ContentTypes are matched against the content type of the stored file
+	// Entries may be exact ("application/json"), a wildcard subtype ("text/*") or "*"
+	ContentTypes []string
+
+	Codec CompressionCodec
+}
+
+// CompressionOptions configures a CompressionPlugin
+type CompressionOptions struct {
+	// Rules are checked in order, the first rule matching the content type is used
+	// Files without a matching rule are stored uncompressed
+	Rules []CompressionRule
+
+	// MinSize is the smallest file that is compressed, in bytes
+	MinSize int
+}
+
+// DefaultCompressionOptions gzips text-like content of at least 1 KiB
+func DefaultCompressionOptions() CompressionOptions {
+	return CompressionOptions{
+		Rules: []CompressionRule{{
+			ContentTypes: []string{
+				"text/*",
+				"application/json",
+				"application/x-ndjson",
+				"application/xml",
+				"application/javascript",
+				"application/yaml",
+			},
+			Codec: GzipCodec(gzip.DefaultCompression),
+		}},
+		MinSize: 1024,
+	}
+}
+
+// codecFor returns the codec of the first rule matching contentType
+func (o CompressionOptions) codecFor(contentType *string) CompressionCodec {
+	if contentType == nil {
+		return nil
+	}
+
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(*contentType, ";", 2)[0]))
+	for _, rule := range o.Rules {
+		for _, pattern := range rule.ContentTypes {
+			if matchContentType(pattern, mediaType) {
+				return rule.Codec
+			}
+		}
+	}
+	return nil
+}
+
+// matchContentType matches a media type against "*", "type/*" or an exact pattern
+func matchContentType(pattern string, mediaType string) bool {
+	pattern = strings.ToLower(pattern)
+	if pattern == "*" || pattern == mediaType {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
+
+// Compressed files are stored in an envelope that records the encoding and original size:
+// magic, encoding name length, encoding name, original size (uint64 big-endian), payload
+const (
+	compressionMagic = "RLMZ\x01"
+
+	// identityEncoding marks uncompressed data that happens to start with the magic
+	identityEncoding = "identity"
+
+	maxEnvelopeHeader = len(compressionMagic) + 1 + 255 + 8
+)
+
+func encodeEnvelope(encoding string, originalSize int, payload []byte) []byte {
+	buf := make([]byte, 0, len(compressionMagic)+1+len(encoding)+8+len(payload))
+	buf = append(buf, compressionMagic...)
+	buf = append(buf, byte(len(encoding)))
+	buf = append(buf, encoding...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(originalSize))
+	return append(buf, payload...)
+}
+
+// decodeEnvelopeHeader parses the envelope header
+// ok is false for data that isn't in an envelope
+func decodeEnvelopeHeader(data []byte) (encoding string, originalSize int64, headerSize int, ok bool) {
+	if !bytes.HasPrefix(data, []byte(compressionMagic)) || len(data) < len(compressionMagic)+1 {
+		return "", 0, 0, false
+	}
+
+	offset := len(compressionMagic)
+	nameLength := int(data[offset])
+	offset++
+	if len(data) < offset+nameLength+8 {
+		return "", 0, 0, false
+	}
+
+	encoding = string(data[offset : offset+nameLength])
+	offset += nameLength
+	originalSize = int64(binary.BigEndian.Uint64(data[offset:]))
+	return encoding, originalSize, offset + 8, true
+}
+
+// CompressionPlugin wraps a StoragePlugin and compresses files transparently
+//
+// Data is compressed on store according to its content type and decompressed on retrieve,
+// so it works on top of any existing plugin. StatFile and ListFiles report the original size
+// and the encoding in ContentEncoding, which takes a read of the envelope header of every file.
+type CompressionPlugin struct {
+	transformingPlugin
+	options CompressionOptions
+}
+
+// NewCompressionPlugin wraps inner with transparent compression
+func NewCompressionPlugin(inner StoragePlugin, options CompressionOptions) *CompressionPlugin {
+	for _, rule := range options.Rules {
+		if rule.Codec != nil {
+			RegisterCompressionCodec(rule.Codec)
+		}
+	}
+	return &CompressionPlugin{transformingPlugin: transformingPlugin{inner: inner}, options: options}
+}
+
+// compress returns the data to store for the given content type
+func (p *CompressionPlugin) compress(data []byte, contentType *string) ([]byte, error) {
+	codec := p.options.codecFor(contentType)
+	if codec != nil && len(data) >= p.options.MinSize {
+		compressed, err := codec.Compress(data)
+		if err != nil {
+			return nil, NewStorageError("failed to compress data: " + err.Error())
+		}
+
+		// Only keep the compressed form when it actually saves space
+		envelope := encodeEnvelope(codec.Encoding(), len(data), compressed)
+		if len(envelope) < len(data) {
+			return envelope, nil
+		}
+	}
+
+	if bytes.HasPrefix(data, []byte(compressionMagic)) {
+		return encodeEnvelope(identityEncoding, len(data), data), nil
+	}
+	return data, nil
+}
+
+// decompress reverses compress
+func (p *CompressionPlugin) decompress(data []byte) ([]byte, error) {
+	encoding, originalSize, headerSize, ok := decodeEnvelopeHeader(data)
+	if !ok {
+		return data, nil
+	}
+
+	if originalSize < 0 {
+		return nil, NewStorageError("invalid compression header")
+	}
+
+	payload := data[headerSize:]
+	if encoding == identityEncoding {
+		return payload, nil
+	}
+
+	codec, ok := getCompressionCodec(encoding)
+	if !ok {
+		return nil, NewConfigurationError("no compression codec registered for " + encoding)
+	}
+
+	decompressed, err := codec.Decompress(payload, originalSize)
+	if err != nil {
+		return nil, NewStorageError("failed to decompress data: " + err.Error())
+	}
+	return decompressed, nil
+}
+
+// describe returns the metadata of a stored file with the original size and the encoding
+func (p *CompressionPlugin) describe(metadata *FileMetadata) (*FileMetadata, error) {
+	header, err := retrieveRange(p.inner, metadata.Path, 0, int64(maxEnvelopeHeader))
+	if err != nil {
+		return nil, err
+	}
+
+	if encoding, originalSize, _, ok := decodeEnvelopeHeader(header); ok {
+		result := *metadata
+		result.Size = originalSize
+		if encoding != identityEncoding {
+			result.ContentEncoding = &encoding
+		}
+		return &result, nil
+	}
+	return metadata, nil
+}
+
+// StoreFile compresses data and stores it in the wrapped plugin
+func (p *CompressionPlugin) StoreFile(path string, data []byte, contentType *string) error {
+	stored, err := p.compress(data, contentType)
+	if err != nil {
+		return err
+	}
+	return p.inner.StoreFile(path, stored, contentType)
+}
+
+// RetrieveFile retrieves a file from the wrapped plugin and decompresses it
+func (p *CompressionPlugin) RetrieveFile(path string) ([]byte, error) {
+	data, err := p.inner.RetrieveFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return p.decompress(data)
+}
+
+// StoreFileWithContext compresses data and stores it with cancellation support
+func (p *CompressionPlugin) StoreFileWithContext(ctx context.Context, path string, data []byte, contentType *string) error {
+	stored, err := p.compress(data, contentType)
+	if err != nil {
+		return err
+	}
+	return storeFile(ctx, p.inner, path, stored, contentType, ProgressFromContext(ctx))
+}
+
+// RetrieveFileWithContext retrieves and decompresses a file with cancellation support
+func (p *CompressionPlugin) RetrieveFileWithContext(ctx context.Context, path string) ([]byte, error) {
+	data, err := retrieveFile(ctx, p.inner, path)
+	if err != nil {
+		return nil, err
+	}
+	return p.decompress(data)
+}
+
+// StoreFileWithOptions compresses data and passes the options on to the wrapped plugin
+func (p *CompressionPlugin) StoreFileWithOptions(ctx context.Context, path string, data []byte, options StoreOptions) error {
+	stored, err := p.compress(data, options.ContentType)
+	if err != nil {
+		return err
+	}
+	return storeWithOptions(ctx, p.inner, path, stored, options, ProgressFromContext(ctx))
+}
+
+// StatFile returns the metadata of the wrapped plugin with the original size and the encoding
+func (p *CompressionPlugin) StatFile(path string) (*FileMetadata, error) {
+	metadata, err := statFile(p.inner, path)
+	if err != nil {
+		return nil, err
+	}
+	return p.describe(metadata)
+}
+
+// ListFiles lists the wrapped plugin with the original sizes and encodings
+func (p *CompressionPlugin) ListFiles(prefix string, cursor string, limit int) (*ListResult, error) {
+	result, err := listFiles(p.inner, prefix, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := describeFiles(result.Files, p.describe); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// RetrieveVersion retrieves a version from the wrapped plugin and decompresses it
+func (p *CompressionPlugin) RetrieveVersion(path string, versionID string) ([]byte, error) {
+	versioning, err := versioningPlugin(p.inner)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := versioning.RetrieveVersion(path, versionID)
+	if err != nil {
+		return nil, err
+	}
+	return p.decompress(data)
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// testData returns inputs that exercise the different paths of the codecs
+func testData() map[string][]byte {
+	random := make([]byte, 200<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	var lines strings.Builder
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&lines, "%d,user-%d,%d\n", i, i%313, i*i%1009)
+	}
+
+	return map[string][]byte{
+		"empty":       {},
+		"single byte": {'x'},
+		"short text":  []byte("hello, world"),
+		"run":         bytes.Repeat([]byte{0}, 300<<10),
+		"text":        []byte(lines.String()),
+		"random":      random,
+		"mixed":       append(append([]byte(lines.String()[:50000]), random[:50000]...), lines.String()[:50000]...),
+	}
+}
+
+func TestCompressionCodecs(t *testing.T) {
+	codecs := []CompressionCodec{GzipCodec(gzip.BestSpeed), GzipCodec(gzip.BestCompression)}
+
+	for _, codec := range codecs {
+		for name, data := range testData() {
+			t.Run(codec.Encoding()+"/"+name, func(t *testing.T) {
+				compressed, err := codec.Compress(data)
+				if err != nil {
+					t.Fatalf("Compress() error = %v", err)
+				}
+				decompressed, err := codec.Decompress(compressed, int64(len(data)))
+				if err != nil {
+					t.Fatalf("Decompress() error = %v", err)
+				}
+				if !bytes.Equal(decompressed, data) {
+					t.Fatalf("round trip of %d bytes returned %d different bytes", len(data), len(decompressed))
+				}
+			})
+		}
+	}
+}
+
+func TestGzipDecompressLimit(t *testing.T) {
+	data := bytes.Repeat([]byte{0}, 1<<20)
+	compressed, err := GzipCodec(gzip.BestCompression).Compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		originalSize int64
+		wantErr      bool
+	}{
+		{name: "recorded size", originalSize: int64(len(data))},
+		{name: "larger than recorded", originalSize: 1024, wantErr: true},
+		{name: "negative size", originalSize: -1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GzipCodec(gzip.DefaultCompression).Decompress(compressed, tt.originalSize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decompress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, data) {
+				t.Fatalf("Decompress() returned %d different bytes", len(got))
+			}
+		})
+	}
+}
+
+func TestCompressionEnvelope(t *testing.T) {
+	text := strings.Repeat("compressible text ", 200)
+	magic := compressionMagic + strings.Repeat("x", 10)
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(3)).Read(random)
+
+	options := DefaultCompressionOptions()
+	options.Rules = append([]CompressionRule{{ContentTypes: []string{"application/x-ndjson"}}}, options.Rules...)
+
+	tests := []struct {
+		name         string
+		data         []byte
+		contentType  *string
+		wantEncoding string
+	}{
+		{name: "gzip text", data: []byte(text), contentType: ptr("text/plain; charset=utf-8"), wantEncoding: "gzip"},
+		{name: "gzip json", data: []byte(text), contentType: ptr("application/json"), wantEncoding: "gzip"},
+		{name: "first matching rule", data: []byte(text), contentType: ptr("application/x-ndjson")},
+		{name: "below min size", data: []byte("short text"), contentType: ptr("text/plain")},
+		{name: "no content type", data: []byte(text)},
+		{name: "binary content type", data: []byte(text), contentType: ptr("image/png")},
+		{name: "incompressible", data: random, contentType: ptr("text/plain")},
+		{name: "starts with the magic", data: []byte(magic), contentType: ptr("image/png"), wantEncoding: identityEncoding},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newMemoryPlugin(nil)
+			plugin := NewCompressionPlugin(inner, options)
+
+			if err := plugin.StoreFile("file", tt.data, tt.contentType); err != nil {
+				t.Fatalf("StoreFile() error = %v", err)
+			}
+
+			stored, _ := inner.data("file")
+			encoding, originalSize, _, ok := decodeEnvelopeHeader(stored)
+			if tt.wantEncoding == "" {
+				if ok || !bytes.Equal(stored, tt.data) {
+					t.Fatalf("stored %d bytes in an envelope, want the data as-is", len(stored))
+				}
+			} else {
+				if !ok || encoding != tt.wantEncoding || originalSize != int64(len(tt.data)) {
+					t.Fatalf("envelope = %q, %d bytes, ok %v, want %q, %d bytes", encoding, originalSize, ok, tt.wantEncoding, len(tt.data))
+				}
+			}
+
+			retrieved, err := plugin.RetrieveFile("file")
+			if err != nil {
+				t.Fatalf("RetrieveFile() error = %v", err)
+			}
+			if !bytes.Equal(retrieved, tt.data) {
+				t.Fatalf("RetrieveFile() returned %d different bytes", len(retrieved))
+			}
+
+			metadata, err := plugin.StatFile("file")
+			if err != nil {
+				t.Fatalf("StatFile() error = %v", err)
+			}
+			if metadata.Size != int64(len(tt.data)) {
+				t.Errorf("StatFile().Size = %d, want %d", metadata.Size, len(tt.data))
+			}
+			wantContentEncoding := tt.wantEncoding
+			if wantContentEncoding == identityEncoding {
+				wantContentEncoding = ""
+			}
+			if got := metadata.ContentEncoding; (got == nil) != (wantContentEncoding == "") || got != nil && *got != wantContentEncoding {
+				t.Errorf("StatFile().ContentEncoding = %v, want %q", got, wantContentEncoding)
+			}
+		})
+	}
+}
+
+func TestCompressionUnknownEncoding(t *testing.T) {
+	inner := newMemoryPlugin(map[string]string{
+		"file": string(encodeEnvelope("brotli", 5, []byte("?????"))),
+	})
+	plugin := NewCompressionPlugin(inner, DefaultCompressionOptions())
+
+	_, err := plugin.RetrieveFile("file")
+	checkErrorType(t, err, ptr(ConfigurationErrorType))
+}
+
+func TestCompressionSizeMismatch(t *testing.T) {
+	compressed, err := GzipCodec(gzip.DefaultCompression).Compress(bytes.Repeat([]byte("a"), 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := newMemoryPlugin(map[string]string{
+		"file": string(encodeEnvelope("gzip", 10, compressed)),
+	})
+	plugin := NewCompressionPlugin(inner, DefaultCompressionOptions())
+
+	_, err = plugin.RetrieveFile("file")
+	checkErrorType(t, err, ptr(StorageErrorType))
+}
+
+func TestCompressionListFiles(t *testing.T) {
+	inner := newMemoryPlugin(nil)
+	plugin := NewCompressionPlugin(inner, DefaultCompressionOptions())
+	text := strings.Repeat("compressible text ", 200)
+
+	if err := plugin.StoreFile("a.txt", []byte(text), ptr("text/plain")); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.StoreFile("b.bin", []byte("raw"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := plugin.ListFiles("", "", 0)
+	if err != nil {
+		t.Fatalf("ListFiles() error = %v", err)
+	}
+	want := map[string]int64{"a.txt": int64(len(text)), "b.bin": 3}
+	if len(result.Files) != len(want) {
+		t.Fatalf("ListFiles() returned %d files, want %d", len(result.Files), len(want))
+	}
+	for _, file := range result.Files {
+		if file.Size != want[file.Path] {
+			t.Errorf("%s size = %d, want %d", file.Path, file.Size, want[file.Path])
+		}
+	}
+}
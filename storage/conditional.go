@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"strings"
+	"sync"
+)
+
+// PathMutex serializes operations on the same path while letting different paths proceed in parallel
+// The zero value is ready to use
+type PathMutex struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	mu      sync.Mutex
+	holders int
+}
+
+// Lock locks path and returns the function that unlocks it
+func (m *PathMutex) Lock(path string) func() {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*pathLock)
+	}
+	lock, ok := m.locks[path]
+	if !ok {
+		lock = &pathLock{}
+		m.locks[path] = lock
+	}
+	lock.holders++
+	m.mu.Unlock()
+
+	lock.mu.Lock()
+
+	return func() {
+		lock.mu.Unlock()
+
+		m.mu.Lock()
+		lock.holders--
+		if lock.holders == 0 {
+			delete(m.locks, path)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// LockPair locks two paths and returns the function that unlocks both
+// The paths are locked in a fixed order, so operations locking the same pair in opposite
+// directions, such as two moves, can't deadlock
+func (m *PathMutex) LockPair(a string, b string) func() {
+	if a == b {
+		return m.Lock(a)
+	}
+	if b < a {
+		a, b = b, a
+	}
+
+	unlockFirst := m.Lock(a)
+	unlockSecond := m.Lock(b)
+	return func() {
+		unlockSecond()
+		unlockFirst()
+	}
+}
+
+// conditionalWrites serializes the conditional writes the library emulates for plugins
+// without OptionsStoragePlugin support
+var conditionalWrites PathMutex
+
+// hasPreconditions reports whether the options make the store conditional
+func (o StoreOptions) hasPreconditions() bool {
+	return o.IfMatch != nil || o.IfNoneMatch != nil
+}
+
+// validatePreconditions checks that the conditions sent by the host are well-formed
+func validatePreconditions(options StoreOptions) error {
+	if options.IfNoneMatch != nil && *options.IfNoneMatch != "*" {
+		return NewInvalidInputError("if_none_match only supports \"*\"")
+	}
+	if options.IfMatch != nil && *options.IfMatch == "" {
+		return NewInvalidInputError("if_match must not be empty")
+	}
+	return nil
+}
+
+// CheckPreconditions checks the conditions of a store against the file currently at the path
+// current is nil when no file exists; a failed condition is reported as a PreconditionFailedErrorType error
+func CheckPreconditions(current *FileMetadata, options StoreOptions) error {
+	if options.IfNoneMatch != nil && current != nil {
+		return NewPreconditionFailedError("file already exists: " + current.Path)
+	}
+
+	if options.IfMatch != nil {
+		if current == nil {
+			return NewPreconditionFailedError("file does not exist")
+		}
+		if *options.IfMatch == "*" {
+			return nil
+		}
+		if current.ETag == nil {
+			return NewUnsupportedError("plugin does not report ETags for " + current.Path)
+		}
+		if normalizeETag(*current.ETag) != normalizeETag(*options.IfMatch) {
+			return NewPreconditionFailedError("ETag does not match for " + current.Path)
+		}
+	}
+
+	return nil
+}
+
+// normalizeETag strips the weak prefix and quotes so ETags compare by value
+func normalizeETag(etag string) string {
+	etag = strings.TrimPrefix(etag, "W/")
+	return strings.Trim(etag, "\"")
+}
+
+// checkPluginPreconditions looks up the current file through the plugin and checks the conditions
+func checkPluginPreconditions(plugin StoragePlugin, path string, options StoreOptions) error {
+	// Create-only writes just need to know whether the file exists
+	if options.IfMatch == nil {
+		if plugin.FileExists(path) {
+			return NewPreconditionFailedError("file already exists: " + path)
+		}
+		return nil
+	}
+
+	current, err := statFile(plugin, path)
+	if err != nil {
+		if !IsNotFound(err) {
+			return err
+		}
+		current = nil
+	}
+	return CheckPreconditions(current, options)
+}
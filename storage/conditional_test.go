@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// blocks reports whether lock is still waiting after a short while
+func blocks(lock func() func()) (bool, func()) {
+	acquired := make(chan func(), 1)
+	go func() { acquired <- lock() }()
+
+	select {
+	case unlock := <-acquired:
+		return false, unlock
+	case <-time.After(50 * time.Millisecond):
+		return true, func() { (<-acquired)() }
+	}
+}
+
+func TestPathMutex(t *testing.T) {
+	tests := []struct {
+		name       string
+		held       func(m *PathMutex) func()
+		next       func(m *PathMutex) func()
+		wantBlocks bool
+	}{
+		{
+			name:       "same path",
+			held:       func(m *PathMutex) func() { return m.Lock("a") },
+			next:       func(m *PathMutex) func() { return m.Lock("a") },
+			wantBlocks: true,
+		},
+		{
+			name: "different paths",
+			held: func(m *PathMutex) func() { return m.Lock("a") },
+			next: func(m *PathMutex) func() { return m.Lock("b") },
+		},
+		{
+			name:       "pair holds its first path",
+			held:       func(m *PathMutex) func() { return m.LockPair("a", "b") },
+			next:       func(m *PathMutex) func() { return m.Lock("a") },
+			wantBlocks: true,
+		},
+		{
+			name:       "pair holds its second path",
+			held:       func(m *PathMutex) func() { return m.LockPair("a", "b") },
+			next:       func(m *PathMutex) func() { return m.Lock("b") },
+			wantBlocks: true,
+		},
+		{
+			name:       "pair in the opposite direction",
+			held:       func(m *PathMutex) func() { return m.LockPair("a", "b") },
+			next:       func(m *PathMutex) func() { return m.LockPair("b", "a") },
+			wantBlocks: true,
+		},
+		{
+			name: "pair of other paths",
+			held: func(m *PathMutex) func() { return m.LockPair("a", "b") },
+			next: func(m *PathMutex) func() { return m.LockPair("c", "d") },
+		},
+		{
+			name:       "pair of the same path",
+			held:       func(m *PathMutex) func() { return m.LockPair("a", "a") },
+			next:       func(m *PathMutex) func() { return m.Lock("a") },
+			wantBlocks: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m PathMutex
+			unlockHeld := tt.held(&m)
+
+			blocked, unlockNext := blocks(func() func() { return tt.next(&m) })
+			if blocked != tt.wantBlocks {
+				t.Errorf("second lock blocked = %v, want %v", blocked, tt.wantBlocks)
+			}
+
+			unlockHeld()
+			unlockNext()
+			if len(m.locks) != 0 {
+				t.Errorf("%d locks left after unlocking, want 0", len(m.locks))
+			}
+		})
+	}
+}
+
+func TestPathMutexOpposingPairs(t *testing.T) {
+	var m PathMutex
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			m.LockPair("a", "b")()
+		}()
+		go func() {
+			defer wg.Done()
+			m.LockPair("b", "a")()
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("moves locking the same pair in opposite directions deadlocked")
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	etag := "\"abc\""
+	weak := "W/\"abc\""
+	other := "\"def\""
+	wildcard := "*"
+	current := &FileMetadata{Path: "a.txt", ETag: &etag}
+
+	tests := []struct {
+		name     string
+		current  *FileMetadata
+		options  StoreOptions
+		wantType *ErrorType
+	}{
+		{name: "unconditional", current: current},
+		{name: "create new", options: StoreOptions{IfNoneMatch: &wildcard}},
+		{name: "create existing", current: current, options: StoreOptions{IfNoneMatch: &wildcard}, wantType: ptr(PreconditionFailedErrorType)},
+		{name: "match", current: current, options: StoreOptions{IfMatch: &etag}},
+		{name: "weak match", current: current, options: StoreOptions{IfMatch: &weak}},
+		{name: "mismatch", current: current, options: StoreOptions{IfMatch: &other}, wantType: ptr(PreconditionFailedErrorType)},
+		{name: "match any existing", current: current, options: StoreOptions{IfMatch: &wildcard}},
+		{name: "match missing", options: StoreOptions{IfMatch: &wildcard}, wantType: ptr(PreconditionFailedErrorType)},
+		{name: "no ETag", current: &FileMetadata{Path: "a.txt"}, options: StoreOptions{IfMatch: &etag}, wantType: ptr(UnsupportedErrorType)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckPreconditions(tt.current, tt.options)
+			checkErrorType(t, err, tt.wantType)
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx that carries the progress function of an operation
+func WithProgress(ctx context.Context, progress ProgressFunc) context.Context {
+	if progress == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, progressKey{}, progress)
+}
+
+// ProgressFromContext returns the progress function carried by ctx
+// A no-op function is returned when the operation has no progress reporting
+func ProgressFromContext(ctx context.Context) ProgressFunc {
+	if progress, ok := ctx.Value(progressKey{}).(ProgressFunc); ok {
+		return progress
+	}
+	return func(float64) {}
+}
+
+// contextError converts a context error into a PluginError
+func contextError(err error) *PluginError {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return NewTimeoutError("operation deadline exceeded")
+	}
+	return NewCancelledError("operation cancelled")
+}
+
+// storeFile stores data using the most specific store method the plugin implements
+// Plugins without context support can't be interrupted, so ctx is only checked before the call
+func storeFile(ctx context.Context, plugin StoragePlugin, path string, data []byte, contentType *string, progress ProgressFunc) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+
+	if ctxPlugin, ok := plugin.(StoragePluginWithContext); ok {
+		return ctxPlugin.StoreFileWithContext(WithProgress(ctx, progress), path, data, contentType)
+	}
+
+	if progressPlugin, ok := plugin.(ProgressStoragePlugin); ok {
+		if progress == nil {
+			progress = func(float64) {}
+		}
+		return progressPlugin.StoreFileWithProgress(path, data, contentType, progress)
+	}
+
+	// Legacy plugins report progress through the global ReportProgress
+	return storeWithGlobalProgress(plugin, path, data, contentType, progress)
+}
+
+// retrieveFile retrieves a file, passing ctx to plugins that support it
+func retrieveFile(ctx context.Context, plugin StoragePlugin, path string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+
+	if ctxPlugin, ok := plugin.(StoragePluginWithContext); ok {
+		return ctxPlugin.RetrieveFileWithContext(ctx, path)
+	}
+	return plugin.RetrieveFile(path)
+}
+
+// deleteFile deletes a file, passing ctx to plugins that support it
+func deleteFile(ctx context.Context, plugin StoragePlugin, path string) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+
+	if ctxPlugin, ok := plugin.(StoragePluginWithContext); ok {
+		return ctxPlugin.DeleteFileWithContext(ctx, path)
+	}
+	return plugin.DeleteFile(path)
+}
+
+// fileExists checks a file, passing ctx to plugins that support it
+func fileExists(ctx context.Context, plugin StoragePlugin, path string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, contextError(err)
+	}
+
+	if ctxPlugin, ok := plugin.(StoragePluginWithContext); ok {
+		return ctxPlugin.FileExistsWithContext(ctx, path)
+	}
+	return plugin.FileExists(path), nil
+}
+
+// runPeriodically calls fn every interval until stop is closed
+// The context passed to fn is cancelled when stop is closed, so a run in progress ends early
+func runPeriodically(stop <-chan struct{}, interval time.Duration, fn func(ctx context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				select {
+				case <-stop:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			fn(ctx)
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"testing"
+)
+
+// contextPlugin implements StoragePluginWithContext and records the context it is called with
+type contextPlugin struct {
+	*memoryPlugin
+	progress ProgressFunc
+}
+
+func (p *contextPlugin) StoreFileWithContext(ctx context.Context, path string, data []byte, contentType *string) error {
+	p.progress = ProgressFromContext(ctx)
+	p.progress(1)
+	return p.StoreFile(path, data, contentType)
+}
+
+func (p *contextPlugin) RetrieveFileWithContext(ctx context.Context, path string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.RetrieveFile(path)
+}
+
+func (p *contextPlugin) DeleteFileWithContext(ctx context.Context, path string) error {
+	return p.DeleteFile(path)
+}
+
+func (p *contextPlugin) FileExistsWithContext(ctx context.Context, path string) (bool, error) {
+	return p.FileExists(path), nil
+}
+
+// progressPlugin implements ProgressStoragePlugin
+type progressPlugin struct {
+	*memoryPlugin
+}
+
+func (p *progressPlugin) StoreFileWithProgress(path string, data []byte, contentType *string, progress ProgressFunc) error {
+	progress(1)
+	return p.StoreFile(path, data, contentType)
+}
+
+func TestStoreFileProgress(t *testing.T) {
+	plugins := map[string]StoragePlugin{
+		"context":  &contextPlugin{memoryPlugin: newMemoryPlugin(nil)},
+		"progress": &progressPlugin{newMemoryPlugin(nil)},
+		"legacy":   &reportingPlugin{newMemoryPlugin(nil)},
+	}
+
+	for name, plugin := range plugins {
+		t.Run(name, func(t *testing.T) {
+			reported := false
+			progress := func(float64) { reported = true }
+			if err := storeFile(context.Background(), plugin, "a", []byte("x"), nil, progress); err != nil {
+				t.Fatal(err)
+			}
+			if !reported {
+				t.Error("progress wasn't reported")
+			}
+			if !plugin.FileExists("a") {
+				t.Error("file wasn't stored")
+			}
+
+			// Without a progress function the plugin gets a no-op one
+			if err := storeFile(context.Background(), plugin, "b", []byte("x"), nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCancelledBeforeCall(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	plugin := newMemoryPlugin(map[string]string{"a": "x"})
+	checkErrorType(t, storeFile(ctx, plugin, "b", nil, nil, nil), ptr(CancelledErrorType))
+	_, err := retrieveFile(ctx, plugin, "a")
+	checkErrorType(t, err, ptr(CancelledErrorType))
+	checkErrorType(t, deleteFile(ctx, plugin, "a"), ptr(CancelledErrorType))
+	_, err = fileExists(ctx, plugin, "a")
+	checkErrorType(t, err, ptr(CancelledErrorType))
+
+	if plugin.count("store")+plugin.count("retrieve")+plugin.count("delete")+plugin.count("exists") != 0 {
+		t.Error("plugin was called after the operation was cancelled")
+	}
+}
@@ -0,0 +1,47 @@
+package storage
+
+import "context"
+
+// copyFile copies a file using the plugin's native copy when available
+// Otherwise the file is retrieved and stored again under the destination path
+func copyFile(plugin StoragePlugin, sourcePath string, destinationPath string) error {
+	if sourcePath == destinationPath {
+		return NewInvalidInputError("source and destination paths are the same")
+	}
+
+	if copier, ok := plugin.(CopyStoragePlugin); ok {
+		return copier.CopyFile(sourcePath, destinationPath)
+	}
+
+	data, err := plugin.RetrieveFile(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	// Keep the content type and custom metadata when the plugin can tell us what they were
+	var options StoreOptions
+	if stat, ok := plugin.(StatStoragePlugin); ok {
+		if metadata, err := stat.StatFile(sourcePath); err == nil {
+			options = preservedOptions(metadata)
+		}
+	}
+
+	return storeWithOptions(context.Background(), plugin, destinationPath, data, options, nil)
+}
+
+// moveFile moves a file using the plugin's native move when available
+// Otherwise the file is copied and the source deleted afterwards
+func moveFile(plugin StoragePlugin, sourcePath string, destinationPath string) error {
+	if sourcePath == destinationPath {
+		return NewInvalidInputError("source and destination paths are the same")
+	}
+
+	if mover, ok := plugin.(MoveStoragePlugin); ok {
+		return mover.MoveFile(sourcePath, destinationPath)
+	}
+
+	if err := copyFile(plugin, sourcePath, destinationPath); err != nil {
+		return err
+	}
+	return plugin.DeleteFile(sourcePath)
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// nativeCopyPlugin copies and moves on the backend and counts the calls
+type nativeCopyPlugin struct {
+	*memoryPlugin
+	copies int
+	moves  int
+}
+
+func (p *nativeCopyPlugin) CopyFile(sourcePath string, destinationPath string) error {
+	p.copies++
+	data, err := p.RetrieveFile(sourcePath)
+	if err != nil {
+		return err
+	}
+	return p.StoreFile(destinationPath, data, nil)
+}
+
+func (p *nativeCopyPlugin) MoveFile(sourcePath string, destinationPath string) error {
+	p.moves++
+	if err := p.CopyFile(sourcePath, destinationPath); err != nil {
+		return err
+	}
+	return p.DeleteFile(sourcePath)
+}
+
+func TestCopyMoveFallback(t *testing.T) {
+	tests := []struct {
+		name        string
+		move        bool
+		source      string
+		destination string
+		wantErr     *ErrorType
+	}{
+		{name: "copy", source: "a", destination: "b"},
+		{name: "move", move: true, source: "a", destination: "b"},
+		{name: "copy over existing", source: "a", destination: "c"},
+		{name: "copy to itself", source: "a", destination: "a", wantErr: ptr(InvalidInputError)},
+		{name: "move to itself", move: true, source: "a", destination: "a", wantErr: ptr(InvalidInputError)},
+		{name: "missing source", source: "missing", destination: "b", wantErr: ptr(NotFoundErrorType)},
+		{name: "move missing source", move: true, source: "missing", destination: "b", wantErr: ptr(NotFoundErrorType)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := newMemoryPlugin(map[string]string{"c": "old"})
+			plugin.StoreFile("a", []byte("abc"), ptr("text/plain"))
+
+			var err error
+			if tt.move {
+				err = moveFile(plugin, tt.source, tt.destination)
+			} else {
+				err = copyFile(plugin, tt.source, tt.destination)
+			}
+			checkErrorType(t, err, tt.wantErr)
+			if tt.wantErr != nil {
+				if _, ok := plugin.data("a"); !ok {
+					t.Error("failed operation removed the source")
+				}
+				return
+			}
+
+			if data, _ := plugin.data(tt.destination); string(data) != "abc" {
+				t.Errorf("destination holds %q, want abc", data)
+			}
+			if metadata, _ := plugin.StatFile(tt.destination); metadata.ContentType == nil || *metadata.ContentType != "text/plain" {
+				t.Error("content type wasn't kept")
+			}
+			if _, ok := plugin.data(tt.source); ok == tt.move {
+				t.Errorf("source exists = %v after move = %v", ok, tt.move)
+			}
+		})
+	}
+}
+
+func TestCopyMoveNative(t *testing.T) {
+	plugin := &nativeCopyPlugin{memoryPlugin: newMemoryPlugin(map[string]string{"a": "abc"})}
+
+	checkErrorType(t, copyFile(plugin, "a", "b"), nil)
+	checkErrorType(t, moveFile(plugin, "b", "c"), nil)
+	if plugin.copies != 2 || plugin.moves != 1 {
+		t.Errorf("%d native copies and %d moves, want 2 and 1", plugin.copies, plugin.moves)
+	}
+	if plugin.count("retrieve") != 2 || plugin.count("stat") != 0 {
+		t.Error("native copy fell back to retrieving the file")
+	}
+}
+
+// metadataPlugin keeps the custom metadata passed in the store options and reports it from StatFile
+type metadataPlugin struct {
+	*memoryPlugin
+	metadata map[string]map[string]string
+}
+
+func newMetadataPlugin() *metadataPlugin {
+	return &metadataPlugin{memoryPlugin: newMemoryPlugin(nil), metadata: make(map[string]map[string]string)}
+}
+
+func (p *metadataPlugin) StoreFileWithOptions(ctx context.Context, path string, data []byte, options StoreOptions) error {
+	p.metadata[path] = options.Metadata
+	return p.StoreFile(path, data, options.ContentType)
+}
+
+func (p *metadataPlugin) StatFile(path string) (*FileMetadata, error) {
+	metadata, err := p.memoryPlugin.StatFile(path)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Metadata = p.metadata[path]
+	return metadata, nil
+}
+
+func TestPreservedOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata *FileMetadata
+		want     StoreOptions
+	}{
+		{name: "no file"},
+		{name: "plain file", metadata: &FileMetadata{Path: "a", Size: 3}},
+		{
+			name:     "content type and metadata",
+			metadata: &FileMetadata{Path: "a", Size: 3, ContentType: ptr("text/plain"), ETag: ptr("\"1\""), Metadata: map[string]string{"owner": "42"}},
+			want:     StoreOptions{ContentType: ptr("text/plain"), Metadata: map[string]string{"owner": "42"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := preservedOptions(tt.metadata); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("preservedOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyMoveMetadata(t *testing.T) {
+	metadata := map[string]string{"owner": "42", "original_name": "a.png"}
+
+	for _, move := range []bool{false, true} {
+		plugin := newMetadataPlugin()
+		options := StoreOptions{ContentType: ptr("image/png"), Metadata: metadata}
+		if err := storeFileWithOptions(context.Background(), plugin, "a", []byte("abc"), options, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		var err error
+		if move {
+			err = moveFile(plugin, "a", "b")
+		} else {
+			err = copyFile(plugin, "a", "b")
+		}
+		if err != nil {
+			t.Fatalf("move = %v: error = %v", move, err)
+		}
+
+		stat, err := plugin.StatFile("b")
+		if err != nil {
+			t.Fatalf("StatFile() error = %v", err)
+		}
+		if !reflect.DeepEqual(stat.Metadata, metadata) {
+			t.Errorf("move = %v: metadata = %v, want %v", move, stat.Metadata, metadata)
+		}
+		if stat.ContentType == nil || *stat.ContentType != "image/png" {
+			t.Errorf("move = %v: content type = %v, want image/png", move, stat.ContentType)
+		}
+	}
+}
+
+func TestStoreMetadataUnsupported(t *testing.T) {
+	options := StoreOptions{Metadata: map[string]string{"owner": "42"}}
+
+	err := storeFileWithOptions(context.Background(), newMemoryPlugin(nil), "a", []byte("abc"), options, nil)
+	checkErrorType(t, err, ptr(UnsupportedErrorType))
+
+	err = storeFileWithOptions(context.Background(), newMetadataPlugin(), "a", []byte("abc"), options, nil)
+	checkErrorType(t, err, nil)
+}
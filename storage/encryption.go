@@ -0,0 +1,598 @@
+package storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/matt953/relm-plugin-core-go/config"
+)
+
+// Plugin config keys for the encryption keys
+const (
+	EncryptionKeyConfigKey          = "encryption_key"
+	EncryptionKeyIDConfigKey        = "encryption_key_id"
+	EncryptionPreviousKeysConfigKey = "encryption_previous_keys"
+)
+
+// DefaultEncryptionKeyID is the key ID used when encryption_key_id isn't configured
+const DefaultEncryptionKeyID = "default"
+
+// KeyProvider supplies the key encryption keys (KEKs) of an EncryptionPlugin
+// Keys are AES keys of 16, 24 or 32 bytes
+type KeyProvider interface {
+	// CurrentKey returns the key used to encrypt new files and its ID
+	CurrentKey() (keyID string, key []byte, err error)
+
+	// Key returns the key with the given ID, for decrypting files stored with an older key
+	Key(keyID string) ([]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider holding a fixed set of keys
+type StaticKeyProvider struct {
+	currentID string
+	keys      map[string][]byte
+}
+
+// NewStaticKeyProvider returns a provider that encrypts with keys[currentID]
+// The other keys are only used to decrypt files stored before a key rotation
+func NewStaticKeyProvider(currentID string, keys map[string][]byte) (*StaticKeyProvider, error) {
+	if _, ok := keys[currentID]; !ok {
+		return nil, NewConfigurationError(fmt.Sprintf("no encryption key with ID %q", currentID))
+	}
+
+	copied := make(map[string][]byte, len(keys))
+	for keyID, key := range keys {
+		if keyID == "" || len(keyID) > 255 {
+			return nil, NewConfigurationError(fmt.Sprintf("invalid encryption key ID %q", keyID))
+		}
+		if err := validateKeyLength(key); err != nil {
+			return nil, err
+		}
+		copied[keyID] = append([]byte(nil), key...)
+	}
+
+	return &StaticKeyProvider{currentID: currentID, keys: copied}, nil
+}
+
+// CurrentKey returns the key used to encrypt new files
+func (p *StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	return p.currentID, p.keys[p.currentID], nil
+}
+
+// Key returns the key with the given ID
+func (p *StaticKeyProvider) Key(keyID string) ([]byte, error) {
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, NewConfigurationError(fmt.Sprintf("unknown encryption key ID %q", keyID))
+	}
+	return key, nil
+}
+
+// KeyProviderFromConfig builds a StaticKeyProvider from the plugin config
+// encryption_key is the base64 encoded current key and encryption_key_id its ID;
+// encryption_previous_keys lists older keys as comma-separated "id:base64" pairs
+func KeyProviderFromConfig() (*StaticKeyProvider, error) {
+	value, ok := config.GetPluginConfigValue(EncryptionKeyConfigKey)
+	if !ok || value == "" {
+		return nil, NewConfigurationError(EncryptionKeyConfigKey + " is not configured")
+	}
+
+	currentID := config.GetPluginOrDefault(EncryptionKeyIDConfigKey, DefaultEncryptionKeyID)
+	current, err := decodeConfigKey(EncryptionKeyConfigKey, value)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string][]byte{currentID: current}
+
+	if value, ok := config.GetPluginConfigValue(EncryptionPreviousKeysConfigKey); ok && value != "" {
+		for _, entry := range strings.Split(value, ",") {
+			keyID, encoded, found := strings.Cut(strings.TrimSpace(entry), ":")
+			if !found {
+				return nil, NewConfigurationError(fmt.Sprintf("invalid %s entry %q, expected id:key", EncryptionPreviousKeysConfigKey, entry))
+			}
+			if _, exists := keys[keyID]; exists {
+				return nil, NewConfigurationError(fmt.Sprintf("duplicate encryption key ID %q", keyID))
+			}
+
+			key, err := decodeConfigKey(EncryptionPreviousKeysConfigKey, encoded)
+			if err != nil {
+				return nil, err
+			}
+			keys[keyID] = key
+		}
+	}
+
+	return NewStaticKeyProvider(currentID, keys)
+}
+
+func decodeConfigKey(name string, value string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, NewConfigurationError(fmt.Sprintf("invalid %s: not base64 encoded", name))
+	}
+	return key, nil
+}
+
+func validateKeyLength(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return NewConfigurationError(fmt.Sprintf("invalid encryption key length %d, expected 16, 24 or 32 bytes", len(key)))
+	}
+}
+
+// configKeyProvider loads its keys from the plugin config on first use
+// so the plugin can be created before initialize_with_config is called
+type configKeyProvider struct {
+	mutex    sync.Mutex
+	provider *StaticKeyProvider
+}
+
+// NewConfigKeyProvider returns a KeyProvider that reads its keys with KeyProviderFromConfig on first use
+func NewConfigKeyProvider() KeyProvider {
+	return &configKeyProvider{}
+}
+
+func (p *configKeyProvider) load() (*StaticKeyProvider, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// Failures aren't cached so a missing key is picked up once the config is set
+	if p.provider == nil {
+		provider, err := KeyProviderFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		p.provider = provider
+	}
+	return p.provider, nil
+}
+
+func (p *configKeyProvider) CurrentKey() (string, []byte, error) {
+	provider, err := p.load()
+	if err != nil {
+		return "", nil, err
+	}
+	return provider.CurrentKey()
+}
+
+func (p *configKeyProvider) Key(keyID string) ([]byte, error) {
+	provider, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	return provider.Key(keyID)
+}
+
+// Encrypted files start with a header naming the key that wrapped the data key:
+// magic, key ID length, key ID, wrapped data key length, wrapped data key, data nonce,
+// sealed attributes length (uint16 big-endian), sealed attributes;
+// followed by the AES-GCM ciphertext of the file authenticated with the header and the path
+const (
+	encryptionMagic = "RLME\x01"
+
+	dataKeySize  = 32
+	gcmNonceSize = 12
+	gcmTagSize   = 16
+
+	// maxEncryptionPrefix covers the header up to the sealed attributes
+	maxEncryptionPrefix = len(encryptionMagic) + 1 + 255 + 1 + 255 + gcmNonceSize + 2
+	maxSealedAttributes = 0xffff
+)
+
+// encryptedAttributes are the attributes of a file that are encrypted with it instead of
+// being passed to the wrapped plugin
+type encryptedAttributes struct {
+	ContentType *string           `json:"content_type,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// encryptionHeader is the parsed header of an encrypted file
+type encryptionHeader struct {
+	keyID            string
+	wrappedKey       []byte
+	dataNonce        []byte
+	attributesOffset int
+	sealedAttributes []byte
+
+	// size is the full size of the header, it may exceed the data that was decoded
+	size int
+}
+
+// EncryptionPlugin wraps a StoragePlugin and encrypts files before they reach it
+//
+// Every file is encrypted with its own AES-256-GCM data key, which is stored in the file
+// header wrapped with the current key of the KeyProvider, together with that key's ID.
+// The content type and custom metadata are encrypted in the header and the path is authenticated
+// with the data, so the wrapped plugin never sees plaintext, plaintext checksums, content types or
+// metadata, and a file copied to another path in the backend fails to decrypt. Files that aren't
+// encrypted are rejected on retrieve. StatFile and ListFiles report the plaintext size, content type
+// and metadata, which takes a read of the header of every file.
+type EncryptionPlugin struct {
+	transformingPlugin
+	keys KeyProvider
+}
+
+// NewEncryptionPlugin wraps inner with envelope encryption using keys from provider
+// Use NewConfigKeyProvider to load the keys from the plugin config
+func NewEncryptionPlugin(inner StoragePlugin, provider KeyProvider) *EncryptionPlugin {
+	return &EncryptionPlugin{transformingPlugin: transformingPlugin{inner: inner}, keys: provider}
+}
+
+// providesCapability reports custom metadata support whatever the wrapped plugin supports,
+// the metadata is kept in the encrypted header
+func (p *EncryptionPlugin) providesCapability(OptionsStoragePlugin) {}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, NewConfigurationError("invalid encryption key: " + err.Error())
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, NewStorageError("failed to initialize encryption: " + err.Error())
+	}
+	return gcm, nil
+}
+
+// additionalData binds part of the header to the normalized path of the file
+func additionalData(header []byte, path string) ([]byte, error) {
+	normalized, err := normalizePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), header...), normalized...), nil
+}
+
+func randomBytes(size int) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, NewStorageError("failed to generate random data: " + err.Error())
+	}
+	return buf, nil
+}
+
+// encrypt returns the encrypted file with its header
+func (p *EncryptionPlugin) encrypt(path string, data []byte, attributes encryptedAttributes) ([]byte, error) {
+	keyID, kek, err := p.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if keyID == "" || len(keyID) > 255 {
+		return nil, NewConfigurationError(fmt.Sprintf("invalid encryption key ID %q", keyID))
+	}
+
+	wrapGCM, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := randomBytes(dataKeySize)
+	if err != nil {
+		return nil, err
+	}
+	dataGCM, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapNonce, err := randomBytes(wrapGCM.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	dataNonce, err := randomBytes(dataGCM.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	attributesNonce, err := randomBytes(dataGCM.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	// The data key is bound to the key ID so a header can't be edited to point at another key
+	wrappedKey := wrapGCM.Seal(wrapNonce, wrapNonce, dataKey, []byte(keyID))
+
+	header := make([]byte, 0, maxEncryptionPrefix)
+	header = append(header, encryptionMagic...)
+	header = append(header, byte(len(keyID)))
+	header = append(header, keyID...)
+	header = append(header, byte(len(wrappedKey)))
+	header = append(header, wrappedKey...)
+	header = append(header, dataNonce...)
+
+	encoded, err := json.Marshal(attributes)
+	if err != nil {
+		return nil, NewStorageError("failed to encode attributes: " + err.Error())
+	}
+	aad, err := additionalData(header, path)
+	if err != nil {
+		return nil, err
+	}
+	sealedAttributes := dataGCM.Seal(attributesNonce, attributesNonce, encoded, aad)
+	if len(sealedAttributes) > maxSealedAttributes {
+		return nil, NewInvalidInputError("file attributes are too large to encrypt")
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(len(sealedAttributes)))
+	header = append(header, sealedAttributes...)
+
+	aad, err = additionalData(header, path)
+	if err != nil {
+		return nil, err
+	}
+	return dataGCM.Seal(header, dataNonce, data, aad), nil
+}
+
+// decodeEncryptionHeader parses the header of an encrypted file
+// ok is false for data that isn't encrypted. When data is only the start of the file,
+// the sealed attributes are nil if they extend past it and header.size tells how much to read.
+func decodeEncryptionHeader(data []byte) (header encryptionHeader, ok bool) {
+	if len(data) < len(encryptionMagic)+1 || string(data[:len(encryptionMagic)]) != encryptionMagic {
+		return header, false
+	}
+
+	offset := len(encryptionMagic)
+	idLength := int(data[offset])
+	offset++
+	if len(data) < offset+idLength+1 {
+		return header, false
+	}
+	header.keyID = string(data[offset : offset+idLength])
+	offset += idLength
+
+	keyLength := int(data[offset])
+	offset++
+	if len(data) < offset+keyLength+gcmNonceSize+2 {
+		return header, false
+	}
+	header.wrappedKey = data[offset : offset+keyLength]
+	offset += keyLength
+	header.dataNonce = data[offset : offset+gcmNonceSize]
+	offset += gcmNonceSize
+
+	header.attributesOffset = offset
+	attributesLength := int(binary.BigEndian.Uint16(data[offset:]))
+	offset += 2
+	header.size = offset + attributesLength
+	if len(data) >= header.size {
+		header.sealedAttributes = data[offset:header.size]
+	}
+	return header, true
+}
+
+// dataKey unwraps the data key of a file
+func (p *EncryptionPlugin) dataKey(path string, header encryptionHeader) (cipher.AEAD, error) {
+	kek, err := p.keys.Key(header.keyID)
+	if err != nil {
+		return nil, err
+	}
+	wrapGCM, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(header.wrappedKey) < wrapGCM.NonceSize() {
+		return nil, NewStorageError("invalid encryption header: " + path)
+	}
+	dataKey, err := wrapGCM.Open(nil, header.wrappedKey[:wrapGCM.NonceSize()], header.wrappedKey[wrapGCM.NonceSize():], []byte(header.keyID))
+	if err != nil {
+		return nil, NewStorageError("failed to unwrap data key: " + path)
+	}
+	return newGCM(dataKey)
+}
+
+// openAttributes decrypts the attributes in the header of a file
+// raw is the start of the file, up to at least header.size bytes
+func openAttributes(path string, dataGCM cipher.AEAD, header encryptionHeader, raw []byte) (encryptedAttributes, error) {
+	var attributes encryptedAttributes
+	sealed := header.sealedAttributes
+	if len(sealed) < dataGCM.NonceSize() {
+		return attributes, NewStorageError("invalid encryption header: " + path)
+	}
+
+	aad, err := additionalData(raw[:header.attributesOffset], path)
+	if err != nil {
+		return attributes, err
+	}
+	encoded, err := dataGCM.Open(nil, sealed[:dataGCM.NonceSize()], sealed[dataGCM.NonceSize():], aad)
+	if err != nil {
+		return attributes, NewStorageError("failed to decrypt the attributes of " + path + ": header has been modified or the key is wrong")
+	}
+	if err := json.Unmarshal(encoded, &attributes); err != nil {
+		return attributes, NewStorageError("failed to decode the attributes of " + path + ": " + err.Error())
+	}
+	return attributes, nil
+}
+
+// decrypt reverses encrypt
+func (p *EncryptionPlugin) decrypt(path string, data []byte) ([]byte, encryptedAttributes, error) {
+	header, ok := decodeEncryptionHeader(data)
+	if !ok {
+		return nil, encryptedAttributes{}, NewStorageError("file is not encrypted: " + path)
+	}
+	if header.sealedAttributes == nil {
+		return nil, encryptedAttributes{}, NewStorageError("invalid encryption header: " + path)
+	}
+
+	dataGCM, err := p.dataKey(path, header)
+	if err != nil {
+		return nil, encryptedAttributes{}, err
+	}
+	attributes, err := openAttributes(path, dataGCM, header, data)
+	if err != nil {
+		return nil, encryptedAttributes{}, err
+	}
+
+	aad, err := additionalData(data[:header.size], path)
+	if err != nil {
+		return nil, encryptedAttributes{}, err
+	}
+	plaintext, err := dataGCM.Open(nil, header.dataNonce, data[header.size:], aad)
+	if err != nil {
+		return nil, encryptedAttributes{}, NewStorageError("failed to decrypt " + path + ": data has been modified, the file was moved or the key is wrong")
+	}
+	return plaintext, attributes, nil
+}
+
+// retrieve retrieves and decrypts a file
+func (p *EncryptionPlugin) retrieve(ctx context.Context, path string) ([]byte, encryptedAttributes, error) {
+	data, err := retrieveFile(ctx, p.inner, path)
+	if err != nil {
+		return nil, encryptedAttributes{}, err
+	}
+	return p.decrypt(path, data)
+}
+
+// innerOptions strips the parts of the options that would reveal the plaintext
+// AES-GCM authenticates the data, so the checksum isn't needed to detect corruption
+func innerOptions(options StoreOptions) StoreOptions {
+	options.ContentType = nil
+	options.Checksum = nil
+	options.Metadata = nil
+	return options
+}
+
+// StoreFile encrypts data and stores it in the wrapped plugin
+func (p *EncryptionPlugin) StoreFile(path string, data []byte, contentType *string) error {
+	stored, err := p.encrypt(path, data, encryptedAttributes{ContentType: contentType})
+	if err != nil {
+		return err
+	}
+	return p.inner.StoreFile(path, stored, nil)
+}
+
+// RetrieveFile retrieves a file from the wrapped plugin and decrypts it
+func (p *EncryptionPlugin) RetrieveFile(path string) ([]byte, error) {
+	data, _, err := p.retrieve(context.Background(), path)
+	return data, err
+}
+
+// StoreFileWithContext encrypts data and stores it with cancellation support
+func (p *EncryptionPlugin) StoreFileWithContext(ctx context.Context, path string, data []byte, contentType *string) error {
+	stored, err := p.encrypt(path, data, encryptedAttributes{ContentType: contentType})
+	if err != nil {
+		return err
+	}
+	return storeFile(ctx, p.inner, path, stored, nil, ProgressFromContext(ctx))
+}
+
+// RetrieveFileWithContext retrieves and decrypts a file with cancellation support
+func (p *EncryptionPlugin) RetrieveFileWithContext(ctx context.Context, path string) ([]byte, error) {
+	data, _, err := p.retrieve(ctx, path)
+	return data, err
+}
+
+// StoreFileWithOptions encrypts data and passes the options on to the wrapped plugin
+// The checksum has already been verified against the plaintext and is not passed on
+func (p *EncryptionPlugin) StoreFileWithOptions(ctx context.Context, path string, data []byte, options StoreOptions) error {
+	stored, err := p.encrypt(path, data, encryptedAttributes{ContentType: options.ContentType, Metadata: options.Metadata})
+	if err != nil {
+		return err
+	}
+	return storeWithOptions(ctx, p.inner, path, stored, innerOptions(options), ProgressFromContext(ctx))
+}
+
+// CopyFile decrypts the file and encrypts it again for the destination,
+// since the path of a file is authenticated with its data
+func (p *EncryptionPlugin) CopyFile(sourcePath string, destinationPath string) error {
+	data, attributes, err := p.retrieve(context.Background(), sourcePath)
+	if err != nil {
+		return err
+	}
+	stored, err := p.encrypt(destinationPath, data, attributes)
+	if err != nil {
+		return err
+	}
+	return p.inner.StoreFile(destinationPath, stored, nil)
+}
+
+// MoveFile copies the file to the destination and deletes the source
+func (p *EncryptionPlugin) MoveFile(sourcePath string, destinationPath string) error {
+	if err := p.CopyFile(sourcePath, destinationPath); err != nil {
+		return err
+	}
+	return p.inner.DeleteFile(sourcePath)
+}
+
+// StatFile returns the metadata of the wrapped plugin with the plaintext size, content type, custom metadata and key ID
+func (p *EncryptionPlugin) StatFile(path string) (*FileMetadata, error) {
+	metadata, err := statFile(p.inner, path)
+	if err != nil {
+		return nil, err
+	}
+	return p.describe(metadata)
+}
+
+// ListFiles lists the wrapped plugin with the plaintext sizes, content types, custom metadata and key IDs
+func (p *EncryptionPlugin) ListFiles(prefix string, cursor string, limit int) (*ListResult, error) {
+	result, err := listFiles(p.inner, prefix, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := describeFiles(result.Files, p.describe); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// describe returns the metadata of a stored file with the plaintext size, content type, custom metadata and key ID
+// Files that aren't encrypted are reported as the wrapped plugin sees them, without a key ID.
+// The checksum and ETag of the wrapped plugin describe the ciphertext, the checksum is dropped.
+func (p *EncryptionPlugin) describe(metadata *FileMetadata) (*FileMetadata, error) {
+	raw, err := retrieveRange(p.inner, metadata.Path, 0, int64(maxEncryptionPrefix))
+	if err != nil {
+		return nil, err
+	}
+	header, ok := decodeEncryptionHeader(raw)
+	if !ok {
+		return metadata, nil
+	}
+	if header.sealedAttributes == nil {
+		if raw, err = retrieveRange(p.inner, metadata.Path, 0, int64(header.size)); err != nil {
+			return nil, err
+		}
+		if header, ok = decodeEncryptionHeader(raw); !ok || header.sealedAttributes == nil {
+			return nil, NewStorageError("invalid encryption header: " + metadata.Path)
+		}
+	}
+
+	dataGCM, err := p.dataKey(metadata.Path, header)
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := openAttributes(metadata.Path, dataGCM, header, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	result := *metadata
+	result.Size = metadata.Size - int64(header.size+gcmTagSize)
+	if result.Size < 0 {
+		return nil, NewStorageError("invalid encryption header: " + metadata.Path)
+	}
+	result.ContentType = attributes.ContentType
+	result.Metadata = attributes.Metadata
+	result.EncryptionKeyID = &header.keyID
+	result.Checksum = nil
+	return &result, nil
+}
+
+// RetrieveVersion retrieves a version from the wrapped plugin and decrypts it
+func (p *EncryptionPlugin) RetrieveVersion(path string, versionID string) ([]byte, error) {
+	versioning, err := versioningPlugin(p.inner)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := versioning.RetrieveVersion(path, versionID)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, _, err := p.decrypt(path, data)
+	return plaintext, err
+}
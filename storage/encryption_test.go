@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func testKeys(t *testing.T, currentID string) *StaticKeyProvider {
+	t.Helper()
+
+	provider, err := NewStaticKeyProvider(currentID, map[string][]byte{
+		"old": bytes.Repeat([]byte{1}, 16),
+		"new": bytes.Repeat([]byte{2}, 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestEncryptionEnvelope(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: []byte{}},
+		{name: "text", data: []byte("secret text")},
+		{name: "looks encrypted", data: []byte(encryptionMagic + "\x03new")},
+		{name: "large", data: bytes.Repeat([]byte("0123456789"), 100000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newMemoryPlugin(nil)
+			plugin := NewEncryptionPlugin(inner, testKeys(t, "new"))
+
+			if err := plugin.StoreFile("file", tt.data, ptr("text/x-secret")); err != nil {
+				t.Fatalf("StoreFile() error = %v", err)
+			}
+
+			stored, _ := inner.data("file")
+			header, ok := decodeEncryptionHeader(stored)
+			if !ok || header.keyID != "new" {
+				t.Fatalf("header key ID = %q, ok %v, want %q", header.keyID, ok, "new")
+			}
+			if want := header.size + len(tt.data) + gcmTagSize; len(stored) != want {
+				t.Errorf("stored %d bytes, want %d", len(stored), want)
+			}
+			if len(tt.data) > 0 && bytes.Contains(stored[header.size:], tt.data) {
+				t.Errorf("ciphertext contains the plaintext")
+			}
+			if bytes.Contains(stored, []byte("text/x-secret")) {
+				t.Errorf("stored data contains the content type")
+			}
+			if metadata, _ := inner.StatFile("file"); metadata.ContentType != nil {
+				t.Errorf("wrapped plugin received content type %q", *metadata.ContentType)
+			}
+
+			retrieved, err := plugin.RetrieveFile("file")
+			if err != nil {
+				t.Fatalf("RetrieveFile() error = %v", err)
+			}
+			if !bytes.Equal(retrieved, tt.data) {
+				t.Fatalf("RetrieveFile() returned %d different bytes", len(retrieved))
+			}
+
+			metadata, err := plugin.StatFile("file")
+			if err != nil {
+				t.Fatalf("StatFile() error = %v", err)
+			}
+			if metadata.Size != int64(len(tt.data)) {
+				t.Errorf("StatFile().Size = %d, want %d", metadata.Size, len(tt.data))
+			}
+			if metadata.EncryptionKeyID == nil || *metadata.EncryptionKeyID != "new" {
+				t.Errorf("StatFile().EncryptionKeyID = %v, want %q", metadata.EncryptionKeyID, "new")
+			}
+			if metadata.ContentType == nil || *metadata.ContentType != "text/x-secret" {
+				t.Errorf("StatFile().ContentType = %v, want %q", metadata.ContentType, "text/x-secret")
+			}
+		})
+	}
+}
+
+func TestEncryptionDecrypt(t *testing.T) {
+	storedAt := func(path string, currentID string) []byte {
+		inner := newMemoryPlugin(nil)
+		if err := NewEncryptionPlugin(inner, testKeys(t, currentID)).StoreFile(path, []byte("secret text"), nil); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := inner.data(path)
+		return data
+	}
+	stored := func(currentID string) []byte {
+		return storedAt("file", currentID)
+	}
+	modified := func(data []byte, offset int) []byte {
+		data = append([]byte(nil), data...)
+		if offset < 0 {
+			offset += len(data)
+		}
+		data[offset] ^= 1
+		return data
+	}
+	// The key ID is the first field after the magic and its length
+	renamed := func(data []byte) []byte {
+		data = append([]byte(nil), data...)
+		copy(data[len(encryptionMagic)+1:], "old")
+		return data
+	}
+
+	onlyNew, err := NewStaticKeyProvider("new", map[string][]byte{"new": bytes.Repeat([]byte{2}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		stored   []byte
+		keys     KeyProvider
+		wantType *ErrorType
+	}{
+		{name: "current key", stored: stored("new"), keys: testKeys(t, "new")},
+		{name: "rotated key", stored: stored("old"), keys: testKeys(t, "new")},
+		{name: "retired key", stored: stored("old"), keys: onlyNew, wantType: ptr(ConfigurationErrorType)},
+		{name: "modified ciphertext", stored: modified(stored("new"), -1), keys: testKeys(t, "new"), wantType: ptr(StorageErrorType)},
+		{name: "modified header", stored: modified(stored("new"), -(len("secret text") + gcmTagSize + 1)), keys: testKeys(t, "new"), wantType: ptr(StorageErrorType)},
+		{name: "modified data nonce", stored: modified(stored("new"), len(encryptionMagic)+1+len("new")+1+gcmNonceSize+dataKeySize+gcmTagSize), keys: testKeys(t, "new"), wantType: ptr(StorageErrorType)},
+		{name: "moved in the backend", stored: storedAt("other", "new"), keys: testKeys(t, "new"), wantType: ptr(StorageErrorType)},
+		{name: "unnormalized path", stored: storedAt("./file", "new"), keys: testKeys(t, "new")},
+		{name: "header pointing at another key", stored: renamed(stored("new")), keys: testKeys(t, "new"), wantType: ptr(StorageErrorType)},
+		{name: "not encrypted", stored: []byte("secret text"), keys: testKeys(t, "new"), wantType: ptr(StorageErrorType)},
+		{name: "truncated header", stored: stored("new")[:len(encryptionMagic)+3], keys: testKeys(t, "new"), wantType: ptr(StorageErrorType)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newMemoryPlugin(map[string]string{"file": string(tt.stored)})
+			data, err := NewEncryptionPlugin(inner, tt.keys).RetrieveFile("file")
+			checkErrorType(t, err, tt.wantType)
+			if tt.wantType == nil && string(data) != "secret text" {
+				t.Fatalf("RetrieveFile() = %q, want %q", data, "secret text")
+			}
+		})
+	}
+}
+
+func TestEncryptionUnencryptedFiles(t *testing.T) {
+	inner := newMemoryPlugin(map[string]string{"plain.txt": "not encrypted"})
+	plugin := NewEncryptionPlugin(inner, testKeys(t, "new"))
+	if err := plugin.StoreFile("secret.txt", []byte("secret text"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := plugin.ListFiles("", "", 0)
+	if err != nil {
+		t.Fatalf("ListFiles() error = %v", err)
+	}
+	if len(result.Files) != 2 {
+		t.Fatalf("ListFiles() returned %d files, want 2", len(result.Files))
+	}
+	wantSizes := map[string]int64{"plain.txt": int64(len("not encrypted")), "secret.txt": int64(len("secret text"))}
+	for _, file := range result.Files {
+		encrypted := file.Path == "secret.txt"
+		if (file.EncryptionKeyID != nil) != encrypted {
+			t.Errorf("%s EncryptionKeyID = %v, want encrypted %v", file.Path, file.EncryptionKeyID, encrypted)
+		}
+		if file.Size != wantSizes[file.Path] {
+			t.Errorf("%s size = %d, want %d", file.Path, file.Size, wantSizes[file.Path])
+		}
+	}
+
+	_, err = plugin.RetrieveFile("plain.txt")
+	checkErrorType(t, err, ptr(StorageErrorType))
+}
+
+func TestEncryptionCopyMove(t *testing.T) {
+	inner := newMemoryPlugin(nil)
+	plugin := NewEncryptionPlugin(inner, testKeys(t, "new"))
+	if err := plugin.StoreFile("a.txt", []byte("secret text"), ptr("text/plain")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyFile(plugin, "a.txt", "b.txt"); err != nil {
+		t.Fatalf("copyFile() error = %v", err)
+	}
+	if err := moveFile(plugin, "a.txt", "c.txt"); err != nil {
+		t.Fatalf("moveFile() error = %v", err)
+	}
+
+	if plugin.FileExists("a.txt") {
+		t.Errorf("source still exists after move")
+	}
+	for _, path := range []string{"b.txt", "c.txt"} {
+		data, err := plugin.RetrieveFile(path)
+		if err != nil || string(data) != "secret text" {
+			t.Errorf("RetrieveFile(%q) = %q, %v, want %q", path, data, err, "secret text")
+		}
+		metadata, err := plugin.StatFile(path)
+		if err != nil || metadata.ContentType == nil || *metadata.ContentType != "text/plain" {
+			t.Errorf("StatFile(%q) content type = %v, %v, want %q", path, metadata, err, "text/plain")
+		}
+	}
+}
+
+func TestNewStaticKeyProvider(t *testing.T) {
+	tests := []struct {
+		name      string
+		currentID string
+		keys      map[string][]byte
+		wantErr   bool
+	}{
+		{name: "valid", currentID: "a", keys: map[string][]byte{"a": make([]byte, 32), "b": make([]byte, 24)}},
+		{name: "missing current key", currentID: "c", keys: map[string][]byte{"a": make([]byte, 32)}, wantErr: true},
+		{name: "short key", currentID: "a", keys: map[string][]byte{"a": make([]byte, 8)}, wantErr: true},
+		{name: "empty key ID", currentID: "a", keys: map[string][]byte{"a": make([]byte, 16), "": make([]byte, 16)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewStaticKeyProvider(tt.currentID, tt.keys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewStaticKeyProvider() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncryptionMetadata(t *testing.T) {
+	inner := newMemoryPlugin(nil)
+	plugin := NewEncryptionPlugin(inner, testKeys(t, "new"))
+	metadata := map[string]string{"owner": "secret-owner"}
+
+	// The metadata is kept in the encrypted header, so the wrapped plugin doesn't need to support it
+	options := StoreOptions{ContentType: ptr("text/plain"), Metadata: metadata}
+	if err := storeFileWithOptions(context.Background(), plugin, "a.txt", []byte("secret text"), options, nil); err != nil {
+		t.Fatalf("storeFileWithOptions() error = %v", err)
+	}
+
+	stored, _ := inner.data("a.txt")
+	if bytes.Contains(stored, []byte("secret-owner")) {
+		t.Errorf("stored data contains the metadata")
+	}
+	if err := copyFile(plugin, "a.txt", "b.txt"); err != nil {
+		t.Fatalf("copyFile() error = %v", err)
+	}
+
+	for _, path := range []string{"a.txt", "b.txt"} {
+		stat, err := plugin.StatFile(path)
+		if err != nil {
+			t.Fatalf("StatFile(%q) error = %v", path, err)
+		}
+		if !reflect.DeepEqual(stat.Metadata, metadata) {
+			t.Errorf("StatFile(%q).Metadata = %v, want %v", path, stat.Metadata, metadata)
+		}
+	}
+}
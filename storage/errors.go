@@ -1,6 +1,11 @@
 package storage
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
 
 // PluginError represents different types of errors that can occur in storage plugins
 type PluginError struct {
@@ -17,6 +22,37 @@ const (
 	NetworkErrorType  
 	ConfigurationErrorType
 	UnknownErrorType
+	NotFoundErrorType
+	UnsupportedErrorType
+	CancelledErrorType
+	TimeoutErrorType
+	ChecksumMismatchErrorType
+	PreconditionFailedErrorType
+	UnavailableErrorType
+	QuotaExceededErrorType
+	PolicyViolationErrorType
+)
+
+// ErrorCode is the machine-readable error code reported across the FFI boundary by storage_last_error
+// The values are part of the FFI contract with the host and must never be renumbered
+type ErrorCode int32
+
+const (
+	ErrorCodeNone               ErrorCode = 0
+	ErrorCodeInvalidInput       ErrorCode = 1
+	ErrorCodeStorage            ErrorCode = 2
+	ErrorCodeNetwork            ErrorCode = 3
+	ErrorCodeConfiguration      ErrorCode = 4
+	ErrorCodeUnknown            ErrorCode = 5
+	ErrorCodeNotFound           ErrorCode = 6
+	ErrorCodeUnsupported        ErrorCode = 7
+	ErrorCodeCancelled          ErrorCode = 8
+	ErrorCodeTimeout            ErrorCode = 9
+	ErrorCodeChecksumMismatch   ErrorCode = 10
+	ErrorCodePreconditionFailed ErrorCode = 11
+	ErrorCodeUnavailable        ErrorCode = 12
+	ErrorCodeQuotaExceeded      ErrorCode = 13
+	ErrorCodePolicyViolation    ErrorCode = 14
 )
 
 func (e *PluginError) Error() string {
@@ -31,11 +67,68 @@ func (e *PluginError) Error() string {
 		return fmt.Sprintf("Configuration error: %s", e.Message)
 	case UnknownErrorType:
 		return fmt.Sprintf("Unknown error: %s", e.Message)
+	case NotFoundErrorType:
+		return fmt.Sprintf("Not found: %s", e.Message)
+	case UnsupportedErrorType:
+		return fmt.Sprintf("Not supported: %s", e.Message)
+	case CancelledErrorType:
+		return fmt.Sprintf("Cancelled: %s", e.Message)
+	case TimeoutErrorType:
+		return fmt.Sprintf("Timeout: %s", e.Message)
+	case ChecksumMismatchErrorType:
+		return fmt.Sprintf("Checksum mismatch: %s", e.Message)
+	case PreconditionFailedErrorType:
+		return fmt.Sprintf("Precondition failed: %s", e.Message)
+	case UnavailableErrorType:
+		return fmt.Sprintf("Unavailable: %s", e.Message)
+	case QuotaExceededErrorType:
+		return fmt.Sprintf("Quota exceeded: %s", e.Message)
+	case PolicyViolationErrorType:
+		return fmt.Sprintf("Policy violation: %s", e.Message)
 	default:
 		return fmt.Sprintf("Unknown error: %s", e.Message)
 	}
 }
 
+// Code returns the FFI error code for this error
+func (e *PluginError) Code() ErrorCode {
+	switch e.Type {
+	case InvalidInputError:
+		return ErrorCodeInvalidInput
+	case StorageErrorType:
+		return ErrorCodeStorage
+	case NetworkErrorType:
+		return ErrorCodeNetwork
+	case ConfigurationErrorType:
+		return ErrorCodeConfiguration
+	case NotFoundErrorType:
+		return ErrorCodeNotFound
+	case UnsupportedErrorType:
+		return ErrorCodeUnsupported
+	case CancelledErrorType:
+		return ErrorCodeCancelled
+	case TimeoutErrorType:
+		return ErrorCodeTimeout
+	case ChecksumMismatchErrorType:
+		return ErrorCodeChecksumMismatch
+	case PreconditionFailedErrorType:
+		return ErrorCodePreconditionFailed
+	case UnavailableErrorType:
+		return ErrorCodeUnavailable
+	case QuotaExceededErrorType:
+		return ErrorCodeQuotaExceeded
+	case PolicyViolationErrorType:
+		return ErrorCodePolicyViolation
+	default:
+		return ErrorCodeUnknown
+	}
+}
+
+// Retryable reports whether the operation may succeed if the host tries again
+func (e *PluginError) Retryable() bool {
+	return e.Type == NetworkErrorType || e.Type == TimeoutErrorType || e.Type == UnavailableErrorType
+}
+
 // NewInvalidInputError creates a new invalid input error
 func NewInvalidInputError(message string) *PluginError {
 	return &PluginError{
@@ -74,4 +167,115 @@ func NewUnknownError(message string) *PluginError {
 		Type:    UnknownErrorType,
 		Message: message,
 	}
-}
\ No newline at end of file
+}
+
+// NewNotFoundError creates a new not found error
+func NewNotFoundError(message string) *PluginError {
+	return &PluginError{
+		Type:    NotFoundErrorType,
+		Message: message,
+	}
+}
+
+// NewUnsupportedError creates a new error for operations the plugin doesn't implement
+func NewUnsupportedError(message string) *PluginError {
+	return &PluginError{
+		Type:    UnsupportedErrorType,
+		Message: message,
+	}
+}
+
+// NewCancelledError creates a new error for operations cancelled by the host
+func NewCancelledError(message string) *PluginError {
+	return &PluginError{
+		Type:    CancelledErrorType,
+		Message: message,
+	}
+}
+
+// NewTimeoutError creates a new error for operations that exceeded their deadline
+func NewTimeoutError(message string) *PluginError {
+	return &PluginError{
+		Type:    TimeoutErrorType,
+		Message: message,
+	}
+}
+
+// NewChecksumMismatchError creates a new error for data that doesn't match its checksum
+func NewChecksumMismatchError(message string) *PluginError {
+	return &PluginError{
+		Type:    ChecksumMismatchErrorType,
+		Message: message,
+	}
+}
+
+// NewPreconditionFailedError creates a new error for conditional writes whose condition doesn't hold
+func NewPreconditionFailedError(message string) *PluginError {
+	return &PluginError{
+		Type:    PreconditionFailedErrorType,
+		Message: message,
+	}
+}
+
+// NewUnavailableError creates a new error for calls rejected because the backend is considered unhealthy
+func NewUnavailableError(message string) *PluginError {
+	return &PluginError{
+		Type:    UnavailableErrorType,
+		Message: message,
+	}
+}
+
+// NewQuotaExceededError creates a new error for writes that would exceed a storage quota
+func NewQuotaExceededError(message string) *PluginError {
+	return &PluginError{
+		Type:    QuotaExceededErrorType,
+		Message: message,
+	}
+}
+
+// NewPolicyViolationError creates a new error for uploads rejected by the upload policy
+func NewPolicyViolationError(message string) *PluginError {
+	return &PluginError{
+		Type:    PolicyViolationErrorType,
+		Message: message,
+	}
+}
+
+// AsPluginError converts any error into a PluginError
+// Context errors become cancelled or timeout errors, anything else that doesn't wrap a PluginError is an unknown error
+func AsPluginError(err error) *PluginError {
+	var pluginErr *PluginError
+	if errors.As(err, &pluginErr) {
+		return pluginErr
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return contextError(err)
+	}
+	return NewUnknownError(err.Error())
+}
+
+// joinErrors combines the errors of an operation that kept going past failures
+// The result has the type of the first error and lists every message
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = AsPluginError(err).Message
+	}
+	return &PluginError{
+		Type:    AsPluginError(errs[0]).Type,
+		Message: fmt.Sprintf("%d errors: %s", len(errs), strings.Join(messages, "; ")),
+	}
+}
+
+// IsNotFound reports whether err is a not found error
+func IsNotFound(err error) bool {
+	var pluginErr *PluginError
+	return errors.As(err, &pluginErr) && pluginErr.Type == NotFoundErrorType
+}
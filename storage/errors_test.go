@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestPluginErrorCode(t *testing.T) {
+	tests := []struct {
+		err       error
+		code      ErrorCode
+		retryable bool
+	}{
+		{err: NewInvalidInputError("x"), code: ErrorCodeInvalidInput},
+		{err: NewStorageError("x"), code: ErrorCodeStorage},
+		{err: NewNetworkError("x"), code: ErrorCodeNetwork, retryable: true},
+		{err: NewConfigurationError("x"), code: ErrorCodeConfiguration},
+		{err: NewUnknownError("x"), code: ErrorCodeUnknown},
+		{err: NewNotFoundError("x"), code: ErrorCodeNotFound},
+		{err: NewUnsupportedError("x"), code: ErrorCodeUnsupported},
+		{err: fmt.Errorf("wrapped: %w", NewNetworkError("x")), code: ErrorCodeNetwork, retryable: true},
+		{err: errors.New("plain"), code: ErrorCodeUnknown},
+		{err: NewCancelledError("x"), code: ErrorCodeCancelled},
+		{err: NewTimeoutError("x"), code: ErrorCodeTimeout, retryable: true},
+		{err: context.Canceled, code: ErrorCodeCancelled},
+		{err: fmt.Errorf("upload: %w", context.DeadlineExceeded), code: ErrorCodeTimeout, retryable: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			pluginErr := AsPluginError(tt.err)
+			if pluginErr.Code() != tt.code || pluginErr.Retryable() != tt.retryable {
+				t.Errorf("code %d, retryable %v, want %d, %v", pluginErr.Code(), pluginErr.Retryable(), tt.code, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: NewNotFoundError("a"), want: true},
+		{err: fmt.Errorf("stat: %w", NewNotFoundError("a")), want: true},
+		{err: NewStorageError("a")},
+		{err: errors.New("a")},
+		{err: nil},
+	}
+
+	for _, tt := range tests {
+		if got := IsNotFound(tt.err); got != tt.want {
+			t.Errorf("IsNotFound(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestMissingFileErrors(t *testing.T) {
+	plugin := newMemoryPlugin(nil)
+
+	_, err := statFile(basicPlugin{plugin}, "missing")
+	checkErrorType(t, err, ptr(NotFoundErrorType))
+	_, err = listFiles(basicPlugin{plugin}, "", "", 0)
+	checkErrorType(t, err, ptr(UnsupportedErrorType))
+}
@@ -0,0 +1,499 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExpiryPrefix is the reserved path prefix under which ExpiryPlugin keeps the expiry of files
+const ExpiryPrefix = ".expiry/"
+
+// ExpirySweepIntervalConfigKey is the plugin config key of the background sweep interval
+const ExpirySweepIntervalConfigKey = "expiry_sweep_interval_ms"
+
+// lifecyclePlugin returns the plugin as a LifecycleStoragePlugin
+func lifecyclePlugin(plugin StoragePlugin) (LifecycleStoragePlugin, error) {
+	lifecycle, ok := plugin.(LifecycleStoragePlugin)
+	if !ok {
+		return nil, NewUnsupportedError("Plugin does not support file expiry")
+	}
+	return lifecycle, nil
+}
+
+// resolveExpiry converts the TTL of the options into an expiry time
+func resolveExpiry(options *StoreOptions, now time.Time) error {
+	if options.TTLSeconds == nil {
+		return nil
+	}
+	if options.ExpiresAt != nil {
+		return NewInvalidInputError("expires_at and ttl_seconds can't be combined")
+	}
+	if *options.TTLSeconds <= 0 {
+		return NewInvalidInputError(fmt.Sprintf("invalid ttl_seconds: %d", *options.TTLSeconds))
+	}
+
+	expires := now.Add(time.Duration(*options.TTLSeconds) * time.Second).UTC()
+	options.ExpiresAt = &expires
+	options.TTLSeconds = nil
+	return nil
+}
+
+// ExpiryOptions configures an ExpiryPlugin
+type ExpiryOptions struct {
+	// SweepInterval runs SweepExpiredFiles in the background, 0 leaves sweeping to the host
+	SweepInterval time.Duration
+}
+
+// ExpiryOptionsFromConfig builds expiry options from the plugin config
+func ExpiryOptionsFromConfig() (ExpiryOptions, error) {
+	var options ExpiryOptions
+
+	interval, err := pluginConfigMillis(ExpirySweepIntervalConfigKey, 0)
+	if err != nil {
+		return options, err
+	}
+	options.SweepInterval = interval
+	return options, nil
+}
+
+// expiryRecord is stored for every file that expires
+type expiryRecord struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ExpiryPlugin adds per-file expiry to plugins without native lifecycle rules
+//
+// The expiry of a file is kept in a small JSON record under ExpiryPrefix and cleared when the file
+// is replaced or deleted through this plugin. Expired files stay readable until they are swept.
+// The wrapped plugin must implement ListingStoragePlugin for sweeps to find the records.
+type ExpiryPlugin struct {
+	reservedPathPlugin
+	options ExpiryOptions
+	locks   PathMutex
+
+	// multipartPaths maps the uploads initiated through the plugin to their path
+	mutex          sync.Mutex
+	multipartPaths map[string]string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewExpiryPlugin wraps inner with file expiry
+func NewExpiryPlugin(inner StoragePlugin, options ExpiryOptions) *ExpiryPlugin {
+	p := &ExpiryPlugin{
+		reservedPathPlugin: reservedPathPlugin{
+			interceptedPlugin: &interceptedPlugin{inner: inner, interceptor: passthrough},
+			checkPath:         checkExpiryPath,
+		},
+		options:        options,
+		multipartPaths: make(map[string]string),
+		stop:           make(chan struct{}),
+	}
+	if options.SweepInterval > 0 {
+		go runPeriodically(p.stop, options.SweepInterval, func(ctx context.Context) { p.SweepExpiredFiles(ctx) })
+	}
+	return p
+}
+
+// WithExpiry returns a Middleware that adds file expiry
+func WithExpiry(options ExpiryOptions) Middleware {
+	return func(plugin StoragePlugin) StoragePlugin {
+		return NewExpiryPlugin(plugin, options)
+	}
+}
+
+func (p *ExpiryPlugin) providesCapability(LifecycleStoragePlugin) {}
+
+// checkExpiryPath rejects paths under the reserved prefix
+func checkExpiryPath(path string) error {
+	if strings.HasPrefix(path, ExpiryPrefix) {
+		return NewInvalidInputError("path is reserved for file expiry: " + path)
+	}
+	return nil
+}
+
+func expiryRecordPath(path string) string {
+	return ExpiryPrefix + path
+}
+
+// readExpiry returns the expiry of path, nil when it doesn't expire
+func (p *ExpiryPlugin) readExpiry(path string) (*time.Time, error) {
+	data, err := p.inner.RetrieveFile(expiryRecordPath(path))
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var record expiryRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, NewStorageError(fmt.Sprintf("invalid expiry record of %s: %v", path, err))
+	}
+	return &record.ExpiresAt, nil
+}
+
+// writeExpiry records the expiry of path
+func (p *ExpiryPlugin) writeExpiry(path string, expiresAt time.Time) error {
+	data, err := json.Marshal(expiryRecord{ExpiresAt: expiresAt.UTC()})
+	if err != nil {
+		return NewStorageError("failed to encode expiry record: " + err.Error())
+	}
+	contentType := "application/json"
+	return p.inner.StoreFile(expiryRecordPath(path), data, &contentType)
+}
+
+// clearExpiry removes the expiry of path
+func (p *ExpiryPlugin) clearExpiry(path string) error {
+	if err := p.inner.DeleteFile(expiryRecordPath(path)); err != nil && !IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// StoreFile stores the file without expiry
+func (p *ExpiryPlugin) StoreFile(path string, data []byte, contentType *string) error {
+	return p.StoreFileWithContext(context.Background(), path, data, contentType)
+}
+
+// StoreFileWithContext stores the file without expiry
+func (p *ExpiryPlugin) StoreFileWithContext(ctx context.Context, path string, data []byte, contentType *string) error {
+	if err := checkExpiryPath(path); err != nil {
+		return err
+	}
+
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	if err := storeFile(ctx, p.inner, path, data, contentType, ProgressFromContext(ctx)); err != nil {
+		return err
+	}
+	return p.clearExpiry(path)
+}
+
+// StoreFileWithOptions stores the file and records its expiry
+// The record is written after the file, so a failed store leaves the expiry of the current file in place
+func (p *ExpiryPlugin) StoreFileWithOptions(ctx context.Context, path string, data []byte, options StoreOptions) error {
+	if err := checkExpiryPath(path); err != nil {
+		return err
+	}
+	if err := resolveExpiry(&options, time.Now()); err != nil {
+		return err
+	}
+
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	expiresAt := options.ExpiresAt
+	options.ExpiresAt = nil
+	if err := storeWithOptions(ctx, p.inner, path, data, options, ProgressFromContext(ctx)); err != nil {
+		return err
+	}
+
+	if expiresAt == nil {
+		return p.clearExpiry(path)
+	}
+	return p.writeExpiry(path, *expiresAt)
+}
+
+// DeleteFile deletes the file and its expiry
+func (p *ExpiryPlugin) DeleteFile(path string) error {
+	return p.DeleteFileWithContext(context.Background(), path)
+}
+
+// DeleteFileWithContext deletes the file and its expiry
+func (p *ExpiryPlugin) DeleteFileWithContext(ctx context.Context, path string) error {
+	if err := checkExpiryPath(path); err != nil {
+		return err
+	}
+
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	err := deleteFile(ctx, p.inner, path)
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+	if clearErr := p.clearExpiry(path); clearErr != nil {
+		return clearErr
+	}
+	return err
+}
+
+// DeleteFiles deletes the files one by one so their expiry is removed as well
+func (p *ExpiryPlugin) DeleteFiles(paths []string) ([]DeleteResult, error) {
+	results := make([]DeleteResult, len(paths))
+	for i, path := range paths {
+		results[i] = NewDeleteResult(path, p.DeleteFile(path))
+	}
+	return results, nil
+}
+
+// CopyFile copies the file, the copy doesn't expire
+func (p *ExpiryPlugin) CopyFile(sourcePath string, destinationPath string) error {
+	if err := checkExpiryPath(sourcePath); err != nil {
+		return err
+	}
+	if err := checkExpiryPath(destinationPath); err != nil {
+		return err
+	}
+
+	unlock := p.locks.Lock(destinationPath)
+	defer unlock()
+
+	if err := copyFile(p.inner, sourcePath, destinationPath); err != nil {
+		return err
+	}
+	return p.clearExpiry(destinationPath)
+}
+
+// MoveFile moves the file together with its expiry
+func (p *ExpiryPlugin) MoveFile(sourcePath string, destinationPath string) error {
+	if err := checkExpiryPath(sourcePath); err != nil {
+		return err
+	}
+	if err := checkExpiryPath(destinationPath); err != nil {
+		return err
+	}
+	if sourcePath == destinationPath {
+		return NewInvalidInputError("source and destination paths are the same")
+	}
+
+	unlock := p.locks.LockPair(sourcePath, destinationPath)
+	defer unlock()
+
+	expiresAt, err := p.readExpiry(sourcePath)
+	if err != nil {
+		return err
+	}
+	if err := moveFile(p.inner, sourcePath, destinationPath); err != nil {
+		return err
+	}
+
+	if expiresAt == nil {
+		return p.clearExpiry(destinationPath)
+	}
+	if err := p.writeExpiry(destinationPath, *expiresAt); err != nil {
+		return err
+	}
+	return p.clearExpiry(sourcePath)
+}
+
+// OpenUpload starts an upload whose file doesn't expire
+func (p *ExpiryPlugin) OpenUpload(path string, contentType *string) (UploadWriter, error) {
+	if err := checkExpiryPath(path); err != nil {
+		return nil, err
+	}
+
+	writer, err := newUploadWriter(p.inner, path, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return &expiryUpload{UploadWriter: writer, plugin: p, path: path}, nil
+}
+
+type expiryUpload struct {
+	UploadWriter
+	plugin *ExpiryPlugin
+	path   string
+}
+
+func (u *expiryUpload) Commit() error {
+	unlock := u.plugin.locks.Lock(u.path)
+	defer unlock()
+
+	if err := u.UploadWriter.Commit(); err != nil {
+		return err
+	}
+	return u.plugin.clearExpiry(u.path)
+}
+
+// InitiateMultipartUpload starts a multipart upload and removes the expiry of the file it replaces
+// The expiry is removed up front as well as on completion, so uploads completed after the plugin was
+// reloaded, whose path isn't known any more, don't inherit the expiry of the file they replace
+func (p *ExpiryPlugin) InitiateMultipartUpload(path string, contentType *string) (string, error) {
+	if err := checkExpiryPath(path); err != nil {
+		return "", err
+	}
+
+	multipart, err := multipartPlugin(p.inner)
+	if err != nil {
+		return "", err
+	}
+
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	if err := p.clearExpiry(path); err != nil {
+		return "", err
+	}
+	uploadID, err := multipart.InitiateMultipartUpload(path, contentType)
+	if err != nil {
+		return "", err
+	}
+
+	p.mutex.Lock()
+	p.multipartPaths[uploadID] = path
+	p.mutex.Unlock()
+	return uploadID, nil
+}
+
+// CompleteMultipartUpload completes the upload and removes any expiry given to its path since it was initiated
+// An expiry set in the meantime by a store to the same path is kept for uploads that weren't initiated through
+// this plugin
+func (p *ExpiryPlugin) CompleteMultipartUpload(uploadID string, parts []UploadedPart) error {
+	multipart, err := multipartPlugin(p.inner)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	path, known := p.multipartPaths[uploadID]
+	p.mutex.Unlock()
+	if !known {
+		return multipart.CompleteMultipartUpload(uploadID, parts)
+	}
+
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	if err := multipart.CompleteMultipartUpload(uploadID, parts); err != nil {
+		return err
+	}
+	p.forgetMultipart(uploadID)
+	return p.clearExpiry(path)
+}
+
+// AbortMultipartUpload aborts the upload
+func (p *ExpiryPlugin) AbortMultipartUpload(uploadID string) error {
+	multipart, err := multipartPlugin(p.inner)
+	if err != nil {
+		return err
+	}
+
+	if err := multipart.AbortMultipartUpload(uploadID); err != nil {
+		return err
+	}
+	p.forgetMultipart(uploadID)
+	return nil
+}
+
+func (p *ExpiryPlugin) forgetMultipart(uploadID string) {
+	p.mutex.Lock()
+	delete(p.multipartPaths, uploadID)
+	p.mutex.Unlock()
+}
+
+// StatFile returns the metadata of the wrapped plugin with the expiry of the file
+func (p *ExpiryPlugin) StatFile(path string) (*FileMetadata, error) {
+	if err := checkExpiryPath(path); err != nil {
+		return nil, err
+	}
+
+	metadata, err := statFile(p.inner, path)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt, err := p.readExpiry(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := *metadata
+	result.ExpiresAt = expiresAt
+	return &result, nil
+}
+
+// ListFiles lists the wrapped plugin without the reserved expiry records
+func (p *ExpiryPlugin) ListFiles(prefix string, cursor string, limit int) (*ListResult, error) {
+	if strings.HasPrefix(prefix, ExpiryPrefix) {
+		return &ListResult{Files: []FileMetadata{}}, nil
+	}
+
+	result, err := listFiles(p.inner, prefix, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	files := result.Files[:0]
+	for _, file := range result.Files {
+		if !strings.HasPrefix(file.Path, ExpiryPrefix) {
+			files = append(files, file)
+		}
+	}
+	result.Files = files
+	return result, nil
+}
+
+// SweepExpiredFiles deletes the files past their expiry and returns how many were deleted
+// Every expiry record is read, the cost of a sweep grows with the number of expiring files.
+// A record that can't be read or a file that can't be deleted is logged and skipped, the sweep goes on
+// and returns the combined errors together with the number of files it did delete.
+func (p *ExpiryPlugin) SweepExpiredFiles(ctx context.Context) (int, error) {
+	deleted := 0
+	var errs []error
+	cursor := ""
+	for {
+		page, err := listFiles(p.inner, ExpiryPrefix, cursor, MaxListLimit)
+		if err != nil {
+			return deleted, joinErrors(append(errs, err))
+		}
+
+		for _, file := range page.Files {
+			if err := ctx.Err(); err != nil {
+				return deleted, joinErrors(append(errs, contextError(err)))
+			}
+
+			path := strings.TrimPrefix(file.Path, ExpiryPrefix)
+			expired, err := p.expire(ctx, path, time.Now())
+			if err != nil {
+				log.Printf("Failed to sweep expired file %s: %v", path, err)
+				errs = append(errs, err)
+				continue
+			}
+			if expired {
+				deleted++
+			}
+		}
+
+		if page.NextCursor == nil {
+			return deleted, joinErrors(errs)
+		}
+		cursor = *page.NextCursor
+	}
+}
+
+// expire deletes path and its expiry record when it has expired by now
+// The record is read again under the path lock in case the file was replaced since it was listed
+func (p *ExpiryPlugin) expire(ctx context.Context, path string, now time.Time) (bool, error) {
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	expiresAt, err := p.readExpiry(path)
+	if err != nil || expiresAt == nil || expiresAt.After(now) {
+		return false, err
+	}
+
+	// A file deleted around the plugin only leaves its record behind
+	err = deleteFile(ctx, p.inner, path)
+	if err != nil && !IsNotFound(err) {
+		return false, err
+	}
+	if clearErr := p.clearExpiry(path); clearErr != nil {
+		return false, clearErr
+	}
+	return err == nil, nil
+}
+
+// Cleanup stops the background sweep and cleans up the wrapped plugin
+func (p *ExpiryPlugin) Cleanup() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	return p.inner.Cleanup()
+}
@@ -0,0 +1,345 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeExpiring stores content at path through the plugin, expiring at expiresAt unless it is nil
+func storeExpiring(t *testing.T, plugin *ExpiryPlugin, path string, content string, expiresAt *time.Time) {
+	t.Helper()
+
+	if err := plugin.StoreFileWithOptions(context.Background(), path, []byte(content), StoreOptions{ExpiresAt: expiresAt}); err != nil {
+		t.Fatalf("StoreFileWithOptions(%q) error = %v", path, err)
+	}
+}
+
+// expiryOf returns the expiry reported by StatFile for path
+func expiryOf(t *testing.T, plugin *ExpiryPlugin, path string) *time.Time {
+	t.Helper()
+
+	metadata, err := plugin.StatFile(path)
+	if err != nil {
+		t.Fatalf("StatFile(%q) error = %v", path, err)
+	}
+	return metadata.ExpiresAt
+}
+
+func TestExpiryStore(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	tests := []struct {
+		name    string
+		options StoreOptions
+		// then is stored over the file afterwards when set
+		then        *StoreOptions
+		want        *time.Time
+		wantTTL     bool
+		wantType    *ErrorType
+		wantNoStore bool
+	}{
+		{name: "no expiry"},
+		{name: "expires at", options: StoreOptions{ExpiresAt: &expiresAt}, want: &expiresAt},
+		{name: "ttl", options: StoreOptions{TTLSeconds: ptr(int64(60))}, wantTTL: true},
+		{name: "invalid ttl", options: StoreOptions{TTLSeconds: ptr(int64(0))}, wantType: ptr(InvalidInputError), wantNoStore: true},
+		{name: "expires at and ttl", options: StoreOptions{ExpiresAt: &expiresAt, TTLSeconds: ptr(int64(60))}, wantType: ptr(InvalidInputError), wantNoStore: true},
+		{name: "overwritten without expiry", options: StoreOptions{ExpiresAt: &expiresAt}, then: &StoreOptions{}},
+		{name: "overwritten with another expiry", options: StoreOptions{TTLSeconds: ptr(int64(60))}, then: &StoreOptions{ExpiresAt: &expiresAt}, want: &expiresAt},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := NewExpiryPlugin(newMemoryPlugin(nil), ExpiryOptions{})
+
+			err := plugin.StoreFileWithOptions(context.Background(), "a.txt", []byte("data"), tt.options)
+			checkErrorType(t, err, tt.wantType)
+			if tt.wantNoStore {
+				if plugin.FileExists("a.txt") {
+					t.Errorf("file was stored")
+				}
+				return
+			}
+			if tt.then != nil {
+				if err := plugin.StoreFileWithOptions(context.Background(), "a.txt", []byte("new"), *tt.then); err != nil {
+					t.Fatalf("StoreFileWithOptions() error = %v", err)
+				}
+			}
+
+			got := expiryOf(t, plugin, "a.txt")
+			switch {
+			case tt.wantTTL:
+				if got == nil || got.Before(time.Now().Add(50*time.Second)) || got.After(time.Now().Add(time.Minute)) {
+					t.Errorf("expiry = %v, want about a minute from now", got)
+				}
+			case tt.want == nil:
+				if got != nil {
+					t.Errorf("expiry = %v, want none", got)
+				}
+			default:
+				if got == nil || !got.Equal(*tt.want) {
+					t.Errorf("expiry = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestExpiryReservedPaths(t *testing.T) {
+	plugin := NewExpiryPlugin(newMemoryPlugin(nil), ExpiryOptions{})
+	storeExpiring(t, plugin, "a.txt", "data", ptr(time.Now().Add(time.Hour)))
+
+	checkErrorType(t, plugin.StoreFile(expiryRecordPath("a.txt"), []byte("{}"), nil), ptr(InvalidInputError))
+	_, err := plugin.RetrieveFile(expiryRecordPath("a.txt"))
+	checkErrorType(t, err, ptr(InvalidInputError))
+
+	result, err := plugin.ListFiles("", "", 0)
+	if err != nil {
+		t.Fatalf("ListFiles() error = %v", err)
+	}
+	if len(result.Files) != 1 || result.Files[0].Path != "a.txt" {
+		t.Errorf("ListFiles() = %v, want only a.txt", result.Files)
+	}
+}
+
+func TestSweepExpiredFiles(t *testing.T) {
+	inner := newMemoryPlugin(nil)
+	plugin := NewExpiryPlugin(inner, ExpiryOptions{})
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	storeExpiring(t, plugin, "expired.txt", "data", &past)
+	storeExpiring(t, plugin, "dir/expired.txt", "data", &past)
+	storeExpiring(t, plugin, "later.txt", "data", &future)
+	storeExpiring(t, plugin, "kept.txt", "data", nil)
+
+	// A file deleted around the plugin leaves its record behind
+	storeExpiring(t, plugin, "gone.txt", "data", &past)
+	inner.DeleteFile("gone.txt")
+
+	deleted, err := plugin.SweepExpiredFiles(context.Background())
+	if err != nil {
+		t.Fatalf("SweepExpiredFiles() error = %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("SweepExpiredFiles() = %d, want 2", deleted)
+	}
+
+	for path, want := range map[string]bool{"expired.txt": false, "dir/expired.txt": false, "later.txt": true, "kept.txt": true} {
+		if got := plugin.FileExists(path); got != want {
+			t.Errorf("FileExists(%q) = %v, want %v", path, got, want)
+		}
+	}
+	for _, path := range []string{"expired.txt", "dir/expired.txt", "gone.txt"} {
+		if _, ok := inner.data(expiryRecordPath(path)); ok {
+			t.Errorf("expiry record of %s is left", path)
+		}
+	}
+	if _, ok := inner.data(expiryRecordPath("later.txt")); !ok {
+		t.Errorf("expiry record of later.txt was removed")
+	}
+}
+
+func TestSweepExpiredFilesErrors(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	inner := newMemoryPlugin(map[string]string{
+		"bad.txt":                     "data",
+		expiryRecordPath("bad.txt"):   "not json",
+		"worse.txt":                   "data",
+		expiryRecordPath("worse.txt"): "{",
+	})
+	plugin := NewExpiryPlugin(inner, ExpiryOptions{})
+	for i := 0; i < 3; i++ {
+		storeExpiring(t, plugin, fmt.Sprintf("file%d.txt", i), "data", &past)
+	}
+
+	deleted, err := plugin.SweepExpiredFiles(context.Background())
+	checkErrorType(t, err, ptr(StorageErrorType))
+	if !strings.HasPrefix(AsPluginError(err).Message, "2 errors") {
+		t.Errorf("error = %v, want both corrupt records reported", err)
+	}
+	if deleted != 3 {
+		t.Errorf("SweepExpiredFiles() = %d, want 3 deleted past the corrupt records", deleted)
+	}
+	for _, path := range []string{"bad.txt", "worse.txt"} {
+		if _, ok := inner.data(path); !ok {
+			t.Errorf("%s with a corrupt record was deleted", path)
+		}
+		if _, ok := inner.data(expiryRecordPath(path)); !ok {
+			t.Errorf("corrupt record of %s was removed", path)
+		}
+	}
+}
+
+func TestSweepExpiredFilesCancelled(t *testing.T) {
+	plugin := NewExpiryPlugin(newMemoryPlugin(nil), ExpiryOptions{})
+	storeExpiring(t, plugin, "a.txt", "data", ptr(time.Now().Add(-time.Minute)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	deleted, err := plugin.SweepExpiredFiles(ctx)
+	checkErrorType(t, err, ptr(CancelledErrorType))
+	if deleted != 0 || !plugin.FileExists("a.txt") {
+		t.Errorf("cancelled sweep deleted %d files", deleted)
+	}
+}
+
+func TestExpiryCopyMove(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	tests := []struct {
+		name     string
+		transfer func(p *ExpiryPlugin) error
+		// wantSource is the expiry of a.txt afterwards, nil when it doesn't expire or no longer exists
+		wantSource      *time.Time
+		wantDestination *time.Time
+	}{
+		{
+			name:       "copy doesn't expire",
+			transfer:   func(p *ExpiryPlugin) error { return p.CopyFile("a.txt", "b.txt") },
+			wantSource: &expiresAt,
+		},
+		{
+			name:            "move keeps the expiry",
+			transfer:        func(p *ExpiryPlugin) error { return p.MoveFile("a.txt", "b.txt") },
+			wantDestination: &expiresAt,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newMemoryPlugin(nil)
+			plugin := NewExpiryPlugin(inner, ExpiryOptions{})
+			storeExpiring(t, plugin, "a.txt", "data", &expiresAt)
+			// The destination expires as well so the copy has to clear it
+			storeExpiring(t, plugin, "b.txt", "old", ptr(expiresAt.Add(time.Hour)))
+
+			if err := tt.transfer(plugin); err != nil {
+				t.Fatalf("transfer error = %v", err)
+			}
+
+			if data, _ := plugin.RetrieveFile("b.txt"); string(data) != "data" {
+				t.Errorf("destination = %q, want %q", data, "data")
+			}
+			if got := expiryOf(t, plugin, "b.txt"); !equalTimes(got, tt.wantDestination) {
+				t.Errorf("destination expiry = %v, want %v", got, tt.wantDestination)
+			}
+			if tt.wantSource != nil {
+				if got := expiryOf(t, plugin, "a.txt"); !equalTimes(got, tt.wantSource) {
+					t.Errorf("source expiry = %v, want %v", got, tt.wantSource)
+				}
+			} else if _, ok := inner.data(expiryRecordPath("a.txt")); ok {
+				t.Errorf("expiry record of the moved file is left")
+			}
+		})
+	}
+}
+
+func equalTimes(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// uploadsPlugin adds multipart uploads to memoryPlugin, parts are numbered in the order they are uploaded
+// and a completed upload stores all of them
+type uploadsPlugin struct {
+	*memoryPlugin
+	uploads map[string]string
+	parts   map[string][][]byte
+}
+
+func newUploadsPlugin() *uploadsPlugin {
+	return &uploadsPlugin{memoryPlugin: newMemoryPlugin(nil), uploads: make(map[string]string), parts: make(map[string][][]byte)}
+}
+
+func (p *uploadsPlugin) InitiateMultipartUpload(path string, contentType *string) (string, error) {
+	uploadID := fmt.Sprintf("upload-%d", len(p.uploads))
+	p.uploads[uploadID] = path
+	return uploadID, nil
+}
+
+func (p *uploadsPlugin) UploadPart(uploadID string, partNumber int, data []byte) (*UploadedPart, error) {
+	p.parts[uploadID] = append(p.parts[uploadID], data)
+	return &UploadedPart{PartNumber: partNumber, Size: int64(len(data))}, nil
+}
+
+func (p *uploadsPlugin) ListUploadedParts(uploadID string) ([]UploadedPart, error) {
+	parts := make([]UploadedPart, len(p.parts[uploadID]))
+	for i, data := range p.parts[uploadID] {
+		parts[i] = UploadedPart{PartNumber: i + 1, Size: int64(len(data))}
+	}
+	return parts, nil
+}
+
+func (p *uploadsPlugin) CompleteMultipartUpload(uploadID string, parts []UploadedPart) error {
+	path, ok := p.uploads[uploadID]
+	if !ok {
+		return NewNotFoundError(uploadID)
+	}
+	var data []byte
+	for _, part := range p.parts[uploadID] {
+		data = append(data, part...)
+	}
+	delete(p.uploads, uploadID)
+	return p.StoreFile(path, data, nil)
+}
+
+func (p *uploadsPlugin) AbortMultipartUpload(uploadID string) error {
+	delete(p.uploads, uploadID)
+	return nil
+}
+
+func TestExpiryMultipartUpload(t *testing.T) {
+	tests := []struct {
+		name string
+		// reload completes the upload through a new plugin that didn't initiate it
+		reload bool
+		want   bool
+	}{
+		{name: "completed through the same plugin"},
+		// The expiry is only cleared when the upload is initiated
+		{name: "completed after a reload", reload: true, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newUploadsPlugin()
+			plugin := NewExpiryPlugin(inner, ExpiryOptions{})
+			storeExpiring(t, plugin, "a.txt", "old", ptr(time.Now().Add(time.Hour)))
+
+			uploadID, err := plugin.InitiateMultipartUpload("a.txt", nil)
+			if err != nil {
+				t.Fatalf("InitiateMultipartUpload() error = %v", err)
+			}
+			if expiryOf(t, plugin, "a.txt") != nil {
+				t.Errorf("expiry of the replaced file is kept after initiating the upload")
+			}
+			part, _ := plugin.UploadPart(uploadID, 1, []byte("new"))
+
+			// A store with an expiry while the upload is running
+			storeExpiring(t, plugin, "a.txt", "other", ptr(time.Now().Add(time.Hour)))
+
+			if tt.reload {
+				plugin = NewExpiryPlugin(inner, ExpiryOptions{})
+			}
+			if err := plugin.CompleteMultipartUpload(uploadID, []UploadedPart{*part}); err != nil {
+				t.Fatalf("CompleteMultipartUpload() error = %v", err)
+			}
+
+			if data, _ := plugin.RetrieveFile("a.txt"); string(data) != "new" {
+				t.Errorf("content = %q, want %q", data, "new")
+			}
+			if got := expiryOf(t, plugin, "a.txt") != nil; got != tt.want {
+				t.Errorf("uploaded file expires = %v, want %v", got, tt.want)
+			}
+			if len(plugin.multipartPaths) != 0 {
+				t.Errorf("%d uploads are still tracked", len(plugin.multipartPaths))
+			}
+		})
+	}
+}
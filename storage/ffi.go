@@ -13,6 +13,24 @@ typedef struct {
     char* error_msg;
 } FFIResult;
 
+// StorageErrorInfo details the last failed call, see storage_last_error
+typedef struct {
+    int32_t error_code;
+    bool retryable;
+} StorageErrorInfo;
+
+// Each host thread keeps the error of its own last call, like errno
+static __thread StorageErrorInfo last_error;
+
+static inline void set_last_error(int32_t error_code, bool retryable) {
+    last_error.error_code = error_code;
+    last_error.retryable = retryable;
+}
+
+static inline StorageErrorInfo get_last_error(void) {
+    return last_error;
+}
+
 typedef void (*progress_callback_t)(double progress, void* user_data);
 
 static inline void call_progress_callback(uintptr_t callback, double progress, void* user_data) {
@@ -23,9 +41,12 @@ static inline void call_progress_callback(uintptr_t callback, double progress, v
 */
 import "C"
 import (
+	"context"
+	"encoding/json"
 	"runtime"
 	"runtime/debug"
 	"sync"
+	"time"
 	"unsafe"
 	
 	"github.com/matt953/relm-plugin-core-go/config"
@@ -39,6 +60,9 @@ var (
 
 // ReportProgress is exported for plugins to use
 // It reports upload progress from 0.0 to 1.0
+//
+// Deprecated: the callback is shared by all uploads, so concurrent uploads report
+// each other's progress. Implement ProgressStoragePlugin instead.
 func ReportProgress(progress float64) {
 	progressMutex.Lock()
 	defer progressMutex.Unlock()
@@ -89,11 +113,22 @@ func newSuccessResult(data []byte) C.FFIResult {
 		result.data_len = 0
 	}
 	result.error_msg = nil
+	C.set_last_error(C.int32_t(ErrorCodeNone), C.bool(false))
 
 	return result
 }
 
+func newSuccessJSONResult(v interface{}) C.FFIResult {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return newErrorResult("Failed to serialize response: " + err.Error())
+	}
+	return newSuccessResult(data)
+}
+
 func newSuccessEmpty() C.FFIResult {
+	C.set_last_error(C.int32_t(ErrorCodeNone), C.bool(false))
+
 	return C.FFIResult{
 		success:   C.bool(true),
 		data:      nil,
@@ -103,6 +138,20 @@ func newSuccessEmpty() C.FFIResult {
 }
 
 func newErrorResult(errorMsg string) C.FFIResult {
+	return newErrorResultWithCode(errorMsg, ErrorCodeUnknown, false)
+}
+
+// newPluginErrorResult converts a plugin error into an FFI result carrying its error code
+func newPluginErrorResult(err error) C.FFIResult {
+	pluginErr := AsPluginError(err)
+	return newErrorResultWithCode(err.Error(), pluginErr.Code(), pluginErr.Retryable())
+}
+
+func newNoPluginResult() C.FFIResult {
+	return newErrorResultWithCode("No plugin registered", ErrorCodeConfiguration, false)
+}
+
+func newErrorResultWithCode(errorMsg string, code ErrorCode, retryable bool) C.FFIResult {
 	var error_msg *C.char
 	if errorMsg != "" {
 		error_msg = C.CString(errorMsg)
@@ -110,6 +159,9 @@ func newErrorResult(errorMsg string) C.FFIResult {
 		error_msg = nil
 	}
 
+	// cgo runs exported functions on the calling thread, so the error is recorded for the host thread that made the call
+	C.set_last_error(C.int32_t(code), C.bool(retryable))
+
 	return C.FFIResult{
 		success:   C.bool(false),
 		data:      nil,
@@ -120,6 +172,14 @@ func newErrorResult(errorMsg string) C.FFIResult {
 
 // FFI export functions that will be called from Rust
 
+// storage_last_error returns the error code and retryable flag of the last call made on
+// the calling thread, the code is 0 when that call succeeded
+//
+//export storage_last_error
+func storage_last_error() C.StorageErrorInfo {
+	return C.get_last_error()
+}
+
 //export store_file_with_content_type
 func store_file_with_content_type(
 	path *C.char,
@@ -131,10 +191,13 @@ func store_file_with_content_type(
 ) C.FFIResult {
 	plugin := GetRegisteredPlugin()
 	if plugin == nil {
-		return newErrorResult("No plugin registered")
+		return newNoPluginResult()
 	}
 
-	goPath := goString(path)
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
 	goData := goBytes(data, length)
 
 	var goContentType *string
@@ -143,138 +206,1157 @@ func store_file_with_content_type(
 		goContentType = &ct
 	}
 
-	// Set up progress callback if provided
+	var progress ProgressFunc
 	if progressCallback != 0 {
-		progressMutex.Lock()
-		currentProgressCallback = func(progress float64) {
-			C.call_progress_callback(C.uintptr_t(progressCallback), C.double(progress), userData)
+		progress = func(p float64) {
+			C.call_progress_callback(C.uintptr_t(progressCallback), C.double(p), userData)
 		}
-		progressMutex.Unlock()
-		
-		defer func() {
-			progressMutex.Lock()
-			currentProgressCallback = nil
-			progressMutex.Unlock()
-		}()
 	}
 
-	err := plugin.StoreFile(goPath, goData, goContentType)
+	goContentType, err = prepareStore(goPath, goData, goContentType)
 	if err != nil {
-		return newErrorResult(err.Error())
+		return newPluginErrorResult(err)
+	}
+
+	err = storeFile(context.Background(), plugin, goPath, goData, goContentType, progress)
+	if err != nil {
+		return newPluginErrorResult(err)
 	}
 
 	return newSuccessEmpty()
 }
 
+// Cancellable operations: the host picks a unique operation ID per call and can
+// abort the call with cancel_operation, a timeout of 0 means no deadline
 
-//export retrieve_file
-func retrieve_file(path *C.char) C.FFIResult {
+//export store_file_with_operation
+func store_file_with_operation(
+	operationID *C.char,
+	path *C.char,
+	data *C.uint8_t,
+	length C.size_t,
+	contentType *C.char,
+	timeoutMs C.uint64_t,
+	progressCallback C.uintptr_t,
+	userData unsafe.Pointer,
+) C.FFIResult {
 	plugin := GetRegisteredPlugin()
 	if plugin == nil {
-		return newErrorResult("No plugin registered")
+		return newNoPluginResult()
 	}
 
-	goPath := goString(path)
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
 
-	data, err := plugin.RetrieveFile(goPath)
+	ctx, finish, err := beginOperation(goString(operationID), time.Duration(timeoutMs)*time.Millisecond)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+	defer finish()
+
+	goData := goBytes(data, length)
+
+	var goContentType *string
+	if contentType != nil {
+		ct := goString(contentType)
+		goContentType = &ct
+	}
+
+	var progress ProgressFunc
+	if progressCallback != 0 {
+		progress = func(p float64) {
+			C.call_progress_callback(C.uintptr_t(progressCallback), C.double(p), userData)
+		}
+	}
+
+	goContentType, err = prepareStore(goPath, goData, goContentType)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	err = storeFile(ctx, plugin, goPath, goData, goContentType, progress)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessEmpty()
+}
+
+// store_file_with_options takes the StoreOptions as JSON, the operation ID and timeout work like store_file_with_operation
+//
+//export store_file_with_options
+func store_file_with_options(
+	operationID *C.char,
+	path *C.char,
+	data *C.uint8_t,
+	length C.size_t,
+	optionsJson *C.char,
+	timeoutMs C.uint64_t,
+	progressCallback C.uintptr_t,
+	userData unsafe.Pointer,
+) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	options, err := parseStoreOptions(goString(optionsJson))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	ctx, finish, err := beginOperation(goString(operationID), time.Duration(timeoutMs)*time.Millisecond)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+	defer finish()
+
+	goData := goBytes(data, length)
+
+	var progress ProgressFunc
+	if progressCallback != 0 {
+		progress = func(p float64) {
+			C.call_progress_callback(C.uintptr_t(progressCallback), C.double(p), userData)
+		}
+	}
+
+	options.ContentType, err = prepareStore(goPath, goData, options.ContentType)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	err = storeFileWithOptions(ctx, plugin, goPath, goData, options, progress)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessEmpty()
+}
+
+//export retrieve_file_with_operation
+func retrieve_file_with_operation(operationID *C.char, path *C.char, timeoutMs C.uint64_t) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	ctx, finish, err := beginOperation(goString(operationID), time.Duration(timeoutMs)*time.Millisecond)
 	if err != nil {
-		return newErrorResult(err.Error())
+		return newPluginErrorResult(err)
+	}
+	defer finish()
+
+	data, err := retrieveFile(ctx, plugin, goPath)
+	if err != nil {
+		return newPluginErrorResult(err)
 	}
 
 	return newSuccessResult(data)
 }
 
-//export delete_file
-func delete_file(path *C.char) C.FFIResult {
+//export delete_file_with_operation
+func delete_file_with_operation(operationID *C.char, path *C.char, timeoutMs C.uint64_t) C.FFIResult {
 	plugin := GetRegisteredPlugin()
 	if plugin == nil {
-		return newErrorResult("No plugin registered")
+		return newNoPluginResult()
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
 	}
 
-	goPath := goString(path)
+	ctx, finish, err := beginOperation(goString(operationID), time.Duration(timeoutMs)*time.Millisecond)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+	defer finish()
 
-	err := plugin.DeleteFile(goPath)
+	err = deleteFile(ctx, plugin, goPath)
 	if err != nil {
-		return newErrorResult(err.Error())
+		return newPluginErrorResult(err)
 	}
 
 	return newSuccessEmpty()
 }
 
-//export file_exists
-func file_exists(path *C.char) C.bool {
+//export file_exists_with_operation
+func file_exists_with_operation(operationID *C.char, path *C.char, timeoutMs C.uint64_t) C.FFIResult {
 	plugin := GetRegisteredPlugin()
 	if plugin == nil {
-		return C.bool(false)
+		return newNoPluginResult()
 	}
 
-	goPath := goString(path)
-	exists := plugin.FileExists(goPath)
-	return C.bool(exists)
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	ctx, finish, err := beginOperation(goString(operationID), time.Duration(timeoutMs)*time.Millisecond)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+	defer finish()
+
+	exists, err := fileExists(ctx, plugin, goPath)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessJSONResult(exists)
 }
 
-//export generate_file_url
-func generate_file_url(path *C.char, baseURL *C.char) *C.char {
+//export cancel_operation
+func cancel_operation(operationID *C.char) C.bool {
+	return C.bool(cancelOperation(goString(operationID)))
+}
+
+// Streaming uploads: open_upload returns an upload ID, the host then pushes the
+// data with write_upload_chunk (in order) and finishes with commit_upload or abort_upload
+
+//export open_upload
+func open_upload(path *C.char, contentType *C.char) C.FFIResult {
 	plugin := GetRegisteredPlugin()
 	if plugin == nil {
-		return nil
+		return newNoPluginResult()
 	}
 
-	goPath := goString(path)
-	goBaseURL := goString(baseURL)
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
 
-	url := plugin.GenerateURL(goPath, goBaseURL)
-	if url == nil {
-		return nil
+	var goContentType *string
+	if contentType != nil {
+		ct := goString(contentType)
+		goContentType = &ct
 	}
 
-	return cString(*url)
+	uploadID, err := openUpload(plugin, goPath, goContentType)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessResult([]byte(uploadID))
 }
 
-//export provider_name
-func provider_name() *C.char {
+// open_upload_with_options takes the StoreOptions as JSON, the checksum and conditions are checked on commit
+//
+//export open_upload_with_options
+func open_upload_with_options(path *C.char, optionsJson *C.char) C.FFIResult {
 	plugin := GetRegisteredPlugin()
 	if plugin == nil {
-		return cString("Unknown Go Plugin")
+		return newNoPluginResult()
 	}
 
-	name := plugin.ProviderName()
-	return cString(name)
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	options, err := parseStoreOptions(goString(optionsJson))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	uploadID, err := openUploadWithOptions(plugin, goPath, options)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessResult([]byte(uploadID))
 }
 
-//export initialize_with_config
-func initialize_with_config(configJson *C.char) C.bool {
-	configStr := goString(configJson)
-	
-	// Set the global config
-	if err := config.SetConfigFromJSON(configStr); err != nil {
-		println("initialize_with_config: failed to set global config:", err.Error())
+//export write_upload_chunk
+func write_upload_chunk(uploadID *C.char, data *C.uint8_t, length C.size_t) C.FFIResult {
+	writer, ok := getUpload(goString(uploadID))
+	if !ok {
+		return newPluginErrorResult(NewNotFoundError("Unknown upload ID"))
+	}
+
+	if err := writer.WriteChunk(goBytes(data, length)); err != nil {
+		// A failed chunk leaves the upload incomplete, so it can't be committed any more
+		discardUpload(goString(uploadID))
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessEmpty()
+}
+
+//export commit_upload
+func commit_upload(uploadID *C.char) C.FFIResult {
+	writer, ok := takeUpload(goString(uploadID))
+	if !ok {
+		return newPluginErrorResult(NewNotFoundError("Unknown upload ID"))
+	}
+
+	if err := writer.Commit(); err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessEmpty()
+}
+
+//export abort_upload
+func abort_upload(uploadID *C.char) C.FFIResult {
+	writer, ok := takeUpload(goString(uploadID))
+	if !ok {
+		return newPluginErrorResult(NewNotFoundError("Unknown upload ID"))
+	}
+
+	if err := writer.Abort(); err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessEmpty()
+}
+
+//export supports_streaming_upload
+func supports_streaming_upload() C.bool {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
 		return C.bool(false)
 	}
-	
-	// Plugin initialization - verify we have a registered plugin
+
+	return C.bool(implements[StreamingStoragePlugin](plugin))
+}
+
+// Multipart uploads: unlike streaming uploads, multipart state is kept by the
+// backend so the host can resume an interrupted upload with list_uploaded_parts
+
+//export initiate_multipart_upload
+func initiate_multipart_upload(path *C.char, contentType *C.char) C.FFIResult {
 	plugin := GetRegisteredPlugin()
-	return C.bool(plugin != nil)
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	multipart, err := multipartPlugin(plugin)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	var goContentType *string
+	if contentType != nil {
+		ct := goString(contentType)
+		goContentType = &ct
+	}
+
+	if err := checkMultipartUpload(goPath, goContentType); err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	uploadID, err := multipart.InitiateMultipartUpload(goPath, goContentType)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+	trackMultipartUpload(uploadID, goPath, goContentType)
+
+	return newSuccessJSONResult(MultipartUpload{UploadID: uploadID, Path: goPath})
 }
 
-//export init_plugin
-func init_plugin() C.bool {
-	// Plugin initialization - just verify we have a registered plugin
+//export upload_part
+func upload_part(uploadID *C.char, partNumber C.uint32_t, data *C.uint8_t, length C.size_t) C.FFIResult {
 	plugin := GetRegisteredPlugin()
-	return C.bool(plugin != nil)
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	multipart, err := multipartPlugin(plugin)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	if err := validatePartNumber(int(partNumber)); err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	goUploadID := goString(uploadID)
+	goData := goBytes(data, length)
+	if err := checkMultipartPart(goUploadID, int(partNumber), goData); err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	part, err := multipart.UploadPart(goUploadID, int(partNumber), goData)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessJSONResult(part)
 }
 
-//export cleanup_plugin
-func cleanup_plugin() C.bool {
-	// Add debug logging to see if this is being called
-	println("cleanup_plugin called")
+//export list_uploaded_parts
+func list_uploaded_parts(uploadID *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	multipart, err := multipartPlugin(plugin)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	parts, err := multipart.ListUploadedParts(goString(uploadID))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+	if parts == nil {
+		parts = []UploadedPart{}
+	}
+
+	return newSuccessJSONResult(parts)
+}
 
+//export complete_multipart_upload
+func complete_multipart_upload(uploadID *C.char, partsJson *C.char) C.FFIResult {
 	plugin := GetRegisteredPlugin()
 	if plugin == nil {
-		println("cleanup_plugin: no plugin registered")
-		return C.bool(false)
+		return newNoPluginResult()
 	}
 
+	multipart, err := multipartPlugin(plugin)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	parts, err := parsePartManifest(goString(partsJson))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	goUploadID := goString(uploadID)
+	if err := checkMultipartCompletion(multipart, goUploadID, parts); err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	if err := multipart.CompleteMultipartUpload(goUploadID, parts); err != nil {
+		return newPluginErrorResult(err)
+	}
+	forgetMultipartUpload(goUploadID)
+
+	return newSuccessEmpty()
+}
+
+//export abort_multipart_upload
+func abort_multipart_upload(uploadID *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	multipart, err := multipartPlugin(plugin)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	goUploadID := goString(uploadID)
+	if err := multipart.AbortMultipartUpload(goUploadID); err != nil {
+		return newPluginErrorResult(err)
+	}
+	forgetMultipartUpload(goUploadID)
+
+	return newSuccessEmpty()
+}
+
+//export supports_multipart_upload
+func supports_multipart_upload() C.bool {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return C.bool(false)
+	}
+
+	return C.bool(implements[MultipartStoragePlugin](plugin))
+}
+
+//export list_file_versions
+func list_file_versions(path *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	versioning, err := versioningPlugin(plugin)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	versions, err := versioning.ListVersions(goPath)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+	if versions == nil {
+		versions = []FileVersion{}
+	}
+
+	return newSuccessJSONResult(versions)
+}
+
+//export retrieve_file_version
+func retrieve_file_version(path *C.char, versionID *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	versioning, err := versioningPlugin(plugin)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	data, err := versioning.RetrieveVersion(goPath, goString(versionID))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessResult(data)
+}
+
+//export restore_file_version
+func restore_file_version(path *C.char, versionID *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	versioning, err := versioningPlugin(plugin)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	goVersionID := goString(versionID)
+	if err := checkRestore(versioning, goPath, goVersionID); err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	if err := versioning.RestoreVersion(goPath, goVersionID); err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessEmpty()
+}
+
+//export delete_file_version
+func delete_file_version(path *C.char, versionID *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	versioning, err := versioningPlugin(plugin)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	if err := versioning.DeleteVersion(goPath, goString(versionID)); err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessEmpty()
+}
+
+//export purge_expired_versions
+func purge_expired_versions() C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	versioning, err := versioningPlugin(plugin)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	purged, err := versioning.PurgeExpiredVersions()
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessJSONResult(map[string]int{"purged": purged})
+}
+
+//export supports_versioning
+func supports_versioning() C.bool {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return C.bool(false)
+	}
+
+	return C.bool(implements[VersioningStoragePlugin](plugin))
+}
+
+//export sweep_expired_files
+func sweep_expired_files() C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	lifecycle, err := lifecyclePlugin(plugin)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	deleted, err := lifecycle.SweepExpiredFiles(context.Background())
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessJSONResult(map[string]int{"deleted": deleted})
+}
+
+//export supports_expiry
+func supports_expiry() C.bool {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return C.bool(false)
+	}
+
+	return C.bool(implements[LifecycleStoragePlugin](plugin))
+}
+
+//export get_storage_usage
+func get_storage_usage(scope *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	quota, err := quotaPlugin(plugin)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	usage, err := quota.Usage(goString(scope))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessJSONResult(usage)
+}
+
+//export get_storage_usage_report
+func get_storage_usage_report() C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	quota, err := quotaPlugin(plugin)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	report, err := quota.UsageReport()
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+	if report == nil {
+		report = []Usage{}
+	}
+
+	return newSuccessJSONResult(report)
+}
+
+//export set_storage_quota
+func set_storage_quota(scope *C.char, quotaJson *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	quotas, err := quotaPlugin(plugin)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	quota, err := parseQuota(goString(quotaJson))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	if err := quotas.SetQuota(goString(scope), quota); err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessEmpty()
+}
+
+//export supports_quota
+func supports_quota() C.bool {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return C.bool(false)
+	}
+
+	return C.bool(implements[QuotaStoragePlugin](plugin))
+}
+
+//export retrieve_file
+func retrieve_file(path *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	data, err := plugin.RetrieveFile(goPath)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessResult(data)
+}
+
+// retrieve_file_verified fails with a checksum mismatch if the content no longer matches the recorded checksum
+//
+//export retrieve_file_verified
+func retrieve_file_verified(path *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	data, err := retrieveFileVerified(context.Background(), plugin, goPath)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessResult(data)
+}
+
+//export retrieve_file_with_metadata
+func retrieve_file_with_metadata(path *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	data, metadata, err := retrieveFileWithMetadata(context.Background(), plugin, goPath)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	frame, err := frameWithMetadata(metadata, data)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessResult(frame)
+}
+
+//export file_size
+func file_size(path *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	size, err := fileSize(plugin, goPath)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessJSONResult(size)
+}
+
+// retrieve_file_range reads length bytes starting at offset, a length of 0 reads to the end of the file
+//
+//export retrieve_file_range
+func retrieve_file_range(path *C.char, offset C.uint64_t, length C.uint64_t) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	data, err := retrieveRange(plugin, goPath, int64(offset), int64(length))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessResult(data)
+}
+
+//export supports_ranged_read
+func supports_ranged_read() C.bool {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return C.bool(false)
+	}
+
+	return C.bool(implements[RangedStoragePlugin](plugin))
+}
+
+//export stat_file
+func stat_file(path *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	metadata, err := statFile(plugin, goPath)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessJSONResult(metadata)
+}
+
+//export supports_stat
+func supports_stat() C.bool {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return C.bool(false)
+	}
+
+	return C.bool(implements[StatStoragePlugin](plugin))
+}
+
+//export list_files
+func list_files(prefix *C.char, cursor *C.char, limit C.uint32_t) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	goPrefix, err := ValidatePrefix(goString(prefix))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	result, err := listFiles(plugin, goPrefix, goString(cursor), int(limit))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessJSONResult(result)
+}
+
+//export supports_listing
+func supports_listing() C.bool {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return C.bool(false)
+	}
+
+	return C.bool(implements[ListingStoragePlugin](plugin))
+}
+
+//export delete_file
+func delete_file(path *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	err = plugin.DeleteFile(goPath)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessEmpty()
+}
+
+//export delete_files
+func delete_files(pathsJson *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	paths, err := parsePathList(goString(pathsJson))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	results, err := deleteFiles(plugin, paths)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessJSONResult(results)
+}
+
+//export copy_file
+func copy_file(sourcePath *C.char, destinationPath *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	goSourcePath, err := ValidatePath(goString(sourcePath))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+	goDestinationPath, err := ValidatePath(goString(destinationPath))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	if err := checkTransfer(plugin, goSourcePath, goDestinationPath); err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	err = copyFile(plugin, goSourcePath, goDestinationPath)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessEmpty()
+}
+
+//export move_file
+func move_file(sourcePath *C.char, destinationPath *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	goSourcePath, err := ValidatePath(goString(sourcePath))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+	goDestinationPath, err := ValidatePath(goString(destinationPath))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	if err := checkTransfer(plugin, goSourcePath, goDestinationPath); err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	err = moveFile(plugin, goSourcePath, goDestinationPath)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessEmpty()
+}
+
+//export file_exists
+func file_exists(path *C.char) C.bool {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return C.bool(false)
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return C.bool(false)
+	}
+
+	exists := plugin.FileExists(goPath)
+	return C.bool(exists)
+}
+
+//export files_exist
+func files_exist(pathsJson *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	paths, err := parsePathList(goString(pathsJson))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	results, err := filesExist(plugin, paths)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessJSONResult(results)
+}
+
+//export generate_file_url
+func generate_file_url(path *C.char, baseURL *C.char) *C.char {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return nil
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return nil
+	}
+	goBaseURL := goString(baseURL)
+
+	url := plugin.GenerateURL(goPath, goBaseURL)
+	if url == nil {
+		return nil
+	}
+
+	return cString(*url)
+}
+
+//export generate_signed_url
+func generate_signed_url(path *C.char, optionsJson *C.char) C.FFIResult {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return newNoPluginResult()
+	}
+
+	goPath, err := ValidatePath(goString(path))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	options, err := parseURLOptions(goString(optionsJson))
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	signedURL, err := generateSignedURL(plugin, goPath, options)
+	if err != nil {
+		return newPluginErrorResult(err)
+	}
+
+	return newSuccessJSONResult(signedURL)
+}
+
+//export supports_signed_url
+func supports_signed_url() C.bool {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return C.bool(false)
+	}
+
+	return C.bool(implements[SignedURLStoragePlugin](plugin))
+}
+
+//export provider_name
+func provider_name() *C.char {
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		return cString("Unknown Go Plugin")
+	}
+
+	name := plugin.ProviderName()
+	return cString(name)
+}
+
+//export initialize_with_config
+func initialize_with_config(configJson *C.char) C.bool {
+	configStr := goString(configJson)
+	
+	// Set the global config
+	if err := config.SetConfigFromJSON(configStr); err != nil {
+		println("initialize_with_config: failed to set global config:", err.Error())
+		return C.bool(false)
+	}
+
+	rules, err := PathRulesFromConfig()
+	if err != nil {
+		println("initialize_with_config: invalid path rules:", err.Error())
+		return C.bool(false)
+	}
+	SetPathRules(rules)
+
+	policy, err := UploadPolicyFromConfig()
+	if err != nil {
+		println("initialize_with_config: invalid upload policy:", err.Error())
+		return C.bool(false)
+	}
+	SetUploadPolicy(policy)
+	
+	// Plugin initialization - verify we have a registered plugin
+	plugin := GetRegisteredPlugin()
+	return C.bool(plugin != nil)
+}
+
+//export init_plugin
+func init_plugin() C.bool {
+	// Plugin initialization - just verify we have a registered plugin
+	plugin := GetRegisteredPlugin()
+	return C.bool(plugin != nil)
+}
+
+//export cleanup_plugin
+func cleanup_plugin() C.bool {
+	// Add debug logging to see if this is being called
+	println("cleanup_plugin called")
+
+	plugin := GetRegisteredPlugin()
+	if plugin == nil {
+		println("cleanup_plugin: no plugin registered")
+		return C.bool(false)
+	}
+
+	cancelAllOperations()
+	abortAllUploads()
+
 	err := plugin.Cleanup()
 	if err != nil {
 		println("cleanup_plugin: plugin cleanup failed:", err.Error())
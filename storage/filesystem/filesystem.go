@@ -0,0 +1,515 @@
+// Package filesystem provides a storage plugin that keeps files on the local disk
+//
+// It is meant for development and single-node deployments and can be exported as-is:
+//
+//	func main() {
+//	    storage.ExportPlugin(filesystem.New(""))
+//	}
+//
+// With an empty root directory, the "root_dir" plugin config value is used.
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/matt953/relm-plugin-core-go/config"
+	"github.com/matt953/relm-plugin-core-go/storage"
+)
+
+// RootDirConfigKey is the plugin config key holding the root directory
+const RootDirConfigKey = "root_dir"
+
+// Plugin stores files below a root directory on the local filesystem
+//
+// Writes go to a temp file that is renamed into place, so readers never see partial files.
+// Content types and custom metadata are kept in JSON sidecars under the reserved .relm directory.
+type Plugin struct {
+	root string
+
+	// locks serializes the writes to each path so conditional writes are atomic
+	locks storage.PathMutex
+}
+
+// sidecar is the metadata stored next to each file
+type sidecar struct {
+	ContentType *string           `json:"content_type,omitempty"`
+	Checksum    *storage.Checksum `json:"checksum,omitempty"`
+
+	// ETag is the quoted SHA-256 of the content, computed on write
+	ETag *string `json:"etag,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Size and ModTime identify the data file the sidecar was written for, so a sidecar left
+	// behind by an interrupted write isn't applied to the file that replaced it
+	Size    *int64 `json:"size,omitempty"`
+	ModTime *int64 `json:"mod_time,omitempty"`
+}
+
+// describes reports whether the sidecar was written for the data file with the given info
+// Sidecars written before Size and ModTime were recorded are trusted
+func (s sidecar) describes(info fs.FileInfo) bool {
+	if s.Size == nil || s.ModTime == nil {
+		return true
+	}
+	return *s.Size == info.Size() && *s.ModTime == info.ModTime().UnixNano()
+}
+
+// empty reports whether there is nothing worth storing in the sidecar
+func (s sidecar) empty() bool {
+	return s.ContentType == nil && s.Checksum == nil && s.ETag == nil && len(s.Metadata) == 0
+}
+
+// New creates a filesystem plugin rooted at rootDir
+// An empty rootDir is resolved from the "root_dir" plugin config value when the plugin is used
+func New(rootDir string) *Plugin {
+	return &Plugin{root: rootDir}
+}
+
+// rootDir returns the absolute root directory of the plugin
+func (p *Plugin) rootDir() (string, error) {
+	root := p.root
+	if root == "" {
+		value, ok := config.GetPluginConfigValue(RootDirConfigKey)
+		if !ok || value == "" {
+			return "", storage.NewConfigurationError("missing plugin config value: " + RootDirConfigKey)
+		}
+		root = value
+	}
+
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", storage.NewConfigurationError("invalid root directory: " + err.Error())
+	}
+	return abs, nil
+}
+
+// StoreFile stores data at the specified path with optional content type
+func (p *Plugin) StoreFile(path string, data []byte, contentType *string) error {
+	writer, err := p.OpenUpload(path, contentType)
+	if err != nil {
+		return err
+	}
+	if err := writer.WriteChunk(data); err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Commit()
+}
+
+// RetrieveFile retrieves file data from the specified path
+func (p *Plugin) RetrieveFile(path string) ([]byte, error) {
+	full, err := p.filePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(full)
+	if err != nil {
+		return nil, fileError(path, err)
+	}
+	return data, nil
+}
+
+// DeleteFile deletes the file at the specified path
+func (p *Plugin) DeleteFile(path string) error {
+	full, err := p.filePath(path)
+	if err != nil {
+		return err
+	}
+
+	cleaned, _ := cleanPath(path)
+	unlock := p.locks.Lock(cleaned)
+	defer unlock()
+
+	if err := os.Remove(full); err != nil {
+		return fileError(path, err)
+	}
+
+	root, _ := p.rootDir()
+	removeEmptyParents(root, full)
+
+	if meta, err := p.sidecarPath(path); err == nil {
+		if os.Remove(meta) == nil {
+			removeEmptyParents(filepath.Join(root, internalDir, "meta"), meta)
+		}
+	}
+	return nil
+}
+
+// FileExists checks if a file exists at the specified path
+func (p *Plugin) FileExists(path string) bool {
+	full, err := p.filePath(path)
+	if err != nil {
+		return false
+	}
+
+	info, err := os.Stat(full)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// GenerateURL joins the path onto the host's base URL
+// Returns nil if no base URL is given since local files have no public address of their own
+func (p *Plugin) GenerateURL(path string, baseURL string) *string {
+	cleaned, err := cleanPath(path)
+	if err != nil || baseURL == "" {
+		return nil
+	}
+
+	url := strings.TrimRight(baseURL, "/") + "/" + cleaned
+	return &url
+}
+
+// ProviderName returns a human-readable name for this storage provider
+func (p *Plugin) ProviderName() string {
+	return "Local Filesystem"
+}
+
+// Cleanup performs any necessary cleanup when the plugin is being unloaded
+func (p *Plugin) Cleanup() error {
+	return nil
+}
+
+// StoreFileWithOptions stores data and records the content type, checksum and custom metadata in the sidecar
+// Conditions are checked under the path lock right before the file is moved into place
+func (p *Plugin) StoreFileWithOptions(ctx context.Context, path string, data []byte, options storage.StoreOptions) error {
+	writer, err := p.openUpload(path, sidecar{ContentType: options.ContentType, Checksum: options.Checksum, Metadata: options.Metadata})
+	if err != nil {
+		return err
+	}
+
+	if options.IfMatch != nil || options.IfNoneMatch != nil {
+		writer.check = func() error {
+			current, err := p.StatFile(writer.path)
+			if storage.IsNotFound(err) {
+				current, err = nil, nil
+			}
+			if err != nil {
+				return err
+			}
+			return storage.CheckPreconditions(current, options)
+		}
+	}
+	if err := writer.WriteChunk(data); err != nil {
+		writer.Abort()
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		writer.Abort()
+		return err
+	}
+	if err := writer.Commit(); err != nil {
+		return err
+	}
+
+	storage.ProgressFromContext(ctx)(1.0)
+	return nil
+}
+
+// OpenUpload starts a streaming upload into a temp file that is renamed into place on commit
+func (p *Plugin) OpenUpload(path string, contentType *string) (storage.UploadWriter, error) {
+	return p.openUpload(path, sidecar{ContentType: contentType})
+}
+
+// openUpload starts an upload that stores meta in the sidecar on commit
+func (p *Plugin) openUpload(path string, meta sidecar) (*upload, error) {
+	full, err := p.filePath(path)
+	if err != nil {
+		return nil, err
+	}
+	cleaned, _ := cleanPath(path)
+
+	tempDir, err := p.tempDir()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(tempDir, "upload-*")
+	if err != nil {
+		return nil, storage.NewStorageError("failed to create temp file: " + err.Error())
+	}
+
+	return &upload{
+		plugin: p,
+		path:   cleaned,
+		target: full,
+		file:   file,
+		hash:   newUploadHash(),
+		meta:   meta,
+	}, nil
+}
+
+// FileSize returns the size in bytes of the file at the specified path
+func (p *Plugin) FileSize(path string) (int64, error) {
+	info, err := p.statRegular(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// RetrieveRange retrieves up to length bytes starting at offset
+func (p *Plugin) RetrieveRange(path string, offset int64, length int64) ([]byte, error) {
+	full, err := p.filePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(full)
+	if err != nil {
+		return nil, fileError(path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fileError(path, err)
+	}
+	if offset > info.Size() {
+		return nil, storage.NewInvalidInputError(fmt.Sprintf("offset %d is beyond the end of the file (%d bytes)", offset, info.Size()))
+	}
+	if remaining := info.Size() - offset; length > remaining {
+		length = remaining
+	}
+
+	data := make([]byte, length)
+	n, err := file.ReadAt(data, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fileError(path, err)
+	}
+	return data[:n], nil
+}
+
+// StatFile returns the metadata of the file at the specified path
+func (p *Plugin) StatFile(path string) (*storage.FileMetadata, error) {
+	info, err := p.statRegular(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cleaned, _ := cleanPath(path)
+	return p.metadata(cleaned, info), nil
+}
+
+// CopyFile copies the file and its sidecar to destinationPath
+func (p *Plugin) CopyFile(sourcePath string, destinationPath string) error {
+	source, err := p.filePath(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(source)
+	if err != nil {
+		return fileError(sourcePath, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fileError(sourcePath, err)
+	}
+
+	writer, err := p.openUpload(destinationPath, p.fileSidecar(sourcePath, info))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(writer, file); err != nil {
+		writer.Abort()
+		return storage.NewStorageError("failed to copy file: " + err.Error())
+	}
+	return writer.Commit()
+}
+
+// MoveFile renames the file and its sidecar to destinationPath
+func (p *Plugin) MoveFile(sourcePath string, destinationPath string) error {
+	source, err := p.filePath(sourcePath)
+	if err != nil {
+		return err
+	}
+	destination, err := p.filePath(destinationPath)
+	if err != nil {
+		return err
+	}
+	if source == destination {
+		return storage.NewInvalidInputError("source and destination paths are the same")
+	}
+
+	sourceKey, _ := cleanPath(sourcePath)
+	destinationKey, _ := cleanPath(destinationPath)
+	unlock := p.locks.LockPair(sourceKey, destinationKey)
+	defer unlock()
+
+	if _, err := p.statRegular(sourcePath); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destination), 0o755); err != nil {
+		return storage.NewStorageError("failed to create directory: " + err.Error())
+	}
+	if err := os.Rename(source, destination); err != nil {
+		return fileError(sourcePath, err)
+	}
+
+	root, _ := p.rootDir()
+	removeEmptyParents(root, source)
+
+	meta := p.readSidecar(sourcePath)
+	if err := p.writeSidecar(destinationPath, meta); err != nil {
+		return err
+	}
+	if sourceMeta, err := p.sidecarPath(sourcePath); err == nil {
+		os.Remove(sourceMeta)
+	}
+	return nil
+}
+
+// statRegular stats a stored file and rejects anything that isn't a regular file
+func (p *Plugin) statRegular(path string) (fs.FileInfo, error) {
+	full, err := p.filePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(full)
+	if err != nil {
+		return nil, fileError(path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, storage.NewNotFoundError(path)
+	}
+	return info, nil
+}
+
+// metadata builds the FileMetadata of a stored file
+func (p *Plugin) metadata(path string, info fs.FileInfo) *storage.FileMetadata {
+	modified := info.ModTime().UTC()
+	meta := p.fileSidecar(path, info)
+
+	// Files written before ETags were recorded fall back to modification time and size
+	etag := fmt.Sprintf("\"%x-%x\"", modified.UnixNano(), info.Size())
+	if meta.ETag != nil {
+		etag = *meta.ETag
+	}
+
+	return &storage.FileMetadata{
+		Path:         path,
+		Size:         info.Size(),
+		ContentType:  meta.ContentType,
+		ETag:         &etag,
+		LastModified: &modified,
+		Checksum:     meta.Checksum,
+		Metadata:     meta.Metadata,
+	}
+}
+
+// readSidecar returns the stored metadata of a file, empty if there is none
+func (p *Plugin) readSidecar(path string) sidecar {
+	var meta sidecar
+
+	location, err := p.sidecarPath(path)
+	if err != nil {
+		return meta
+	}
+
+	data, err := os.ReadFile(location)
+	if err != nil {
+		return meta
+	}
+	json.Unmarshal(data, &meta)
+	return meta
+}
+
+// fileSidecar returns the stored metadata of the data file with the given info
+// It is empty when the sidecar belongs to an earlier version of the file whose replacement was interrupted
+func (p *Plugin) fileSidecar(path string, info fs.FileInfo) sidecar {
+	meta := p.readSidecar(path)
+	if !meta.describes(info) {
+		return sidecar{}
+	}
+	return meta
+}
+
+// writeSidecar atomically replaces the stored metadata of a file
+// An empty sidecar removes the file
+func (p *Plugin) writeSidecar(path string, meta sidecar) error {
+	location, err := p.sidecarPath(path)
+	if err != nil {
+		return err
+	}
+
+	if meta.empty() {
+		if err := os.Remove(location); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return storage.NewStorageError("failed to remove metadata: " + err.Error())
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return storage.NewStorageError("failed to encode metadata: " + err.Error())
+	}
+	return p.writeAtomic(location, data)
+}
+
+// writeAtomic writes data to a temp file and renames it to location
+func (p *Plugin) writeAtomic(location string, data []byte) error {
+	temp, err := p.writeTemp(data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp)
+
+	return renameInto(temp, location)
+}
+
+// writeTemp writes data to a new temp file and returns its name
+func (p *Plugin) writeTemp(data []byte) (string, error) {
+	tempDir, err := p.tempDir()
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp(tempDir, "write-*")
+	if err != nil {
+		return "", storage.NewStorageError("failed to create temp file: " + err.Error())
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", storage.NewStorageError("failed to write file: " + err.Error())
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", storage.NewStorageError("failed to write file: " + err.Error())
+	}
+	return file.Name(), nil
+}
+
+// renameInto moves a temp file to location, creating its directory
+func renameInto(temp string, location string) error {
+	if err := os.MkdirAll(filepath.Dir(location), 0o755); err != nil {
+		return storage.NewStorageError("failed to create directory: " + err.Error())
+	}
+	if err := os.Rename(temp, location); err != nil {
+		return storage.NewStorageError("failed to write file: " + err.Error())
+	}
+	return nil
+}
+
+// fileError converts an os error into a PluginError
+func fileError(path string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return storage.NewNotFoundError(path)
+	}
+	return storage.NewStorageError(err.Error())
+}
@@ -0,0 +1,495 @@
+package filesystem
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matt953/relm-plugin-core-go/storage"
+)
+
+// ptr returns a pointer to v, for the optional fields of test cases
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// contentETag returns the ETag of a file written with data
+func contentETag(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return "\"" + hex.EncodeToString(sum[:]) + "\""
+}
+
+// sidecarExists reports whether the sidecar of path is on disk
+func sidecarExists(t *testing.T, p *Plugin, path string) bool {
+	t.Helper()
+
+	location, err := p.sidecarPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(location)
+	return err == nil
+}
+
+func TestSidecar(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(p *Plugin) error
+		path  string
+		// data is the content of path afterwards, contentType and metadata its recorded metadata
+		data        string
+		contentType *string
+		metadata    map[string]string
+		// removed is a path whose file and sidecar must be gone afterwards
+		removed string
+	}{
+		{
+			name:        "store",
+			write:       func(p *Plugin) error { return p.StoreFile("b", []byte("new"), ptr("text/plain")) },
+			path:        "b",
+			data:        "new",
+			contentType: ptr("text/plain"),
+		},
+		{
+			name: "store with options",
+			write: func(p *Plugin) error {
+				options := storage.StoreOptions{ContentType: ptr("text/csv"), Metadata: map[string]string{"owner": "42"}}
+				return p.StoreFileWithOptions(context.Background(), "b", []byte("new"), options)
+			},
+			path:        "b",
+			data:        "new",
+			contentType: ptr("text/csv"),
+			metadata:    map[string]string{"owner": "42"},
+		},
+		{
+			name:  "replace drops the old metadata",
+			write: func(p *Plugin) error { return p.StoreFile("a", []byte("new"), nil) },
+			path:  "a",
+			data:  "new",
+		},
+		{
+			name: "upload",
+			write: func(p *Plugin) error {
+				writer, err := p.OpenUpload("dir/b", ptr("text/plain"))
+				if err != nil {
+					return err
+				}
+				for _, chunk := range []string{"ne", "w"} {
+					if err := writer.WriteChunk([]byte(chunk)); err != nil {
+						return err
+					}
+				}
+				return writer.Commit()
+			},
+			path:        "dir/b",
+			data:        "new",
+			contentType: ptr("text/plain"),
+		},
+		{
+			name:        "copy",
+			write:       func(p *Plugin) error { return p.CopyFile("a", "b") },
+			path:        "b",
+			data:        "old",
+			contentType: ptr("text/html"),
+			metadata:    map[string]string{"owner": "7"},
+		},
+		{
+			name:        "move",
+			write:       func(p *Plugin) error { return p.MoveFile("a", "dir/b") },
+			path:        "dir/b",
+			data:        "old",
+			contentType: ptr("text/html"),
+			metadata:    map[string]string{"owner": "7"},
+			removed:     "a",
+		},
+		{
+			name: "multipart upload",
+			write: func(p *Plugin) error {
+				uploadID, err := p.InitiateMultipartUpload("b", ptr("text/plain"))
+				if err != nil {
+					return err
+				}
+				var parts []storage.UploadedPart
+				for i, chunk := range []string{"ne", "w"} {
+					part, err := p.UploadPart(uploadID, i+1, []byte(chunk))
+					if err != nil {
+						return err
+					}
+					parts = append(parts, *part)
+				}
+				return p.CompleteMultipartUpload(uploadID, parts)
+			},
+			path:        "b",
+			data:        "new",
+			contentType: ptr("text/plain"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(t.TempDir())
+			options := storage.StoreOptions{ContentType: ptr("text/html"), Metadata: map[string]string{"owner": "7"}}
+			if err := p.StoreFileWithOptions(context.Background(), "a", []byte("old"), options); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.write(p); err != nil {
+				t.Fatalf("write error = %v", err)
+			}
+
+			data, err := p.RetrieveFile(tt.path)
+			if err != nil || string(data) != tt.data {
+				t.Fatalf("RetrieveFile(%q) = %q, %v, want %q", tt.path, data, err, tt.data)
+			}
+			metadata, err := p.StatFile(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *metadata.ETag != contentETag(tt.data) {
+				t.Errorf("ETag = %s, want %s", *metadata.ETag, contentETag(tt.data))
+			}
+			if (metadata.ContentType == nil) != (tt.contentType == nil) || (tt.contentType != nil && *metadata.ContentType != *tt.contentType) {
+				t.Errorf("content type = %v, want %v", metadata.ContentType, tt.contentType)
+			}
+			if fmt.Sprint(metadata.Metadata) != fmt.Sprint(tt.metadata) {
+				t.Errorf("metadata = %v, want %v", metadata.Metadata, tt.metadata)
+			}
+
+			if tt.removed != "" {
+				if p.FileExists(tt.removed) || sidecarExists(t, p, tt.removed) {
+					t.Errorf("%s or its sidecar is left behind", tt.removed)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteRemovesSidecar(t *testing.T) {
+	p := New(t.TempDir())
+	if err := p.StoreFile("dir/a", []byte("data"), ptr("text/plain")); err != nil {
+		t.Fatal(err)
+	}
+	if !sidecarExists(t, p, "dir/a") {
+		t.Fatal("no sidecar was written")
+	}
+
+	if err := p.DeleteFile("dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	if sidecarExists(t, p, "dir/a") {
+		t.Error("sidecar is left behind")
+	}
+	if _, err := os.Stat(filepath.Join(p.root, internalDir, "meta", "dir")); !os.IsNotExist(err) {
+		t.Error("empty sidecar directory is left behind")
+	}
+}
+
+func TestStaleSidecar(t *testing.T) {
+	tests := []struct {
+		name string
+		// sidecar is written over the one of the stored file, nil keeps it
+		sidecar *sidecar
+		// replace overwrites the data file behind the plugin's back, as an interrupted write would
+		replace         bool
+		wantContentType bool
+		wantETag        string
+	}{
+		{name: "current", wantContentType: true, wantETag: contentETag("old")},
+		{name: "interrupted replacement", replace: true},
+		{name: "written before sizes were recorded", sidecar: &sidecar{ContentType: ptr("text/html"), ETag: ptr("\"legacy\"")}, replace: true, wantContentType: true, wantETag: "\"legacy\""},
+		{name: "written before ETags were recorded", sidecar: &sidecar{ContentType: ptr("text/html")}, wantContentType: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(t.TempDir())
+			if err := p.StoreFile("a", []byte("old"), ptr("text/html")); err != nil {
+				t.Fatal(err)
+			}
+			if tt.sidecar != nil {
+				location, _ := p.sidecarPath("a")
+				encoded, _ := json.Marshal(tt.sidecar)
+				if err := os.WriteFile(location, encoded, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.replace {
+				full, _ := p.filePath("a")
+				if err := os.WriteFile(full, []byte("replaced"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			metadata, err := p.StatFile("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (metadata.ContentType != nil) != tt.wantContentType {
+				t.Errorf("content type = %v, want one %v", metadata.ContentType, tt.wantContentType)
+			}
+
+			// Without a recorded ETag it falls back to modification time and size
+			wantETag := tt.wantETag
+			if wantETag == "" {
+				wantETag = fmt.Sprintf("\"%x-%x\"", metadata.LastModified.UnixNano(), metadata.Size)
+			}
+			if *metadata.ETag != wantETag {
+				t.Errorf("ETag = %s, want %s", *metadata.ETag, wantETag)
+			}
+		})
+	}
+}
+
+func TestStoreFileWithOptionsPreconditions(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  storage.StoreOptions
+		wantType *storage.ErrorType
+	}{
+		{name: "matching ETag", options: storage.StoreOptions{IfMatch: ptr(contentETag("old"))}},
+		{name: "stale ETag", options: storage.StoreOptions{IfMatch: ptr(contentETag("older"))}, wantType: ptr(storage.PreconditionFailedErrorType)},
+		{name: "create only", options: storage.StoreOptions{IfNoneMatch: ptr("*")}, wantType: ptr(storage.PreconditionFailedErrorType)},
+		{name: "weak ETag", options: storage.StoreOptions{IfMatch: ptr("W/" + contentETag("old"))}},
+		{name: "any file", options: storage.StoreOptions{IfMatch: ptr("*")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(t.TempDir())
+			if err := p.StoreFile("a", []byte("old"), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			err := p.StoreFileWithOptions(context.Background(), "a", []byte("new"), tt.options)
+			if tt.wantType == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantType != nil && (err == nil || storage.AsPluginError(err).Type != *tt.wantType) {
+				t.Fatalf("error = %v, want error type %d", err, *tt.wantType)
+			}
+
+			want := "new"
+			if tt.wantType != nil {
+				want = "old"
+			}
+			if data, _ := p.RetrieveFile("a"); string(data) != want {
+				t.Errorf("content = %q, want %q", data, want)
+			}
+		})
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	p := New(t.TempDir())
+	for _, path := range []string{"a/2", "a/1", "a/b/1", "a0", "b/1"} {
+		if err := p.StoreFile(path, []byte("x"), ptr("text/plain")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var paths []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("listing doesn't end")
+		}
+		result, err := p.ListFiles("a/", cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range result.Files {
+			paths = append(paths, file.Path)
+		}
+		if result.NextCursor == nil {
+			break
+		}
+		cursor = *result.NextCursor
+	}
+
+	want := []string{"a/1", "a/2", "a/b/1"}
+	if len(paths) != len(want) {
+		t.Fatalf("listed %v, want %v", paths, want)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Fatalf("listed %v, want %v", paths, want)
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "a/b.txt", want: "a/b.txt"},
+		{path: "a//b/./c", want: "a/b/c"},
+		{path: "a/", want: "a"},
+		{path: "", wantErr: true},
+		{path: ".", wantErr: true},
+		{path: "/a", wantErr: true},
+		{path: "a/../b", wantErr: true},
+		{path: "a\\b", wantErr: true},
+		{path: "a\x00b", wantErr: true},
+		{path: internalDir, wantErr: true},
+		{path: internalDir + "/meta/a.json", wantErr: true},
+		{path: "./" + internalDir + "/tmp", wantErr: true},
+		{path: internalDir + "x/a", want: internalDir + "x/a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := cleanPath(tt.path)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("cleanPath(%q) = %q, %v, want %q, error %v", tt.path, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	tests := []struct {
+		name string
+		// parts are uploaded in this order, complete lists the parts passed to CompleteMultipartUpload
+		parts    []int
+		complete []int
+		// badETag replaces the ETag of the first completed part
+		badETag  bool
+		want     string
+		wantType *storage.ErrorType
+	}{
+		{name: "in order", parts: []int{1, 2, 3}, complete: []int{1, 2, 3}, want: "p1p2p3"},
+		{name: "out of order", parts: []int{3, 1, 2}, complete: []int{1, 2, 3}, want: "p1p2p3"},
+		{name: "subset", parts: []int{1, 2, 3}, complete: []int{1, 3}, want: "p1p3"},
+		{name: "missing part", parts: []int{1}, complete: []int{1, 2}, wantType: ptr(storage.InvalidInputError)},
+		{name: "ETag mismatch", parts: []int{1}, complete: []int{1}, badETag: true, wantType: ptr(storage.InvalidInputError)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(t.TempDir())
+			uploadID, err := p.InitiateMultipartUpload("a", ptr("text/plain"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			uploaded := make(map[int]storage.UploadedPart)
+			for _, number := range tt.parts {
+				part, err := p.UploadPart(uploadID, number, []byte(fmt.Sprintf("p%d", number)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				uploaded[number] = *part
+			}
+			listed, err := p.ListUploadedParts(uploadID)
+			if err != nil || len(listed) != len(tt.parts) {
+				t.Fatalf("ListUploadedParts() = %v, %v", listed, err)
+			}
+
+			var parts []storage.UploadedPart
+			for _, number := range tt.complete {
+				part, ok := uploaded[number]
+				if !ok {
+					part = storage.UploadedPart{PartNumber: number}
+				}
+				parts = append(parts, part)
+			}
+			if tt.badETag {
+				parts[0].ETag = "\"other\""
+			}
+
+			err = p.CompleteMultipartUpload(uploadID, parts)
+			if tt.wantType != nil {
+				if err == nil || storage.AsPluginError(err).Type != *tt.wantType {
+					t.Fatalf("error = %v, want error type %d", err, *tt.wantType)
+				}
+				if p.FileExists("a") {
+					t.Error("failed upload stored the file")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if data, _ := p.RetrieveFile("a"); string(data) != tt.want {
+				t.Errorf("content = %q, want %q", data, tt.want)
+			}
+			if _, err := p.ListUploadedParts(uploadID); err == nil {
+				t.Error("completed upload is still listed")
+			}
+		})
+	}
+}
+
+func TestMultipartSurvivesRestart(t *testing.T) {
+	root := t.TempDir()
+	uploadID, err := New(root).InitiateMultipartUpload("a", ptr("text/plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, err := New(root).UploadPart(uploadID, 1, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(root)
+	if err := p.CompleteMultipartUpload(uploadID, []storage.UploadedPart{*part}); err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := p.StatFile("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *metadata.ETag != contentETag("data") || metadata.ContentType == nil || *metadata.ContentType != "text/plain" {
+		t.Errorf("StatFile() = ETag %s, content type %v", *metadata.ETag, metadata.ContentType)
+	}
+}
+
+func TestAbortMultipartUpload(t *testing.T) {
+	p := New(t.TempDir())
+	uploadID, err := p.InitiateMultipartUpload("a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.UploadPart(uploadID, 1, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.AbortMultipartUpload(uploadID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.UploadPart(uploadID, 2, []byte("data")); err == nil || !storage.IsNotFound(err) {
+		t.Errorf("UploadPart() after abort = %v, want a not found error", err)
+	}
+}
+
+func TestStoreFileWithOptionsChecksum(t *testing.T) {
+	p := New(t.TempDir())
+	checksum, _ := storage.ComputeChecksum(storage.ChecksumSHA256, []byte("data"))
+	options := storage.StoreOptions{ContentType: ptr("text/plain"), Checksum: checksum}
+	if err := p.StoreFileWithOptions(context.Background(), "a", []byte("data"), options); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"a", "b"} {
+		if path == "b" {
+			if err := p.CopyFile("a", "b"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		metadata, err := p.StatFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.Checksum == nil || *metadata.Checksum != *checksum {
+			t.Errorf("%s checksum = %v, want %v", path, metadata.Checksum, checksum)
+		}
+	}
+}
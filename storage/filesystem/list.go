@@ -0,0 +1,119 @@
+package filesystem
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/matt953/relm-plugin-core-go/storage"
+)
+
+// errPageFull stops the walk once a page and the lookahead entry have been found
+var errPageFull = errors.New("page full")
+
+// listedFile is a file found by the walk
+type listedFile struct {
+	path  string
+	entry fs.DirEntry
+}
+
+// ListFiles returns up to limit files whose path starts with prefix, ordered by path
+// The cursor is the path of the last file of the previous page
+//
+// Directories are walked in path order and only where they can hold files after the cursor,
+// so a page reads the directories up to its last file and stops after limit+1 files.
+func (p *Plugin) ListFiles(prefix string, cursor string, limit int) (*storage.ListResult, error) {
+	root, err := p.rootDir()
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = storage.DefaultListLimit
+	}
+
+	var files []listedFile
+	err = walkOrdered(root, "", func(rel string, entry fs.DirEntry) (bool, error) {
+		if entry.IsDir() {
+			dir := rel + "/"
+			if rel == internalDir {
+				return false, nil
+			}
+			// Skip directories outside the prefix and those whose paths all sort before the cursor
+			if !strings.HasPrefix(dir, prefix) && !strings.HasPrefix(prefix, dir) {
+				return false, nil
+			}
+			return cursor < dir || strings.HasPrefix(cursor, dir), nil
+		}
+
+		if !entry.Type().IsRegular() || !strings.HasPrefix(rel, prefix) || rel <= cursor {
+			return false, nil
+		}
+		files = append(files, listedFile{path: rel, entry: entry})
+		if len(files) > limit {
+			return false, errPageFull
+		}
+		return false, nil
+	})
+	if err != nil && !errors.Is(err, errPageFull) {
+		return nil, storage.NewStorageError("failed to list files: " + err.Error())
+	}
+
+	result := &storage.ListResult{Files: []storage.FileMetadata{}}
+	for i, file := range files {
+		if i == limit {
+			next := files[i-1].path
+			result.NextCursor = &next
+			break
+		}
+
+		info, err := file.entry.Info()
+		if err != nil {
+			// Removed since the directory was read
+			continue
+		}
+		result.Files = append(result.Files, *p.metadata(file.path, info))
+	}
+	return result, nil
+}
+
+// walkOrdered calls visit for the entries below dir in the order of their storage paths
+// Unlike filepath.WalkDir it orders a directory as its name plus "/", so "a/b" comes after "a-c"
+// like in a sorted list of paths. visit returns whether to descend into a directory.
+func walkOrdered(root string, dir string, visit func(rel string, entry fs.DirEntry) (bool, error)) error {
+	entries, err := os.ReadDir(filepath.Join(root, filepath.FromSlash(dir)))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	sortKey := func(entry fs.DirEntry) string {
+		if entry.IsDir() {
+			return entry.Name() + "/"
+		}
+		return entry.Name()
+	}
+	sort.Slice(entries, func(i, j int) bool { return sortKey(entries[i]) < sortKey(entries[j]) })
+
+	for _, entry := range entries {
+		rel := entry.Name()
+		if dir != "" {
+			rel = dir + "/" + rel
+		}
+
+		descend, err := visit(rel, entry)
+		if err != nil {
+			return err
+		}
+		if descend {
+			if err := walkOrdered(root, rel, visit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
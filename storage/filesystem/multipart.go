@@ -0,0 +1,236 @@
+package filesystem
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/matt953/relm-plugin-core-go/storage"
+)
+
+// multipartState is persisted for every multipart upload so it survives restarts
+type multipartState struct {
+	Path        string  `json:"path"`
+	ContentType *string `json:"content_type,omitempty"`
+}
+
+// InitiateMultipartUpload starts a multipart upload and returns its upload ID
+// Parts are kept under the reserved .relm directory until the upload is completed or aborted
+func (p *Plugin) InitiateMultipartUpload(path string, contentType *string) (string, error) {
+	cleaned, err := cleanPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", storage.NewStorageError("failed to generate upload ID: " + err.Error())
+	}
+	uploadID := hex.EncodeToString(buf)
+
+	dir, err := p.multipartDir(uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(multipartState{Path: cleaned, ContentType: contentType})
+	if err != nil {
+		return "", storage.NewStorageError("failed to encode upload state: " + err.Error())
+	}
+	if err := p.writeAtomic(filepath.Join(dir, "upload.json"), data); err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+// UploadPart stores a part of the upload, replacing any earlier upload of the same part number
+func (p *Plugin) UploadPart(uploadID string, partNumber int, data []byte) (*storage.UploadedPart, error) {
+	dir, err := p.existingMultipartDir(uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	part := storage.UploadedPart{
+		PartNumber: partNumber,
+		Size:       int64(len(data)),
+		ETag:       hex.EncodeToString(sum[:]),
+	}
+
+	if err := p.writeAtomic(partPath(dir, partNumber), data); err != nil {
+		return nil, err
+	}
+
+	info, err := json.Marshal(part)
+	if err != nil {
+		return nil, storage.NewStorageError("failed to encode part: " + err.Error())
+	}
+	if err := p.writeAtomic(partPath(dir, partNumber)+".json", info); err != nil {
+		return nil, err
+	}
+	return &part, nil
+}
+
+// ListUploadedParts returns the parts uploaded so far ordered by part number
+func (p *Plugin) ListUploadedParts(uploadID string) ([]storage.UploadedPart, error) {
+	dir, err := p.existingMultipartDir(uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, storage.NewStorageError("failed to list parts: " + err.Error())
+	}
+
+	parts := []storage.UploadedPart{}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "part-") || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, storage.NewStorageError("failed to read part: " + err.Error())
+		}
+
+		var part storage.UploadedPart
+		if err := json.Unmarshal(data, &part); err != nil {
+			return nil, storage.NewStorageError("failed to decode part: " + err.Error())
+		}
+		parts = append(parts, part)
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	return parts, nil
+}
+
+// CompleteMultipartUpload concatenates the listed parts into the final file
+func (p *Plugin) CompleteMultipartUpload(uploadID string, parts []storage.UploadedPart) error {
+	dir, err := p.existingMultipartDir(uploadID)
+	if err != nil {
+		return err
+	}
+
+	uploaded, err := p.ListUploadedParts(uploadID)
+	if err != nil {
+		return err
+	}
+	etags := make(map[int]string, len(uploaded))
+	for _, part := range uploaded {
+		etags[part.PartNumber] = part.ETag
+	}
+	for _, part := range parts {
+		etag, ok := etags[part.PartNumber]
+		if !ok {
+			return storage.NewInvalidInputError(fmt.Sprintf("part %d has not been uploaded", part.PartNumber))
+		}
+		if etag != part.ETag {
+			return storage.NewInvalidInputError(fmt.Sprintf("ETag mismatch for part %d", part.PartNumber))
+		}
+	}
+
+	state, err := readMultipartState(dir)
+	if err != nil {
+		return err
+	}
+
+	writer, err := p.openUpload(state.Path, sidecar{ContentType: state.ContentType})
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if err := appendPart(writer, partPath(dir, part.PartNumber)); err != nil {
+			writer.Abort()
+			return err
+		}
+	}
+	if err := writer.Commit(); err != nil {
+		return err
+	}
+
+	os.RemoveAll(dir)
+	return nil
+}
+
+// AbortMultipartUpload discards the upload and all of its parts
+func (p *Plugin) AbortMultipartUpload(uploadID string) error {
+	dir, err := p.existingMultipartDir(uploadID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return storage.NewStorageError("failed to remove upload: " + err.Error())
+	}
+	return nil
+}
+
+// multipartDir returns the directory holding the state and parts of an upload
+func (p *Plugin) multipartDir(uploadID string) (string, error) {
+	if _, err := hex.DecodeString(uploadID); err != nil || uploadID == "" {
+		return "", storage.NewInvalidInputError("invalid upload ID: " + uploadID)
+	}
+
+	root, err := p.rootDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, internalDir, "multipart", uploadID), nil
+}
+
+// existingMultipartDir returns the directory of an upload that has been initiated
+func (p *Plugin) existingMultipartDir(uploadID string) (string, error) {
+	dir, err := p.multipartDir(uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "upload.json")); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", storage.NewNotFoundError("upload " + uploadID)
+		}
+		return "", storage.NewStorageError(err.Error())
+	}
+	return dir, nil
+}
+
+func readMultipartState(dir string) (*multipartState, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "upload.json"))
+	if err != nil {
+		return nil, storage.NewStorageError("failed to read upload state: " + err.Error())
+	}
+
+	var state multipartState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, storage.NewStorageError("failed to decode upload state: " + err.Error())
+	}
+	return &state, nil
+}
+
+func partPath(dir string, partNumber int) string {
+	return filepath.Join(dir, fmt.Sprintf("part-%05d", partNumber))
+}
+
+// appendPart copies a part file onto the end of the assembled file
+func appendPart(dst io.Writer, location string) error {
+	src, err := os.Open(location)
+	if err != nil {
+		return storage.NewStorageError("failed to open part: " + err.Error())
+	}
+	defer src.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return storage.NewStorageError("failed to assemble parts: " + err.Error())
+	}
+	return nil
+}
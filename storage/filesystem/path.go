@@ -0,0 +1,106 @@
+package filesystem
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/matt953/relm-plugin-core-go/storage"
+)
+
+// internalDir holds temp files and sidecars inside the root directory
+// Paths under it are rejected so stored files can never collide with them
+const internalDir = ".relm"
+
+// cleanPath validates a storage path and returns it in canonical slash form
+func cleanPath(p string) (string, error) {
+	if p == "" {
+		return "", storage.NewInvalidInputError("path must not be empty")
+	}
+	if strings.ContainsRune(p, 0) {
+		return "", storage.NewInvalidInputError("path must not contain NUL bytes")
+	}
+	if strings.Contains(p, "\\") {
+		return "", storage.NewInvalidInputError("path must not contain backslashes")
+	}
+	if strings.HasPrefix(p, "/") {
+		return "", storage.NewInvalidInputError("path must be relative")
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return "", storage.NewInvalidInputError("path must not contain '..' segments")
+		}
+	}
+
+	cleaned := path.Clean(p)
+	if cleaned == "." {
+		return "", storage.NewInvalidInputError("path must not be empty")
+	}
+	if cleaned == internalDir || strings.HasPrefix(cleaned, internalDir+"/") {
+		return "", storage.NewInvalidInputError("path is reserved: " + p)
+	}
+	return cleaned, nil
+}
+
+// filePath returns the location of a stored file on disk
+func (p *Plugin) filePath(storagePath string) (string, error) {
+	root, err := p.rootDir()
+	if err != nil {
+		return "", err
+	}
+
+	cleaned, err := cleanPath(storagePath)
+	if err != nil {
+		return "", err
+	}
+
+	full := filepath.Join(root, filepath.FromSlash(cleaned))
+
+	// Defense in depth: the joined path must stay inside the root
+	rel, err := filepath.Rel(root, full)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", storage.NewInvalidInputError("path escapes the storage root: " + storagePath)
+	}
+	return full, nil
+}
+
+// sidecarPath returns the location of the metadata sidecar of a stored file
+func (p *Plugin) sidecarPath(storagePath string) (string, error) {
+	root, err := p.rootDir()
+	if err != nil {
+		return "", err
+	}
+
+	cleaned, err := cleanPath(storagePath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, internalDir, "meta", filepath.FromSlash(cleaned)+".json"), nil
+}
+
+// tempDir returns the directory for in-progress writes
+// It lives inside the root so the final rename stays on the same filesystem
+func (p *Plugin) tempDir() (string, error) {
+	root, err := p.rootDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(root, internalDir, "tmp")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", storage.NewStorageError("failed to create temp directory: " + err.Error())
+	}
+	return dir, nil
+}
+
+// removeEmptyParents removes the empty directories left behind by a delete, up to the root
+func removeEmptyParents(root string, full string) {
+	dir := filepath.Dir(full)
+	for dir != root && strings.HasPrefix(dir, root) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
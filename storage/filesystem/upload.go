@@ -0,0 +1,110 @@
+package filesystem
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"os"
+	"path/filepath"
+
+	"github.com/matt953/relm-plugin-core-go/storage"
+)
+
+// upload is a streaming upload into a temp file
+// The content is hashed while it is written so the ETag is known on commit
+type upload struct {
+	plugin *Plugin
+	path   string
+	target string
+	file   *os.File
+	hash   hash.Hash
+	meta   sidecar
+
+	// check runs under the path lock right before the file is moved into place
+	check func() error
+}
+
+// Write appends data to the temp file
+func (u *upload) Write(data []byte) (int, error) {
+	n, err := u.file.Write(data)
+	u.hash.Write(data[:n])
+	return n, err
+}
+
+// WriteChunk appends the next chunk of data to the temp file
+func (u *upload) WriteChunk(chunk []byte) error {
+	if _, err := u.Write(chunk); err != nil {
+		return storage.NewStorageError("failed to write chunk: " + err.Error())
+	}
+	return nil
+}
+
+// Commit flushes the temp file and renames it into place
+// The sidecar is staged in a temp file and renamed after the data, so a crash in between leaves
+// the old sidecar, which no longer describes the new data and is ignored by readers
+func (u *upload) Commit() error {
+	defer os.Remove(u.file.Name())
+
+	if err := u.file.Sync(); err != nil {
+		u.file.Close()
+		return storage.NewStorageError("failed to flush file: " + err.Error())
+	}
+	if err := u.file.Close(); err != nil {
+		return storage.NewStorageError("failed to close file: " + err.Error())
+	}
+	info, err := os.Stat(u.file.Name())
+	if err != nil {
+		return storage.NewStorageError("failed to stat file: " + err.Error())
+	}
+
+	unlock := u.plugin.locks.Lock(u.path)
+	defer unlock()
+
+	if u.check != nil {
+		if err := u.check(); err != nil {
+			return err
+		}
+	}
+
+	etag := "\"" + hex.EncodeToString(u.hash.Sum(nil)) + "\""
+	size, modTime := info.Size(), info.ModTime().UnixNano()
+	u.meta.ETag = &etag
+	u.meta.Size = &size
+	u.meta.ModTime = &modTime
+
+	location, err := u.plugin.sidecarPath(u.path)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(u.meta)
+	if err != nil {
+		return storage.NewStorageError("failed to encode metadata: " + err.Error())
+	}
+	sidecarTemp, err := u.plugin.writeTemp(encoded)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sidecarTemp)
+
+	if err := os.MkdirAll(filepath.Dir(u.target), 0o755); err != nil {
+		return storage.NewStorageError("failed to create directory: " + err.Error())
+	}
+	if err := os.Rename(u.file.Name(), u.target); err != nil {
+		return storage.NewStorageError("failed to move file into place: " + err.Error())
+	}
+	return renameInto(sidecarTemp, location)
+}
+
+// Abort removes the temp file
+func (u *upload) Abort() error {
+	u.file.Close()
+	if err := os.Remove(u.file.Name()); err != nil && !os.IsNotExist(err) {
+		return storage.NewStorageError("failed to remove temp file: " + err.Error())
+	}
+	return nil
+}
+
+func newUploadHash() hash.Hash {
+	return sha256.New()
+}
@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ptr returns a pointer to v, for the optional fields of test cases
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// checkErrorType fails the test unless err is a PluginError of the wanted type, or nil when no type is wanted
+func checkErrorType(t *testing.T, err error, want *ErrorType) {
+	t.Helper()
+
+	if want == nil {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return
+	}
+	if err == nil {
+		t.Fatalf("no error, want error type %d", *want)
+	}
+	if perr := AsPluginError(err); perr.Type != *want {
+		t.Fatalf("error = %v, want error type %d", err, *want)
+	}
+}
+
+// memoryPlugin keeps files in memory
+// It counts the calls made to it and fails them with the errors set in failures, keyed by operation
+type memoryPlugin struct {
+	mutex    sync.Mutex
+	files    map[string]memoryFile
+	versions int
+	calls    map[string]int
+	failures map[string]error
+}
+
+type memoryFile struct {
+	data        []byte
+	contentType *string
+	etag        string
+	modified    time.Time
+}
+
+// newMemoryPlugin returns a plugin holding the given files
+func newMemoryPlugin(files map[string]string) *memoryPlugin {
+	p := &memoryPlugin{files: make(map[string]memoryFile), calls: make(map[string]int), failures: make(map[string]error)}
+	for path, data := range files {
+		p.StoreFile(path, []byte(data), nil)
+	}
+	p.calls = make(map[string]int)
+	return p
+}
+
+// call records a call to operation and returns the failure set for it
+// The mutex must be held
+func (p *memoryPlugin) call(operation string) error {
+	p.calls[operation]++
+	return p.failures[operation]
+}
+
+// fail makes the calls to operation fail with err, nil makes them succeed again
+func (p *memoryPlugin) fail(operation string, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err == nil {
+		delete(p.failures, operation)
+		return
+	}
+	p.failures[operation] = err
+}
+
+// count returns the number of calls made to operation
+func (p *memoryPlugin) count(operation string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.calls[operation]
+}
+
+// age makes the file at path look as if it was last modified age ago
+func (p *memoryPlugin) age(path string, age time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	file := p.files[path]
+	file.modified = time.Now().Add(-age)
+	p.files[path] = file
+}
+
+// data returns the stored content of path, false when there is no file
+func (p *memoryPlugin) data(path string) ([]byte, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	file, ok := p.files[path]
+	return file.data, ok
+}
+
+func (p *memoryPlugin) StoreFile(path string, data []byte, contentType *string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.call("store"); err != nil {
+		return err
+	}
+	p.versions++
+	p.files[path] = memoryFile{
+		data:        append([]byte(nil), data...),
+		contentType: contentType,
+		etag:        fmt.Sprintf("\"%d\"", p.versions),
+		modified:    time.Now(),
+	}
+	return nil
+}
+
+func (p *memoryPlugin) RetrieveFile(path string) ([]byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.call("retrieve"); err != nil {
+		return nil, err
+	}
+	file, ok := p.files[path]
+	if !ok {
+		return nil, NewNotFoundError(path)
+	}
+	return append([]byte(nil), file.data...), nil
+}
+
+func (p *memoryPlugin) DeleteFile(path string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.call("delete"); err != nil {
+		return err
+	}
+	if _, ok := p.files[path]; !ok {
+		return NewNotFoundError(path)
+	}
+	delete(p.files, path)
+	return nil
+}
+
+func (p *memoryPlugin) FileExists(path string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.call("exists")
+	_, ok := p.files[path]
+	return ok
+}
+
+func (p *memoryPlugin) GenerateURL(path string, baseURL string) *string {
+	return nil
+}
+
+func (p *memoryPlugin) ProviderName() string {
+	return "memory"
+}
+
+func (p *memoryPlugin) Cleanup() error {
+	return nil
+}
+
+func (p *memoryPlugin) StatFile(path string) (*FileMetadata, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.call("stat"); err != nil {
+		return nil, err
+	}
+	file, ok := p.files[path]
+	if !ok {
+		return nil, NewNotFoundError(path)
+	}
+	return p.metadata(path, file), nil
+}
+
+func (p *memoryPlugin) metadata(path string, file memoryFile) *FileMetadata {
+	etag, modified := file.etag, file.modified
+	return &FileMetadata{Path: path, Size: int64(len(file.data)), ContentType: file.contentType, ETag: &etag, LastModified: &modified}
+}
+
+func (p *memoryPlugin) ListFiles(prefix string, cursor string, limit int) (*ListResult, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.call("list"); err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for path := range p.files {
+		if strings.HasPrefix(path, prefix) && path > cursor {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	result := &ListResult{Files: []FileMetadata{}}
+	for i, path := range paths {
+		if i == limit {
+			next := paths[i-1]
+			result.NextCursor = &next
+			break
+		}
+		result.Files = append(result.Files, *p.metadata(path, p.files[path]))
+	}
+	return result, nil
+}
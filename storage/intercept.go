@@ -0,0 +1,398 @@
+package storage
+
+import "context"
+
+// interceptedPlugin runs every call to the wrapped plugin through an Interceptor
+type interceptedPlugin struct {
+	inner       StoragePlugin
+	interceptor Interceptor
+}
+
+// intercept runs fn through the interceptor and returns its result
+func intercept[T any](p *interceptedPlugin, ctx context.Context, call Call, fn func(ctx context.Context) (T, error)) (T, error) {
+	var result T
+	err := p.interceptor(ctx, call, func(ctx context.Context) error {
+		value, err := awaitContext(ctx, func() (T, error) { return fn(ctx) })
+		if err != nil {
+			return err
+		}
+		result = value
+		return nil
+	})
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return result, nil
+}
+
+// interceptErr is intercept for calls without a result
+func interceptErr(p *interceptedPlugin, ctx context.Context, call Call, fn func(ctx context.Context) error) error {
+	_, err := intercept(p, ctx, call, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, fn(ctx)
+	})
+	return err
+}
+
+// Unwrap returns the wrapped plugin
+func (p *interceptedPlugin) Unwrap() StoragePlugin {
+	return p.inner
+}
+
+func (p *interceptedPlugin) StoreFile(path string, data []byte, contentType *string) error {
+	return p.StoreFileWithContext(context.Background(), path, data, contentType)
+}
+
+func (p *interceptedPlugin) RetrieveFile(path string) ([]byte, error) {
+	return p.RetrieveFileWithContext(context.Background(), path)
+}
+
+func (p *interceptedPlugin) DeleteFile(path string) error {
+	return p.DeleteFileWithContext(context.Background(), path)
+}
+
+// FileExists reports false when the check fails
+func (p *interceptedPlugin) FileExists(path string) bool {
+	exists, err := p.FileExistsWithContext(context.Background(), path)
+	return err == nil && exists
+}
+
+func (p *interceptedPlugin) GenerateURL(path string, baseURL string) *string {
+	return p.inner.GenerateURL(path, baseURL)
+}
+
+func (p *interceptedPlugin) ProviderName() string {
+	return p.inner.ProviderName()
+}
+
+func (p *interceptedPlugin) Cleanup() error {
+	return p.inner.Cleanup()
+}
+
+func (p *interceptedPlugin) StoreFileWithContext(ctx context.Context, path string, data []byte, contentType *string) error {
+	progress := ProgressFromContext(ctx)
+	return interceptErr(p, ctx, Call{Operation: "store_file", Path: path, Idempotent: true}, func(ctx context.Context) error {
+		return storeFile(ctx, p.inner, path, data, contentType, progress)
+	})
+}
+
+func (p *interceptedPlugin) RetrieveFileWithContext(ctx context.Context, path string) ([]byte, error) {
+	return intercept(p, ctx, Call{Operation: "retrieve_file", Path: path, Idempotent: true}, func(ctx context.Context) ([]byte, error) {
+		return retrieveFile(ctx, p.inner, path)
+	})
+}
+
+func (p *interceptedPlugin) DeleteFileWithContext(ctx context.Context, path string) error {
+	return interceptErr(p, ctx, Call{Operation: "delete_file", Path: path, Idempotent: true}, func(ctx context.Context) error {
+		return deleteFile(ctx, p.inner, path)
+	})
+}
+
+func (p *interceptedPlugin) FileExistsWithContext(ctx context.Context, path string) (bool, error) {
+	return intercept(p, ctx, Call{Operation: "file_exists", Path: path, Idempotent: true}, func(ctx context.Context) (bool, error) {
+		return fileExists(ctx, p.inner, path)
+	})
+}
+
+// StoreFileWithOptions isn't retried when it has preconditions, a repeated conditional write could fail
+// because the first attempt succeeded
+func (p *interceptedPlugin) StoreFileWithOptions(ctx context.Context, path string, data []byte, options StoreOptions) error {
+	progress := ProgressFromContext(ctx)
+	call := Call{Operation: "store_file_with_options", Path: path, Idempotent: !options.hasPreconditions()}
+	return interceptErr(p, ctx, call, func(ctx context.Context) error {
+		return storeWithOptions(ctx, p.inner, path, data, options, progress)
+	})
+}
+
+func (p *interceptedPlugin) OpenUpload(path string, contentType *string) (UploadWriter, error) {
+	return intercept(p, context.Background(), Call{Operation: "open_upload", Path: path, Idempotent: true}, func(ctx context.Context) (UploadWriter, error) {
+		return newUploadWriter(p.inner, path, contentType)
+	})
+}
+
+func (p *interceptedPlugin) FileSize(path string) (int64, error) {
+	return intercept(p, context.Background(), Call{Operation: "file_size", Path: path, Idempotent: true}, func(ctx context.Context) (int64, error) {
+		return fileSize(p.inner, path)
+	})
+}
+
+func (p *interceptedPlugin) RetrieveRange(path string, offset int64, length int64) ([]byte, error) {
+	return intercept(p, context.Background(), Call{Operation: "retrieve_file_range", Path: path, Idempotent: true}, func(ctx context.Context) ([]byte, error) {
+		return retrieveRange(p.inner, path, offset, length)
+	})
+}
+
+func (p *interceptedPlugin) StatFile(path string) (*FileMetadata, error) {
+	return intercept(p, context.Background(), Call{Operation: "stat_file", Path: path, Idempotent: true}, func(ctx context.Context) (*FileMetadata, error) {
+		return statFile(p.inner, path)
+	})
+}
+
+func (p *interceptedPlugin) ListFiles(prefix string, cursor string, limit int) (*ListResult, error) {
+	return intercept(p, context.Background(), Call{Operation: "list_files", Path: prefix, Idempotent: true}, func(ctx context.Context) (*ListResult, error) {
+		return listFiles(p.inner, prefix, cursor, limit)
+	})
+}
+
+func (p *interceptedPlugin) GenerateSignedURL(path string, options URLOptions) (*SignedURL, error) {
+	return intercept(p, context.Background(), Call{Operation: "generate_signed_url", Path: path, Idempotent: true}, func(ctx context.Context) (*SignedURL, error) {
+		return generateSignedURL(p.inner, path, options)
+	})
+}
+
+func (p *interceptedPlugin) CopyFile(sourcePath string, destinationPath string) error {
+	return interceptErr(p, context.Background(), Call{Operation: "copy_file", Path: sourcePath, Idempotent: true}, func(ctx context.Context) error {
+		return copyFile(p.inner, sourcePath, destinationPath)
+	})
+}
+
+// MoveFile isn't retried, a repeated move fails once the source is gone
+func (p *interceptedPlugin) MoveFile(sourcePath string, destinationPath string) error {
+	return interceptErr(p, context.Background(), Call{Operation: "move_file", Path: sourcePath}, func(ctx context.Context) error {
+		return moveFile(p.inner, sourcePath, destinationPath)
+	})
+}
+
+func (p *interceptedPlugin) InitiateMultipartUpload(path string, contentType *string) (string, error) {
+	return intercept(p, context.Background(), Call{Operation: "initiate_multipart_upload", Path: path}, func(ctx context.Context) (string, error) {
+		multipart, err := multipartPlugin(p.inner)
+		if err != nil {
+			return "", err
+		}
+		return multipart.InitiateMultipartUpload(path, contentType)
+	})
+}
+
+func (p *interceptedPlugin) UploadPart(uploadID string, partNumber int, data []byte) (*UploadedPart, error) {
+	return intercept(p, context.Background(), Call{Operation: "upload_part", Idempotent: true}, func(ctx context.Context) (*UploadedPart, error) {
+		multipart, err := multipartPlugin(p.inner)
+		if err != nil {
+			return nil, err
+		}
+		return multipart.UploadPart(uploadID, partNumber, data)
+	})
+}
+
+func (p *interceptedPlugin) ListUploadedParts(uploadID string) ([]UploadedPart, error) {
+	return intercept(p, context.Background(), Call{Operation: "list_uploaded_parts", Idempotent: true}, func(ctx context.Context) ([]UploadedPart, error) {
+		multipart, err := multipartPlugin(p.inner)
+		if err != nil {
+			return nil, err
+		}
+		return multipart.ListUploadedParts(uploadID)
+	})
+}
+
+func (p *interceptedPlugin) CompleteMultipartUpload(uploadID string, parts []UploadedPart) error {
+	return interceptErr(p, context.Background(), Call{Operation: "complete_multipart_upload"}, func(ctx context.Context) error {
+		multipart, err := multipartPlugin(p.inner)
+		if err != nil {
+			return err
+		}
+		return multipart.CompleteMultipartUpload(uploadID, parts)
+	})
+}
+
+func (p *interceptedPlugin) AbortMultipartUpload(uploadID string) error {
+	return interceptErr(p, context.Background(), Call{Operation: "abort_multipart_upload", Idempotent: true}, func(ctx context.Context) error {
+		multipart, err := multipartPlugin(p.inner)
+		if err != nil {
+			return err
+		}
+		return multipart.AbortMultipartUpload(uploadID)
+	})
+}
+
+func (p *interceptedPlugin) DeleteFiles(paths []string) ([]DeleteResult, error) {
+	return intercept(p, context.Background(), Call{Operation: "delete_files", Idempotent: true}, func(ctx context.Context) ([]DeleteResult, error) {
+		return deleteFiles(p.inner, paths)
+	})
+}
+
+func (p *interceptedPlugin) FilesExist(paths []string) ([]ExistsResult, error) {
+	return intercept(p, context.Background(), Call{Operation: "files_exist", Idempotent: true}, func(ctx context.Context) ([]ExistsResult, error) {
+		return filesExist(p.inner, paths)
+	})
+}
+
+func (p *interceptedPlugin) ListVersions(path string) ([]FileVersion, error) {
+	return intercept(p, context.Background(), Call{Operation: "list_file_versions", Path: path, Idempotent: true}, func(ctx context.Context) ([]FileVersion, error) {
+		versioning, err := versioningPlugin(p.inner)
+		if err != nil {
+			return nil, err
+		}
+		return versioning.ListVersions(path)
+	})
+}
+
+func (p *interceptedPlugin) RetrieveVersion(path string, versionID string) ([]byte, error) {
+	return intercept(p, context.Background(), Call{Operation: "retrieve_file_version", Path: path, Idempotent: true}, func(ctx context.Context) ([]byte, error) {
+		versioning, err := versioningPlugin(p.inner)
+		if err != nil {
+			return nil, err
+		}
+		return versioning.RetrieveVersion(path, versionID)
+	})
+}
+
+func (p *interceptedPlugin) RetrieveVersionRange(path string, versionID string, offset int64, length int64) ([]byte, error) {
+	return intercept(p, context.Background(), Call{Operation: "retrieve_file_version_range", Path: path, Idempotent: true}, func(ctx context.Context) ([]byte, error) {
+		versioning, err := versioningPlugin(p.inner)
+		if err != nil {
+			return nil, err
+		}
+		return retrieveVersionRange(versioning, path, versionID, offset, length)
+	})
+}
+
+func (p *interceptedPlugin) RestoreVersion(path string, versionID string) error {
+	return interceptErr(p, context.Background(), Call{Operation: "restore_file_version", Path: path}, func(ctx context.Context) error {
+		versioning, err := versioningPlugin(p.inner)
+		if err != nil {
+			return err
+		}
+		return versioning.RestoreVersion(path, versionID)
+	})
+}
+
+func (p *interceptedPlugin) DeleteVersion(path string, versionID string) error {
+	return interceptErr(p, context.Background(), Call{Operation: "delete_file_version", Path: path, Idempotent: true}, func(ctx context.Context) error {
+		versioning, err := versioningPlugin(p.inner)
+		if err != nil {
+			return err
+		}
+		return versioning.DeleteVersion(path, versionID)
+	})
+}
+
+func (p *interceptedPlugin) PurgeExpiredVersions() (int, error) {
+	return intercept(p, context.Background(), Call{Operation: "purge_expired_versions", Idempotent: true}, func(ctx context.Context) (int, error) {
+		versioning, err := versioningPlugin(p.inner)
+		if err != nil {
+			return 0, err
+		}
+		return versioning.PurgeExpiredVersions()
+	})
+}
+
+func (p *interceptedPlugin) SweepExpiredFiles(ctx context.Context) (int, error) {
+	return intercept(p, ctx, Call{Operation: "sweep_expired_files", Idempotent: true}, func(ctx context.Context) (int, error) {
+		lifecycle, err := lifecyclePlugin(p.inner)
+		if err != nil {
+			return 0, err
+		}
+		return lifecycle.SweepExpiredFiles(ctx)
+	})
+}
+
+func (p *interceptedPlugin) Usage(scope string) (*Usage, error) {
+	return intercept(p, context.Background(), Call{Operation: "get_storage_usage", Path: scope, Idempotent: true}, func(ctx context.Context) (*Usage, error) {
+		quota, err := quotaPlugin(p.inner)
+		if err != nil {
+			return nil, err
+		}
+		return quota.Usage(scope)
+	})
+}
+
+func (p *interceptedPlugin) UsageReport() ([]Usage, error) {
+	return intercept(p, context.Background(), Call{Operation: "get_storage_usage_report", Idempotent: true}, func(ctx context.Context) ([]Usage, error) {
+		quota, err := quotaPlugin(p.inner)
+		if err != nil {
+			return nil, err
+		}
+		return quota.UsageReport()
+	})
+}
+
+func (p *interceptedPlugin) SetQuota(scope string, quota Quota) error {
+	return interceptErr(p, context.Background(), Call{Operation: "set_storage_quota", Path: scope, Idempotent: true}, func(ctx context.Context) error {
+		quotas, err := quotaPlugin(p.inner)
+		if err != nil {
+			return err
+		}
+		return quotas.SetQuota(scope, quota)
+	})
+}
+
+// reservedPathPlugin is embedded by the decorators that keep their own records in the wrapped plugin
+// under a reserved prefix. It rejects reads of reserved paths with the error of checkPath, so the
+// records can't be read around the decorator, and passes other reads through.
+type reservedPathPlugin struct {
+	*interceptedPlugin
+	checkPath func(path string) error
+}
+
+func (p *reservedPathPlugin) RetrieveFile(path string) ([]byte, error) {
+	return p.RetrieveFileWithContext(context.Background(), path)
+}
+
+func (p *reservedPathPlugin) RetrieveFileWithContext(ctx context.Context, path string) ([]byte, error) {
+	if err := p.checkPath(path); err != nil {
+		return nil, err
+	}
+	return p.interceptedPlugin.RetrieveFileWithContext(ctx, path)
+}
+
+// FileExists reports false for reserved paths
+func (p *reservedPathPlugin) FileExists(path string) bool {
+	exists, err := p.FileExistsWithContext(context.Background(), path)
+	return err == nil && exists
+}
+
+func (p *reservedPathPlugin) FileExistsWithContext(ctx context.Context, path string) (bool, error) {
+	if err := p.checkPath(path); err != nil {
+		return false, err
+	}
+	return p.interceptedPlugin.FileExistsWithContext(ctx, path)
+}
+
+// FilesExist reports reserved paths as missing
+func (p *reservedPathPlugin) FilesExist(paths []string) ([]ExistsResult, error) {
+	results, err := p.interceptedPlugin.FilesExist(paths)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		if p.checkPath(results[i].Path) != nil {
+			results[i].Exists = false
+		}
+	}
+	return results, nil
+}
+
+// GenerateURL returns nil for reserved paths
+func (p *reservedPathPlugin) GenerateURL(path string, baseURL string) *string {
+	if p.checkPath(path) != nil {
+		return nil
+	}
+	return p.interceptedPlugin.GenerateURL(path, baseURL)
+}
+
+func (p *reservedPathPlugin) GenerateSignedURL(path string, options URLOptions) (*SignedURL, error) {
+	if err := p.checkPath(path); err != nil {
+		return nil, err
+	}
+	return p.interceptedPlugin.GenerateSignedURL(path, options)
+}
+
+func (p *reservedPathPlugin) FileSize(path string) (int64, error) {
+	if err := p.checkPath(path); err != nil {
+		return 0, err
+	}
+	return p.interceptedPlugin.FileSize(path)
+}
+
+func (p *reservedPathPlugin) RetrieveRange(path string, offset int64, length int64) ([]byte, error) {
+	if err := p.checkPath(path); err != nil {
+		return nil, err
+	}
+	return p.interceptedPlugin.RetrieveRange(path, offset, length)
+}
+
+func (p *reservedPathPlugin) StatFile(path string) (*FileMetadata, error) {
+	if err := p.checkPath(path); err != nil {
+		return nil, err
+	}
+	return p.interceptedPlugin.StatFile(path)
+}
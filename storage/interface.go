@@ -1,5 +1,7 @@
 package storage
 
+import "context"
+
 // StoragePlugin defines the interface that all storage plugins must implement
 type StoragePlugin interface {
 	// StoreFile stores data at the specified path with optional content type
@@ -26,6 +28,233 @@ type StoragePlugin interface {
 	Cleanup() error
 }
 
+// StreamingStoragePlugin extends StoragePlugin with chunked uploads
+// Plugins that implement this can receive large files without buffering the whole payload in memory
+type StreamingStoragePlugin interface {
+	StoragePlugin
+
+	// OpenUpload starts a streaming upload to the specified path with optional content type
+	OpenUpload(path string, contentType *string) (UploadWriter, error)
+}
+
+// UploadWriter receives the data of a streaming upload chunk by chunk
+type UploadWriter interface {
+	// WriteChunk appends the next chunk of data to the upload
+	WriteChunk(chunk []byte) error
+
+	// Commit finalizes the upload and makes the file available at its path
+	// If Commit fails the upload is discarded
+	Commit() error
+
+	// Abort discards the upload and any data written so far
+	Abort() error
+}
+
+// OptionsStoragePlugin extends StoragePlugin with the options form of StoreFile
+// Plugins that implement this should persist the content type and checksum so StatFile can return them,
+// and must enforce IfMatch and IfNoneMatch atomically (see CheckPreconditions)
+type OptionsStoragePlugin interface {
+	StoragePlugin
+
+	// StoreFileWithOptions stores data at the specified path
+	// The context is cancelled when the host cancels the operation, progress is available through ProgressFromContext
+	StoreFileWithOptions(ctx context.Context, path string, data []byte, options StoreOptions) error
+}
+
+// StoragePluginWithContext extends StoragePlugin with context-aware methods
+// The context is cancelled when the host cancels the operation or its deadline passes
+type StoragePluginWithContext interface {
+	StoragePlugin
+
+	// StoreFileWithContext stores data with cancellation support
+	// Upload progress can be reported through ProgressFromContext(ctx)
+	StoreFileWithContext(ctx context.Context, path string, data []byte, contentType *string) error
+
+	// RetrieveFileWithContext retrieves file data with cancellation support
+	RetrieveFileWithContext(ctx context.Context, path string) ([]byte, error)
+
+	// DeleteFileWithContext deletes a file with cancellation support
+	DeleteFileWithContext(ctx context.Context, path string) error
+
+	// FileExistsWithContext checks if a file exists with cancellation support
+	FileExistsWithContext(ctx context.Context, path string) (bool, error)
+}
+
+// ProgressStoragePlugin extends StoragePlugin with per-operation progress reporting
+// Plugins should implement this instead of calling ReportProgress so concurrent uploads report their own progress
+type ProgressStoragePlugin interface {
+	StoragePlugin
+
+	// StoreFileWithProgress stores data like StoreFile and reports upload progress through progress
+	// progress is never nil and may be called from any goroutine
+	StoreFileWithProgress(path string, data []byte, contentType *string, progress ProgressFunc) error
+}
+
+// ProgressFunc receives the progress of a single operation from 0.0 to 1.0
+type ProgressFunc func(progress float64)
+
+// RangedStoragePlugin extends StoragePlugin with partial reads
+// Plugins that implement this can serve byte ranges without loading the whole file
+type RangedStoragePlugin interface {
+	StoragePlugin
+
+	// FileSize returns the size in bytes of the file at the specified path
+	FileSize(path string) (int64, error)
+
+	// RetrieveRange retrieves up to length bytes starting at offset
+	// Fewer bytes are returned when the range extends past the end of the file
+	RetrieveRange(path string, offset int64, length int64) ([]byte, error)
+}
+
+// StatStoragePlugin extends StoragePlugin with file metadata lookups
+type StatStoragePlugin interface {
+	StoragePlugin
+
+	// StatFile returns the metadata of the file at the specified path without retrieving its content
+	StatFile(path string) (*FileMetadata, error)
+}
+
+// ListingStoragePlugin extends StoragePlugin with paginated enumeration of stored files
+type ListingStoragePlugin interface {
+	StoragePlugin
+
+	// ListFiles returns up to limit files whose path starts with prefix, ordered by path
+	// An empty cursor starts from the beginning, otherwise pass the NextCursor of the previous page
+	ListFiles(prefix string, cursor string, limit int) (*ListResult, error)
+}
+
+// SignedURLStoragePlugin extends StoragePlugin with time-limited URLs
+// Plugins that implement this let clients upload and download directly instead of going through the host
+type SignedURLStoragePlugin interface {
+	StoragePlugin
+
+	// GenerateSignedURL generates a URL for the specified path that expires after options.ExpiresIn()
+	// Options are validated and defaulted before the plugin is called
+	GenerateSignedURL(path string, options URLOptions) (*SignedURL, error)
+}
+
+// CopyStoragePlugin extends StoragePlugin with server-side copies
+type CopyStoragePlugin interface {
+	StoragePlugin
+
+	// CopyFile copies the file at sourcePath to destinationPath, replacing any existing file
+	CopyFile(sourcePath string, destinationPath string) error
+}
+
+// MoveStoragePlugin extends StoragePlugin with server-side moves and renames
+type MoveStoragePlugin interface {
+	StoragePlugin
+
+	// MoveFile moves the file at sourcePath to destinationPath, replacing any existing file
+	MoveFile(sourcePath string, destinationPath string) error
+}
+
+// MultipartStoragePlugin extends StoragePlugin with resumable multipart uploads
+// Parts can be uploaded independently and in any order, so an interrupted upload only resends missing parts
+type MultipartStoragePlugin interface {
+	StoragePlugin
+
+	// InitiateMultipartUpload starts a multipart upload to the specified path and returns its upload ID
+	InitiateMultipartUpload(path string, contentType *string) (string, error)
+
+	// UploadPart stores a part of the upload, replacing any earlier upload of the same part number
+	UploadPart(uploadID string, partNumber int, data []byte) (*UploadedPart, error)
+
+	// ListUploadedParts returns the parts uploaded so far ordered by part number
+	ListUploadedParts(uploadID string) ([]UploadedPart, error)
+
+	// CompleteMultipartUpload assembles the listed parts into the final file
+	// Parts are listed in ascending order and their ETags must match the uploaded parts
+	CompleteMultipartUpload(uploadID string, parts []UploadedPart) error
+
+	// AbortMultipartUpload discards the upload and all of its parts
+	AbortMultipartUpload(uploadID string) error
+}
+
+// BatchDeleteStoragePlugin extends StoragePlugin with deleting many files in one call
+type BatchDeleteStoragePlugin interface {
+	StoragePlugin
+
+	// DeleteFiles deletes the specified paths and returns one result per path in the same order
+	// A failure for one path must not stop the others; the error return is for failures of the whole batch
+	DeleteFiles(paths []string) ([]DeleteResult, error)
+}
+
+// BatchExistsStoragePlugin extends StoragePlugin with checking many files in one call
+type BatchExistsStoragePlugin interface {
+	StoragePlugin
+
+	// FilesExist checks the specified paths and returns one result per path in the same order
+	FilesExist(paths []string) ([]ExistsResult, error)
+}
+
+// VersioningStoragePlugin extends StoragePlugin with versions of overwritten and deleted files
+// Plugins that implement this keep earlier versions when a file is overwritten and can restore them
+type VersioningStoragePlugin interface {
+	StoragePlugin
+
+	// ListVersions returns the versions of the file at path, newest first
+	// Deleted files are listed with a delete marker as their latest version
+	ListVersions(path string) ([]FileVersion, error)
+
+	// RetrieveVersion retrieves the data of a version
+	RetrieveVersion(path string, versionID string) ([]byte, error)
+
+	// RestoreVersion makes a copy of a version the latest version of the file, which also undeletes it
+	RestoreVersion(path string, versionID string) error
+
+	// DeleteVersion permanently deletes a version that isn't the latest one
+	DeleteVersion(path string, versionID string) error
+
+	// PurgeExpiredVersions permanently deletes the versions past their retention period
+	// and returns how many were deleted
+	PurgeExpiredVersions() (int, error)
+}
+
+// RangedVersionStoragePlugin extends VersioningStoragePlugin with partial reads of versions
+// Without it, parts of a version are cut from the whole version returned by RetrieveVersion
+type RangedVersionStoragePlugin interface {
+	VersioningStoragePlugin
+
+	// RetrieveVersionRange retrieves up to length bytes of a version starting at offset
+	// Fewer bytes are returned when the range extends past the end of the version, a length of 0 reads until the end
+	RetrieveVersionRange(path string, versionID string, offset int64, length int64) ([]byte, error)
+}
+
+// LifecycleStoragePlugin is implemented by plugins that expire files
+// The plugin honours StoreOptions.ExpiresAt and deletes expired files when they are swept,
+// backends with native lifecycle rules may delete them earlier on their own
+type LifecycleStoragePlugin interface {
+	StoragePlugin
+
+	// SweepExpiredFiles deletes the files past their expiry and returns how many were deleted
+	SweepExpiredFiles(ctx context.Context) (int, error)
+}
+
+// QuotaStoragePlugin is implemented by plugins that account storage usage per scope and enforce quotas
+// A scope is a path prefix such as "orgs/42/", writes that would exceed its quota fail with QuotaExceededErrorType
+type QuotaStoragePlugin interface {
+	StoragePlugin
+
+	// Usage returns the usage and quota of a scope
+	Usage(scope string) (*Usage, error)
+
+	// UsageReport counts the files of every scope again and returns the usage of all known scopes
+	UsageReport() ([]Usage, error)
+
+	// SetQuota sets the quota of a scope, replacing the default quota
+	SetQuota(scope string, quota Quota) error
+}
+
+// WrappingStoragePlugin is implemented by decorators that forward every capability to the plugin they wrap
+// The supports_* exports look through it and report the capabilities of the wrapped plugin
+type WrappingStoragePlugin interface {
+	StoragePlugin
+
+	// Unwrap returns the wrapped plugin
+	Unwrap() StoragePlugin
+}
+
 // Global variable to hold the registered plugin instance
 var registeredPlugin StoragePlugin
 
@@ -0,0 +1,42 @@
+package storage
+
+const (
+	// DefaultListLimit is the page size used when the host doesn't request one
+	DefaultListLimit = 1000
+
+	// MaxListLimit is the largest page size passed to plugins
+	MaxListLimit = 10000
+)
+
+// ListResult is a single page of a file listing
+// It is serialized as JSON when returned through the FFI
+type ListResult struct {
+	Files []FileMetadata `json:"files"`
+
+	// NextCursor is the continuation token for the next page, nil when the listing is complete
+	NextCursor *string `json:"next_cursor,omitempty"`
+}
+
+// listFiles returns a page of files under prefix with the limit clamped to the supported range
+func listFiles(plugin StoragePlugin, prefix string, cursor string, limit int) (*ListResult, error) {
+	listing, ok := plugin.(ListingStoragePlugin)
+	if !ok {
+		return nil, NewUnsupportedError("Plugin does not support listing files")
+	}
+
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	result, err := listing.ListFiles(prefix, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	if result.Files == nil {
+		result.Files = []FileMetadata{}
+	}
+	return result, nil
+}
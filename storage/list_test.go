@@ -0,0 +1,73 @@
+package storage
+
+import "testing"
+
+// limitPlugin records the page size it is asked for and returns no files
+type limitPlugin struct {
+	*memoryPlugin
+	limit int
+}
+
+func (p *limitPlugin) ListFiles(prefix string, cursor string, limit int) (*ListResult, error) {
+	p.limit = limit
+	return &ListResult{}, nil
+}
+
+func TestListFilesLimit(t *testing.T) {
+	tests := []struct {
+		limit int
+		want  int
+	}{
+		{limit: 0, want: DefaultListLimit},
+		{limit: -1, want: DefaultListLimit},
+		{limit: 10, want: 10},
+		{limit: MaxListLimit + 1, want: MaxListLimit},
+	}
+
+	for _, tt := range tests {
+		plugin := &limitPlugin{memoryPlugin: newMemoryPlugin(nil)}
+		result, err := listFiles(plugin, "", "", tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plugin.limit != tt.want {
+			t.Errorf("limit %d passed as %d, want %d", tt.limit, plugin.limit, tt.want)
+		}
+		if result.Files == nil {
+			t.Error("empty listing has nil files")
+		}
+	}
+}
+
+func TestListFilesPages(t *testing.T) {
+	plugin := newMemoryPlugin(map[string]string{"a/1": "", "a/2": "", "a/3": "", "b/1": ""})
+
+	var paths []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("listing doesn't end")
+		}
+		result, err := listFiles(plugin, "a/", cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range result.Files {
+			paths = append(paths, file.Path)
+		}
+		if result.NextCursor == nil {
+			break
+		}
+		cursor = *result.NextCursor
+	}
+
+	if len(paths) != 3 || paths[0] != "a/1" || paths[1] != "a/2" || paths[2] != "a/3" {
+		t.Errorf("listed %v, want a/1 a/2 a/3", paths)
+	}
+}
+
+func TestListFilesUnsupported(t *testing.T) {
+	if _, err := listFiles(basicPlugin{newMemoryPlugin(nil)}, "", "", 0); err == nil {
+		t.Error("listing a plugin without ListFiles succeeded")
+	}
+}
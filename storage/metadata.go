@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Limits of the custom metadata attached to a file
+const (
+	MaxMetadataKeyLength = 128
+	MaxMetadataSize      = 8 << 10
+)
+
+// FileMetadata describes a stored file
+// It is serialized as JSON when returned through the FFI
+type FileMetadata struct {
+	Path         string     `json:"path"`
+	Size         int64      `json:"size"`
+	ContentType  *string    `json:"content_type,omitempty"`
+	ETag         *string    `json:"etag,omitempty"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+
+	// Checksum is the digest recorded when the file was stored, if the plugin keeps one
+	Checksum *Checksum `json:"checksum,omitempty"`
+
+	// ContentEncoding is set when the data is stored compressed, e.g. "gzip"
+	ContentEncoding *string `json:"content_encoding,omitempty"`
+
+	// EncryptionKeyID is the ID of the key that encrypted the file, when it is stored encrypted
+	EncryptionKeyID *string `json:"encryption_key_id,omitempty"`
+
+	// Metadata is the custom key/value metadata given when the file was stored
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// ExpiresAt is when the file is deleted by a sweep, nil when it doesn't expire
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// statFile returns the metadata of the file at path
+// Plugins that don't implement StatStoragePlugin only get the size filled in
+func statFile(plugin StoragePlugin, path string) (*FileMetadata, error) {
+	if stat, ok := plugin.(StatStoragePlugin); ok {
+		return stat.StatFile(path)
+	}
+
+	if !plugin.FileExists(path) {
+		return nil, NewNotFoundError(path)
+	}
+
+	size, err := fileSize(plugin, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileMetadata{
+		Path: path,
+		Size: size,
+	}, nil
+}
+
+// validateMetadata checks custom metadata against the key format and size limits
+// Keys are made of ASCII letters, digits, '-', '_' and '.', the size counts the bytes of all keys and values
+func validateMetadata(metadata map[string]string) error {
+	size := 0
+	for key, value := range metadata {
+		if key == "" || len(key) > MaxMetadataKeyLength {
+			return NewInvalidInputError(fmt.Sprintf("metadata keys must be 1 to %d characters long", MaxMetadataKeyLength))
+		}
+		for _, c := range key {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+				return NewInvalidInputError(fmt.Sprintf("invalid metadata key %q", key))
+			}
+		}
+		size += len(key) + len(value)
+	}
+
+	if size > MaxMetadataSize {
+		return NewInvalidInputError(fmt.Sprintf("metadata is %d bytes, the limit is %d", size, MaxMetadataSize))
+	}
+	return nil
+}
+
+// preservedOptions returns the store options that recreate the content type and custom metadata of a file
+// when its data is stored again, e.g. by a copy or a restore
+func preservedOptions(metadata *FileMetadata) StoreOptions {
+	if metadata == nil {
+		return StoreOptions{}
+	}
+	return StoreOptions{ContentType: metadata.ContentType, Metadata: metadata.Metadata}
+}
+
+// retrieveFileWithMetadata retrieves a file together with its metadata
+// The two are read separately, a concurrent write can make them describe different versions
+func retrieveFileWithMetadata(ctx context.Context, plugin StoragePlugin, path string) ([]byte, *FileMetadata, error) {
+	data, err := retrieveFile(ctx, plugin, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata, err := statFile(plugin, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, metadata, nil
+}
+
+// frameWithMetadata prefixes data with its JSON metadata for a single FFI response
+// The frame is the length of the JSON as a little-endian uint32, the JSON, then the data
+func frameWithMetadata(metadata *FileMetadata, data []byte) ([]byte, error) {
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, NewStorageError("failed to encode metadata: " + err.Error())
+	}
+
+	frame := make([]byte, 4, 4+len(encoded)+len(data))
+	binary.LittleEndian.PutUint32(frame, uint32(len(encoded)))
+	frame = append(frame, encoded...)
+	return append(frame, data...), nil
+}
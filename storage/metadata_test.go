@@ -0,0 +1,42 @@
+package storage
+
+import "testing"
+
+// basicPlugin hides the optional interfaces of the plugin it wraps
+type basicPlugin struct {
+	StoragePlugin
+}
+
+func TestStatFile(t *testing.T) {
+	inner := newMemoryPlugin(nil)
+	inner.StoreFile("a", []byte("abc"), ptr("text/plain"))
+
+	tests := []struct {
+		name   string
+		plugin StoragePlugin
+		// full is set when the plugin reports more than the size
+		full bool
+	}{
+		{name: "stat plugin", plugin: inner, full: true},
+		{name: "fallback", plugin: basicPlugin{inner}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata, err := statFile(tt.plugin, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if metadata.Path != "a" || metadata.Size != 3 {
+				t.Errorf("metadata = %+v, want path a and size 3", metadata)
+			}
+			if full := metadata.ContentType != nil && metadata.ETag != nil && metadata.LastModified != nil; full != tt.full {
+				t.Errorf("content type, etag and modification time filled in = %v, want %v", full, tt.full)
+			}
+
+			if _, err := statFile(tt.plugin, "missing"); err == nil {
+				t.Error("missing file has metadata")
+			}
+		})
+	}
+}
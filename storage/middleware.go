@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/matt953/relm-plugin-core-go/config"
+)
+
+// Middleware decorates a StoragePlugin, e.g. with retries or timeouts
+type Middleware func(plugin StoragePlugin) StoragePlugin
+
+// Chain wraps plugin with the middleware, the first middleware is the outermost
+func Chain(plugin StoragePlugin, middleware ...Middleware) StoragePlugin {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		plugin = middleware[i](plugin)
+	}
+	return plugin
+}
+
+// Call describes a plugin call passing through an Interceptor
+type Call struct {
+	// Operation is the name of the FFI export the call belongs to, e.g. "store_file"
+	Operation string
+
+	// Path is the file the call operates on, empty for calls on several files or on an upload
+	Path string
+
+	// Idempotent is false for calls that can't safely be repeated, such as completing a multipart upload
+	Idempotent bool
+}
+
+// Interceptor runs around every plugin call made through an intercepted plugin
+// invoke performs the call; it may be called several times but never concurrently. When ctx is done
+// before the plugin returns, invoke returns without waiting for it and the call must not be repeated,
+// shouldRetry reports false for that error.
+type Interceptor func(ctx context.Context, call Call, invoke func(ctx context.Context) error) error
+
+// Intercept returns a Middleware that runs interceptor around every call to the plugin
+// The decorated plugin forwards all optional capabilities, falling back like the FFI does
+// when the wrapped plugin doesn't implement them
+func Intercept(interceptor Interceptor) Middleware {
+	return func(plugin StoragePlugin) StoragePlugin {
+		return &interceptedPlugin{inner: plugin, interceptor: interceptor}
+	}
+}
+
+// capabilityProvider is implemented by decorators that provide the capability T themselves
+// instead of forwarding it, e.g. VersioningPlugin for VersioningStoragePlugin
+type capabilityProvider[T StoragePlugin] interface {
+	providesCapability(T)
+}
+
+// capabilityHider is implemented by decorators that don't forward some capabilities of the plugin they wrap,
+// e.g. EncryptionPlugin for streaming uploads. hidesCapability is called with a nil pointer to the capability
+// interface, such as (*StreamingStoragePlugin)(nil)
+type capabilityHider interface {
+	hidesCapability(capability any) bool
+}
+
+// implements reports whether plugin implements the capability T, looking through decorators
+func implements[T StoragePlugin](plugin StoragePlugin) bool {
+	for {
+		if _, ok := plugin.(capabilityProvider[T]); ok {
+			return true
+		}
+		if hider, ok := plugin.(capabilityHider); ok && hider.hidesCapability((*T)(nil)) {
+			return false
+		}
+		wrapper, ok := plugin.(WrappingStoragePlugin)
+		if !ok {
+			break
+		}
+		plugin = wrapper.Unwrap()
+	}
+
+	_, ok := plugin.(T)
+	return ok
+}
+
+// abandonedCallError is returned by awaitContext when ctx is done before fn returns
+// fn is still running, so repeating the call would run it concurrently with itself
+type abandonedCallError struct {
+	*PluginError
+}
+
+func (e *abandonedCallError) Unwrap() error {
+	return e.PluginError
+}
+
+// awaitContext runs fn and returns early when ctx is done
+// Plugin methods that don't take a context can't be interrupted, they finish in the background
+// and their result is discarded
+func awaitContext[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	var zero T
+	if ctx.Done() == nil {
+		return fn()
+	}
+	if err := ctx.Err(); err != nil {
+		return zero, contextError(err)
+	}
+
+	type outcome struct {
+		value T
+		err   error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		value, err := fn()
+		done <- outcome{value: value, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.value, result.err
+	case <-ctx.Done():
+		return zero, &abandonedCallError{PluginError: contextError(ctx.Err())}
+	}
+}
+
+// Plugin config keys for the built-in middleware
+const (
+	RetryMaxAttemptsConfigKey        = "retry_max_attempts"
+	RetryInitialBackoffConfigKey     = "retry_initial_backoff_ms"
+	RetryMaxBackoffConfigKey         = "retry_max_backoff_ms"
+	CallTimeoutConfigKey             = "call_timeout_ms"
+	CircuitBreakerThresholdConfigKey = "circuit_breaker_threshold"
+	CircuitBreakerCooldownConfigKey  = "circuit_breaker_cooldown_ms"
+	CacheMaxBytesConfigKey           = "cache_max_bytes"
+	CacheMaxFileSizeConfigKey        = "cache_max_file_size"
+	CacheTTLConfigKey                = "cache_ttl_ms"
+)
+
+// MiddlewareFromConfig builds the built-in middleware enabled in the plugin config
+// The cache is enabled by cache_max_bytes > 0, retries by retry_max_attempts > 1, the circuit breaker
+// by circuit_breaker_threshold > 0 and per-call timeouts by call_timeout_ms > 0. The middleware is returned
+// in the order cache, retry, circuit breaker, timeout, so cache hits skip the backend entirely and every
+// attempt gets its own timeout and counts towards the breaker.
+// The config is only available after initialize_with_config, so call this from a PluginInitializer
+func MiddlewareFromConfig() ([]Middleware, error) {
+	var middleware []Middleware
+
+	cache := DefaultCacheOptions()
+	maxBytes, err := pluginConfigInt(CacheMaxBytesConfigKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes > 0 {
+		cache.MaxBytes = int64(maxBytes)
+		maxFileSize, err := pluginConfigInt(CacheMaxFileSizeConfigKey, int(cache.MaxFileSize))
+		if err != nil {
+			return nil, err
+		}
+		cache.MaxFileSize = int64(maxFileSize)
+		if cache.TTL, err = pluginConfigMillis(CacheTTLConfigKey, cache.TTL); err != nil {
+			return nil, err
+		}
+		middleware = append(middleware, WithCache(cache))
+	}
+
+	retry := DefaultRetryPolicy()
+	attempts, err := pluginConfigInt(RetryMaxAttemptsConfigKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	if attempts > 1 {
+		retry.MaxAttempts = attempts
+		if retry.InitialBackoff, err = pluginConfigMillis(RetryInitialBackoffConfigKey, retry.InitialBackoff); err != nil {
+			return nil, err
+		}
+		if retry.MaxBackoff, err = pluginConfigMillis(RetryMaxBackoffConfigKey, retry.MaxBackoff); err != nil {
+			return nil, err
+		}
+		middleware = append(middleware, WithRetry(retry))
+	}
+
+	breaker := DefaultCircuitBreakerSettings()
+	threshold, err := pluginConfigInt(CircuitBreakerThresholdConfigKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	if threshold > 0 {
+		breaker.FailureThreshold = threshold
+		if breaker.Cooldown, err = pluginConfigMillis(CircuitBreakerCooldownConfigKey, breaker.Cooldown); err != nil {
+			return nil, err
+		}
+		middleware = append(middleware, WithCircuitBreaker(breaker))
+	}
+
+	timeout, err := pluginConfigMillis(CallTimeoutConfigKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		middleware = append(middleware, WithTimeout(timeout))
+	}
+
+	return middleware, nil
+}
+
+// pluginConfigInt reads a non-negative integer from the plugin config
+func pluginConfigInt(key string, defaultValue int) (int, error) {
+	value, ok := config.GetPluginConfigValue(key)
+	if !ok || value == "" {
+		return defaultValue, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, NewConfigurationError(fmt.Sprintf("invalid %s: %q", key, value))
+	}
+	return n, nil
+}
+
+// pluginConfigMillis reads a duration in milliseconds from the plugin config
+func pluginConfigMillis(key string, defaultValue time.Duration) (time.Duration, error) {
+	n, err := pluginConfigInt(key, -1)
+	if err != nil || n < 0 {
+		return defaultValue, err
+	}
+	return time.Duration(n) * time.Millisecond, nil
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// MinPartNumber is the number of the first part of a multipart upload
+	MinPartNumber = 1
+
+	// MaxPartNumber is the highest part number a multipart upload may use
+	MaxPartNumber = 10000
+)
+
+// MultipartUpload identifies a multipart upload started with InitiateMultipartUpload
+// It is serialized as JSON when returned through the FFI
+type MultipartUpload struct {
+	UploadID string `json:"upload_id"`
+	Path     string `json:"path"`
+}
+
+// UploadedPart describes a part that has been uploaded
+// A list of parts is the JSON manifest passed to complete_multipart_upload
+type UploadedPart struct {
+	PartNumber int    `json:"part_number"`
+	Size       int64  `json:"size"`
+	ETag       string `json:"etag"`
+}
+
+// multipartPlugin returns the plugin as a MultipartStoragePlugin
+func multipartPlugin(plugin StoragePlugin) (MultipartStoragePlugin, error) {
+	multipart, ok := plugin.(MultipartStoragePlugin)
+	if !ok {
+		return nil, NewUnsupportedError("Plugin does not support multipart uploads")
+	}
+	return multipart, nil
+}
+
+// validatePartNumber checks that a part number is in the supported range
+func validatePartNumber(partNumber int) error {
+	if partNumber < MinPartNumber || partNumber > MaxPartNumber {
+		return NewInvalidInputError(fmt.Sprintf("part number must be between %d and %d", MinPartNumber, MaxPartNumber))
+	}
+	return nil
+}
+
+// parsePartManifest decodes the part manifest sent by the host
+// Parts must be listed in ascending order without duplicates
+func parsePartManifest(manifestJSON string) ([]UploadedPart, error) {
+	var parts []UploadedPart
+	if err := json.Unmarshal([]byte(manifestJSON), &parts); err != nil {
+		return nil, NewInvalidInputError("failed to parse part manifest: " + err.Error())
+	}
+	if len(parts) == 0 {
+		return nil, NewInvalidInputError("part manifest must list at least one part")
+	}
+
+	for i, part := range parts {
+		if err := validatePartNumber(part.PartNumber); err != nil {
+			return nil, err
+		}
+		if i > 0 && part.PartNumber <= parts[i-1].PartNumber {
+			return nil, NewInvalidInputError("parts must be listed in ascending order without duplicates")
+		}
+	}
+	return parts, nil
+}
@@ -0,0 +1,40 @@
+package storage
+
+import "testing"
+
+func TestParsePartManifest(t *testing.T) {
+	tests := []struct {
+		name      string
+		manifest  string
+		wantParts int
+		wantErr   bool
+	}{
+		{name: "single part", manifest: `[{"part_number":1,"size":4,"etag":"a"}]`, wantParts: 1},
+		{name: "gaps are allowed", manifest: `[{"part_number":1},{"part_number":3},{"part_number":10000}]`, wantParts: 3},
+		{name: "empty", manifest: `[]`, wantErr: true},
+		{name: "out of order", manifest: `[{"part_number":2},{"part_number":1}]`, wantErr: true},
+		{name: "duplicate", manifest: `[{"part_number":1},{"part_number":1}]`, wantErr: true},
+		{name: "part number zero", manifest: `[{"part_number":0}]`, wantErr: true},
+		{name: "part number too high", manifest: `[{"part_number":10001}]`, wantErr: true},
+		{name: "malformed", manifest: `[{"part_number":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts, err := parsePartManifest(tt.manifest)
+			if tt.wantErr {
+				checkErrorType(t, err, ptr(InvalidInputError))
+				return
+			}
+			checkErrorType(t, err, nil)
+			if len(parts) != tt.wantParts {
+				t.Errorf("parsed %d parts, want %d", len(parts), tt.wantParts)
+			}
+		})
+	}
+}
+
+func TestMultipartUnsupported(t *testing.T) {
+	_, err := multipartPlugin(newMemoryPlugin(nil))
+	checkErrorType(t, err, ptr(UnsupportedErrorType))
+}
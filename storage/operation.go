@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Cancel functions of in-flight operations keyed by the host supplied operation ID
+var (
+	activeOperations = make(map[string]context.CancelFunc)
+	operationsMutex  sync.Mutex
+)
+
+// beginOperation creates the context for a host operation
+// An empty operation ID creates an operation that can't be cancelled, a zero timeout means no deadline
+// The returned function must be called when the operation finishes
+func beginOperation(operationID string, timeout time.Duration) (context.Context, func(), error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	if operationID == "" {
+		return ctx, cancel, nil
+	}
+
+	operationsMutex.Lock()
+	defer operationsMutex.Unlock()
+
+	if _, exists := activeOperations[operationID]; exists {
+		cancel()
+		return nil, nil, NewInvalidInputError("operation ID already in use: " + operationID)
+	}
+	activeOperations[operationID] = cancel
+
+	finish := func() {
+		operationsMutex.Lock()
+		delete(activeOperations, operationID)
+		operationsMutex.Unlock()
+		cancel()
+	}
+	return ctx, finish, nil
+}
+
+// cancelOperation cancels an in-flight operation
+// Returns false if no operation with that ID is running
+func cancelOperation(operationID string) bool {
+	operationsMutex.Lock()
+	cancel, ok := activeOperations[operationID]
+	operationsMutex.Unlock()
+
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// cancelAllOperations cancels every in-flight operation
+// Called when the plugin is being unloaded
+func cancelAllOperations() {
+	operationsMutex.Lock()
+	defer operationsMutex.Unlock()
+
+	for _, cancel := range activeOperations {
+		cancel()
+	}
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCancelOperation(t *testing.T) {
+	ctx, finish, err := beginOperation("op", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := beginOperation("op", 0); err == nil {
+		t.Error("operation ID used twice")
+	}
+
+	if !cancelOperation("op") {
+		t.Fatal("running operation can't be cancelled")
+	}
+	if ctx.Err() == nil {
+		t.Error("cancelled operation's context is still live")
+	}
+	checkErrorType(t, storeFile(ctx, newMemoryPlugin(nil), "a", nil, nil, nil), ptr(CancelledErrorType))
+
+	finish()
+	if cancelOperation("op") {
+		t.Error("finished operation can still be cancelled")
+	}
+	if _, finish, err := beginOperation("op", 0); err != nil {
+		t.Errorf("operation ID isn't released when the operation finishes: %v", err)
+	} else {
+		finish()
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	ctx, finish, err := beginOperation("", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer finish()
+
+	<-ctx.Done()
+	_, err = retrieveFile(ctx, newMemoryPlugin(map[string]string{"a": "x"}), "a")
+	checkErrorType(t, err, ptr(TimeoutErrorType))
+}
+
+func TestCancelAllOperations(t *testing.T) {
+	first, finishFirst, _ := beginOperation("first", 0)
+	defer finishFirst()
+	second, finishSecond, _ := beginOperation("second", 0)
+	defer finishSecond()
+
+	cancelAllOperations()
+	if first.Err() == nil || second.Err() == nil {
+		t.Error("operation survived cancelAllOperations")
+	}
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// StoreOptions carries the optional parameters of a store call
+// It is passed as JSON through the FFI
+type StoreOptions struct {
+	ContentType *string `json:"content_type,omitempty"`
+
+	// Checksum is the expected digest of the data
+	// The library verifies it before the plugin is called, plugins should persist it for StatFile
+	Checksum *Checksum `json:"checksum,omitempty"`
+
+	// IfMatch only stores the data when the ETag of the current file matches, "*" requires any file to exist
+	IfMatch *string `json:"if_match,omitempty"`
+
+	// IfNoneMatch set to "*" only stores the data when no file exists at the path
+	IfNoneMatch *string `json:"if_none_match,omitempty"`
+
+	// Metadata is custom key/value metadata stored with the file and returned by StatFile
+	// Plugins that implement OptionsStoragePlugin should persist it and return it unchanged
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// ExpiresAt is when the file is deleted by the next sweep, see LifecycleStoragePlugin
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// TTLSeconds sets ExpiresAt relative to the time of the store
+	// The library converts it into ExpiresAt, plugins only see ExpiresAt
+	TTLSeconds *int64 `json:"ttl_seconds,omitempty"`
+}
+
+// parseStoreOptions decodes the store options sent by the host
+func parseStoreOptions(optionsJSON string) (StoreOptions, error) {
+	var options StoreOptions
+	if optionsJSON == "" {
+		return options, nil
+	}
+
+	if err := json.Unmarshal([]byte(optionsJSON), &options); err != nil {
+		return options, NewInvalidInputError("failed to parse store options: " + err.Error())
+	}
+	if err := validatePreconditions(options); err != nil {
+		return options, err
+	}
+	if err := validateMetadata(options.Metadata); err != nil {
+		return options, err
+	}
+	if err := resolveExpiry(&options, time.Now()); err != nil {
+		return options, err
+	}
+	return options, nil
+}
+
+// storeFileWithOptions verifies the data against the options and stores it
+// Plugins that don't implement OptionsStoragePlugin only receive the content type,
+// their conditional writes are emulated and only atomic with respect to other conditional writes.
+// Custom metadata and expiry are rejected for plugins that can't keep them rather than silently dropped
+func storeFileWithOptions(ctx context.Context, plugin StoragePlugin, path string, data []byte, options StoreOptions, progress ProgressFunc) error {
+	if len(options.Metadata) > 0 && !implements[OptionsStoragePlugin](plugin) {
+		return NewUnsupportedError("Plugin does not support custom metadata")
+	}
+	if options.ExpiresAt != nil && !implements[LifecycleStoragePlugin](plugin) {
+		return NewUnsupportedError("Plugin does not support file expiry")
+	}
+	if options.Checksum != nil {
+		if err := options.Checksum.Verify(data); err != nil {
+			return err
+		}
+	}
+
+	return storeWithOptions(ctx, plugin, path, data, options, progress)
+}
+
+// storeWithOptions stores data whose checksum has already been verified
+// Wrappers that transform the data use it to pass the options on to the plugin they wrap
+func storeWithOptions(ctx context.Context, plugin StoragePlugin, path string, data []byte, options StoreOptions, progress ProgressFunc) error {
+	if optionsPlugin, ok := plugin.(OptionsStoragePlugin); ok {
+		if err := ctx.Err(); err != nil {
+			return contextError(err)
+		}
+		return optionsPlugin.StoreFileWithOptions(WithProgress(ctx, progress), path, data, options)
+	}
+
+	if options.hasPreconditions() {
+		unlock := conditionalWrites.Lock(path)
+		defer unlock()
+
+		if err := checkPluginPreconditions(plugin, path, options); err != nil {
+			return err
+		}
+	}
+
+	return storeFile(ctx, plugin, path, data, options.ContentType, progress)
+}
+
+// retrieveFileVerified retrieves a file and checks it against the checksum recorded at store time
+// Files without a recorded checksum are returned unchecked
+func retrieveFileVerified(ctx context.Context, plugin StoragePlugin, path string) ([]byte, error) {
+	data, err := retrieveFile(ctx, plugin, path)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := statFile(plugin, path)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Checksum != nil {
+		if err := metadata.Checksum.Verify(data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/matt953/relm-plugin-core-go/config"
+)
+
+// DefaultMaxPathLength is the longest path accepted by default, in bytes
+const DefaultMaxPathLength = 1024
+
+// Plugin config keys for the path rules
+const (
+	PathMaxLengthConfigKey      = "path_max_length"
+	PathAllowedPatternConfigKey = "path_allowed_pattern"
+)
+
+// PathRules configures the validation of paths received from the host
+type PathRules struct {
+	// MaxLength is the longest normalized path accepted in bytes, 0 means no limit
+	MaxLength int
+
+	// AllowedPattern must match the whole normalized path when set
+	AllowedPattern *regexp.Regexp
+}
+
+// Current path rules applied by the FFI entry points
+var (
+	pathRules      = DefaultPathRules()
+	pathRulesMutex sync.RWMutex
+)
+
+// DefaultPathRules returns the rules used when nothing is configured
+func DefaultPathRules() PathRules {
+	return PathRules{MaxLength: DefaultMaxPathLength}
+}
+
+// SetPathRules replaces the path rules applied before every plugin call
+func SetPathRules(rules PathRules) {
+	pathRulesMutex.Lock()
+	defer pathRulesMutex.Unlock()
+
+	pathRules = rules
+}
+
+// GetPathRules returns the path rules currently applied
+func GetPathRules() PathRules {
+	pathRulesMutex.RLock()
+	defer pathRulesMutex.RUnlock()
+
+	return pathRules
+}
+
+// PathRulesFromConfig builds path rules from the plugin config
+// Keys that aren't set keep their default value
+func PathRulesFromConfig() (PathRules, error) {
+	rules := DefaultPathRules()
+
+	if value, ok := config.GetPluginConfigValue(PathMaxLengthConfigKey); ok {
+		maxLength, err := strconv.Atoi(value)
+		if err != nil || maxLength < 0 {
+			return rules, NewConfigurationError(fmt.Sprintf("invalid %s: %q", PathMaxLengthConfigKey, value))
+		}
+		rules.MaxLength = maxLength
+	}
+
+	if value, ok := config.GetPluginConfigValue(PathAllowedPatternConfigKey); ok && value != "" {
+		pattern, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return rules, NewConfigurationError(fmt.Sprintf("invalid %s: %v", PathAllowedPatternConfigKey, err))
+		}
+		rules.AllowedPattern = pattern
+	}
+
+	return rules, nil
+}
+
+// ValidatePath checks a file path against the current rules and returns its normalized form
+// Empty segments and "." segments are removed; empty, absolute and ".." paths are rejected
+func ValidatePath(path string) (string, error) {
+	if path == "" {
+		return "", NewInvalidInputError("path must not be empty")
+	}
+	if strings.HasSuffix(path, "/") {
+		return "", NewInvalidInputError("path must not end with '/': " + path)
+	}
+
+	normalized, err := normalizePath(path)
+	if err != nil {
+		return "", err
+	}
+	if normalized == "" {
+		return "", NewInvalidInputError("path must not be empty")
+	}
+	return normalized, nil
+}
+
+// ValidatePrefix checks a listing prefix against the current rules and returns its normalized form
+// Unlike paths, prefixes may be empty and may end with '/'
+func ValidatePrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return "", nil
+	}
+
+	normalized, err := normalizePath(prefix)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(prefix, "/") && normalized != "" {
+		normalized += "/"
+	}
+	return normalized, nil
+}
+
+// normalizePath applies the checks shared by paths and prefixes
+func normalizePath(path string) (string, error) {
+	for _, r := range path {
+		if r == 0 {
+			return "", NewInvalidInputError("path must not contain NUL bytes")
+		}
+		if unicode.IsControl(r) {
+			return "", NewInvalidInputError("path must not contain control characters")
+		}
+	}
+	if strings.HasPrefix(path, "/") {
+		return "", NewInvalidInputError("path must be relative: " + path)
+	}
+	if strings.Contains(path, "\\") {
+		return "", NewInvalidInputError("path must not contain backslashes: " + path)
+	}
+
+	segments := make([]string, 0, strings.Count(path, "/")+1)
+	for _, segment := range strings.Split(path, "/") {
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			return "", NewInvalidInputError("path must not contain '..' segments: " + path)
+		}
+		segments = append(segments, segment)
+	}
+	normalized := strings.Join(segments, "/")
+
+	rules := GetPathRules()
+	if rules.MaxLength > 0 && len(normalized) > rules.MaxLength {
+		return "", NewInvalidInputError(fmt.Sprintf("path is longer than %d bytes", rules.MaxLength))
+	}
+	if rules.AllowedPattern != nil && normalized != "" && !rules.AllowedPattern.MatchString(normalized) {
+		return "", NewInvalidInputError("path contains characters that are not allowed: " + path)
+	}
+
+	return normalized, nil
+}
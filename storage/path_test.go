@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestValidatePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   *PathRules
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", path: "docs/readme.md", want: "docs/readme.md"},
+		{name: "empty segments", path: "docs//a///b.txt", want: "docs/a/b.txt"},
+		{name: "dot segments", path: "./docs/./a.txt", want: "docs/a.txt"},
+		{name: "unicode", path: "fotos/été.jpg", want: "fotos/été.jpg"},
+		{name: "empty", path: "", wantErr: true},
+		{name: "only dots", path: "./.", wantErr: true},
+		{name: "trailing slash", path: "docs/", wantErr: true},
+		{name: "absolute", path: "/etc/passwd", wantErr: true},
+		{name: "parent", path: "docs/../secret", wantErr: true},
+		{name: "backslash", path: "docs\\a.txt", wantErr: true},
+		{name: "NUL byte", path: "docs/a\x00.txt", wantErr: true},
+		{name: "control character", path: "docs/a\n.txt", wantErr: true},
+		{name: "too long", path: strings.Repeat("a", DefaultMaxPathLength+1), wantErr: true},
+		{name: "length counts the normalized path", rules: &PathRules{MaxLength: 5}, path: "./a//b/c", want: "a/b/c"},
+		{name: "no length limit", rules: &PathRules{}, path: strings.Repeat("a", DefaultMaxPathLength+1), want: strings.Repeat("a", DefaultMaxPathLength+1)},
+		{name: "allowed pattern", rules: &PathRules{AllowedPattern: regexp.MustCompile(`^(?:[a-z/.]+)$`)}, path: "docs/a.txt", want: "docs/a.txt"},
+		{name: "disallowed by pattern", rules: &PathRules{AllowedPattern: regexp.MustCompile(`^(?:[a-z/.]+)$`)}, path: "docs/A.txt", wantErr: true},
+	}
+
+	defer SetPathRules(GetPathRules())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := DefaultPathRules()
+			if tt.rules != nil {
+				rules = *tt.rules
+			}
+			SetPathRules(rules)
+
+			got, err := ValidatePath(tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ValidatePath(%q) = %q, want an error", tt.path, got)
+				}
+				if perr := AsPluginError(err); perr == nil || perr.Type != InvalidInputError {
+					t.Fatalf("ValidatePath(%q) error = %v, want an invalid input error", tt.path, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ValidatePath(%q) error = %v", tt.path, err)
+			}
+			if got != tt.want {
+				t.Errorf("ValidatePath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		want    string
+		wantErr bool
+	}{
+		{prefix: "", want: ""},
+		{prefix: "docs", want: "docs"},
+		{prefix: "docs/", want: "docs/"},
+		{prefix: "docs//a/", want: "docs/a/"},
+		{prefix: "./", want: ""},
+		{prefix: "/docs/", wantErr: true},
+		{prefix: "docs/../", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ValidatePrefix(tt.prefix)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidatePrefix(%q) error = %v, want error %v", tt.prefix, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ValidatePrefix(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/matt953/relm-plugin-core-go/config"
+)
+
+// UploadPolicyConfigKey is the plugin config key holding the upload policy as JSON
+const UploadPolicyConfigKey = "upload_policy"
+
+// sniffLength is the number of leading bytes DetectContentType looks at
+const sniffLength = 512
+
+// DetectContentType returns the MIME type of data determined from its first 512 bytes
+// Data that isn't recognized is "application/octet-stream"
+func DetectContentType(data []byte) string {
+	return http.DetectContentType(data)
+}
+
+// genericContentTypes are the detected types that many formats share, e.g. JSON and CSV detect as
+// text/plain and office documents as application/zip, so they don't contradict a declared type
+var genericContentTypes = map[string]bool{
+	"application/octet-stream": true,
+	"application/zip":          true,
+	"text/plain":               true,
+	"text/xml":                 true,
+}
+
+// signatureContentTypes are the declared types whose files start with a signature DetectContentType
+// recognizes, so data detected as a generic type can't be in that format
+var signatureContentTypes = map[string]bool{
+	"application/pdf": true,
+	"audio/aiff":      true,
+	"audio/basic":     true,
+	"audio/midi":      true,
+	"audio/wave":      true,
+	"image/bmp":       true,
+	"image/gif":       true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/webp":      true,
+	"image/x-icon":    true,
+	"video/avi":       true,
+	"video/mp4":       true,
+	"video/webm":      true,
+}
+
+// mediaType returns the content type without parameters, e.g. "text/plain" for "text/plain; charset=utf-8"
+func mediaType(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+// UploadRule restricts the files stored under a path prefix
+type UploadRule struct {
+	Prefix string `json:"prefix"`
+
+	// AllowedTypes lists the accepted content types, "image/*" accepts every image type
+	// An empty list accepts any content type
+	AllowedTypes []string `json:"allowed_types,omitempty"`
+
+	// MaxSize is the largest file accepted in bytes, 0 means no limit
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+// allows reports whether the rule accepts the content type
+func (r UploadRule) allows(contentType string) bool {
+	if len(r.AllowedTypes) == 0 {
+		return true
+	}
+
+	contentType = mediaType(contentType)
+	for _, allowed := range r.AllowedTypes {
+		allowed = mediaType(allowed)
+		if allowed == contentType || allowed == "*/*" {
+			return true
+		}
+		if family, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(contentType, family+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadPolicy configures the checks applied to stored files
+// It is configured as JSON under the "upload_policy" plugin config key
+type UploadPolicy struct {
+	// Rules apply to the files under their prefix, the rule with the longest matching prefix wins
+	Rules []UploadRule `json:"rules"`
+}
+
+// Current upload policy applied by the FFI entry points
+var (
+	uploadPolicy      UploadPolicy
+	uploadPolicyMutex sync.RWMutex
+)
+
+// SetUploadPolicy replaces the upload policy applied before every store
+func SetUploadPolicy(policy UploadPolicy) {
+	uploadPolicyMutex.Lock()
+	defer uploadPolicyMutex.Unlock()
+
+	uploadPolicy = policy
+}
+
+// GetUploadPolicy returns the upload policy currently applied
+func GetUploadPolicy() UploadPolicy {
+	uploadPolicyMutex.RLock()
+	defer uploadPolicyMutex.RUnlock()
+
+	return uploadPolicy
+}
+
+// UploadPolicyFromConfig builds the upload policy from the plugin config
+// Without a configured policy every upload is accepted
+func UploadPolicyFromConfig() (UploadPolicy, error) {
+	var policy UploadPolicy
+
+	value, ok := config.GetPluginConfigValue(UploadPolicyConfigKey)
+	if !ok || value == "" {
+		return policy, nil
+	}
+	if err := json.Unmarshal([]byte(value), &policy); err != nil {
+		return policy, NewConfigurationError(fmt.Sprintf("invalid %s: %v", UploadPolicyConfigKey, err))
+	}
+
+	for _, rule := range policy.Rules {
+		if rule.MaxSize < 0 {
+			return policy, NewConfigurationError(fmt.Sprintf("invalid %s: negative max_size for %q", UploadPolicyConfigKey, rule.Prefix))
+		}
+		for _, allowed := range rule.AllowedTypes {
+			if !strings.Contains(allowed, "/") {
+				return policy, NewConfigurationError(fmt.Sprintf("invalid %s: content type %q for %q", UploadPolicyConfigKey, allowed, rule.Prefix))
+			}
+		}
+	}
+	return policy, nil
+}
+
+// Rule returns the rule that applies to path, nil when no rule does
+func (p UploadPolicy) Rule(path string) *UploadRule {
+	var match *UploadRule
+	for i, rule := range p.Rules {
+		if strings.HasPrefix(path, rule.Prefix) && (match == nil || len(rule.Prefix) > len(match.Prefix)) {
+			match = &p.Rules[i]
+		}
+	}
+	return match
+}
+
+// Check rejects a file of size bytes and the given content type that the policy doesn't accept at path
+func (p UploadPolicy) Check(path string, size int64, contentType string) error {
+	rule := p.Rule(path)
+	if rule == nil {
+		return nil
+	}
+	return rule.check(path, size, contentType)
+}
+
+// check rejects a file of size bytes and the given content type that the rule doesn't accept
+func (r UploadRule) check(path string, size int64, contentType string) error {
+	if err := r.checkSize(path, size); err != nil {
+		return err
+	}
+	return r.checkType(contentType)
+}
+
+// checkSize rejects a file of size bytes that exceeds the rule
+func (r UploadRule) checkSize(path string, size int64) error {
+	if r.MaxSize > 0 && size > r.MaxSize {
+		return NewPolicyViolationError(fmt.Sprintf("%s is %d bytes, files under %q may not exceed %d bytes", path, size, r.Prefix, r.MaxSize))
+	}
+	return nil
+}
+
+// checkType rejects a content type the rule doesn't allow
+func (r UploadRule) checkType(contentType string) error {
+	if !r.allows(contentType) {
+		return NewPolicyViolationError(fmt.Sprintf("content type %s is not allowed under %q", mediaType(contentType), r.Prefix))
+	}
+	return nil
+}
+
+// checkedContentType returns the content type the policy checks for data declared as declared
+// The declared type can't be trusted, so a specific detected type that conflicts with it wins.
+// A generic detected type leaves the declared type in place, unless the declared format has a
+// signature that would have been detected, e.g. an executable declared as image/png.
+func checkedContentType(detected string, declared *string) string {
+	if declared == nil {
+		return detected
+	}
+	if mediaType(detected) == mediaType(*declared) {
+		return *declared
+	}
+	if genericContentTypes[mediaType(detected)] && !signatureContentTypes[mediaType(*declared)] {
+		return *declared
+	}
+	return detected
+}
+
+// prepareStore detects the content type of data when none is declared and checks the file against the upload policy
+// It returns the content type to store the file with
+func prepareStore(path string, data []byte, declared *string) (*string, error) {
+	detected := DetectContentType(data)
+	if err := GetUploadPolicy().Check(path, int64(len(data)), checkedContentType(detected, declared)); err != nil {
+		return nil, err
+	}
+
+	if declared == nil {
+		return &detected, nil
+	}
+	return declared, nil
+}
+
+// policyUpload checks a streaming upload against the upload policy as its chunks arrive
+// The content type is detected from the first chunk
+type policyUpload struct {
+	UploadWriter
+	rule        *UploadRule
+	path        string
+	contentType *string
+	size        int64
+	checked     bool
+}
+
+// newPolicyUpload wraps writer with the checks of the policy rule for path, if there is one
+func newPolicyUpload(writer UploadWriter, path string, contentType *string) UploadWriter {
+	policy := GetUploadPolicy()
+	rule := policy.Rule(path)
+	if rule == nil {
+		return writer
+	}
+	return &policyUpload{UploadWriter: writer, rule: rule, path: path, contentType: contentType}
+}
+
+func (u *policyUpload) WriteChunk(chunk []byte) error {
+	if err := u.rule.checkSize(u.path, u.size+int64(len(chunk))); err != nil {
+		return err
+	}
+	if !u.checked {
+		if err := u.rule.checkType(checkedContentType(DetectContentType(chunk), u.contentType)); err != nil {
+			return err
+		}
+	}
+
+	if err := u.UploadWriter.WriteChunk(chunk); err != nil {
+		return err
+	}
+	u.size += int64(len(chunk))
+	u.checked = u.checked || len(chunk) > 0
+	return nil
+}
+
+// Commit checks the type of empty uploads, which never wrote a chunk
+func (u *policyUpload) Commit() error {
+	if !u.checked {
+		if err := u.rule.checkType(checkedContentType(DetectContentType(nil), u.contentType)); err != nil {
+			u.UploadWriter.Abort()
+			return err
+		}
+	}
+	return u.UploadWriter.Commit()
+}
+
+// checkTransfer checks the file at sourcePath against the upload policy of destinationPath before
+// it is copied or moved there, the same way as if it were stored at destinationPath
+func checkTransfer(plugin StoragePlugin, sourcePath string, destinationPath string) error {
+	rule := GetUploadPolicy().Rule(destinationPath)
+	if rule == nil {
+		return nil
+	}
+
+	metadata, err := statFile(plugin, sourcePath)
+	if err != nil {
+		return err
+	}
+	if err := rule.checkSize(destinationPath, metadata.Size); err != nil {
+		return err
+	}
+
+	head, err := retrieveRange(plugin, sourcePath, 0, min(metadata.Size, sniffLength))
+	if err != nil {
+		return err
+	}
+	return rule.checkType(checkedContentType(DetectContentType(head), metadata.ContentType))
+}
+
+// checkRestore checks a version against the upload policy of its path before it is restored
+// Unknown versions and delete markers are left to RestoreVersion to reject
+func checkRestore(versioning VersioningStoragePlugin, path string, versionID string) error {
+	rule := GetUploadPolicy().Rule(path)
+	if rule == nil {
+		return nil
+	}
+
+	versions, err := versioning.ListVersions(path)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if version.VersionID != versionID || version.DeleteMarker {
+			continue
+		}
+		if err := rule.checkSize(path, version.Size); err != nil {
+			return err
+		}
+
+		head, err := retrieveVersionRange(versioning, path, versionID, 0, min(version.Size, sniffLength))
+		if err != nil {
+			return err
+		}
+		return rule.checkType(checkedContentType(DetectContentType(head), version.ContentType))
+	}
+	return nil
+}
+
+// Multipart uploads initiated since the plugin was loaded, keyed by upload ID
+// Uploads resumed after a restart aren't known and are rejected while the policy has rules
+var (
+	policyMultiparts      = make(map[string]*policyMultipart)
+	policyMultipartsMutex sync.Mutex
+)
+
+// policyMultipart is a multipart upload checked against the upload policy
+// The content type is detected from the first part and the size is checked on completion
+type policyMultipart struct {
+	path        string
+	contentType *string
+	checked     bool
+}
+
+// checkMultipartUpload checks the declared content type of a multipart upload against the upload policy
+// Without a declared type the check waits for the first part
+func checkMultipartUpload(path string, contentType *string) error {
+	rule := GetUploadPolicy().Rule(path)
+	if rule == nil || contentType == nil {
+		return nil
+	}
+	return rule.checkType(*contentType)
+}
+
+// trackMultipartUpload remembers an upload initiated at path so its parts and completion can be checked
+// Uploads are tracked even without a rule for their path, since the policy may change before they complete
+func trackMultipartUpload(uploadID string, path string, contentType *string) {
+	policyMultipartsMutex.Lock()
+	defer policyMultipartsMutex.Unlock()
+
+	policyMultiparts[uploadID] = &policyMultipart{path: path, contentType: contentType}
+}
+
+// trackedMultipart returns the upload and the rule that applies to it, nil when it isn't checked
+// Unknown uploads are rejected while the policy has rules, their path and declared type aren't known
+func trackedMultipart(uploadID string) (*policyMultipart, *UploadRule, error) {
+	policyMultipartsMutex.Lock()
+	upload, ok := policyMultiparts[uploadID]
+	policyMultipartsMutex.Unlock()
+
+	policy := GetUploadPolicy()
+	if !ok {
+		if len(policy.Rules) == 0 {
+			return nil, nil, nil
+		}
+		return nil, nil, NewPolicyViolationError(fmt.Sprintf("upload %s wasn't initiated since the plugin was loaded and can't be checked against the upload policy", uploadID))
+	}
+
+	rule := policy.Rule(upload.path)
+	if rule == nil {
+		return nil, nil, nil
+	}
+	return upload, rule, nil
+}
+
+// checkMultipartPart rejects a part that is larger than the file may be, and checks the content
+// type detected from the first part
+func checkMultipartPart(uploadID string, partNumber int, data []byte) error {
+	upload, rule, err := trackedMultipart(uploadID)
+	if upload == nil {
+		return err
+	}
+
+	if err := rule.checkSize(upload.path, int64(len(data))); err != nil {
+		return err
+	}
+	if partNumber != MinPartNumber {
+		return nil
+	}
+	if err := rule.checkType(checkedContentType(DetectContentType(data), upload.contentType)); err != nil {
+		return err
+	}
+
+	policyMultipartsMutex.Lock()
+	upload.checked = true
+	policyMultipartsMutex.Unlock()
+	return nil
+}
+
+// checkMultipartCompletion checks the size of the assembled file by summing the sizes of its parts
+// The content type is checked here when the first part was never uploaded
+func checkMultipartCompletion(multipart MultipartStoragePlugin, uploadID string, parts []UploadedPart) error {
+	upload, rule, err := trackedMultipart(uploadID)
+	if upload == nil {
+		return err
+	}
+
+	policyMultipartsMutex.Lock()
+	checked := upload.checked
+	policyMultipartsMutex.Unlock()
+	if !checked {
+		if err := rule.checkType(checkedContentType("application/octet-stream", upload.contentType)); err != nil {
+			return err
+		}
+	}
+
+	uploaded, err := multipart.ListUploadedParts(uploadID)
+	if err != nil {
+		return err
+	}
+	sizes := make(map[int]int64, len(uploaded))
+	for _, part := range uploaded {
+		sizes[part.PartNumber] = part.Size
+	}
+	var size int64
+	for _, part := range parts {
+		size += sizes[part.PartNumber]
+	}
+	return rule.checkSize(upload.path, size)
+}
+
+// forgetMultipartUpload stops checking an upload once it is completed or aborted
+func forgetMultipartUpload(uploadID string) {
+	policyMultipartsMutex.Lock()
+	defer policyMultipartsMutex.Unlock()
+
+	delete(policyMultiparts, uploadID)
+}
@@ -0,0 +1,451 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+// pngData is a PNG signature padded to size bytes
+func pngData(size int) []byte {
+	return []byte("\x89PNG\r\n\x1a\n" + strings.Repeat("0", size-8))
+}
+
+// useUploadPolicy applies policy for the rest of the test
+func useUploadPolicy(t *testing.T, policy UploadPolicy) {
+	t.Helper()
+
+	previous := GetUploadPolicy()
+	SetUploadPolicy(policy)
+	t.Cleanup(func() { SetUploadPolicy(previous) })
+}
+
+var testUploadPolicy = UploadPolicy{Rules: []UploadRule{
+	{Prefix: "images/", AllowedTypes: []string{"image/*"}, MaxSize: 32},
+	{Prefix: "images/raw/"},
+	{Prefix: "docs/", AllowedTypes: []string{"application/json", "text/csv"}},
+}}
+
+func TestUploadPolicyRule(t *testing.T) {
+	tests := []struct {
+		path       string
+		wantPrefix string
+		wantRule   bool
+	}{
+		{path: "images/a.png", wantPrefix: "images/", wantRule: true},
+		{path: "images/raw/a.cr2", wantPrefix: "images/raw/", wantRule: true},
+		{path: "images/rawfile", wantPrefix: "images/", wantRule: true},
+		{path: "docs/a.json", wantPrefix: "docs/", wantRule: true},
+		{path: "other/a", wantRule: false},
+		{path: "images", wantRule: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rule := testUploadPolicy.Rule(tt.path)
+			if (rule != nil) != tt.wantRule || (rule != nil && rule.Prefix != tt.wantPrefix) {
+				t.Errorf("Rule(%q) = %+v, want prefix %q", tt.path, rule, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestUploadRuleAllows(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowed     []string
+		contentType string
+		want        bool
+	}{
+		{name: "no restriction", contentType: "application/x-anything", want: true},
+		{name: "exact", allowed: []string{"application/json"}, contentType: "application/json", want: true},
+		{name: "parameters", allowed: []string{"text/csv"}, contentType: "text/csv; charset=utf-8", want: true},
+		{name: "case", allowed: []string{"Image/PNG"}, contentType: "image/png", want: true},
+		{name: "family", allowed: []string{"image/*"}, contentType: "image/webp", want: true},
+		{name: "other family", allowed: []string{"image/*"}, contentType: "video/mp4", want: false},
+		{name: "family prefix", allowed: []string{"image/*"}, contentType: "imagery/png", want: false},
+		{name: "anything", allowed: []string{"*/*"}, contentType: "video/mp4", want: true},
+		{name: "not listed", allowed: []string{"application/json", "text/csv"}, contentType: "text/html", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := UploadRule{AllowedTypes: tt.allowed}
+			if got := rule.allows(tt.contentType); got != tt.want {
+				t.Errorf("allows(%q) with %v = %v, want %v", tt.contentType, tt.allowed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckedContentType(t *testing.T) {
+	tests := []struct {
+		name     string
+		detected string
+		declared *string
+		want     string
+	}{
+		{name: "nothing declared", detected: "image/png", want: "image/png"},
+		{name: "generic text", detected: "text/plain; charset=utf-8", declared: ptr("application/json"), want: "application/json"},
+		{name: "generic binary", detected: "application/octet-stream", declared: ptr("application/x-parquet"), want: "application/x-parquet"},
+		{name: "office document", detected: "application/zip", declared: ptr("application/vnd.ms-excel"), want: "application/vnd.ms-excel"},
+		{name: "same media type", detected: "text/html; charset=utf-8", declared: ptr("text/html"), want: "text/html"},
+		{name: "conflicting type", detected: "text/html; charset=utf-8", declared: ptr("image/png"), want: "text/html; charset=utf-8"},
+		{name: "executable as png", detected: "application/octet-stream", declared: ptr("image/png"), want: "application/octet-stream"},
+		{name: "zip as jpeg", detected: "application/zip", declared: ptr("image/jpeg"), want: "application/zip"},
+		{name: "text as pdf", detected: "text/plain; charset=utf-8", declared: ptr("application/pdf; version=1.7"), want: "text/plain; charset=utf-8"},
+		{name: "format without a signature", detected: "application/octet-stream", declared: ptr("image/tiff"), want: "image/tiff"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkedContentType(tt.detected, tt.declared); got != tt.want {
+				t.Errorf("checkedContentType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareStore(t *testing.T) {
+	useUploadPolicy(t, testUploadPolicy)
+
+	tests := []struct {
+		name            string
+		path            string
+		data            []byte
+		declared        *string
+		wantType        *ErrorType
+		wantContentType string
+	}{
+		{name: "detected", path: "images/a", data: pngData(12), wantContentType: "image/png"},
+		{name: "declared", path: "images/a", data: pngData(12), declared: ptr("image/png"), wantContentType: "image/png"},
+		{name: "disguised", path: "images/a", data: []byte("<html><body>"), declared: ptr("image/png"), wantType: ptr(PolicyViolationErrorType)},
+		{name: "executable as png", path: "images/a", data: []byte("MZ\x90\x00\x03\x00\x00\x00"), declared: ptr("image/png"), wantType: ptr(PolicyViolationErrorType)},
+		{name: "zip as jpeg", path: "images/a", data: []byte("PK\x03\x04\x14\x00\x00\x00"), declared: ptr("image/jpeg"), wantType: ptr(PolicyViolationErrorType)},
+		{name: "too large", path: "images/a", data: pngData(40), wantType: ptr(PolicyViolationErrorType)},
+		{name: "json", path: "docs/a", data: []byte(`{"a": 1}`), declared: ptr("application/json; charset=utf-8"), wantContentType: "application/json; charset=utf-8"},
+		{name: "undeclared json", path: "docs/a", data: []byte(`{"a": 1}`), wantType: ptr(PolicyViolationErrorType)},
+		{name: "longest prefix", path: "images/raw/a", data: make([]byte, 40), wantContentType: "application/octet-stream"},
+		{name: "no rule", path: "other/a", data: []byte("<html><body>"), declared: ptr("image/png"), wantContentType: "image/png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, err := prepareStore(tt.path, tt.data, tt.declared)
+			checkErrorType(t, err, tt.wantType)
+			if tt.wantType == nil && *contentType != tt.wantContentType {
+				t.Errorf("content type = %q, want %q", *contentType, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestPolicyUpload(t *testing.T) {
+	useUploadPolicy(t, testUploadPolicy)
+
+	tests := []struct {
+		name     string
+		path     string
+		declared *string
+		chunks   [][]byte
+		wantType *ErrorType
+	}{
+		{name: "chunks fit", path: "images/a", chunks: [][]byte{pngData(12), make([]byte, 20)}},
+		{name: "first chunk is sniffed", path: "images/a", chunks: [][]byte{[]byte("<html><body>"), pngData(12)}, wantType: ptr(PolicyViolationErrorType)},
+		{name: "later chunks aren't sniffed", path: "images/a", chunks: [][]byte{pngData(12), []byte("<html><body>")}},
+		{name: "chunks exceed the size", path: "images/a", chunks: [][]byte{pngData(12), make([]byte, 20), make([]byte, 1)}, wantType: ptr(PolicyViolationErrorType)},
+		{name: "empty upload", path: "images/a", wantType: ptr(PolicyViolationErrorType)},
+		{name: "empty upload of a declared type", path: "images/a", declared: ptr("image/png"), wantType: ptr(PolicyViolationErrorType)},
+		{name: "empty upload of a type without a signature", path: "images/a", declared: ptr("image/tiff")},
+		{name: "no rule", path: "other/a", chunks: [][]byte{make([]byte, 100)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newMemoryPlugin(nil)
+			writer, err := newUploadWriter(inner, tt.path, tt.declared)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writer = newPolicyUpload(writer, tt.path, tt.declared)
+
+			err = func() error {
+				for _, chunk := range tt.chunks {
+					if err := writer.WriteChunk(chunk); err != nil {
+						writer.Abort()
+						return err
+					}
+				}
+				return writer.Commit()
+			}()
+			checkErrorType(t, err, tt.wantType)
+			if _, stored := inner.data(tt.path); stored != (tt.wantType == nil) {
+				t.Errorf("stored = %v, want %v", stored, tt.wantType == nil)
+			}
+		})
+	}
+}
+
+func TestCheckTransfer(t *testing.T) {
+	useUploadPolicy(t, testUploadPolicy)
+
+	inner := newMemoryPlugin(nil)
+	inner.StoreFile("src/png", pngData(12), nil)
+	inner.StoreFile("src/disguised", []byte("<html><body>"), ptr("image/png"))
+	inner.StoreFile("src/large", pngData(40), ptr("image/png"))
+	inner.StoreFile("src/json", []byte(`{"a": 1}`), ptr("application/json"))
+
+	tests := []struct {
+		source      string
+		destination string
+		wantType    *ErrorType
+	}{
+		{source: "src/png", destination: "images/a"},
+		{source: "src/disguised", destination: "images/a", wantType: ptr(PolicyViolationErrorType)},
+		{source: "src/large", destination: "images/a", wantType: ptr(PolicyViolationErrorType)},
+		{source: "src/large", destination: "images/raw/a"},
+		{source: "src/json", destination: "docs/a"},
+		{source: "src/json", destination: "images/a", wantType: ptr(PolicyViolationErrorType)},
+		{source: "src/missing", destination: "images/a", wantType: ptr(NotFoundErrorType)},
+		{source: "src/missing", destination: "other/a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.source+" to "+tt.destination, func(t *testing.T) {
+			checkErrorType(t, checkTransfer(inner, tt.source, tt.destination), tt.wantType)
+		})
+	}
+}
+
+// partsPlugin reports the sizes of the parts it was given as the uploaded parts of every upload
+type partsPlugin struct {
+	*memoryPlugin
+	parts []UploadedPart
+}
+
+func (p *partsPlugin) InitiateMultipartUpload(path string, contentType *string) (string, error) {
+	return "", NewUnsupportedError("not implemented")
+}
+
+func (p *partsPlugin) UploadPart(uploadID string, partNumber int, data []byte) (*UploadedPart, error) {
+	return nil, NewUnsupportedError("not implemented")
+}
+
+func (p *partsPlugin) ListUploadedParts(uploadID string) ([]UploadedPart, error) {
+	return p.parts, nil
+}
+
+func (p *partsPlugin) CompleteMultipartUpload(uploadID string, parts []UploadedPart) error {
+	return NewUnsupportedError("not implemented")
+}
+
+func (p *partsPlugin) AbortMultipartUpload(uploadID string) error {
+	return NewUnsupportedError("not implemented")
+}
+
+func TestMultipartUploadPolicy(t *testing.T) {
+	useUploadPolicy(t, testUploadPolicy)
+
+	tests := []struct {
+		name     string
+		path     string
+		declared *string
+		// parts are uploaded in the given order, completed are the part numbers the upload is completed with
+		parts     map[int][]byte
+		order     []int
+		completed []int
+		wantType  *ErrorType
+	}{
+		{
+			name:      "parts fit",
+			path:      "images/a",
+			parts:     map[int][]byte{1: pngData(12), 2: make([]byte, 20)},
+			order:     []int{1, 2},
+			completed: []int{1, 2},
+		},
+		{
+			name:      "assembled file too large",
+			path:      "images/a",
+			parts:     map[int][]byte{1: pngData(12), 2: make([]byte, 20), 3: make([]byte, 20)},
+			order:     []int{1, 2, 3},
+			completed: []int{1, 2, 3},
+			wantType:  ptr(PolicyViolationErrorType),
+		},
+		{
+			name:      "only completed parts count",
+			path:      "images/a",
+			parts:     map[int][]byte{1: pngData(12), 2: make([]byte, 20), 3: make([]byte, 20)},
+			order:     []int{1, 2, 3},
+			completed: []int{1, 2},
+		},
+		{
+			name:      "part too large",
+			path:      "images/a",
+			parts:     map[int][]byte{1: pngData(12), 2: make([]byte, 40)},
+			order:     []int{1, 2},
+			completed: []int{1, 2},
+			wantType:  ptr(PolicyViolationErrorType),
+		},
+		{
+			name:      "first part is sniffed",
+			path:      "images/a",
+			parts:     map[int][]byte{1: []byte("<html><body>"), 2: pngData(12)},
+			order:     []int{2, 1},
+			completed: []int{1, 2},
+			wantType:  ptr(PolicyViolationErrorType),
+		},
+		{
+			name:     "declared type not allowed",
+			path:     "images/a",
+			declared: ptr("text/html"),
+			wantType: ptr(PolicyViolationErrorType),
+		},
+		{
+			name:      "first part never uploaded",
+			path:      "images/a",
+			parts:     map[int][]byte{2: pngData(12)},
+			order:     []int{2},
+			completed: []int{2},
+			wantType:  ptr(PolicyViolationErrorType),
+		},
+		{
+			name:      "first part never uploaded with a declared type",
+			path:      "images/a",
+			declared:  ptr("image/png"),
+			parts:     map[int][]byte{2: pngData(12)},
+			order:     []int{2},
+			completed: []int{2},
+			wantType:  ptr(PolicyViolationErrorType),
+		},
+		{
+			name:      "first part never uploaded with a type without a signature",
+			path:      "images/a",
+			declared:  ptr("image/tiff"),
+			parts:     map[int][]byte{2: pngData(12)},
+			order:     []int{2},
+			completed: []int{2},
+		},
+		{
+			name:      "no rule",
+			path:      "other/a",
+			parts:     map[int][]byte{1: []byte("<html><body>"), 2: make([]byte, 100)},
+			order:     []int{1, 2},
+			completed: []int{1, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploadID := "upload " + tt.name
+			multipart := &partsPlugin{memoryPlugin: newMemoryPlugin(nil)}
+
+			err := func() error {
+				if err := checkMultipartUpload(tt.path, tt.declared); err != nil {
+					return err
+				}
+				trackMultipartUpload(uploadID, tt.path, tt.declared)
+				defer forgetMultipartUpload(uploadID)
+
+				for _, number := range tt.order {
+					if err := checkMultipartPart(uploadID, number, tt.parts[number]); err != nil {
+						return err
+					}
+					multipart.parts = append(multipart.parts, UploadedPart{PartNumber: number, Size: int64(len(tt.parts[number]))})
+				}
+
+				var completed []UploadedPart
+				for _, number := range tt.completed {
+					completed = append(completed, UploadedPart{PartNumber: number})
+				}
+				return checkMultipartCompletion(multipart, uploadID, completed)
+			}()
+			checkErrorType(t, err, tt.wantType)
+		})
+	}
+
+	if len(policyMultiparts) != 0 {
+		t.Errorf("%d uploads are still tracked", len(policyMultiparts))
+	}
+}
+
+func TestMultipartUploadPolicyUnknownUpload(t *testing.T) {
+	multipart := &partsPlugin{memoryPlugin: newMemoryPlugin(nil), parts: []UploadedPart{{PartNumber: 1, Size: 12}}}
+	completed := []UploadedPart{{PartNumber: 1}}
+
+	tests := []struct {
+		name     string
+		policy   UploadPolicy
+		wantType *ErrorType
+	}{
+		{name: "policy with rules", policy: testUploadPolicy, wantType: ptr(PolicyViolationErrorType)},
+		{name: "empty policy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useUploadPolicy(t, tt.policy)
+
+			checkErrorType(t, checkMultipartPart("unknown", 1, pngData(12)), tt.wantType)
+			checkErrorType(t, checkMultipartCompletion(multipart, "unknown", completed), tt.wantType)
+		})
+	}
+
+	t.Run("tracked upload without a rule", func(t *testing.T) {
+		useUploadPolicy(t, testUploadPolicy)
+		trackMultipartUpload("untracked path", "other/a", nil)
+		defer forgetMultipartUpload("untracked path")
+
+		checkErrorType(t, checkMultipartPart("untracked path", 1, []byte("<html><body>")), nil)
+		checkErrorType(t, checkMultipartCompletion(multipart, "untracked path", completed), nil)
+	})
+}
+
+// rangedVersionsPlugin serves the policy checks of restored versions through ranged reads only
+type rangedVersionsPlugin struct {
+	*VersioningPlugin
+	t       *testing.T
+	lengths []int64
+}
+
+func (p *rangedVersionsPlugin) RetrieveVersion(path string, versionID string) ([]byte, error) {
+	p.t.Errorf("RetrieveVersion(%q, %q) read the whole version", path, versionID)
+	return p.VersioningPlugin.RetrieveVersion(path, versionID)
+}
+
+func (p *rangedVersionsPlugin) RetrieveVersionRange(path string, versionID string, offset int64, length int64) ([]byte, error) {
+	p.lengths = append(p.lengths, length)
+	return p.VersioningPlugin.RetrieveVersionRange(path, versionID, offset, length)
+}
+
+func TestCheckRestore(t *testing.T) {
+	useUploadPolicy(t, UploadPolicy{Rules: []UploadRule{{Prefix: "scans/", AllowedTypes: []string{"image/*"}}}})
+
+	plugin, _ := newTestVersioningPlugin(t, DefaultVersioningOptions(), nil)
+	plugin.StoreFile("scans/a", pngData(2048), nil)
+	plugin.StoreFile("scans/a", []byte("<html><body>"), ptr("image/png"))
+	plugin.StoreFile("scans/a", []byte("MZ\x90\x00\x03\x00\x00\x00"), ptr("image/png"))
+	versions, err := plugin.ListVersions("scans/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranged := &rangedVersionsPlugin{VersioningPlugin: plugin, t: t}
+
+	tests := []struct {
+		name     string
+		version  FileVersion
+		wantType *ErrorType
+	}{
+		{name: "image", version: versions[2]},
+		{name: "disguised", version: versions[1], wantType: ptr(PolicyViolationErrorType)},
+		{name: "executable", version: versions[0], wantType: ptr(PolicyViolationErrorType)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranged.lengths = nil
+			checkErrorType(t, checkRestore(ranged, "scans/a", tt.version.VersionID), tt.wantType)
+			if len(ranged.lengths) != 1 || ranged.lengths[0] > sniffLength || ranged.lengths[0] > tt.version.Size {
+				t.Errorf("read lengths = %v, want one read of at most %d bytes", ranged.lengths, sniffLength)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package storage
+
+import "sync"
+
+// legacyProgress keeps the global progress callback to a single upload
+// Uploads reporting through it hold the write lock, the other legacy uploads hold the read lock
+// so their ReportProgress calls can't reach the callback of another upload
+var legacyProgress sync.RWMutex
+
+// storeWithGlobalProgress stores data with a plugin that reports progress through ReportProgress
+// A nil progress stores without reporting
+func storeWithGlobalProgress(plugin StoragePlugin, path string, data []byte, contentType *string, progress ProgressFunc) error {
+	if progress == nil {
+		legacyProgress.RLock()
+		defer legacyProgress.RUnlock()
+
+		return plugin.StoreFile(path, data, contentType)
+	}
+
+	legacyProgress.Lock()
+	defer legacyProgress.Unlock()
+
+	progressMutex.Lock()
+	currentProgressCallback = progress
+	progressMutex.Unlock()
+
+	defer func() {
+		progressMutex.Lock()
+		currentProgressCallback = nil
+		progressMutex.Unlock()
+	}()
+
+	return plugin.StoreFile(path, data, contentType)
+}
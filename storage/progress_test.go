@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// reportingPlugin is a legacy plugin that reports the length of the stored data as progress
+type reportingPlugin struct {
+	*memoryPlugin
+}
+
+func (p *reportingPlugin) StoreFile(path string, data []byte, contentType *string) error {
+	for i := 0; i < 10; i++ {
+		ReportProgress(float64(len(data)))
+	}
+	return p.memoryPlugin.StoreFile(path, data, contentType)
+}
+
+func TestGlobalProgressConcurrentUploads(t *testing.T) {
+	plugin := &reportingPlugin{newMemoryPlugin(nil)}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(size int) {
+			defer wg.Done()
+
+			var reports []float64
+			progress := func(p float64) { reports = append(reports, p) }
+			if size%2 == 0 {
+				// Uploads without a callback still report through ReportProgress
+				progress = nil
+			}
+
+			path := fmt.Sprintf("file-%d", size)
+			if err := storeWithGlobalProgress(plugin, path, make([]byte, size), nil, progress); err != nil {
+				t.Error(err)
+				return
+			}
+			if progress == nil {
+				return
+			}
+			if len(reports) != 10 {
+				t.Errorf("%s got %d progress reports, want 10", path, len(reports))
+			}
+			for _, p := range reports {
+				if p != float64(size) {
+					t.Errorf("%s got the progress of another upload: %v", path, p)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
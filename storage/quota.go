@@ -0,0 +1,922 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/matt953/relm-plugin-core-go/config"
+)
+
+// Plugin config keys for quotas
+const (
+	QuotaScopesConfigKey   = "quota_scopes"
+	QuotaMaxBytesConfigKey = "quota_max_bytes"
+	QuotaMaxFilesConfigKey = "quota_max_files"
+)
+
+// Quota limits the total size and number of files of a scope, 0 means no limit
+// It is passed as JSON through the FFI
+type Quota struct {
+	MaxBytes int64 `json:"max_bytes"`
+	MaxFiles int64 `json:"max_files"`
+}
+
+// Usage reports the total size and number of files of a scope together with its quota
+// It is serialized as JSON when returned through the FFI
+type Usage struct {
+	Scope string `json:"scope"`
+	Bytes int64  `json:"bytes"`
+	Files int64  `json:"files"`
+	Quota Quota  `json:"quota"`
+}
+
+// quotaPlugin returns the plugin as a QuotaStoragePlugin
+func quotaPlugin(plugin StoragePlugin) (QuotaStoragePlugin, error) {
+	quota, ok := plugin.(QuotaStoragePlugin)
+	if !ok {
+		return nil, NewUnsupportedError("Plugin does not support storage quotas")
+	}
+	return quota, nil
+}
+
+// parseQuota decodes the quota sent by the host
+func parseQuota(quotaJSON string) (Quota, error) {
+	var quota Quota
+	if err := json.Unmarshal([]byte(quotaJSON), &quota); err != nil {
+		return quota, NewInvalidInputError("failed to parse quota: " + err.Error())
+	}
+	if quota.MaxBytes < 0 || quota.MaxFiles < 0 {
+		return quota, NewInvalidInputError("quota limits must not be negative")
+	}
+	return quota, nil
+}
+
+// QuotaOptions configures a QuotaPlugin
+type QuotaOptions struct {
+	// Scopes are the path patterns usage is accounted by, "*" matches a single path segment
+	// "orgs/*/" accounts every organization separately and the empty pattern accounts all files together.
+	// A file belongs to the first scope it matches, files that match none aren't accounted.
+	Scopes []string
+
+	// Default is the quota of the scopes without a quota of their own
+	Default Quota
+
+	// Quotas are the quotas of individual scopes, e.g. "orgs/42/"
+	Quotas map[string]Quota
+}
+
+// QuotaOptionsFromConfig builds quota options from the plugin config
+// quota_scopes is a comma separated list of patterns, all files are accounted together when it isn't set
+func QuotaOptionsFromConfig() (QuotaOptions, error) {
+	options := QuotaOptions{Scopes: []string{""}}
+
+	if value, ok := config.GetPluginConfigValue(QuotaScopesConfigKey); ok && strings.TrimSpace(value) != "" {
+		options.Scopes = nil
+		for _, scope := range strings.Split(value, ",") {
+			options.Scopes = append(options.Scopes, strings.TrimSpace(scope))
+		}
+	}
+
+	maxBytes, err := pluginConfigInt(QuotaMaxBytesConfigKey, 0)
+	if err != nil {
+		return options, err
+	}
+	maxFiles, err := pluginConfigInt(QuotaMaxFilesConfigKey, 0)
+	if err != nil {
+		return options, err
+	}
+	options.Default = Quota{MaxBytes: int64(maxBytes), MaxFiles: int64(maxFiles)}
+	return options, nil
+}
+
+// scopeUsage is the accounted usage of a scope
+// Writes in progress reserve their growth so concurrent writes can't overshoot the quota together
+type scopeUsage struct {
+	bytes         int64
+	files         int64
+	reservedBytes int64
+	reservedFiles int64
+}
+
+// QuotaPlugin accounts the total size and number of files per scope and enforces quotas on writes
+//
+// The usage of a scope is counted by listing its files the first time it is needed, so the wrapped
+// plugin must implement ListingStoragePlugin. Afterwards it is kept up to date by the writes that go
+// through this plugin; writes made by other processes are only picked up by UsageReport. Earlier
+// versions kept under VersionsPrefix count toward the bytes of the scope of their file but not toward
+// its files, the other records under VersionsPrefix and ExpiryPrefix aren't accounted.
+type QuotaPlugin struct {
+	*interceptedPlugin
+	options  QuotaOptions
+	patterns [][]string
+
+	mutex  sync.Mutex
+	usage  map[string]*scopeUsage
+	quotas map[string]Quota
+
+	// loads serializes counting the files of a scope, locks serializes the writes to each path
+	loads PathMutex
+	locks PathMutex
+
+	// counting holds off writes while UsageReport starts and finishes counting, writes hold it shared
+	counting sync.RWMutex
+
+	// reports serializes UsageReport, report tracks its listing and is nil when no report is running
+	// It is guarded by mutex
+	reports sync.Mutex
+	report  *usageReport
+
+	// multipartPaths maps the uploads initiated through the plugin to their path
+	multipartPaths map[string]string
+}
+
+// NewQuotaPlugin wraps inner with usage accounting and quota enforcement
+func NewQuotaPlugin(inner StoragePlugin, options QuotaOptions) (*QuotaPlugin, error) {
+	if len(options.Scopes) == 0 {
+		return nil, NewConfigurationError("quota plugin needs at least one scope")
+	}
+
+	patterns := make([][]string, len(options.Scopes))
+	for i, scope := range options.Scopes {
+		if scope == "" {
+			patterns[i] = []string{}
+			continue
+		}
+		if !strings.HasSuffix(scope, "/") || strings.HasPrefix(scope, "/") || strings.Contains(scope, "//") {
+			return nil, NewConfigurationError(fmt.Sprintf("invalid quota scope %q, scopes are path prefixes ending in /", scope))
+		}
+		patterns[i] = strings.Split(strings.TrimSuffix(scope, "/"), "/")
+	}
+
+	quotas := make(map[string]Quota, len(options.Quotas))
+	for scope, quota := range options.Quotas {
+		quotas[scope] = quota
+	}
+
+	return &QuotaPlugin{
+		interceptedPlugin: &interceptedPlugin{inner: inner, interceptor: passthrough},
+		options:           options,
+		patterns:          patterns,
+		usage:             make(map[string]*scopeUsage),
+		quotas:            quotas,
+		multipartPaths:    make(map[string]string),
+	}, nil
+}
+
+// usageReport tracks how far UsageReport has listed the files and the paths written in the meantime
+// Listings are ordered by path, so a path has been reached once the page holding it was fetched.
+type usageReport struct {
+	touched map[string]*touchedPath
+
+	// done are the prefixes listed so far, position is the last path fetched under prefix
+	done     []string
+	prefix   string
+	position string
+}
+
+// touchedPath is a path written while UsageReport lists the files
+type touchedPath struct {
+	// reached is set when the listing had fetched the path before it was first written, it then counted
+	// the file described by size and exists. err is set when that file couldn't be read.
+	reached bool
+	size    int64
+	exists  bool
+	err     error
+}
+
+// reached reports whether the listing has fetched path
+func (r *usageReport) reached(path string) bool {
+	for _, prefix := range r.done {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return strings.HasPrefix(path, r.prefix) && path <= r.position
+}
+
+func (p *QuotaPlugin) providesCapability(QuotaStoragePlugin) {}
+
+// scopeOf returns the scope of the file at path, false when it isn't accounted
+// Earlier versions belong to the scope of their file
+func (p *QuotaPlugin) scopeOf(path string) (string, bool) {
+	if owner, ok := versionOwner(path); ok {
+		path = owner
+	} else if strings.HasPrefix(path, VersionsPrefix) || strings.HasPrefix(path, ExpiryPrefix) {
+		return "", false
+	}
+
+	segments := strings.Split(path, "/")
+	for _, pattern := range p.patterns {
+		// The file must be below the scope, not the scope itself
+		if len(segments) <= len(pattern) {
+			continue
+		}
+
+		matched := true
+		for i, segment := range pattern {
+			if segment != "*" && segment != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if len(pattern) == 0 {
+			return "", true
+		}
+		return strings.Join(segments[:len(pattern)], "/") + "/", true
+	}
+	return "", false
+}
+
+// fileCount returns how many files the file at path counts as, earlier versions don't count
+func fileCount(path string) int64 {
+	if strings.HasPrefix(path, VersionsPrefix) {
+		return 0
+	}
+	return 1
+}
+
+// checkScope rejects anything that isn't a scope of the plugin
+func (p *QuotaPlugin) checkScope(scope string) error {
+	if scope == "" || strings.HasSuffix(scope, "/") {
+		if matched, ok := p.scopeOf(scope + "_"); ok && matched == scope {
+			return nil
+		}
+	}
+	return NewInvalidInputError(fmt.Sprintf("%q is not a quota scope", scope))
+}
+
+// quotaOf returns the quota of scope, the mutex must be held
+func (p *QuotaPlugin) quotaOf(scope string) Quota {
+	if quota, ok := p.quotas[scope]; ok {
+		return quota
+	}
+	return p.options.Default
+}
+
+// scan lists the files under prefix and passes the accounted ones to fn with their scope
+func (p *QuotaPlugin) scan(prefix string, fn func(scope string, file FileMetadata)) error {
+	cursor := ""
+	for {
+		page, err := listFiles(p.inner, prefix, cursor, MaxListLimit)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range page.Files {
+			if scope, ok := p.scopeOf(file.Path); ok {
+				fn(scope, file)
+			}
+		}
+
+		if page.NextCursor == nil {
+			return nil
+		}
+		cursor = *page.NextCursor
+	}
+}
+
+// load returns the usage of scope, counting its files the first time
+func (p *QuotaPlugin) load(scope string) (*scopeUsage, error) {
+	p.mutex.Lock()
+	usage, ok := p.usage[scope]
+	p.mutex.Unlock()
+	if ok {
+		return usage, nil
+	}
+
+	unlock := p.loads.Lock(scope)
+	defer unlock()
+
+	p.mutex.Lock()
+	usage, ok = p.usage[scope]
+	p.mutex.Unlock()
+	if ok {
+		return usage, nil
+	}
+
+	counted := &scopeUsage{}
+	for _, prefix := range coveringPrefixes([]string{scope}) {
+		err := p.scan(prefix, func(fileScope string, file FileMetadata) {
+			if fileScope == scope {
+				counted.bytes += file.Size
+				counted.files += fileCount(file.Path)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// UsageReport may have counted the scope in the meantime
+	if usage, ok := p.usage[scope]; ok {
+		return usage, nil
+	}
+	p.usage[scope] = counted
+	return counted, nil
+}
+
+// reserve checks that growing scope by bytes and files stays within its quota and reserves the growth
+// The returned function releases the reservation and applies the change when the write succeeded
+func (p *QuotaPlugin) reserve(scope string, bytes int64, files int64) (func(applied bool), error) {
+	usage, err := p.load(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	quota := p.quotaOf(scope)
+	if bytes > 0 && quota.MaxBytes > 0 && usage.bytes+usage.reservedBytes+bytes > quota.MaxBytes {
+		return nil, NewQuotaExceededError(fmt.Sprintf("%d more bytes would exceed the quota of %d bytes of %s (%d used)", bytes, quota.MaxBytes, scopeName(scope), usage.bytes))
+	}
+	if files > 0 && quota.MaxFiles > 0 && usage.files+usage.reservedFiles+files > quota.MaxFiles {
+		return nil, NewQuotaExceededError(fmt.Sprintf("%d more files would exceed the quota of %d files of %s (%d used)", files, quota.MaxFiles, scopeName(scope), usage.files))
+	}
+
+	reservedBytes, reservedFiles := max(bytes, 0), max(files, 0)
+	usage.reservedBytes += reservedBytes
+	usage.reservedFiles += reservedFiles
+
+	return func(applied bool) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		usage.reservedBytes -= reservedBytes
+		usage.reservedFiles -= reservedFiles
+		if applied {
+			usage.bytes += bytes
+			usage.files += files
+		}
+	}, nil
+}
+
+func scopeName(scope string) string {
+	if scope == "" {
+		return "the storage"
+	}
+	return scope
+}
+
+// current returns the size of the file at path and whether it exists
+// The size comes from the file's metadata like the sizes of the listings usage is counted from
+func (p *QuotaPlugin) current(path string) (int64, bool, error) {
+	metadata, err := statFile(p.inner, path)
+	if IsNotFound(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return metadata.Size, true, nil
+}
+
+// lock locks path for a write and keeps UsageReport from finishing until the write is done
+func (p *QuotaPlugin) lock(path string) func() {
+	unlock := p.locks.Lock(path)
+	p.counting.RLock()
+	p.touch(path)
+	return func() {
+		p.counting.RUnlock()
+		unlock()
+	}
+}
+
+// lockPair locks both paths of a move like lock
+func (p *QuotaPlugin) lockPair(sourcePath string, destinationPath string) func() {
+	unlock := p.locks.LockPair(sourcePath, destinationPath)
+	p.counting.RLock()
+	p.touch(sourcePath)
+	p.touch(destinationPath)
+	return func() {
+		p.counting.RUnlock()
+		unlock()
+	}
+}
+
+// touch records that path is about to be written when UsageReport is listing the files
+// The path must be locked. When the listing already fetched the path, the file is read before the
+// write since that is what the listing counted.
+func (p *QuotaPlugin) touch(path string) {
+	if _, ok := p.scopeOf(path); !ok {
+		return
+	}
+
+	p.mutex.Lock()
+	report := p.report
+	if report == nil || report.touched[path] != nil {
+		p.mutex.Unlock()
+		return
+	}
+	touched := &touchedPath{reached: report.reached(path)}
+	report.touched[path] = touched
+	p.mutex.Unlock()
+
+	if !touched.reached {
+		return
+	}
+	size, exists, err := p.current(path)
+
+	p.mutex.Lock()
+	touched.size, touched.exists, touched.err = size, exists, err
+	p.mutex.Unlock()
+}
+
+// replace runs a write that replaces the file at path with size bytes if it fits in the quota of its scope
+// The path must be locked with lock
+func (p *QuotaPlugin) replace(path string, size int64, write func() error) error {
+	scope, ok := p.scopeOf(path)
+	if !ok {
+		return write()
+	}
+
+	previous, exists, err := p.current(path)
+	if err != nil {
+		return err
+	}
+	files := fileCount(path)
+	if exists {
+		files = 0
+	}
+
+	release, err := p.reserve(scope, size-previous, files)
+	if err != nil {
+		return err
+	}
+	err = write()
+	release(err == nil)
+	return err
+}
+
+// remove runs a write that removes the file at path from its scope
+// The path must be locked with lock
+func (p *QuotaPlugin) remove(path string, write func() error) error {
+	scope, ok := p.scopeOf(path)
+	if !ok {
+		return write()
+	}
+
+	previous, exists, err := p.current(path)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return write()
+	}
+
+	release, err := p.reserve(scope, -previous, -fileCount(path))
+	if err != nil {
+		return err
+	}
+	err = write()
+	release(err == nil)
+	return err
+}
+
+// StoreFile stores the file if it fits in the quota
+func (p *QuotaPlugin) StoreFile(path string, data []byte, contentType *string) error {
+	return p.StoreFileWithContext(context.Background(), path, data, contentType)
+}
+
+// StoreFileWithContext stores the file if it fits in the quota
+func (p *QuotaPlugin) StoreFileWithContext(ctx context.Context, path string, data []byte, contentType *string) error {
+	unlock := p.lock(path)
+	defer unlock()
+
+	return p.replace(path, int64(len(data)), func() error {
+		return storeFile(ctx, p.inner, path, data, contentType, ProgressFromContext(ctx))
+	})
+}
+
+// StoreFileWithOptions stores the file if it fits in the quota
+func (p *QuotaPlugin) StoreFileWithOptions(ctx context.Context, path string, data []byte, options StoreOptions) error {
+	unlock := p.lock(path)
+	defer unlock()
+
+	return p.replace(path, int64(len(data)), func() error {
+		return storeWithOptions(ctx, p.inner, path, data, options, ProgressFromContext(ctx))
+	})
+}
+
+// DeleteFile deletes the file and releases its usage
+func (p *QuotaPlugin) DeleteFile(path string) error {
+	return p.DeleteFileWithContext(context.Background(), path)
+}
+
+// DeleteFileWithContext deletes the file and releases its usage
+func (p *QuotaPlugin) DeleteFileWithContext(ctx context.Context, path string) error {
+	unlock := p.lock(path)
+	defer unlock()
+
+	return p.remove(path, func() error {
+		return deleteFile(ctx, p.inner, path)
+	})
+}
+
+// DeleteFiles deletes the files one by one so their usage is released
+func (p *QuotaPlugin) DeleteFiles(paths []string) ([]DeleteResult, error) {
+	results := make([]DeleteResult, len(paths))
+	for i, path := range paths {
+		results[i] = NewDeleteResult(path, p.DeleteFile(path))
+	}
+	return results, nil
+}
+
+// CopyFile copies the file if the copy fits in the quota of the destination
+func (p *QuotaPlugin) CopyFile(sourcePath string, destinationPath string) error {
+	unlock := p.lock(destinationPath)
+	defer unlock()
+
+	size, exists, err := p.current(sourcePath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return NewNotFoundError(sourcePath)
+	}
+
+	return p.replace(destinationPath, size, func() error {
+		return copyFile(p.inner, sourcePath, destinationPath)
+	})
+}
+
+// MoveFile moves the file if it fits in the quota of the destination
+func (p *QuotaPlugin) MoveFile(sourcePath string, destinationPath string) error {
+	if sourcePath == destinationPath {
+		return NewInvalidInputError("source and destination paths are the same")
+	}
+
+	unlock := p.lockPair(sourcePath, destinationPath)
+	defer unlock()
+
+	size, exists, err := p.current(sourcePath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return NewNotFoundError(sourcePath)
+	}
+
+	sourceScope, sourceAccounted := p.scopeOf(sourcePath)
+	destinationScope, destinationAccounted := p.scopeOf(destinationPath)
+	if !destinationAccounted {
+		return p.remove(sourcePath, func() error {
+			return moveFile(p.inner, sourcePath, destinationPath)
+		})
+	}
+
+	previous, replaced, err := p.current(destinationPath)
+	if err != nil {
+		return err
+	}
+	bytes, files := size-previous, fileCount(destinationPath)
+	if replaced {
+		files = 0
+	}
+
+	// A move within a scope only changes its usage by the file it replaces
+	if sourceAccounted && sourceScope == destinationScope {
+		bytes, files = bytes-size, files-fileCount(sourcePath)
+	}
+	release, err := p.reserve(destinationScope, bytes, files)
+	if err != nil {
+		return err
+	}
+
+	if sourceAccounted && sourceScope != destinationScope {
+		err = p.remove(sourcePath, func() error {
+			return moveFile(p.inner, sourcePath, destinationPath)
+		})
+	} else {
+		err = moveFile(p.inner, sourcePath, destinationPath)
+	}
+	release(err == nil)
+	return err
+}
+
+// OpenUpload starts an upload that is checked against the quota when it is committed
+func (p *QuotaPlugin) OpenUpload(path string, contentType *string) (UploadWriter, error) {
+	writer, err := newUploadWriter(p.inner, path, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaUpload{UploadWriter: writer, plugin: p, path: path}, nil
+}
+
+type quotaUpload struct {
+	UploadWriter
+	plugin *QuotaPlugin
+	path   string
+	size   int64
+}
+
+func (u *quotaUpload) WriteChunk(chunk []byte) error {
+	if err := u.UploadWriter.WriteChunk(chunk); err != nil {
+		return err
+	}
+	u.size += int64(len(chunk))
+	return nil
+}
+
+// Commit discards the upload when it doesn't fit in the quota
+func (u *quotaUpload) Commit() error {
+	unlock := u.plugin.lock(u.path)
+	defer unlock()
+
+	committed := false
+	err := u.plugin.replace(u.path, u.size, func() error {
+		committed = true
+		return u.UploadWriter.Commit()
+	})
+	if err != nil && !committed {
+		u.UploadWriter.Abort()
+	}
+	return err
+}
+
+// InitiateMultipartUpload starts a multipart upload and remembers its path for accounting
+func (p *QuotaPlugin) InitiateMultipartUpload(path string, contentType *string) (string, error) {
+	multipart, err := multipartPlugin(p.inner)
+	if err != nil {
+		return "", err
+	}
+
+	uploadID, err := multipart.InitiateMultipartUpload(path, contentType)
+	if err != nil {
+		return "", err
+	}
+
+	p.mutex.Lock()
+	p.multipartPaths[uploadID] = path
+	p.mutex.Unlock()
+	return uploadID, nil
+}
+
+// CompleteMultipartUpload completes the upload if the assembled file fits in the quota
+// Uploads that weren't initiated through this plugin, e.g. before it was reloaded, are rejected since
+// their path isn't known, they have to be aborted and started again
+func (p *QuotaPlugin) CompleteMultipartUpload(uploadID string, parts []UploadedPart) error {
+	multipart, err := multipartPlugin(p.inner)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	path, known := p.multipartPaths[uploadID]
+	p.mutex.Unlock()
+
+	if !known {
+		return NewInvalidInputError(fmt.Sprintf("upload %s wasn't initiated through the quota plugin and can't be checked against the quota", uploadID))
+	}
+
+	uploaded, err := multipart.ListUploadedParts(uploadID)
+	if err != nil {
+		return err
+	}
+	sizes := make(map[int]int64, len(uploaded))
+	for _, part := range uploaded {
+		sizes[part.PartNumber] = part.Size
+	}
+	var size int64
+	for _, part := range parts {
+		size += sizes[part.PartNumber]
+	}
+
+	unlock := p.lock(path)
+	defer unlock()
+
+	err = p.replace(path, size, func() error {
+		return multipart.CompleteMultipartUpload(uploadID, parts)
+	})
+	if err == nil {
+		p.forgetMultipart(uploadID)
+	}
+	return err
+}
+
+// AbortMultipartUpload aborts the upload
+func (p *QuotaPlugin) AbortMultipartUpload(uploadID string) error {
+	multipart, err := multipartPlugin(p.inner)
+	if err != nil {
+		return err
+	}
+
+	if err := multipart.AbortMultipartUpload(uploadID); err != nil {
+		return err
+	}
+	p.forgetMultipart(uploadID)
+	return nil
+}
+
+func (p *QuotaPlugin) forgetMultipart(uploadID string) {
+	p.mutex.Lock()
+	delete(p.multipartPaths, uploadID)
+	p.mutex.Unlock()
+}
+
+// Usage returns the usage and quota of a scope, counting its files the first time
+func (p *QuotaPlugin) Usage(scope string) (*Usage, error) {
+	if err := p.checkScope(scope); err != nil {
+		return nil, err
+	}
+
+	usage, err := p.load(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return &Usage{Scope: scope, Bytes: usage.bytes, Files: usage.files, Quota: p.quotaOf(scope)}, nil
+}
+
+// UsageReport counts the files of every scope again and returns the usage of all known scopes
+// Scopes are known once they hold files or were looked up through Usage. Writes through the plugin go on
+// while the files are listed: the listing doesn't count the paths written before it fetched them, and
+// once it is done the written paths are read again while writes wait for the usage to be replaced.
+func (p *QuotaPlugin) UsageReport() ([]Usage, error) {
+	p.reports.Lock()
+	defer p.reports.Unlock()
+
+	// Writes already in progress aren't tracked, wait for them before listing
+	listing := &usageReport{touched: make(map[string]*touchedPath)}
+	p.counting.Lock()
+	p.mutex.Lock()
+	p.report = listing
+	p.mutex.Unlock()
+	p.counting.Unlock()
+
+	counted := make(map[string]*scopeUsage)
+	count := func(scope string, bytes int64, files int64) {
+		usage, ok := counted[scope]
+		if !ok {
+			usage = &scopeUsage{}
+			counted[scope] = usage
+		}
+		usage.bytes += bytes
+		usage.files += files
+	}
+	err := p.list(listing, count)
+
+	p.counting.Lock()
+	defer p.counting.Unlock()
+
+	p.mutex.Lock()
+	p.report = nil
+	p.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Replace what the listing counted for the written paths with their current state
+	for path, touched := range listing.touched {
+		scope, _ := p.scopeOf(path)
+		if touched.reached {
+			if touched.err != nil {
+				return nil, touched.err
+			}
+			if touched.exists {
+				count(scope, -touched.size, -fileCount(path))
+			}
+		}
+
+		size, exists, err := p.current(path)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			count(scope, size, fileCount(path))
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// Update the known scopes in place, writes in progress hold on to them
+	for scope, usage := range p.usage {
+		usage.bytes, usage.files = 0, 0
+		if recount, ok := counted[scope]; ok {
+			usage.bytes, usage.files = recount.bytes, recount.files
+		}
+	}
+	for scope, usage := range counted {
+		if _, ok := p.usage[scope]; !ok {
+			p.usage[scope] = usage
+		}
+	}
+
+	report := make([]Usage, 0, len(p.usage))
+	for scope, usage := range p.usage {
+		report = append(report, Usage{Scope: scope, Bytes: usage.bytes, Files: usage.files, Quota: p.quotaOf(scope)})
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Scope < report[j].Scope })
+	return report, nil
+}
+
+// list counts the accounted files for UsageReport, recording how far it got in report
+// Paths written before their page was fetched are left to UsageReport.
+func (p *QuotaPlugin) list(report *usageReport, count func(scope string, bytes int64, files int64)) error {
+	for _, prefix := range p.scanPrefixes() {
+		p.mutex.Lock()
+		report.prefix, report.position = prefix, ""
+		p.mutex.Unlock()
+
+		cursor := ""
+		for {
+			page, err := listFiles(p.inner, prefix, cursor, MaxListLimit)
+			if err != nil {
+				return err
+			}
+
+			p.mutex.Lock()
+			if len(page.Files) > 0 {
+				report.position = page.Files[len(page.Files)-1].Path
+			}
+			if page.NextCursor == nil {
+				report.done = append(report.done, prefix)
+			}
+			var files []FileMetadata
+			for _, file := range page.Files {
+				if touched := report.touched[file.Path]; touched == nil || touched.reached {
+					files = append(files, file)
+				}
+			}
+			p.mutex.Unlock()
+
+			for _, file := range files {
+				if scope, ok := p.scopeOf(file.Path); ok {
+					count(scope, file.Size, fileCount(file.Path))
+				}
+			}
+
+			if page.NextCursor == nil {
+				break
+			}
+			cursor = *page.NextCursor
+		}
+	}
+	return nil
+}
+
+// scanPrefixes returns the listing prefixes that cover every scope without overlapping
+func (p *QuotaPlugin) scanPrefixes() []string {
+	var prefixes []string
+	for _, pattern := range p.patterns {
+		prefix := ""
+		for _, segment := range pattern {
+			if segment == "*" {
+				break
+			}
+			prefix += segment + "/"
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return coveringPrefixes(prefixes)
+}
+
+// coveringPrefixes returns the listing prefixes that cover the files under prefixes and their earlier
+// versions without overlapping
+func coveringPrefixes(prefixes []string) []string {
+	all := make([]string, 0, 2*len(prefixes))
+	for _, prefix := range prefixes {
+		all = append(all, prefix, VersionsPrefix+prefix)
+	}
+
+	sort.Strings(all)
+	var covering []string
+	for _, prefix := range all {
+		if len(covering) > 0 && strings.HasPrefix(prefix, covering[len(covering)-1]) {
+			continue
+		}
+		covering = append(covering, prefix)
+	}
+	return covering
+}
+
+// SetQuota sets the quota of a scope, replacing the default quota
+// Quotas set at runtime aren't persisted, the host should set them again after a restart
+func (p *QuotaPlugin) SetQuota(scope string, quota Quota) error {
+	if err := p.checkScope(scope); err != nil {
+		return err
+	}
+	if quota.MaxBytes < 0 || quota.MaxFiles < 0 {
+		return NewInvalidInputError("quota limits must not be negative")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.quotas[scope] = quota
+	return nil
+}
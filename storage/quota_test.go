@@ -0,0 +1,378 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newQuotaTestPlugin(t *testing.T, inner *memoryPlugin) *QuotaPlugin {
+	t.Helper()
+
+	plugin, err := NewQuotaPlugin(inner, QuotaOptions{
+		Scopes:  []string{"orgs/*/"},
+		Default: Quota{MaxBytes: 100},
+		Quotas:  map[string]Quota{"orgs/1/": {MaxBytes: 10, MaxFiles: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plugin
+}
+
+func TestQuotaPluginScopes(t *testing.T) {
+	tests := []struct {
+		path      string
+		wantScope string
+		wantOK    bool
+	}{
+		{path: "orgs/1/a", wantScope: "orgs/1/", wantOK: true},
+		{path: "orgs/1/dir/a", wantScope: "orgs/1/", wantOK: true},
+		{path: "orgs/1", wantOK: false},
+		{path: "shared/a", wantOK: false},
+		{path: versionDataPath("orgs/1/a", "1"), wantScope: "orgs/1/", wantOK: true},
+		{path: versionDataPath("orgs/1/a@b", "1"), wantScope: "orgs/1/", wantOK: true},
+		{path: indexPath("orgs/1/a"), wantOK: false},
+		{path: uploadPathRecord("orgs/1/a"), wantOK: false},
+		{path: ExpiryPrefix + "orgs/1/a", wantOK: false},
+	}
+
+	plugin := newQuotaTestPlugin(t, newMemoryPlugin(nil))
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			scope, ok := plugin.scopeOf(tt.path)
+			if scope != tt.wantScope || ok != tt.wantOK {
+				t.Errorf("scopeOf(%q) = %q, %v, want %q, %v", tt.path, scope, ok, tt.wantScope, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestQuotaPluginReservations(t *testing.T) {
+	tests := []struct {
+		name     string
+		write    func(p *QuotaPlugin) error
+		wantType *ErrorType
+		// want is the bytes and files of each scope afterwards
+		want map[string][2]int64
+	}{
+		{
+			name:  "store fits",
+			write: func(p *QuotaPlugin) error { return p.StoreFile("orgs/1/b", []byte("123"), nil) },
+			want:  map[string][2]int64{"orgs/1/": {8, 2}, "orgs/2/": {8, 1}},
+		},
+		{
+			name:     "store exceeds the bytes",
+			write:    func(p *QuotaPlugin) error { return p.StoreFile("orgs/1/b", []byte("123456"), nil) },
+			wantType: ptr(QuotaExceededErrorType),
+			want:     map[string][2]int64{"orgs/1/": {5, 1}},
+		},
+		{
+			name: "store exceeds the files",
+			write: func(p *QuotaPlugin) error {
+				if err := p.StoreFile("orgs/1/c", []byte("1"), nil); err != nil {
+					return err
+				}
+				return p.StoreFile("orgs/1/b", []byte("1"), nil)
+			},
+			wantType: ptr(QuotaExceededErrorType),
+			want:     map[string][2]int64{"orgs/1/": {6, 2}},
+		},
+		{
+			name:  "replace counts the growth",
+			write: func(p *QuotaPlugin) error { return p.StoreFile("orgs/1/a", []byte("0123456789"), nil) },
+			want:  map[string][2]int64{"orgs/1/": {10, 1}},
+		},
+		{
+			name:  "delete releases",
+			write: func(p *QuotaPlugin) error { return p.DeleteFile("orgs/1/a") },
+			want:  map[string][2]int64{"orgs/1/": {0, 0}},
+		},
+		{
+			name:  "copy between scopes",
+			write: func(p *QuotaPlugin) error { return p.CopyFile("orgs/1/a", "orgs/2/a") },
+			want:  map[string][2]int64{"orgs/1/": {5, 1}, "orgs/2/": {13, 2}},
+		},
+		{
+			name:     "copy exceeds the destination",
+			write:    func(p *QuotaPlugin) error { return p.CopyFile("orgs/2/big", "orgs/1/big") },
+			wantType: ptr(QuotaExceededErrorType),
+			want:     map[string][2]int64{"orgs/1/": {5, 1}, "orgs/2/": {8, 1}},
+		},
+		{
+			name:  "move between scopes",
+			write: func(p *QuotaPlugin) error { return p.MoveFile("orgs/1/a", "orgs/2/a") },
+			want:  map[string][2]int64{"orgs/1/": {0, 0}, "orgs/2/": {13, 2}},
+		},
+		{
+			name:  "move within a full scope",
+			write: func(p *QuotaPlugin) error { return p.MoveFile("orgs/2/big", "orgs/2/moved") },
+			want:  map[string][2]int64{"orgs/2/": {8, 1}},
+		},
+		{
+			name:  "move out of the scopes",
+			write: func(p *QuotaPlugin) error { return p.MoveFile("orgs/1/a", "shared/a") },
+			want:  map[string][2]int64{"orgs/1/": {0, 0}},
+		},
+		{
+			name:  "versions count toward the bytes",
+			write: func(p *QuotaPlugin) error { return p.CopyFile("orgs/1/a", versionDataPath("orgs/1/a", "1")) },
+			want:  map[string][2]int64{"orgs/1/": {10, 1}},
+		},
+		{
+			name:     "version exceeds the bytes",
+			write:    func(p *QuotaPlugin) error { return p.StoreFile(versionDataPath("orgs/1/b", "1"), make([]byte, 6), nil) },
+			wantType: ptr(QuotaExceededErrorType),
+			want:     map[string][2]int64{"orgs/1/": {5, 1}},
+		},
+		{
+			name:  "records aren't accounted",
+			write: func(p *QuotaPlugin) error { return p.StoreFile(indexPath("orgs/1/a"), make([]byte, 50), nil) },
+			want:  map[string][2]int64{"orgs/1/": {5, 1}},
+		},
+		{
+			name: "upload exceeds the bytes",
+			write: func(p *QuotaPlugin) error {
+				writer, err := p.OpenUpload("orgs/1/b", nil)
+				if err != nil {
+					return err
+				}
+				if err := writer.WriteChunk([]byte("123456")); err != nil {
+					return err
+				}
+				return writer.Commit()
+			},
+			wantType: ptr(QuotaExceededErrorType),
+			want:     map[string][2]int64{"orgs/1/": {5, 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newMemoryPlugin(map[string]string{"orgs/1/a": "12345", "orgs/2/big": "12345678"})
+			plugin := newQuotaTestPlugin(t, inner)
+
+			checkErrorType(t, tt.write(plugin), tt.wantType)
+
+			for scope, want := range tt.want {
+				usage, err := plugin.Usage(scope)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if usage.Bytes != want[0] || usage.Files != want[1] {
+					t.Errorf("usage of %s = %d bytes, %d files, want %d bytes, %d files", scope, usage.Bytes, usage.Files, want[0], want[1])
+				}
+			}
+			// Rejected writes all go to orgs/1/b
+			if tt.wantType != nil {
+				if _, ok := inner.data("orgs/1/b"); ok {
+					t.Error("rejected write was stored")
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaPluginUsageReport(t *testing.T) {
+	inner := newMemoryPlugin(map[string]string{"orgs/1/a": "12345"})
+	plugin := newQuotaTestPlugin(t, inner)
+	if _, err := plugin.Usage("orgs/1/"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes that bypass the plugin are only picked up by the report
+	inner.StoreFile("orgs/1/b", []byte("12"), nil)
+	inner.StoreFile("orgs/3/a", []byte("123"), nil)
+	inner.StoreFile(versionDataPath("orgs/3/a", "1"), []byte("123"), nil)
+	inner.StoreFile(indexPath("orgs/3/a"), []byte("[]"), nil)
+	inner.StoreFile("shared/a", []byte("123"), nil)
+
+	report, err := plugin.UsageReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Usage{
+		{Scope: "orgs/1/", Bytes: 7, Files: 2, Quota: Quota{MaxBytes: 10, MaxFiles: 2}},
+		{Scope: "orgs/3/", Bytes: 6, Files: 1, Quota: Quota{MaxBytes: 100}},
+	}
+	if fmt.Sprint(report) != fmt.Sprint(want) {
+		t.Errorf("UsageReport() = %+v, want %+v", report, want)
+	}
+
+	// Writes through the plugin are checked against the recounted usage
+	err = plugin.StoreFile("orgs/1/c", []byte("1"), nil)
+	checkErrorType(t, err, ptr(QuotaExceededErrorType))
+}
+
+func TestQuotaPluginConcurrentWrites(t *testing.T) {
+	inner := newMemoryPlugin(nil)
+	plugin, err := NewQuotaPlugin(inner, QuotaOptions{Scopes: []string{""}, Default: Quota{MaxBytes: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	stored := 0
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := plugin.StoreFile(fmt.Sprintf("f%02d", i), []byte("x"), nil); err == nil {
+				mutex.Lock()
+				stored++
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	usage, err := plugin.Usage("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != 10 || usage.Bytes != 10 || usage.Files != 10 {
+		t.Errorf("stored %d files, usage %d bytes, %d files, want 10 of each", stored, usage.Bytes, usage.Files)
+	}
+}
+
+// blockingListPlugin holds up the listing of prefix until release is closed, after the files were fetched
+type blockingListPlugin struct {
+	*memoryPlugin
+	prefix  string
+	listing chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingListPlugin) ListFiles(prefix string, cursor string, limit int) (*ListResult, error) {
+	result, err := p.memoryPlugin.ListFiles(prefix, cursor, limit)
+	if prefix == p.prefix {
+		close(p.listing)
+		<-p.release
+	}
+	return result, err
+}
+
+func TestQuotaPluginWritesDuringUsageReport(t *testing.T) {
+	tests := []struct {
+		name string
+		// prefix is the listing the writes are made during
+		prefix string
+	}{
+		// Listings run in the order of their prefixes: versions of orgs, versions of users, orgs, users
+		{name: "before the files are listed", prefix: VersionsPrefix + "orgs/"},
+		{name: "while the files are listed", prefix: "orgs/"},
+		{name: "after the files are listed", prefix: "users/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := &blockingListPlugin{
+				memoryPlugin: newMemoryPlugin(map[string]string{"orgs/1/a": "12345", "orgs/2/big": "12345678"}),
+				prefix:       tt.prefix,
+				listing:      make(chan struct{}),
+				release:      make(chan struct{}),
+			}
+			plugin, err := NewQuotaPlugin(inner, QuotaOptions{Scopes: []string{"orgs/*/", "users/*/"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			type result struct {
+				report []Usage
+				err    error
+			}
+			reported := make(chan result, 1)
+			go func() {
+				report, err := plugin.UsageReport()
+				reported <- result{report, err}
+			}()
+			<-inner.listing
+
+			written := make(chan error, 1)
+			go func() {
+				if err := plugin.StoreFile("orgs/1/a", []byte("12"), nil); err != nil {
+					written <- err
+					return
+				}
+				if err := plugin.StoreFile("orgs/2/c", []byte("123"), nil); err != nil {
+					written <- err
+					return
+				}
+				written <- plugin.DeleteFile("orgs/2/big")
+			}()
+			select {
+			case err := <-written:
+				if err != nil {
+					t.Fatalf("write error = %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("writes waited for the usage report")
+			}
+			close(inner.release)
+
+			got := <-reported
+			if got.err != nil {
+				t.Fatalf("UsageReport() error = %v", got.err)
+			}
+			want := []Usage{{Scope: "orgs/1/", Bytes: 2, Files: 1}, {Scope: "orgs/2/", Bytes: 3, Files: 1}}
+			if fmt.Sprint(got.report) != fmt.Sprint(want) {
+				t.Errorf("UsageReport() = %+v, want %+v", got.report, want)
+			}
+		})
+	}
+}
+
+func TestQuotaPluginMultipartUpload(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		// reload completes the upload through a new plugin that didn't initiate it
+		reload   bool
+		wantType *ErrorType
+		want     [2]int64
+	}{
+		{name: "fits", size: 5, want: [2]int64{10, 2}},
+		{name: "exceeds the bytes", size: 6, wantType: ptr(QuotaExceededErrorType), want: [2]int64{5, 1}},
+		{name: "initiated before a reload", size: 1, reload: true, wantType: ptr(InvalidInputError), want: [2]int64{5, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newUploadsPlugin()
+			inner.StoreFile("orgs/1/a", []byte("12345"), nil)
+			options := QuotaOptions{Scopes: []string{"orgs/*/"}, Default: Quota{MaxBytes: 10}}
+			plugin, err := NewQuotaPlugin(inner, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			uploadID, err := plugin.InitiateMultipartUpload("orgs/1/b", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			part, err := plugin.UploadPart(uploadID, 1, make([]byte, tt.size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.reload {
+				if plugin, err = NewQuotaPlugin(inner, options); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			checkErrorType(t, plugin.CompleteMultipartUpload(uploadID, []UploadedPart{*part}), tt.wantType)
+			usage, err := plugin.Usage("orgs/1/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := [2]int64{usage.Bytes, usage.Files}; got != tt.want {
+				t.Errorf("usage = %v, want %v", got, tt.want)
+			}
+			if _, ok := inner.data("orgs/1/b"); ok != (tt.wantType == nil) {
+				t.Errorf("upload stored = %v", ok)
+			}
+		})
+	}
+}
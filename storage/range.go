@@ -0,0 +1,94 @@
+package storage
+
+import "fmt"
+
+// fileSize returns the size of the file at path
+// Plugins that implement neither RangedStoragePlugin nor StatStoragePlugin fall back to retrieving the whole file
+func fileSize(plugin StoragePlugin, path string) (int64, error) {
+	if ranged, ok := plugin.(RangedStoragePlugin); ok {
+		return ranged.FileSize(path)
+	}
+
+	if stat, ok := plugin.(StatStoragePlugin); ok {
+		metadata, err := stat.StatFile(path)
+		if err != nil {
+			return 0, err
+		}
+		return metadata.Size, nil
+	}
+
+	data, err := plugin.RetrieveFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// retrieveRange reads length bytes from path starting at offset
+// A length of 0 reads until the end of the file
+func retrieveRange(plugin StoragePlugin, path string, offset int64, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, NewInvalidInputError("offset and length must not be negative")
+	}
+
+	ranged, ok := plugin.(RangedStoragePlugin)
+	if !ok {
+		data, err := plugin.RetrieveFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return sliceRange(data, offset, length)
+	}
+
+	if length == 0 {
+		size, err := ranged.FileSize(path)
+		if err != nil {
+			return nil, err
+		}
+		if offset > size {
+			return nil, rangeError(offset, size)
+		}
+		length = size - offset
+		if length == 0 {
+			return nil, nil
+		}
+	}
+
+	return ranged.RetrieveRange(path, offset, length)
+}
+
+// sliceRange returns the requested range of an in-memory file
+func sliceRange(data []byte, offset int64, length int64) ([]byte, error) {
+	size := int64(len(data))
+	if offset > size {
+		return nil, rangeError(offset, size)
+	}
+
+	end := size
+	if length > 0 && length < size-offset {
+		end = offset + length
+	}
+	return data[offset:end], nil
+}
+
+func rangeError(offset int64, size int64) *PluginError {
+	return NewInvalidInputError(fmt.Sprintf("offset %d is beyond the end of the file (%d bytes)", offset, size))
+}
+
+// retrieveVersionRange reads length bytes of a version starting at offset
+// A length of 0 reads until the end of the version
+func retrieveVersionRange(versioning VersioningStoragePlugin, path string, versionID string, offset int64, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, NewInvalidInputError("offset and length must not be negative")
+	}
+
+	if ranged, ok := versioning.(RangedVersionStoragePlugin); ok {
+		return ranged.RetrieveVersionRange(path, versionID, offset, length)
+	}
+
+	data, err := versioning.RetrieveVersion(path, versionID)
+	if err != nil {
+		return nil, err
+	}
+	return sliceRange(data, offset, length)
+}
@@ -0,0 +1,80 @@
+package storage
+
+import "testing"
+
+// rangedPlugin serves ranges itself instead of going through RetrieveFile
+type rangedPlugin struct {
+	*memoryPlugin
+}
+
+func (p *rangedPlugin) FileSize(path string) (int64, error) {
+	data, ok := p.data(path)
+	if !ok {
+		return 0, NewNotFoundError(path)
+	}
+	return int64(len(data)), nil
+}
+
+func (p *rangedPlugin) RetrieveRange(path string, offset int64, length int64) ([]byte, error) {
+	data, ok := p.data(path)
+	if !ok {
+		return nil, NewNotFoundError(path)
+	}
+	return data[offset : offset+length], nil
+}
+
+func TestRetrieveRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		offset  int64
+		length  int64
+		want    string
+		wantErr bool
+	}{
+		{name: "whole file", want: "abcdef"},
+		{name: "prefix", length: 2, want: "ab"},
+		{name: "middle", offset: 2, length: 3, want: "cde"},
+		{name: "to the end", offset: 4, want: "ef"},
+		{name: "at the end", offset: 6, want: ""},
+		{name: "beyond the end", offset: 7, wantErr: true},
+		{name: "negative offset", offset: -1, wantErr: true},
+		{name: "negative length", length: -1, wantErr: true},
+	}
+
+	plugins := map[string]func() StoragePlugin{
+		"fallback": func() StoragePlugin { return newMemoryPlugin(map[string]string{"a": "abcdef"}) },
+		"ranged": func() StoragePlugin {
+			return &rangedPlugin{newMemoryPlugin(map[string]string{"a": "abcdef"})}
+		},
+	}
+
+	for kind, newPlugin := range plugins {
+		for _, tt := range tests {
+			t.Run(kind+"/"+tt.name, func(t *testing.T) {
+				data, err := retrieveRange(newPlugin(), "a", tt.offset, tt.length)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+				}
+				if !tt.wantErr && string(data) != tt.want {
+					t.Errorf("read %q, want %q", data, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestFileSize(t *testing.T) {
+	inner := newMemoryPlugin(map[string]string{"a": "abcdef"})
+	for _, plugin := range []StoragePlugin{inner, &rangedPlugin{inner}} {
+		size, err := fileSize(plugin, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != 6 {
+			t.Errorf("size = %d, want 6", size)
+		}
+		if _, err := fileSize(plugin, "missing"); err == nil {
+			t.Error("missing file has a size")
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy configures the retry middleware
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first one
+	MaxAttempts int
+
+	// InitialBackoff is the upper bound of the delay before the first retry, it doubles with every retry
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between attempts
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy makes up to 3 attempts with backoff starting at 100ms and capped at 5s
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+	}
+}
+
+// backoff returns the delay before the given retry (1 for the first) using full jitter
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	ceiling := p.MaxBackoff
+	if shift := retry - 1; shift < 62 {
+		if exp := p.InitialBackoff << shift; exp > 0 && exp < ceiling {
+			ceiling = exp
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// WithRetry returns a Middleware that retries idempotent calls failing with a retryable error
+// Calls rejected by an open circuit breaker are not retried, the backend is known to be unhealthy.
+// Neither are calls abandoned by a timeout while the plugin is still running them.
+func WithRetry(policy RetryPolicy) Middleware {
+	return Intercept(func(ctx context.Context, call Call, invoke func(ctx context.Context) error) error {
+		err := invoke(ctx)
+		for attempt := 1; err != nil && attempt < policy.MaxAttempts && call.Idempotent; attempt++ {
+			if !shouldRetry(err) || ctx.Err() != nil {
+				break
+			}
+
+			timer := time.NewTimer(policy.backoff(attempt))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return contextError(ctx.Err())
+			case <-timer.C:
+			}
+
+			err = invoke(ctx)
+		}
+		return err
+	})
+}
+
+func shouldRetry(err error) bool {
+	var abandoned *abandonedCallError
+	if errors.As(err, &abandoned) {
+		return false
+	}
+	pluginErr := AsPluginError(err)
+	return pluginErr.Retryable() && pluginErr.Type != UnavailableErrorType
+}
+
+// WithTimeout returns a Middleware that gives every call a deadline
+// Plugins that take a context see the deadline, calls to other plugin methods are abandoned
+// with a TimeoutErrorType error when it passes and finish in the background. Abandoned calls
+// are not retried by WithRetry.
+func WithTimeout(timeout time.Duration) Middleware {
+	return Intercept(func(ctx context.Context, call Call, invoke func(ctx context.Context) error) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		return invoke(ctx)
+	})
+}
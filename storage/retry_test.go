@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		retry   int
+		ceiling time.Duration
+	}{
+		{name: "first retry", policy: policy, retry: 1, ceiling: 100 * time.Millisecond},
+		{name: "doubles", policy: policy, retry: 3, ceiling: 400 * time.Millisecond},
+		{name: "capped", policy: policy, retry: 5, ceiling: time.Second},
+		{name: "shift overflow", policy: policy, retry: 70, ceiling: time.Second},
+		{name: "no backoff", policy: RetryPolicy{MaxAttempts: 3}, retry: 2, ceiling: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var longest time.Duration
+			for i := 0; i < 1000; i++ {
+				backoff := tt.policy.backoff(tt.retry)
+				if backoff < 0 || backoff > tt.ceiling {
+					t.Fatalf("backoff(%d) = %v, want between 0 and %v", tt.retry, backoff, tt.ceiling)
+				}
+				longest = max(longest, backoff)
+			}
+			// Full jitter spreads the delays over the whole range
+			if longest < tt.ceiling/2 {
+				t.Errorf("longest of 1000 backoffs = %v, want close to %v", longest, tt.ceiling)
+			}
+		})
+	}
+}
+
+// slowPlugin takes delay to retrieve a file and doesn't take a context
+type slowPlugin struct {
+	*memoryPlugin
+	delay time.Duration
+	calls atomic.Int32
+}
+
+func (p *slowPlugin) RetrieveFile(path string) ([]byte, error) {
+	p.calls.Add(1)
+	time.Sleep(p.delay)
+	return nil, NewNetworkError("backend is slow")
+}
+
+func TestWithRetry(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	tests := []struct {
+		name      string
+		failure   error
+		operation string
+		call      func(plugin StoragePlugin) error
+		wantCalls int
+		wantType  *ErrorType
+	}{
+		{
+			name:      "retryable error",
+			failure:   NewNetworkError("connection reset"),
+			operation: "retrieve",
+			call:      func(plugin StoragePlugin) error { _, err := plugin.RetrieveFile("a"); return err },
+			wantCalls: 3,
+			wantType:  ptr(NetworkErrorType),
+		},
+		{
+			name:      "timeout error",
+			failure:   NewTimeoutError("backend timed out"),
+			operation: "retrieve",
+			call:      func(plugin StoragePlugin) error { _, err := plugin.RetrieveFile("a"); return err },
+			wantCalls: 3,
+			wantType:  ptr(TimeoutErrorType),
+		},
+		{
+			name:      "permanent error",
+			failure:   NewStorageError("disk full"),
+			operation: "store",
+			call:      func(plugin StoragePlugin) error { return plugin.StoreFile("a", []byte("x"), nil) },
+			wantCalls: 1,
+			wantType:  ptr(StorageErrorType),
+		},
+		{
+			name:      "open circuit",
+			failure:   NewUnavailableError("circuit breaker is open"),
+			operation: "retrieve",
+			call:      func(plugin StoragePlugin) error { _, err := plugin.RetrieveFile("a"); return err },
+			wantCalls: 1,
+			wantType:  ptr(UnavailableErrorType),
+		},
+		{
+			name:      "move isn't idempotent",
+			failure:   NewNetworkError("connection reset"),
+			operation: "retrieve",
+			call: func(plugin StoragePlugin) error {
+				return plugin.(MoveStoragePlugin).MoveFile("a", "b")
+			},
+			wantCalls: 1,
+			wantType:  ptr(NetworkErrorType),
+		},
+		{
+			name:      "conditional store isn't idempotent",
+			failure:   NewNetworkError("connection reset"),
+			operation: "store",
+			call: func(plugin StoragePlugin) error {
+				options := StoreOptions{IfNoneMatch: ptr("*")}
+				return plugin.(OptionsStoragePlugin).StoreFileWithOptions(context.Background(), "new", []byte("x"), options)
+			},
+			wantCalls: 1,
+			wantType:  ptr(NetworkErrorType),
+		},
+		{
+			name:      "success",
+			operation: "retrieve",
+			call:      func(plugin StoragePlugin) error { _, err := plugin.RetrieveFile("a"); return err },
+			wantCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newMemoryPlugin(map[string]string{"a": "data"})
+			inner.fail(tt.operation, tt.failure)
+
+			err := tt.call(WithRetry(policy)(inner))
+			checkErrorType(t, err, tt.wantType)
+			if calls := inner.count(tt.operation); calls != tt.wantCalls {
+				t.Errorf("%s called %d times, want %d", tt.operation, calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWithRetryAbandonedCall(t *testing.T) {
+	inner := &slowPlugin{memoryPlugin: newMemoryPlugin(nil), delay: 100 * time.Millisecond}
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	plugin := Chain(inner, WithRetry(policy), WithTimeout(10*time.Millisecond))
+
+	_, err := plugin.RetrieveFile("a")
+	checkErrorType(t, err, ptr(TimeoutErrorType))
+	if calls := inner.calls.Load(); calls != 1 {
+		t.Errorf("abandoned call was made %d times, want 1", calls)
+	}
+}
+
+func TestWithRetryCancelled(t *testing.T) {
+	inner := newMemoryPlugin(nil)
+	inner.fail("store", NewNetworkError("connection reset"))
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+	plugin := WithRetry(policy)(inner).(StoragePluginWithContext)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	err := plugin.StoreFileWithContext(ctx, "a", []byte("x"), nil)
+	checkErrorType(t, err, ptr(TimeoutErrorType))
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("cancelled retry waited %v for its backoff", elapsed)
+	}
+}
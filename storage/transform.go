@@ -0,0 +1,162 @@
+package storage
+
+import "context"
+
+// transformingPlugin is embedded by the wrappers that transform the stored data, CompressionPlugin
+// and EncryptionPlugin. It forwards the calls that don't touch file content to the wrapped plugin.
+//
+// The wrappers implement WrappingStoragePlugin so the supports_* exports report the capabilities
+// of the wrapped plugin, except for the ones that can't be forwarded without the stored form of
+// the data leaking out or bypassing the transformation (see hidesCapability).
+type transformingPlugin struct {
+	inner StoragePlugin
+}
+
+// Unwrap returns the wrapped plugin
+func (p *transformingPlugin) Unwrap() StoragePlugin {
+	return p.inner
+}
+
+// hidesCapability hides the capabilities of the wrapped plugin that the wrappers don't forward:
+// uploads are buffered and transformed as a whole, ranged reads need the whole file and
+// signed URLs would serve the stored form of the data
+func (p *transformingPlugin) hidesCapability(capability any) bool {
+	switch capability.(type) {
+	case *StreamingStoragePlugin, *MultipartStoragePlugin, *RangedStoragePlugin, *SignedURLStoragePlugin:
+		return true
+	}
+	return false
+}
+
+// DeleteFile deletes the file from the wrapped plugin
+func (p *transformingPlugin) DeleteFile(path string) error {
+	return p.inner.DeleteFile(path)
+}
+
+// FileExists checks the wrapped plugin
+func (p *transformingPlugin) FileExists(path string) bool {
+	return p.inner.FileExists(path)
+}
+
+// GenerateURL returns nil: a URL into the wrapped backend would serve the stored form of the data
+func (p *transformingPlugin) GenerateURL(path string, baseURL string) *string {
+	return nil
+}
+
+// ProviderName returns the name of the wrapped plugin
+func (p *transformingPlugin) ProviderName() string {
+	return p.inner.ProviderName()
+}
+
+// Cleanup cleans up the wrapped plugin
+func (p *transformingPlugin) Cleanup() error {
+	return p.inner.Cleanup()
+}
+
+// DeleteFileWithContext deletes a file with cancellation support
+func (p *transformingPlugin) DeleteFileWithContext(ctx context.Context, path string) error {
+	return deleteFile(ctx, p.inner, path)
+}
+
+// FileExistsWithContext checks a file with cancellation support
+func (p *transformingPlugin) FileExistsWithContext(ctx context.Context, path string) (bool, error) {
+	return fileExists(ctx, p.inner, path)
+}
+
+// CopyFile copies the stored file as-is
+func (p *transformingPlugin) CopyFile(sourcePath string, destinationPath string) error {
+	return copyFile(p.inner, sourcePath, destinationPath)
+}
+
+// MoveFile moves the stored file as-is
+func (p *transformingPlugin) MoveFile(sourcePath string, destinationPath string) error {
+	return moveFile(p.inner, sourcePath, destinationPath)
+}
+
+// ListVersions lists the versions of the wrapped plugin, sizes are the stored sizes
+func (p *transformingPlugin) ListVersions(path string) ([]FileVersion, error) {
+	versioning, err := versioningPlugin(p.inner)
+	if err != nil {
+		return nil, err
+	}
+	return versioning.ListVersions(path)
+}
+
+// RestoreVersion restores the stored version as-is
+func (p *transformingPlugin) RestoreVersion(path string, versionID string) error {
+	versioning, err := versioningPlugin(p.inner)
+	if err != nil {
+		return err
+	}
+	return versioning.RestoreVersion(path, versionID)
+}
+
+// DeleteVersion deletes a version from the wrapped plugin
+func (p *transformingPlugin) DeleteVersion(path string, versionID string) error {
+	versioning, err := versioningPlugin(p.inner)
+	if err != nil {
+		return err
+	}
+	return versioning.DeleteVersion(path, versionID)
+}
+
+// PurgeExpiredVersions purges the expired versions of the wrapped plugin
+func (p *transformingPlugin) PurgeExpiredVersions() (int, error) {
+	versioning, err := versioningPlugin(p.inner)
+	if err != nil {
+		return 0, err
+	}
+	return versioning.PurgeExpiredVersions()
+}
+
+// SweepExpiredFiles deletes the expired files of the wrapped plugin
+func (p *transformingPlugin) SweepExpiredFiles(ctx context.Context) (int, error) {
+	lifecycle, err := lifecyclePlugin(p.inner)
+	if err != nil {
+		return 0, err
+	}
+	return lifecycle.SweepExpiredFiles(ctx)
+}
+
+// Usage returns the usage of a scope in the wrapped plugin, counted in stored bytes
+func (p *transformingPlugin) Usage(scope string) (*Usage, error) {
+	quota, err := quotaPlugin(p.inner)
+	if err != nil {
+		return nil, err
+	}
+	return quota.Usage(scope)
+}
+
+// UsageReport returns the usage report of the wrapped plugin, counted in stored bytes
+func (p *transformingPlugin) UsageReport() ([]Usage, error) {
+	quota, err := quotaPlugin(p.inner)
+	if err != nil {
+		return nil, err
+	}
+	return quota.UsageReport()
+}
+
+// SetQuota sets the quota of a scope in the wrapped plugin
+func (p *transformingPlugin) SetQuota(scope string, quota Quota) error {
+	quotas, err := quotaPlugin(p.inner)
+	if err != nil {
+		return err
+	}
+	return quotas.SetQuota(scope, quota)
+}
+
+// describeFiles replaces the listed metadata of stored files with the metadata returned by describe
+// Files deleted since they were listed keep their listed metadata
+func describeFiles(files []FileMetadata, describe func(metadata *FileMetadata) (*FileMetadata, error)) error {
+	for i := range files {
+		described, err := describe(&files[i])
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		files[i] = *described
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"hash"
+	"sync"
+)
+
+// Active streaming uploads keyed by upload ID
+var (
+	activeUploads = make(map[string]UploadWriter)
+	uploadsMutex  sync.Mutex
+)
+
+// bufferedUpload is used for plugins that don't implement StreamingStoragePlugin
+// It collects the chunks in memory and hands them to StoreFile on commit
+type bufferedUpload struct {
+	plugin      StoragePlugin
+	path        string
+	contentType *string
+	data        []byte
+}
+
+func (u *bufferedUpload) WriteChunk(chunk []byte) error {
+	u.data = append(u.data, chunk...)
+	return nil
+}
+
+func (u *bufferedUpload) Commit() error {
+	data := u.data
+	u.data = nil
+	return storeWithGlobalProgress(u.plugin, u.path, data, u.contentType, nil)
+}
+
+func (u *bufferedUpload) Abort() error {
+	u.data = nil
+	return nil
+}
+
+// newUploadWriter starts an upload on the plugin, buffering it in memory if the plugin can't stream
+func newUploadWriter(plugin StoragePlugin, path string, contentType *string) (UploadWriter, error) {
+	if streaming, ok := plugin.(StreamingStoragePlugin); ok {
+		return streaming.OpenUpload(path, contentType)
+	}
+	return &bufferedUpload{plugin: plugin, path: path, contentType: contentType}, nil
+}
+
+// checkedUpload verifies the checksum and conditions of the store options when the upload is committed
+// The conditions are checked like the library's emulated conditional writes, so they are only
+// atomic with respect to other conditional writes
+type checkedUpload struct {
+	UploadWriter
+	plugin  StoragePlugin
+	path    string
+	options StoreOptions
+	hash    hash.Hash
+}
+
+func (u *checkedUpload) WriteChunk(chunk []byte) error {
+	if err := u.UploadWriter.WriteChunk(chunk); err != nil {
+		return err
+	}
+	if u.hash != nil {
+		u.hash.Write(chunk)
+	}
+	return nil
+}
+
+// Commit discards the upload when its checksum or conditions don't hold
+func (u *checkedUpload) Commit() error {
+	if u.hash != nil {
+		if err := u.options.Checksum.verifyHash(u.hash); err != nil {
+			u.UploadWriter.Abort()
+			return err
+		}
+	}
+
+	if u.options.hasPreconditions() {
+		unlock := conditionalWrites.Lock(u.path)
+		defer unlock()
+
+		if err := checkPluginPreconditions(u.plugin, u.path, u.options); err != nil {
+			u.UploadWriter.Abort()
+			return err
+		}
+	}
+	return u.UploadWriter.Commit()
+}
+
+// lockedUpload serializes the calls to a registered upload, the host may push chunks from several threads
+type lockedUpload struct {
+	mutex  sync.Mutex
+	writer UploadWriter
+}
+
+func (u *lockedUpload) WriteChunk(chunk []byte) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.writer.WriteChunk(chunk)
+}
+
+func (u *lockedUpload) Commit() error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.writer.Commit()
+}
+
+func (u *lockedUpload) Abort() error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.writer.Abort()
+}
+
+// openUpload starts an upload on the plugin and registers it under a new upload ID
+func openUpload(plugin StoragePlugin, path string, contentType *string) (string, error) {
+	return openUploadWithOptions(plugin, path, StoreOptions{ContentType: contentType})
+}
+
+// openUploadWithOptions starts an upload whose checksum and conditions are checked on commit
+// The chunks are checked against the upload policy as they are written. Custom metadata and expiry
+// are rejected, streamed files are stored without them
+func openUploadWithOptions(plugin StoragePlugin, path string, options StoreOptions) (string, error) {
+	if len(options.Metadata) > 0 {
+		return "", NewUnsupportedError("Custom metadata is not supported for streaming uploads")
+	}
+	if options.ExpiresAt != nil {
+		return "", NewUnsupportedError("File expiry is not supported for streaming uploads")
+	}
+
+	var checksum hash.Hash
+	if options.Checksum != nil {
+		h, err := NewChecksumHash(options.Checksum.Algorithm)
+		if err != nil {
+			return "", err
+		}
+		checksum = h
+	}
+
+	writer, err := newUploadWriter(plugin, path, options.ContentType)
+	if err != nil {
+		return "", err
+	}
+	if checksum != nil || options.hasPreconditions() {
+		writer = &checkedUpload{UploadWriter: writer, plugin: plugin, path: path, options: options, hash: checksum}
+	}
+	writer = newPolicyUpload(writer, path, options.ContentType)
+
+	id, err := newUploadID()
+	if err != nil {
+		writer.Abort()
+		return "", NewStorageError("Failed to generate upload ID: " + err.Error())
+	}
+
+	uploadsMutex.Lock()
+	activeUploads[id] = &lockedUpload{writer: writer}
+	uploadsMutex.Unlock()
+
+	return id, nil
+}
+
+// getUpload returns the upload registered under the given ID
+func getUpload(id string) (UploadWriter, bool) {
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+
+	writer, ok := activeUploads[id]
+	return writer, ok
+}
+
+// takeUpload removes the upload from the registry and returns it
+func takeUpload(id string) (UploadWriter, bool) {
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+
+	writer, ok := activeUploads[id]
+	if ok {
+		delete(activeUploads, id)
+	}
+	return writer, ok
+}
+
+// discardUpload removes the upload from the registry and aborts it
+func discardUpload(id string) {
+	if writer, ok := takeUpload(id); ok {
+		writer.Abort()
+	}
+}
+
+// abortAllUploads aborts every upload that is still open
+// Called when the plugin is being unloaded
+func abortAllUploads() {
+	uploadsMutex.Lock()
+	uploads := activeUploads
+	activeUploads = make(map[string]UploadWriter)
+	uploadsMutex.Unlock()
+
+	for _, writer := range uploads {
+		writer.Abort()
+	}
+}
+
+func newUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBufferedUpload(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		abort  bool
+		// want is the stored content, nil when nothing may be stored
+		want *string
+	}{
+		{name: "chunks", chunks: []string{"ab", "cd", "e"}, want: ptr("abcde")},
+		{name: "empty upload", want: ptr("")},
+		{name: "aborted", chunks: []string{"ab"}, abort: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newMemoryPlugin(nil)
+			id, err := openUpload(inner, "a", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writer, _ := getUpload(id)
+			for _, chunk := range tt.chunks {
+				if err := writer.WriteChunk([]byte(chunk)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			writer, ok := takeUpload(id)
+			if !ok {
+				t.Fatal("upload isn't registered")
+			}
+			if tt.abort {
+				err = writer.Abort()
+			} else {
+				err = writer.Commit()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, stored := inner.data("a")
+			if stored != (tt.want != nil) || (tt.want != nil && string(data) != *tt.want) {
+				t.Errorf("stored %q, %v, want %v", data, stored, tt.want)
+			}
+			if _, ok := getUpload(id); ok {
+				t.Error("finished upload is still registered")
+			}
+		})
+	}
+}
+
+// uploadChunks opens an upload with options, writes the chunks and commits it
+func uploadChunks(plugin StoragePlugin, path string, options StoreOptions, chunks ...string) error {
+	id, err := openUploadWithOptions(plugin, path, options)
+	if err != nil {
+		return err
+	}
+	writer, _ := getUpload(id)
+	for _, chunk := range chunks {
+		if err := writer.WriteChunk([]byte(chunk)); err != nil {
+			return err
+		}
+	}
+
+	writer, ok := takeUpload(id)
+	if !ok {
+		return NewNotFoundError("Unknown upload ID")
+	}
+	return writer.Commit()
+}
+
+func TestUploadWithOptions(t *testing.T) {
+	sum, _ := ComputeChecksum(ChecksumSHA256, []byte("new data"))
+	expiresAt := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		path     string
+		options  StoreOptions
+		wantType *ErrorType
+		// want is the content of path afterwards
+		want string
+	}{
+		{name: "no options", path: "a", want: "new data"},
+		{name: "matching checksum", path: "a", options: StoreOptions{Checksum: sum}, want: "new data"},
+		{name: "checksum mismatch", path: "a", options: StoreOptions{Checksum: &Checksum{Algorithm: ChecksumSHA256, Value: "00"}}, wantType: ptr(ChecksumMismatchErrorType), want: "old"},
+		{name: "unknown algorithm", path: "a", options: StoreOptions{Checksum: &Checksum{Algorithm: "sha3", Value: "00"}}, wantType: ptr(InvalidInputError), want: "old"},
+		{name: "create only", path: "a", options: StoreOptions{IfNoneMatch: ptr("*")}, wantType: ptr(PreconditionFailedErrorType), want: "old"},
+		{name: "create only new file", path: "b", options: StoreOptions{IfNoneMatch: ptr("*")}, want: "new data"},
+		{name: "stale ETag", path: "a", options: StoreOptions{IfMatch: ptr("\"0\"")}, wantType: ptr(PreconditionFailedErrorType), want: "old"},
+		{name: "custom metadata", path: "a", options: StoreOptions{Metadata: map[string]string{"owner": "42"}}, wantType: ptr(UnsupportedErrorType), want: "old"},
+		{name: "expiry", path: "a", options: StoreOptions{ExpiresAt: &expiresAt}, wantType: ptr(UnsupportedErrorType), want: "old"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newMemoryPlugin(map[string]string{"a": "old"})
+
+			err := uploadChunks(inner, tt.path, tt.options, "new ", "data")
+			checkErrorType(t, err, tt.wantType)
+			if data, _ := inner.data(tt.path); string(data) != tt.want {
+				t.Errorf("content = %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
+
+// abortCountingPlugin streams uploads into writers that count how often they are aborted
+type abortCountingPlugin struct {
+	*memoryPlugin
+	aborted int
+}
+
+type abortCountingUpload struct {
+	plugin *abortCountingPlugin
+}
+
+func (p *abortCountingPlugin) OpenUpload(path string, contentType *string) (UploadWriter, error) {
+	return &abortCountingUpload{plugin: p}, nil
+}
+
+func (u *abortCountingUpload) WriteChunk(chunk []byte) error {
+	return nil
+}
+
+func (u *abortCountingUpload) Commit() error {
+	return nil
+}
+
+func (u *abortCountingUpload) Abort() error {
+	u.plugin.aborted++
+	return nil
+}
+
+func TestDiscardUpload(t *testing.T) {
+	plugin := &abortCountingPlugin{memoryPlugin: newMemoryPlugin(nil)}
+	id, err := openUpload(plugin, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	discardUpload(id)
+	discardUpload(id)
+	if _, ok := getUpload(id); ok {
+		t.Error("discarded upload is still registered")
+	}
+	if plugin.aborted != 1 {
+		t.Errorf("upload aborted %d times, want 1", plugin.aborted)
+	}
+}
+
+func TestUploadConcurrentChunks(t *testing.T) {
+	inner := newMemoryPlugin(nil)
+	id, err := openUpload(inner, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, _ := getUpload(id)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			writer.WriteChunk([]byte(fmt.Sprintf("%02d", i)))
+		}(i)
+	}
+	wg.Wait()
+
+	writer, _ = takeUpload(id)
+	if err := writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := inner.data("a"); len(data) != 100 {
+		t.Errorf("stored %d bytes, want the 100 bytes of all chunks", len(data))
+	}
+}
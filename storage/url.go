@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultURLExpiry is used when the host doesn't request an expiry
+	DefaultURLExpiry = 15 * time.Minute
+
+	// MaxURLExpiry is the longest expiry a signed URL may be requested with
+	MaxURLExpiry = 7 * 24 * time.Hour
+)
+
+// URLOptions controls the generation of a signed URL
+// It is passed as JSON through the FFI
+type URLOptions struct {
+	// Method is the HTTP method the URL is valid for: GET (default), HEAD or PUT
+	Method string `json:"method,omitempty"`
+
+	// ExpiresInSeconds is how long the URL stays valid, DefaultURLExpiry when zero
+	ExpiresInSeconds int64 `json:"expires_in_seconds,omitempty"`
+
+	// ContentType restricts the content type of a PUT upload
+	ContentType *string `json:"content_type,omitempty"`
+
+	// Response header overrides applied when the URL is used for a download
+	ResponseContentType        *string `json:"response_content_type,omitempty"`
+	ResponseContentDisposition *string `json:"response_content_disposition,omitempty"`
+	ResponseCacheControl       *string `json:"response_cache_control,omitempty"`
+}
+
+// ExpiresIn returns the requested lifetime of the URL
+func (o URLOptions) ExpiresIn() time.Duration {
+	return time.Duration(o.ExpiresInSeconds) * time.Second
+}
+
+// SignedURL is a time-limited URL for direct access to a stored file
+// It is serialized as JSON when returned through the FFI
+type SignedURL struct {
+	URL       string    `json:"url"`
+	Method    string    `json:"method"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Headers the client must send along with the request, e.g. Content-Type for uploads
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// parseURLOptions decodes and validates the URL options sent by the host
+func parseURLOptions(optionsJSON string) (URLOptions, error) {
+	var options URLOptions
+	if optionsJSON != "" {
+		if err := json.Unmarshal([]byte(optionsJSON), &options); err != nil {
+			return options, NewInvalidInputError("failed to parse URL options: " + err.Error())
+		}
+	}
+
+	options.Method = strings.ToUpper(options.Method)
+	switch options.Method {
+	case "":
+		options.Method = "GET"
+	case "GET", "HEAD", "PUT":
+	default:
+		return options, NewInvalidInputError(fmt.Sprintf("unsupported URL method %q", options.Method))
+	}
+
+	if options.ExpiresInSeconds < 0 {
+		return options, NewInvalidInputError("expires_in_seconds must not be negative")
+	}
+	if options.ExpiresInSeconds == 0 {
+		options.ExpiresInSeconds = int64(DefaultURLExpiry / time.Second)
+	}
+	if options.ExpiresIn() > MaxURLExpiry {
+		return options, NewInvalidInputError(fmt.Sprintf("expiry may not exceed %s", MaxURLExpiry))
+	}
+
+	return options, nil
+}
+
+// generateSignedURL creates a signed URL if the plugin supports it
+func generateSignedURL(plugin StoragePlugin, path string, options URLOptions) (*SignedURL, error) {
+	signer, ok := plugin.(SignedURLStoragePlugin)
+	if !ok {
+		return nil, NewUnsupportedError("Plugin does not support signed URLs")
+	}
+	return signer.GenerateSignedURL(path, options)
+}
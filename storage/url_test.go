@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseURLOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		json       string
+		wantMethod string
+		wantExpiry time.Duration
+		wantErr    bool
+	}{
+		{name: "defaults", json: "", wantMethod: "GET", wantExpiry: DefaultURLExpiry},
+		{name: "empty object", json: "{}", wantMethod: "GET", wantExpiry: DefaultURLExpiry},
+		{name: "lower case method", json: `{"method":"put","expires_in_seconds":60}`, wantMethod: "PUT", wantExpiry: time.Minute},
+		{name: "head", json: `{"method":"HEAD"}`, wantMethod: "HEAD", wantExpiry: DefaultURLExpiry},
+		{name: "longest expiry", json: `{"expires_in_seconds":604800}`, wantMethod: "GET", wantExpiry: MaxURLExpiry},
+		{name: "expiry too long", json: `{"expires_in_seconds":604801}`, wantErr: true},
+		{name: "negative expiry", json: `{"expires_in_seconds":-1}`, wantErr: true},
+		{name: "unsupported method", json: `{"method":"DELETE"}`, wantErr: true},
+		{name: "malformed", json: `{"method":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, err := parseURLOptions(tt.json)
+			if tt.wantErr {
+				checkErrorType(t, err, ptr(InvalidInputError))
+				return
+			}
+			checkErrorType(t, err, nil)
+			if options.Method != tt.wantMethod || options.ExpiresIn() != tt.wantExpiry {
+				t.Errorf("method %s, expiry %s, want %s, %s", options.Method, options.ExpiresIn(), tt.wantMethod, tt.wantExpiry)
+			}
+		})
+	}
+}
+
+// signingPlugin signs URLs by appending the method and expiry
+type signingPlugin struct {
+	*memoryPlugin
+}
+
+func (p *signingPlugin) GenerateSignedURL(path string, options URLOptions) (*SignedURL, error) {
+	return &SignedURL{
+		URL:       "https://example.com/" + path + "?method=" + options.Method,
+		Method:    options.Method,
+		ExpiresAt: time.Now().Add(options.ExpiresIn()),
+	}, nil
+}
+
+func TestGenerateSignedURL(t *testing.T) {
+	options, _ := parseURLOptions("")
+
+	signed, err := generateSignedURL(&signingPlugin{newMemoryPlugin(nil)}, "a", options)
+	checkErrorType(t, err, nil)
+	if signed.URL != "https://example.com/a?method=GET" {
+		t.Errorf("url = %s", signed.URL)
+	}
+
+	_, err = generateSignedURL(newMemoryPlugin(nil), "a", options)
+	checkErrorType(t, err, ptr(UnsupportedErrorType))
+}
@@ -0,0 +1,784 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/matt953/relm-plugin-core-go/config"
+)
+
+// VersionsPrefix is the reserved path prefix under which VersioningPlugin keeps earlier versions
+const VersionsPrefix = ".versions/"
+
+// UnversionedID is the version ID of a file stored before versioning was enabled
+const UnversionedID = "null"
+
+// Plugin config keys for versioning
+const (
+	VersionRetentionConfigKey = "version_retention_days"
+	VersionMaxCountConfigKey  = "version_max_count"
+	SoftDeleteConfigKey       = "soft_delete"
+)
+
+// FileVersion describes one version of a file
+// It is serialized as JSON when returned through the FFI
+type FileVersion struct {
+	VersionID   string    `json:"version_id"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ContentType *string   `json:"content_type,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	// IsLatest is set on the current version, or on the delete marker of a deleted file
+	IsLatest bool `json:"is_latest"`
+
+	// DeleteMarker records that the file was deleted, it has no data
+	DeleteMarker bool `json:"delete_marker"`
+
+	// ExpiresAt is when the version is purged, nil while it is current or when versions are kept forever
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// versioningPlugin returns the plugin as a VersioningStoragePlugin
+func versioningPlugin(plugin StoragePlugin) (VersioningStoragePlugin, error) {
+	versioning, ok := plugin.(VersioningStoragePlugin)
+	if !ok {
+		return nil, NewUnsupportedError("Plugin does not support versioning")
+	}
+	return versioning, nil
+}
+
+// VersioningOptions configures a VersioningPlugin
+type VersioningOptions struct {
+	// Retention is how long overwritten versions and deleted files are kept, 0 keeps them forever
+	Retention time.Duration
+
+	// MaxVersions is the number of earlier versions kept per file, 0 for no limit
+	MaxVersions int
+
+	// SoftDelete keeps deleted files restorable until Retention expires
+	// Without it DeleteFile permanently deletes the file and all of its versions
+	SoftDelete bool
+}
+
+// DefaultVersioningOptions keeps earlier versions and deleted files for 30 days
+func DefaultVersioningOptions() VersioningOptions {
+	return VersioningOptions{
+		Retention:  30 * 24 * time.Hour,
+		SoftDelete: true,
+	}
+}
+
+// VersioningOptionsFromConfig builds versioning options from the plugin config
+// Keys that aren't set keep their default value
+func VersioningOptionsFromConfig() (VersioningOptions, error) {
+	options := DefaultVersioningOptions()
+
+	days, err := pluginConfigInt(VersionRetentionConfigKey, -1)
+	if err != nil {
+		return options, err
+	}
+	if days >= 0 {
+		options.Retention = time.Duration(days) * 24 * time.Hour
+	}
+
+	if options.MaxVersions, err = pluginConfigInt(VersionMaxCountConfigKey, options.MaxVersions); err != nil {
+		return options, err
+	}
+
+	if _, ok := config.GetPluginConfigValue(SoftDeleteConfigKey); ok {
+		options.SoftDelete = config.GetPluginBool(SoftDeleteConfigKey)
+	}
+	return options, nil
+}
+
+// versionIndex lists the versions of a file, newest first
+type versionIndex struct {
+	Versions []FileVersion `json:"versions"`
+
+	// dirty is set when the index was reconciled with the current file and needs saving
+	dirty bool
+}
+
+func (i *versionIndex) latest() *FileVersion {
+	if len(i.Versions) == 0 {
+		return nil
+	}
+	return &i.Versions[0]
+}
+
+func (i *versionIndex) find(versionID string) (int, *FileVersion) {
+	for n := range i.Versions {
+		if i.Versions[n].VersionID == versionID {
+			return n, &i.Versions[n]
+		}
+	}
+	return -1, nil
+}
+
+// VersioningPlugin adds versioning and soft-delete to any StoragePlugin
+//
+// The current version of a file stays at its path so the wrapped plugin can serve it as before.
+// When a file is overwritten or deleted through this plugin the current version is first copied
+// under VersionsPrefix, next to a JSON index of the file's versions. Writes that bypass the
+// plugin aren't versioned.
+type VersioningPlugin struct {
+	reservedPathPlugin
+	options VersioningOptions
+	locks   PathMutex
+}
+
+// NewVersioningPlugin wraps inner with versioning
+func NewVersioningPlugin(inner StoragePlugin, options VersioningOptions) *VersioningPlugin {
+	return &VersioningPlugin{
+		reservedPathPlugin: reservedPathPlugin{
+			interceptedPlugin: &interceptedPlugin{inner: inner, interceptor: passthrough},
+			checkPath:         checkPath,
+		},
+		options: options,
+	}
+}
+
+func (p *VersioningPlugin) providesCapability(VersioningStoragePlugin) {}
+
+// checkPath rejects paths under the reserved prefix
+func checkPath(path string) error {
+	if strings.HasPrefix(path, VersionsPrefix) {
+		return NewInvalidInputError("path is reserved for file versions: " + path)
+	}
+	return nil
+}
+
+func indexPath(path string) string {
+	return VersionsPrefix + path + "@index.json"
+}
+
+func versionDataPath(path string, versionID string) string {
+	return VersionsPrefix + path + "@" + versionID
+}
+
+// versionOwner returns the path of the file an earlier version stored at path belongs to
+// Indexes and the other records under VersionsPrefix don't belong to a file
+func versionOwner(path string) (string, bool) {
+	if !strings.HasPrefix(path, VersionsPrefix) {
+		return "", false
+	}
+	rest := strings.TrimPrefix(path, VersionsPrefix)
+	separator := strings.LastIndex(rest, "@")
+	if separator <= 0 || strings.HasPrefix(rest, "@uploads/") || rest[separator+1:] == "index.json" {
+		return "", false
+	}
+	return rest[:separator], true
+}
+
+func uploadPathRecord(uploadID string) string {
+	return VersionsPrefix + "@uploads/" + hex.EncodeToString([]byte(uploadID))
+}
+
+func newVersionID() (string, error) {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return "", NewStorageError("failed to generate version ID: " + err.Error())
+	}
+	// Version IDs sort by creation time
+	return fmt.Sprintf("%016x%s", time.Now().UnixNano(), hex.EncodeToString(buf)), nil
+}
+
+// loadIndex reads the version index of path and reconciles it with the current file
+// The path lock must be held
+func (p *VersioningPlugin) loadIndex(path string) (*versionIndex, error) {
+	index := &versionIndex{}
+	location := indexPath(path)
+	if p.inner.FileExists(location) {
+		data, err := p.inner.RetrieveFile(location)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, index); err != nil {
+			return nil, NewStorageError("failed to decode version index of " + path + ": " + err.Error())
+		}
+	}
+
+	exists := p.inner.FileExists(path)
+	latest := index.latest()
+	switch {
+	case exists && (latest == nil || !latest.IsLatest || latest.DeleteMarker):
+		// The file predates versioning or was written around the plugin
+		versionID := UnversionedID
+		if latest != nil {
+			id, err := newVersionID()
+			if err != nil {
+				return nil, err
+			}
+			versionID = id
+			latest.IsLatest = false
+		}
+
+		version := FileVersion{VersionID: versionID, Path: path, CreatedAt: time.Now().UTC(), IsLatest: true}
+		if metadata, err := statFile(p.inner, path); err == nil {
+			version.Size = metadata.Size
+			version.ContentType = metadata.ContentType
+			if metadata.LastModified != nil {
+				version.CreatedAt = metadata.LastModified.UTC()
+			}
+		}
+		index.Versions = append([]FileVersion{version}, index.Versions...)
+		index.dirty = true
+	case !exists && latest != nil && latest.IsLatest && !latest.DeleteMarker:
+		// The file was deleted around the plugin, its data is gone
+		index.Versions = index.Versions[1:]
+		if len(index.Versions) > 0 {
+			index.Versions[0].IsLatest = false
+		}
+		index.dirty = true
+	}
+	return index, nil
+}
+
+// saveIndex writes the index, or removes it when there are no versions left
+func (p *VersioningPlugin) saveIndex(path string, index *versionIndex) error {
+	location := indexPath(path)
+	if len(index.Versions) == 0 {
+		if err := p.inner.DeleteFile(location); err != nil && !IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return NewStorageError("failed to encode version index: " + err.Error())
+	}
+	contentType := "application/json"
+	return p.inner.StoreFile(location, data, &contentType)
+}
+
+// retire turns the latest version into a noncurrent version, copying its data out of the way
+// The path lock must be held
+func (p *VersioningPlugin) retire(path string, index *versionIndex, now time.Time) error {
+	latest := index.latest()
+	if latest == nil || !latest.IsLatest {
+		return nil
+	}
+
+	if !latest.DeleteMarker {
+		if err := copyFile(p.inner, path, versionDataPath(path, latest.VersionID)); err != nil {
+			return err
+		}
+	}
+
+	// Delete markers keep the expiry they got when the file was deleted
+	latest.IsLatest = false
+	if p.options.Retention > 0 && !latest.DeleteMarker {
+		expires := now.Add(p.options.Retention)
+		latest.ExpiresAt = &expires
+	}
+	return nil
+}
+
+// prune permanently deletes the noncurrent versions past their retention or beyond MaxVersions
+// and returns how many were deleted
+func (p *VersioningPlugin) prune(path string, index *versionIndex, now time.Time) int {
+	kept := index.Versions[:0]
+	noncurrent := 0
+	pruned := 0
+	for _, version := range index.Versions {
+		if version.IsLatest {
+			kept = append(kept, version)
+			continue
+		}
+
+		expired := version.ExpiresAt != nil && !version.ExpiresAt.After(now)
+		if !version.DeleteMarker && !expired {
+			noncurrent++
+			expired = p.options.MaxVersions > 0 && noncurrent > p.options.MaxVersions
+		}
+		if !expired {
+			kept = append(kept, version)
+			continue
+		}
+
+		if !version.DeleteMarker {
+			p.inner.DeleteFile(versionDataPath(path, version.VersionID))
+		}
+		pruned++
+	}
+
+	// The delete marker of a deleted file is dropped once it expired and nothing is left to restore
+	if len(kept) == 1 && kept[0].DeleteMarker && kept[0].ExpiresAt != nil && !kept[0].ExpiresAt.After(now) {
+		kept = kept[:0]
+		pruned++
+	}
+	index.Versions = kept
+	if pruned > 0 {
+		index.dirty = true
+	}
+	return pruned
+}
+
+// versioned runs a write that replaces the current version of path and records the new version
+// size is -1 when the size isn't known before the write
+func (p *VersioningPlugin) versioned(path string, size int64, contentType *string, write func() error) error {
+	if err := checkPath(path); err != nil {
+		return err
+	}
+
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	index, err := p.loadIndex(path)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	retired := index.latest()
+	if err := p.retire(path, index, now); err != nil {
+		return err
+	}
+
+	if err := write(); err != nil {
+		if retired != nil && !retired.DeleteMarker {
+			p.inner.DeleteFile(versionDataPath(path, retired.VersionID))
+		}
+		return err
+	}
+
+	versionID, err := newVersionID()
+	if err != nil {
+		return err
+	}
+	version := FileVersion{VersionID: versionID, Path: path, Size: size, ContentType: contentType, CreatedAt: now, IsLatest: true}
+	if size < 0 || contentType == nil {
+		if metadata, err := statFile(p.inner, path); err == nil {
+			version.Size = metadata.Size
+			if contentType == nil {
+				version.ContentType = metadata.ContentType
+			}
+		}
+	}
+
+	index.Versions = append([]FileVersion{version}, index.Versions...)
+	p.prune(path, index, now)
+	return p.saveIndex(path, index)
+}
+
+// softDelete replaces the current version of path with a delete marker
+func (p *VersioningPlugin) softDelete(ctx context.Context, path string) error {
+	if err := checkPath(path); err != nil {
+		return err
+	}
+
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	index, err := p.loadIndex(path)
+	if err != nil {
+		return err
+	}
+	latest := index.latest()
+	if latest == nil || latest.DeleteMarker {
+		return NewNotFoundError(path)
+	}
+
+	now := time.Now().UTC()
+	if err := p.retire(path, index, now); err != nil {
+		return err
+	}
+	if err := deleteFile(ctx, p.inner, path); err != nil {
+		p.inner.DeleteFile(versionDataPath(path, latest.VersionID))
+		return err
+	}
+
+	versionID, err := newVersionID()
+	if err != nil {
+		return err
+	}
+	marker := FileVersion{VersionID: versionID, Path: path, CreatedAt: now, IsLatest: true, DeleteMarker: true}
+	if p.options.Retention > 0 {
+		expires := now.Add(p.options.Retention)
+		marker.ExpiresAt = &expires
+	}
+
+	index.Versions = append([]FileVersion{marker}, index.Versions...)
+	p.prune(path, index, now)
+	return p.saveIndex(path, index)
+}
+
+// hardDelete deletes the file and all of its versions
+func (p *VersioningPlugin) hardDelete(ctx context.Context, path string) error {
+	if err := checkPath(path); err != nil {
+		return err
+	}
+
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	index, err := p.loadIndex(path)
+	if err != nil {
+		return err
+	}
+	if err := deleteFile(ctx, p.inner, path); err != nil {
+		return err
+	}
+
+	for _, version := range index.Versions {
+		if !version.IsLatest && !version.DeleteMarker {
+			p.inner.DeleteFile(versionDataPath(path, version.VersionID))
+		}
+	}
+	index.Versions = nil
+	return p.saveIndex(path, index)
+}
+
+// StoreFile stores a new version of the file
+func (p *VersioningPlugin) StoreFile(path string, data []byte, contentType *string) error {
+	return p.StoreFileWithContext(context.Background(), path, data, contentType)
+}
+
+// StoreFileWithContext stores a new version of the file
+func (p *VersioningPlugin) StoreFileWithContext(ctx context.Context, path string, data []byte, contentType *string) error {
+	return p.versioned(path, int64(len(data)), contentType, func() error {
+		return storeFile(ctx, p.inner, path, data, contentType, ProgressFromContext(ctx))
+	})
+}
+
+// StoreFileWithOptions stores a new version of the file
+func (p *VersioningPlugin) StoreFileWithOptions(ctx context.Context, path string, data []byte, options StoreOptions) error {
+	return p.versioned(path, int64(len(data)), options.ContentType, func() error {
+		return storeWithOptions(ctx, p.inner, path, data, options, ProgressFromContext(ctx))
+	})
+}
+
+// DeleteFile soft-deletes the file, or deletes it with all its versions without SoftDelete
+func (p *VersioningPlugin) DeleteFile(path string) error {
+	return p.DeleteFileWithContext(context.Background(), path)
+}
+
+// DeleteFileWithContext soft-deletes the file, or deletes it with all its versions without SoftDelete
+func (p *VersioningPlugin) DeleteFileWithContext(ctx context.Context, path string) error {
+	if p.options.SoftDelete {
+		return p.softDelete(ctx, path)
+	}
+	return p.hardDelete(ctx, path)
+}
+
+// DeleteFiles deletes the files one by one so every deletion is versioned
+func (p *VersioningPlugin) DeleteFiles(paths []string) ([]DeleteResult, error) {
+	results := make([]DeleteResult, len(paths))
+	for i, path := range paths {
+		results[i] = NewDeleteResult(path, p.DeleteFile(path))
+	}
+	return results, nil
+}
+
+// CopyFile copies the file, creating a new version of the destination
+func (p *VersioningPlugin) CopyFile(sourcePath string, destinationPath string) error {
+	if err := checkPath(sourcePath); err != nil {
+		return err
+	}
+	return p.versioned(destinationPath, -1, nil, func() error {
+		return copyFile(p.inner, sourcePath, destinationPath)
+	})
+}
+
+// MoveFile copies the file to a new version of the destination and deletes the source
+func (p *VersioningPlugin) MoveFile(sourcePath string, destinationPath string) error {
+	if err := p.CopyFile(sourcePath, destinationPath); err != nil {
+		return err
+	}
+	return p.DeleteFile(sourcePath)
+}
+
+// ListFiles lists the wrapped plugin without the reserved version files
+func (p *VersioningPlugin) ListFiles(prefix string, cursor string, limit int) (*ListResult, error) {
+	if strings.HasPrefix(prefix, VersionsPrefix) {
+		return &ListResult{Files: []FileMetadata{}}, nil
+	}
+
+	result, err := listFiles(p.inner, prefix, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	files := result.Files[:0]
+	for _, file := range result.Files {
+		if !strings.HasPrefix(file.Path, VersionsPrefix) {
+			files = append(files, file)
+		}
+	}
+	result.Files = files
+	return result, nil
+}
+
+// OpenUpload starts an upload that creates a new version when it is committed
+func (p *VersioningPlugin) OpenUpload(path string, contentType *string) (UploadWriter, error) {
+	if err := checkPath(path); err != nil {
+		return nil, err
+	}
+
+	writer, err := newUploadWriter(p.inner, path, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return &versionedUpload{UploadWriter: writer, plugin: p, path: path, contentType: contentType}, nil
+}
+
+type versionedUpload struct {
+	UploadWriter
+	plugin      *VersioningPlugin
+	path        string
+	contentType *string
+}
+
+func (u *versionedUpload) Commit() error {
+	return u.plugin.versioned(u.path, -1, u.contentType, u.UploadWriter.Commit)
+}
+
+// InitiateMultipartUpload starts a multipart upload and records its path
+// The path is kept with the versions so the upload can be completed after a restart
+func (p *VersioningPlugin) InitiateMultipartUpload(path string, contentType *string) (string, error) {
+	if err := checkPath(path); err != nil {
+		return "", err
+	}
+
+	multipart, err := multipartPlugin(p.inner)
+	if err != nil {
+		return "", err
+	}
+
+	uploadID, err := multipart.InitiateMultipartUpload(path, contentType)
+	if err != nil {
+		return "", err
+	}
+	if err := p.inner.StoreFile(uploadPathRecord(uploadID), []byte(path), nil); err != nil {
+		multipart.AbortMultipartUpload(uploadID)
+		return "", err
+	}
+	return uploadID, nil
+}
+
+// CompleteMultipartUpload completes the upload as a new version of its path
+func (p *VersioningPlugin) CompleteMultipartUpload(uploadID string, parts []UploadedPart) error {
+	multipart, err := multipartPlugin(p.inner)
+	if err != nil {
+		return err
+	}
+
+	record := uploadPathRecord(uploadID)
+	path, err := p.inner.RetrieveFile(record)
+	if err != nil {
+		if IsNotFound(err) {
+			return NewNotFoundError("upload " + uploadID)
+		}
+		return err
+	}
+
+	err = p.versioned(string(path), -1, nil, func() error {
+		return multipart.CompleteMultipartUpload(uploadID, parts)
+	})
+	if err != nil {
+		return err
+	}
+	p.inner.DeleteFile(record)
+	return nil
+}
+
+// AbortMultipartUpload aborts the upload
+func (p *VersioningPlugin) AbortMultipartUpload(uploadID string) error {
+	multipart, err := multipartPlugin(p.inner)
+	if err != nil {
+		return err
+	}
+
+	if err := multipart.AbortMultipartUpload(uploadID); err != nil {
+		return err
+	}
+	p.inner.DeleteFile(uploadPathRecord(uploadID))
+	return nil
+}
+
+// ListVersions returns the versions of the file, newest first
+func (p *VersioningPlugin) ListVersions(path string) ([]FileVersion, error) {
+	if err := checkPath(path); err != nil {
+		return nil, err
+	}
+
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	index, err := p.loadIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	p.prune(path, index, time.Now().UTC())
+	if index.dirty {
+		if err := p.saveIndex(path, index); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(index.Versions) == 0 {
+		return nil, NewNotFoundError(path)
+	}
+	return index.Versions, nil
+}
+
+// RetrieveVersion retrieves the data of a version
+func (p *VersioningPlugin) RetrieveVersion(path string, versionID string) ([]byte, error) {
+	data, _, err := p.retrieveVersion(path, versionID)
+	return data, err
+}
+
+// RetrieveVersionRange retrieves part of a version without reading the rest of it
+func (p *VersioningPlugin) RetrieveVersionRange(path string, versionID string, offset int64, length int64) ([]byte, error) {
+	if err := checkPath(path); err != nil {
+		return nil, err
+	}
+
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	location, _, err := p.versionLocation(path, versionID)
+	if err != nil {
+		return nil, err
+	}
+	return retrieveRange(p.inner, location, offset, length)
+}
+
+// retrieveVersion returns the data of a version and the options that store it again
+func (p *VersioningPlugin) retrieveVersion(path string, versionID string) ([]byte, StoreOptions, error) {
+	if err := checkPath(path); err != nil {
+		return nil, StoreOptions{}, err
+	}
+
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	location, version, err := p.versionLocation(path, versionID)
+	if err != nil {
+		return nil, StoreOptions{}, err
+	}
+	data, err := p.inner.RetrieveFile(location)
+	if err != nil {
+		return nil, StoreOptions{}, err
+	}
+
+	options := StoreOptions{ContentType: version.ContentType}
+	if metadata, err := statFile(p.inner, location); err == nil {
+		options.Metadata = metadata.Metadata
+	}
+	return data, options, nil
+}
+
+// versionLocation returns the version and the path its data is stored at, the path must be locked
+func (p *VersioningPlugin) versionLocation(path string, versionID string) (string, *FileVersion, error) {
+	index, err := p.loadIndex(path)
+	if err != nil {
+		return "", nil, err
+	}
+	_, version := index.find(versionID)
+	if version == nil {
+		return "", nil, NewNotFoundError(fmt.Sprintf("version %s of %s", versionID, path))
+	}
+	if version.DeleteMarker {
+		return "", nil, NewInvalidInputError(fmt.Sprintf("version %s of %s is a delete marker", versionID, path))
+	}
+
+	if version.IsLatest {
+		return path, version, nil
+	}
+	return versionDataPath(path, versionID), version, nil
+}
+
+// RestoreVersion stores a copy of the version as the latest version of the file
+func (p *VersioningPlugin) RestoreVersion(path string, versionID string) error {
+	data, options, err := p.retrieveVersion(path, versionID)
+	if err != nil {
+		return err
+	}
+	return p.StoreFileWithOptions(context.Background(), path, data, options)
+}
+
+// DeleteVersion permanently deletes a version that isn't the latest one
+func (p *VersioningPlugin) DeleteVersion(path string, versionID string) error {
+	if err := checkPath(path); err != nil {
+		return err
+	}
+
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	index, err := p.loadIndex(path)
+	if err != nil {
+		return err
+	}
+	n, version := index.find(versionID)
+	if version == nil {
+		return NewNotFoundError(fmt.Sprintf("version %s of %s", versionID, path))
+	}
+	if version.IsLatest {
+		return NewInvalidInputError("the latest version can't be deleted, delete or overwrite the file instead")
+	}
+
+	if !version.DeleteMarker {
+		if err := p.inner.DeleteFile(versionDataPath(path, versionID)); err != nil && !IsNotFound(err) {
+			return err
+		}
+	}
+	index.Versions = append(index.Versions[:n], index.Versions[n+1:]...)
+	return p.saveIndex(path, index)
+}
+
+// PurgeExpiredVersions deletes the versions past their retention period
+// The wrapped plugin must implement ListingStoragePlugin to find the versioned files.
+// A file whose index can't be read or pruned doesn't stop the purge, the errors are returned together
+func (p *VersioningPlugin) PurgeExpiredVersions() (int, error) {
+	purged := 0
+	cursor := ""
+	var errs []error
+	for {
+		page, err := listFiles(p.inner, VersionsPrefix, cursor, MaxListLimit)
+		if err != nil {
+			return purged, joinErrors(append(errs, err))
+		}
+
+		for _, file := range page.Files {
+			if !strings.HasSuffix(file.Path, "@index.json") || strings.HasPrefix(file.Path, VersionsPrefix+"@uploads/") {
+				continue
+			}
+			path := strings.TrimSuffix(strings.TrimPrefix(file.Path, VersionsPrefix), "@index.json")
+
+			n, err := p.purgePath(path)
+			purged += n
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		if page.NextCursor == nil {
+			return purged, joinErrors(errs)
+		}
+		cursor = *page.NextCursor
+	}
+}
+
+func (p *VersioningPlugin) purgePath(path string) (int, error) {
+	unlock := p.locks.Lock(path)
+	defer unlock()
+
+	index, err := p.loadIndex(path)
+	if err != nil {
+		return 0, err
+	}
+	n := p.prune(path, index, time.Now().UTC())
+	if index.dirty {
+		return n, p.saveIndex(path, index)
+	}
+	return n, nil
+}
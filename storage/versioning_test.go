@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestVersioningPlugin(t *testing.T, options VersioningOptions, files map[string]string) (*VersioningPlugin, *memoryPlugin) {
+	t.Helper()
+
+	inner := newMemoryPlugin(files)
+	return NewVersioningPlugin(inner, options), inner
+}
+
+// storeVersions stores each content in turn at path
+func storeVersions(t *testing.T, plugin *VersioningPlugin, path string, contents ...string) {
+	t.Helper()
+
+	for _, content := range contents {
+		if err := plugin.StoreFile(path, []byte(content), ptr("text/plain")); err != nil {
+			t.Fatalf("StoreFile(%q) error = %v", path, err)
+		}
+	}
+}
+
+// versionContents returns the content of every version of path, newest first, "-" for delete markers
+func versionContents(t *testing.T, plugin *VersioningPlugin, path string) []string {
+	t.Helper()
+
+	versions, err := plugin.ListVersions(path)
+	if err != nil {
+		t.Fatalf("ListVersions(%q) error = %v", path, err)
+	}
+	contents := make([]string, len(versions))
+	for i, version := range versions {
+		if version.DeleteMarker {
+			contents[i] = "-"
+			continue
+		}
+		data, err := plugin.RetrieveVersion(path, version.VersionID)
+		if err != nil {
+			t.Fatalf("RetrieveVersion(%q, %q) error = %v", path, version.VersionID, err)
+		}
+		contents[i] = string(data)
+	}
+	return contents
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestVersioningListRestoreDelete(t *testing.T) {
+	paths := []string{"a.txt", "dir/b@c.txt", "d@index.json", "e@null"}
+
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+			plugin, _ := newTestVersioningPlugin(t, DefaultVersioningOptions(), nil)
+			storeVersions(t, plugin, path, "one", "two", "three")
+
+			if got, want := versionContents(t, plugin, path), []string{"three", "two", "one"}; !equalStrings(got, want) {
+				t.Fatalf("versions = %q, want %q", got, want)
+			}
+
+			versions, _ := plugin.ListVersions(path)
+			if !versions[0].IsLatest || versions[1].IsLatest || versions[1].ExpiresAt == nil {
+				t.Errorf("latest = %v, %v, expiry of the noncurrent version = %v", versions[0].IsLatest, versions[1].IsLatest, versions[1].ExpiresAt)
+			}
+
+			if err := plugin.RestoreVersion(path, versions[2].VersionID); err != nil {
+				t.Fatalf("RestoreVersion() error = %v", err)
+			}
+			if data, _ := plugin.RetrieveFile(path); string(data) != "one" {
+				t.Errorf("RetrieveFile() after restore = %q, want %q", data, "one")
+			}
+
+			if err := plugin.DeleteVersion(path, versions[1].VersionID); err != nil {
+				t.Fatalf("DeleteVersion() error = %v", err)
+			}
+			if got, want := versionContents(t, plugin, path), []string{"one", "three", "one"}; !equalStrings(got, want) {
+				t.Fatalf("versions after delete = %q, want %q", got, want)
+			}
+
+			latest, _ := plugin.ListVersions(path)
+			checkErrorType(t, plugin.DeleteVersion(path, latest[0].VersionID), ptr(InvalidInputError))
+			checkErrorType(t, plugin.DeleteVersion(path, "missing"), ptr(NotFoundErrorType))
+		})
+	}
+}
+
+func TestVersioningPathsWithSeparator(t *testing.T) {
+	plugin, _ := newTestVersioningPlugin(t, DefaultVersioningOptions(), nil)
+
+	// The index of "a" and the versions of "a@index.json" share a prefix in the reserved tree
+	storeVersions(t, plugin, "a", "a1", "a2")
+	storeVersions(t, plugin, "a@index.json", "b1", "b2")
+	storeVersions(t, plugin, "a@b", "c1")
+
+	tests := map[string][]string{
+		"a":            {"a2", "a1"},
+		"a@index.json": {"b2", "b1"},
+		"a@b":          {"c1"},
+	}
+	for path, want := range tests {
+		if got := versionContents(t, plugin, path); !equalStrings(got, want) {
+			t.Errorf("versions of %q = %q, want %q", path, got, want)
+		}
+	}
+
+	result, err := plugin.ListFiles("", "", 0)
+	if err != nil {
+		t.Fatalf("ListFiles() error = %v", err)
+	}
+	if len(result.Files) != len(tests) {
+		t.Errorf("ListFiles() returned %d files, want %d", len(result.Files), len(tests))
+	}
+}
+
+func TestVersioningSoftDelete(t *testing.T) {
+	plugin, _ := newTestVersioningPlugin(t, DefaultVersioningOptions(), nil)
+	storeVersions(t, plugin, "a.txt", "one")
+
+	if err := plugin.DeleteFile("a.txt"); err != nil {
+		t.Fatalf("DeleteFile() error = %v", err)
+	}
+	if plugin.FileExists("a.txt") {
+		t.Fatalf("file exists after delete")
+	}
+	if got, want := versionContents(t, plugin, "a.txt"), []string{"-", "one"}; !equalStrings(got, want) {
+		t.Fatalf("versions = %q, want %q", got, want)
+	}
+	checkErrorType(t, plugin.DeleteFile("a.txt"), ptr(NotFoundErrorType))
+
+	versions, _ := plugin.ListVersions("a.txt")
+	if err := plugin.RestoreVersion("a.txt", versions[1].VersionID); err != nil {
+		t.Fatalf("RestoreVersion() error = %v", err)
+	}
+	if data, _ := plugin.RetrieveFile("a.txt"); string(data) != "one" {
+		t.Errorf("RetrieveFile() after restore = %q, want %q", data, "one")
+	}
+}
+
+func TestVersioningReservedPaths(t *testing.T) {
+	plugin, _ := newTestVersioningPlugin(t, DefaultVersioningOptions(), nil)
+	storeVersions(t, plugin, "a.txt", "one", "two")
+
+	checkErrorType(t, plugin.StoreFile(VersionsPrefix+"a.txt@index.json", []byte("{}"), nil), ptr(InvalidInputError))
+	_, err := plugin.RetrieveFile(VersionsPrefix + "a.txt@index.json")
+	checkErrorType(t, err, ptr(InvalidInputError))
+	if plugin.FileExists(VersionsPrefix + "a.txt@index.json") {
+		t.Errorf("FileExists() reports the version index")
+	}
+}
+
+func TestRetrieveVersionRange(t *testing.T) {
+	plugin, _ := newTestVersioningPlugin(t, DefaultVersioningOptions(), nil)
+	storeVersions(t, plugin, "a.txt", "first version", "second version")
+	plugin.DeleteFile("a.txt")
+	versions, _ := plugin.ListVersions("a.txt")
+
+	tests := []struct {
+		name      string
+		versionID string
+		offset    int64
+		length    int64
+		want      string
+		wantType  *ErrorType
+	}{
+		{name: "earlier version", versionID: versions[2].VersionID, offset: 6, length: 3, want: "ver"},
+		{name: "until the end", versionID: versions[1].VersionID, offset: 7, want: "version"},
+		{name: "past the end", versionID: versions[1].VersionID, offset: 7, length: 100, want: "version"},
+		{name: "delete marker", versionID: versions[0].VersionID, wantType: ptr(InvalidInputError)},
+		{name: "unknown version", versionID: "missing", wantType: ptr(NotFoundErrorType)},
+		{name: "negative offset", versionID: versions[1].VersionID, offset: -1, wantType: ptr(InvalidInputError)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := retrieveVersionRange(plugin, "a.txt", tt.versionID, tt.offset, tt.length)
+			checkErrorType(t, err, tt.wantType)
+			if tt.wantType == nil && string(data) != tt.want {
+				t.Errorf("retrieveVersionRange() = %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestPurgeExpiredVersions(t *testing.T) {
+	tests := []struct {
+		name       string
+		options    VersioningOptions
+		wait       time.Duration
+		wantPurged int
+		wantLeft   []string
+	}{
+		{name: "within retention", options: VersioningOptions{Retention: time.Hour}, wantLeft: []string{"three", "two", "one"}},
+		{name: "past retention", options: VersioningOptions{Retention: time.Millisecond}, wait: 10 * time.Millisecond, wantPurged: 2, wantLeft: []string{"three"}},
+		{name: "kept forever", options: VersioningOptions{}, wantLeft: []string{"three", "two", "one"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin, _ := newTestVersioningPlugin(t, tt.options, nil)
+			storeVersions(t, plugin, "a.txt", "one", "two", "three")
+			time.Sleep(tt.wait)
+
+			purged, err := plugin.PurgeExpiredVersions()
+			if err != nil {
+				t.Fatalf("PurgeExpiredVersions() error = %v", err)
+			}
+			if purged != tt.wantPurged {
+				t.Errorf("PurgeExpiredVersions() = %d, want %d", purged, tt.wantPurged)
+			}
+			if got := versionContents(t, plugin, "a.txt"); !equalStrings(got, tt.wantLeft) {
+				t.Errorf("versions = %q, want %q", got, tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestPurgeExpiredVersionsMaxCount(t *testing.T) {
+	plugin, _ := newTestVersioningPlugin(t, VersioningOptions{MaxVersions: 1}, nil)
+	storeVersions(t, plugin, "a.txt", "one", "two", "three")
+
+	if got, want := versionContents(t, plugin, "a.txt"), []string{"three", "two"}; !equalStrings(got, want) {
+		t.Errorf("versions = %q, want %q", got, want)
+	}
+}
+
+func TestPurgeExpiredVersionsCorruptIndex(t *testing.T) {
+	plugin, inner := newTestVersioningPlugin(t, VersioningOptions{Retention: time.Millisecond}, map[string]string{
+		"bad.txt":                             "current",
+		VersionsPrefix + "bad.txt@index.json": "not json",
+	})
+	storeVersions(t, plugin, "a.txt", "one", "two")
+	storeVersions(t, plugin, "c.txt", "one", "two")
+	time.Sleep(10 * time.Millisecond)
+
+	purged, err := plugin.PurgeExpiredVersions()
+	checkErrorType(t, err, ptr(StorageErrorType))
+	if purged != 2 {
+		t.Errorf("PurgeExpiredVersions() = %d, want 2 purged past the corrupt index", purged)
+	}
+	if _, ok := inner.data(VersionsPrefix + "bad.txt@index.json"); !ok {
+		t.Errorf("corrupt index was removed")
+	}
+}
+
+func TestVersioningCapability(t *testing.T) {
+	versioned := NewVersioningPlugin(newMemoryPlugin(nil), DefaultVersioningOptions())
+
+	tests := []struct {
+		name   string
+		plugin StoragePlugin
+		want   bool
+	}{
+		{name: "plain plugin", plugin: newMemoryPlugin(nil)},
+		{name: "versioning plugin", plugin: versioned, want: true},
+		{name: "behind middleware", plugin: Intercept(passthrough)(versioned), want: true},
+		{name: "behind compression", plugin: NewCompressionPlugin(versioned, DefaultCompressionOptions()), want: true},
+		{name: "compression without versioning", plugin: NewCompressionPlugin(newMemoryPlugin(nil), DefaultCompressionOptions())},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := implements[VersioningStoragePlugin](tt.plugin); got != tt.want {
+				t.Errorf("implements[VersioningStoragePlugin]() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}